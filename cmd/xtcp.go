@@ -1,21 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/alerts"
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/capture"
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/config"
 	"github.com/Edgio/xtcp/pkg/disabler"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/geoip"
+	"github.com/Edgio/xtcp/pkg/inetdiager"
 	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/Edgio/xtcp/pkg/misc"
 	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/nlpcap"
 	"github.com/Edgio/xtcp/pkg/poller"
 	"github.com/Edgio/xtcp/pkg/pollerstater"
+	"github.com/Edgio/xtcp/pkg/replay"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"github.com/Edgio/xtcp/pkg/services"
+	"github.com/Edgio/xtcp/pkg/sockmetrics"
+	"github.com/Edgio/xtcp/pkg/streamer"
+	"github.com/Edgio/xtcp/pkg/tagging"
+	"github.com/Edgio/xtcp/pkg/topn"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
 	"github.com/Edgio/xtcp/pkg/xtcpstater"
 	"github.com/pkg/profile"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,10 +46,6 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const (
-	debugLevel int = 11
-)
-
 var (
 	// Passed by "go build -ldflags" for the show version
 	commit string
@@ -35,67 +54,24 @@ var (
 
 // main function is responsible for a few key activities
 // 0. Exits if we aren't running on Linux
-// 1. Handles all the CLI flags
+// 1. Handles all the CLI flags, the config file, and the environment variables (see the config package)
 // 1.1 Populates a big cliFlags struct to make it easy to pass to other goroutines
 // 3. Version printing
-// 4. Starts disablement checker (disabler) goroutine
+// 4. Starts disablement checker (disabler) goroutine, which exits or pauses polling when xtcp is disabled
 // 5. Allows for profiling options
-// 6. Starts the staters (the multiple metrics go routines), which includes the Prometheus metric endpoints HTTP handler
-// 7. Starts the poller which is really the main loop for xtcp
+// 6. Starts the staters (the multiple metrics go routines), which includes the Prometheus metric endpoints HTTP handler,
+// and the admin HTTP API if there is a token file
+// 7. Starts the gRPC streamer for live record subscriptions (if enabled)
+// 8. Starts the poller which is really the main loop for xtcp, or replays a capture file instead (see the replay package)
+// 9. On SIGTERM/SIGINT (or maxLoops), drains the pipeline and flushes the stats before exiting
 func main() {
 
 	misc.DieIfNotLinux()
 
-	no4 := flag.Bool("no4", false, "no IPv4, default false = IPv4 enabled")
-	no6 := flag.Bool("no6", false, "no IPv6, default false = IPv6 enabled")
-	timeout := flag.Int64("timeout", 50, "Netlink socket timeout in milliseconds.  Zero(0) for no timeout.  Default 50 ms") // can be increased to 100ms if needed
-	pollingFrequency := flag.Duration("frequency", 30*time.Second, "Polling frequency. Default 30 seconds")                 // TODO make default 10s
-	pollingSafetyBuffer := flag.Float64("pollingSafetyBuffer", 0.8, "pollingSafetyBuffer defines the point at which warnings about long polling duration are generated, defined as a percentage of pollingFrequencySeconds.  Default = 0.8 (80%)")
-	maxLoops := flag.Int("maxLoops", 0, "Maximum number of loops, or zero (0) for forever.  Default 0")
-	// Option to allow shutting down workers between polls
-	shutdownWorkers := flag.Bool("shutdownWorkers", false, "shutdownWorkers, default false")
-	// Numbers of workers
-	netlinkers4 := flag.Int("netlinkers4", 4, "netlinkers4, default 4")      //4
-	netlinkers6 := flag.Int("netlinkers6", 2, "netlinkers6, default 2")      //2
-	inetdiagers4 := flag.Int("inetdiagers4", 10, "inetdiagers4, default 10") //10
-	inetdiagers6 := flag.Int("inetdiagers6", 4, "inetdiagers6, default 4")   //4
-	// Shortcut for single (x1) worker of each type (which helps debug with less concurrency)
-	single := flag.Bool("single", false, "Single means only one (1) of each worker type")
-	nlmsgSeq := flag.Int("nlmsgSeq", 666, "nlmsgSeq sequence number (start), which should be uint32")
-	// packetSize of the buffer the netlinkers syscall.Recvfrom to read into
-	// TODO profile changing this.  Quick test of 2048 and 8192 shows changing this works fine
-	packetSize := flag.Int("packetSize", 0, "netlinker packetSize.  buffer size = packetSize * packetSizeMply. Use zero (0) for syscall.Getpagesize(). Default = 0")
-	packetSizeMply := flag.Int("packetSizeMply", 8, "netlinker packetSize multiplier.  buffer size = packetSize * packetSizeMply.  Default = 8")
-
-	// Channel sizes
-	netlinkerChSize := flag.Int("netlinkerChSize", 100, "netlinkerChSize, Default 100")
-
-	// Control how many messages to from netlink to inetdiager
-	samplingModulus := flag.Int("samplingModulus", 2, "samplingModulus.  Netlinker will sample every Xth inetdiag messages to send to inetdiager. Default 2") //TODO make default 1
-	// CLI standard out reporting modulus.  e.g. report every x inetd messages
-	inetdiagerReportModulus := flag.Int("inetdiagerReportModulus", 2000, "inetdiagerReportModulus. Report every X inetd messages to Kafka. Default 2000") //TODO make default 1000
-	inetdiagerStatsRatio := flag.Float64("inetdiagerStatsRatio", 0.9, "inetdiagerStatsRatio controls the how often the inetdiagers send summary stats, which is as a percentage of the pollingFrequencySeconds. Default = 0.9 (90% of pollingFrequencySeconds)")
-
-	// UDP send destination
-	udpSendDest := flag.String("udpSendDest", "127.0.0.1:13000", "UDP socket send destination. Default = 127.0.0.1:13000")
-
-	// Prometheus related
-	//promListen := flag.String("promListen", "[::1]:9000", "Prometheus http listening socket. Use 0.0.0.0:9000 for all interfaces. Default = [::1]:9000")
-	promListen := flag.String("promListen", "127.0.0.1:9000", "Prometheus http listening socket. Use 0.0.0.0:9000 for all interfaces. Default = 127.0.0.1:9000")
-	promPath := flag.String("promPath", "/metrics", "Prometheus http path. Default = /metrics")
-	// curl -s http://[::1]:9000/metrics 2>&1 | grep -v "#"
-	// curl -s http://127.0.0.1:9000/metrics 2>&1 | grep -v "#"
-
-	// We do NOT want inetdiagers to block when sending these stats over the channel.
-	// It's OK if they do backup in the channel, because we should have plenty of idle time at the end of the polling loop to catch up on this work
-	promPollerChSize := flag.Int("promPollerChSize", 4, "promPollerChSize is the channel size for the pollerStaterCh, Default 4")
-	promNetlinkerChSize := flag.Int("promNetlinkerChSize", 10, "promChSize is the channel size for the netlinkerStaterCh, Default 10")
-	promInetdiagerChSize := flag.Int("promInetdiagerChSize", 100, "promChSize is the channel size for the inetdiagerStaterCh, Default 100")
-	// TODO we could potentially have multiple counterIncrementer workers
+	// All the xtcp settings are registered as flags from the cliflags struct tags, so the defaults,
+	// the config file keys, and the environment variable names all come from the one place
+	cliFlags := config.Register(flag.CommandLine)
 
-	// Statsd related
-	statsdDst := flag.String("statdDst", "127.0.0.1:8125", "Statds UDP socket destination. Default = 127.0.0.1:8125")
-	noStatsd := flag.Bool("noStatsd", false, "no noStatsd, default false = noStatsd enabled")
 	// tcpdump -ni lo -vv -X udp port 8125
 	// # cat statsd.conf
 	// LoadPlugin statsd
@@ -109,31 +85,16 @@ func main() {
 	//   DeleteGauges true
 	// </Plugin>
 
+	// curl -s http://[::1]:9000/metrics 2>&1 | grep -v "#"
+	// curl -s http://127.0.0.1:9000/metrics 2>&1 | grep -v "#"
+
 	// Go runtime & profiling
-	// Maximum number of CPUs that can be executing simultaneously
-	// https://golang.org/pkg/runtime/#GOMAXPROCS -> zero (0) means default
-	goMaxProcs := flag.Int("goMaxProcs", 4, "goMaxProcs = https://golang.org/pkg/runtime/#GOMAXPROCS, default = 4. 0 = golang default.")
 	profileMode := flag.String("profile.mode", "", "enable profiling mode, one of [cpu, mem, mutex, block]")
 
-	// Happy noise
-	happyPollerReportModulus := flag.Int("happyPollerReportModulus", 1000, "xtcp poller emits some non-error/happy log messages, and this modules controls the rate. Default = 10")
-	happyIstaterReportModulus := flag.Int("happyIstaterReportModulus", 10000, "xtcp inetdiagstater emits some non-error/happy log messages, and this modules controls the rate. Default = 1000")
-
-	// Variables relating to the "disabler" go routine which polls for if xtcp should be running
-	noDisabler := flag.Bool("noDisabler", false, "Flag to disable the Disabler poller, default false = Disabler enabled")
-	disablerFrequency := flag.Duration("disablerFrequency", 60*time.Second, "Disabler polling frequency. Default 60 seconds")
-	disablerCommand := flag.String("disablerCommand", "echo", "Command to run/poll to check if xtcp should exit(0)")
-	disablerArgument1 := flag.String("disablerArgument1", "$XTCP_DISABLED", "Argument to disablerCommand")
-
-	// XTCP stater
-	xTCPStaterFrequency := flag.Duration("xTCPStaterFrequencySeconds", 60*time.Second, "XTCP stater reporting frequency. Default 60 seconds")
-	xTCPStaterSystemctlPath := flag.String("xTCPStaterSystemctlPath", "/bin/systemctl", "Full system path to systemctl.  Default \"/bin/systemctl\"")
-	xTCPStaterPsPath := flag.String("xTCPStaterPsPath", "/bin/ps", "Full system path to ps.  Default \"/bin/ps\"")
-
 	version := flag.Bool("version", false, "show version")
-	defaults := flag.Bool("defaults", false, "show default configuration")
-
-	nsq := flag.String("nsq", "", "Write to NSQ IP:Port")
+	defaults := flag.Bool("defaults", false, "show default configuration, in the config file format")
+	configFile := flag.String("config", "", "YAML config file.  Environment variables (XTCP_<FLAG>) override the file, and flags override both.  Default = \"\" (no config file)")
+	dumpConfig := flag.Bool("dumpConfig", false, "show the effective configuration (defaults, config file, environment, and flags merged), in the config file format")
 
 	flag.Parse()
 
@@ -146,122 +107,36 @@ func main() {
 
 	// Print out defaults
 	if *defaults {
-		if debugLevel > 10 {
-			fmt.Println("*no4:", *no4)
-			fmt.Println("*no6:", *no6)
-			fmt.Println("*timeout:", *timeout, "(ms)")
-			fmt.Println("*pollingFrequency:", *pollingFrequency)
-			fmt.Println("*pollingSafetyBuffer:", *pollingSafetyBuffer)
-			fmt.Println("*maxLoops:", *maxLoops)
-			fmt.Println("*shutdownWorkers:", *shutdownWorkers)
-			fmt.Println("*netlinkers4:", *netlinkers4)
-			fmt.Println("*netlinkers6:", *netlinkers6)
-			fmt.Println("*inetdiagers4:", *inetdiagers4)
-			fmt.Println("*inetdiagers6:", *inetdiagers6)
-			fmt.Println("*single:", *single)
-			fmt.Println("*nlmsgSeq:", *nlmsgSeq)
-			fmt.Println("*packetSize:", *packetSize)
-			fmt.Println("*packetSizeMply:", *packetSizeMply)
-			fmt.Println("*netlinkerChSize:", *netlinkerChSize)
-			fmt.Println("*samplingModulus:", *samplingModulus)
-			fmt.Println("*inetdiagerReportModulus:", *inetdiagerReportModulus)
-			fmt.Println("*inetdiagerStatsRatio:", *inetdiagerStatsRatio)
-			fmt.Println("*udpSendDest:", *udpSendDest)
-			fmt.Println("*promListen:", *promListen)
-			fmt.Println("*promPath:", *promPath)
-			fmt.Println("*promPollerChSize:", *promPollerChSize)
-			fmt.Println("*promNetlinkerChSize:", *promNetlinkerChSize)
-			fmt.Println("*promInetdiagerChSize:", *promInetdiagerChSize)
-			fmt.Println("*statsdDst:", *statsdDst)
-			fmt.Println("*noStatsd:", *noStatsd)
-			fmt.Println("*goMaxProcs:", *goMaxProcs)
-			fmt.Println("*happyPollerReportModulus:", *happyPollerReportModulus)
-			fmt.Println("*happyIstaterReportModulus:", *happyIstaterReportModulus)
-			fmt.Println("*noDisabler:", *noDisabler)
-			fmt.Println("*disablerFrequency:", *disablerFrequency)
-			fmt.Println("*disablerCommand:", *disablerCommand)
-			fmt.Println("*disablerArgument1:", *disablerArgument1)
-			fmt.Println("*xTCPStaterFrequency:", *xTCPStaterFrequency)
-			fmt.Println("*xTCPStaterSystemctlPath:", *xTCPStaterSystemctlPath)
-			fmt.Println("*xTCPStaterPsPath:", *xTCPStaterPsPath)
-			fmt.Println("*nsq:", *nsq)
+		if err := config.Defaults(os.Stdout); err != nil {
+			log.Fatalf("config.Defaults error:%s", err)
 		}
 		os.Exit(0)
 	}
 
-	if *single == true {
-		*netlinkers4 = 1
-		*netlinkers6 = 1
-		*inetdiagers4 = 1
-		*inetdiagers6 = 1
-	}
-
-	if debugLevel > 100 {
-		fmt.Println("*netlinkers4:", *netlinkers4)
-		fmt.Println("*netlinkers6:", *netlinkers6)
-		fmt.Println("*inetdiagers4:", *inetdiagers4)
-		fmt.Println("*inetdiagers6:", *inetdiagers6)
-	}
-
-	// Copy all the CLI flags to the struct, to make passing the flags more simple
-	var cliFlags cliflags.CliFlags
-	cliFlags.No4 = no4
-	cliFlags.No6 = no6
-	cliFlags.Timeout = timeout
-	cliFlags.PollingFrequency = pollingFrequency
-	cliFlags.PollingSafetyBuffer = pollingSafetyBuffer
-	cliFlags.MaxLoops = maxLoops
-	cliFlags.ShutdownWorkers = shutdownWorkers
-	cliFlags.Netlinkers4 = netlinkers4
-	cliFlags.Netlinkers6 = netlinkers6
-	cliFlags.Inetdiagers4 = inetdiagers4
-	cliFlags.Inetdiagers6 = inetdiagers6
-	cliFlags.Single = single
-	cliFlags.NlmsgSeq = nlmsgSeq
-	cliFlags.PacketSize = packetSize
-	cliFlags.PacketSizeMply = packetSizeMply
-	cliFlags.NetlinkerChSize = netlinkerChSize
-	cliFlags.SamplingModulus = samplingModulus
-	cliFlags.InetdiagerReportModulus = inetdiagerReportModulus
-	cliFlags.InetdiagerStatsRatio = inetdiagerStatsRatio
-	cliFlags.GoMaxProcs = goMaxProcs
-	cliFlags.UDPSendDest = udpSendDest
-	cliFlags.PromListen = promListen
-	cliFlags.PromPath = promPath
-	cliFlags.PromPollerChSize = promPollerChSize
-	cliFlags.PromNetlinkerChSize = promNetlinkerChSize
-	cliFlags.PromInetdiagerChSize = promInetdiagerChSize
-	cliFlags.StatsdDst = statsdDst
-	cliFlags.NoStatsd = noStatsd
-	cliFlags.HappyPollerReportModulus = happyPollerReportModulus
-	cliFlags.HappyIstaterReportModulus = happyIstaterReportModulus
-	cliFlags.NoDisabler = noDisabler
-	cliFlags.DisablerFrequency = disablerFrequency
-	cliFlags.DisablerCommand = disablerCommand
-	cliFlags.DisablerArgument1 = disablerArgument1
-	cliFlags.XTCPStaterFrequency = xTCPStaterFrequency
-	cliFlags.XTCPStaterSystemctlPath = xTCPStaterSystemctlPath
-	cliFlags.XTCPStaterPsPath = xTCPStaterPsPath
-	cliFlags.NSQ = nsq
-
-	// Start background polling job to cleanly exit if the return code of executing 'disablerCommand' is "1"
-	// Using a channel here to block waiting for disabler.Disabler to complete once before proceeding passed this main block
-	// Otherwise, golang is so fast that it races ahead and actually starts polling etc below before this check completes
-	var disablerCheckComplete chan struct{}
-	disablerCheckComplete = make(chan struct{}, 2)
-	if *cliFlags.NoDisabler == false {
-		go disabler.Disabler(cliFlags, disablerCheckComplete, false)
-		// block waiting for disabler on the first iteration
-		<-disablerCheckComplete
-		if debugLevel > 10 {
-			fmt.Println("Disable check complete")
+	if err := config.Apply(flag.CommandLine, cliFlags, *configFile); err != nil {
+		log.Fatalf("config error:%s", err)
+	}
+
+	if err := logging.Setup(os.Stdout, cliFlags); err != nil {
+		log.Fatalf("logging.Setup error:%s", err)
+	}
+	logger := logging.Logger("main")
+
+	if *dumpConfig {
+		if err := config.Dump(os.Stdout, cliFlags); err != nil {
+			log.Fatalf("config.Dump error:%s", err)
 		}
+		os.Exit(0)
 	}
 
+	logger.Debug("Main workers",
+		"netlinkers4", *cliFlags.Netlinkers4,
+		"netlinkers6", *cliFlags.Netlinkers6,
+		"inetdiagers4", *cliFlags.Inetdiagers4,
+		"inetdiagers6", *cliFlags.Inetdiagers6)
+
 	mp := runtime.GOMAXPROCS(*cliFlags.GoMaxProcs)
-	if debugLevel > 10 {
-		fmt.Println("Main runtime.GOMAXPROCS was:", mp)
-	}
+	logger.Info("Main runtime.GOMAXPROCS", "was", mp, "now", *cliFlags.GoMaxProcs)
 
 	// profiling goodness
 	// "github.com/pkg/profile"
@@ -271,9 +146,7 @@ func main() {
 	// e.g. ./xtcp -profile.mode cpu
 	// go tool pprof -http=":8081" xtcp cpu.pprof
 
-	if debugLevel > 10 {
-		fmt.Println("*profileMode:", *profileMode)
-	}
+	logger.Info("Main profiling", "profileMode", *profileMode)
 	switch *profileMode {
 	case "cpu":
 		defer profile.Start(profile.CPUProfile, profile.ProfilePath(".")).Stop()
@@ -288,26 +161,61 @@ func main() {
 		defer profile.Start(profile.BlockProfile, profile.ProfilePath(".")).Stop()
 	case "trace":
 		defer profile.Start(profile.TraceProfile, profile.ProfilePath(".")).Stop()
-	default:
-		if debugLevel > 10 {
-			fmt.Println("No profiling")
-		}
 	}
 
 	// Start prometheus exporter
 	//http.Handle("/metrics", promhttp.Handler())
 	// https: //pkg.go.dev/github.com/prometheus/client_golang/prometheus/promhttp?tab=doc#HandlerOpts
-	http.Handle(*promPath, promhttp.HandlerFor(
+	http.Handle(*cliFlags.PromPath, promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
 	))
-	go http.ListenAndServe(*promListen, nil)
-	if debugLevel > 10 {
-		fmt.Println("Prometheus http listener started on:", *promListen, *promPath)
+
+	// The controller holds the settings which can be changed at runtime, and allows immediate polls
+	// The admin HTTP API is only enabled if there is a token file
+	var ctl *admin.Controller
+	ctl = admin.NewController(cliFlags)
+	var adminAPI *admin.API
+	if *cliFlags.AdminTokenFile != "" {
+		var err error
+		adminAPI, err = admin.NewAPI(ctl, cliFlags, *cliFlags.AdminTokenFile, *cliFlags.AdminAuditLog)
+		if err != nil {
+			log.Fatalf("admin.NewAPI error:%s", err)
+		}
+		adminAPI.Register(http.DefaultServeMux)
+		logger.Info("Admin API enabled", "listen", *cliFlags.PromListen, "path", "/admin/")
 	}
+
+	// SIGHUP reloads the config file and environment, applying the settings which are safe to change
+	go reloadOnSIGHUP(cliFlags, *configFile, ctl)
+
+	// SIGUSR1 toggles trace logging for every subsystem, and back again
+	go toggleTraceOnSIGUSR1()
+
+	// SIGTERM/SIGINT cancel ctx, which starts the graceful shutdown (see shutdown below)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// Start background polling job to check if xtcp is disabled, which either exits cleanly, or pauses polling (disablerAction)
+	// Using a channel here to block waiting for disabler.Disabler to complete once before proceeding passed this main block
+	// Otherwise, golang is so fast that it races ahead and actually starts polling etc below before this check completes
+	if *cliFlags.NoDisabler == false {
+		disablerSource, err := disabler.NewSource(cliFlags)
+		if err != nil {
+			log.Fatalf("disabler.NewSource error:%s", err)
+		}
+		disablerCheckComplete := make(chan struct{}, 1)
+		go disabler.Disabler(ctx, cliFlags, disablerSource, ctl, disablerCheckComplete, false)
+		// block waiting for disabler on the first iteration
+		<-disablerCheckComplete
+		logger.Info("Disable check complete")
+	}
+
+	go http.ListenAndServe(*cliFlags.PromListen, nil)
+	logger.Info("Prometheus http listener started", "listen", *cliFlags.PromListen, "path", *cliFlags.PromPath)
 	// Start the stats workers
 	// Please note theres a single (x1) worker of each type currently,
 	// because making the prometheus counters concurrently is a little tricky
@@ -316,55 +224,346 @@ func main() {
 	// (this might actually be the recommended way)
 	// TODO. Improve concurrency
 
-	// xtcpstater reports on the over all xtcp process, via "systemctl status" and "ps"
-	go xtcpstater.XTCPStater(cliFlags)
+	// staterWG is used on shutdown to wait for the staters to send their final stats
+	var staterWG sync.WaitGroup
+
+	// xtcpstater reports on the over all xtcp process, reading /proc and the cgroup files by default,
+	// or via "systemctl status" and "ps" as the fallback (xTCPStaterSource)
+	staterWG.Add(1)
+	go xtcpstater.XTCPStater(ctx, cliFlags, &staterWG)
 
 	var pollerStaterCh chan pollerstater.PollerStats
 	pollerStaterCh = make(chan pollerstater.PollerStats, *cliFlags.PromPollerChSize)
-	go pollerstater.PollerStater(pollerStaterCh, cliFlags)
+	staterWG.Add(1)
+	go pollerstater.PollerStater(pollerStaterCh, cliFlags, &staterWG)
 
 	var netlinkerStaterCh chan netlinkerstater.NetlinkerStatsWrapper
 	netlinkerStaterCh = make(chan netlinkerstater.NetlinkerStatsWrapper, *cliFlags.PromNetlinkerChSize)
-	go netlinkerstater.NetlinkerStater(netlinkerStaterCh, cliFlags)
+	staterWG.Add(1)
+	go netlinkerstater.NetlinkerStater(netlinkerStaterCh, cliFlags, &staterWG)
 
 	var inetdiagerStaterCh chan inetdiagerstater.InetdiagerStatsWrapper
 	inetdiagerStaterCh = make(chan inetdiagerstater.InetdiagerStatsWrapper, *cliFlags.PromInetdiagerChSize)
-	go inetdiagerstater.InetdiagerStater(inetdiagerStaterCh, cliFlags)
-
-	if debugLevel > 10 {
-		fmt.Println("Main staters started")
+	staterWG.Add(1)
+	go inetdiagerstater.InetdiagerStater(inetdiagerStaterCh, cliFlags, &staterWG)
+
+	logger.Info("Main staters started")
+
+	// Start the gRPC streaming server for live record subscriptions
+	// The streamer is always created, but without the listener there will never be any subscribers,
+	// so the inetdiagers just skip the streaming work.
+	var recordStreamer *streamer.Streamer
+	recordStreamer = streamer.NewStreamer(cliFlags)
+	if *cliFlags.GRPCListen != "" {
+		go streamer.Serve(*cliFlags.GRPCListen, recordStreamer)
 	}
 
 	// Hostname is required for the XtcpRecord.hostname proto, and called here once rather than per address family in the pollers
 	var hostname string
 	hostname = misc.GetHostname()
-	if debugLevel > 10 {
-		fmt.Println("Main hostname:", hostname)
-	}
+	logger.Info("Main hostname", "hostname", hostname)
 
 	// Setup addressFamilies to iterate over
 	// We're doing most things for both IPv4 and IPv6
 	var addressFamilies []uint8
-	if !*no4 {
+	if !*cliFlags.No4 {
 		addressFamilies = append(addressFamilies, unix.AF_INET)
 	}
-	if !*no6 {
+	if !*cliFlags.No6 {
 		addressFamilies = append(addressFamilies, unix.AF_INET6)
 	}
 
-	// Start poller per address family
-	var pollerWG sync.WaitGroup
-	for _, addressFamily := range addressFamilies {
-		if debugLevel > 10 {
-			fmt.Println("Main starting poller:", addressFamily, "(", misc.KernelEnumToString[addressFamily], ")")
+	// The pollers dump the sockets in these TCP states
+	if _, err := xtcpnl.StateMask(*cliFlags.States); err != nil {
+		log.Fatalf("xtcpnl.StateMask states:%s error:%s", *cliFlags.States, err)
+	}
+
+	// The pollers split each poll into these dump shards
+	if _, err := xtcpnl.ShardsFromFlags(cliFlags); err != nil {
+		log.Fatalf("xtcpnl.ShardsFromFlags dumpShards:%d dumpShardRanges:%s error:%s", *cliFlags.DumpShards, *cliFlags.DumpShardRanges, err)
+	}
+
+	// The msgSampler decides which messages the netlinkers pass to the inetdiagers
+	msgSampler, err := sampler.NewMessageSampler(cliFlags)
+	if err != nil {
+		log.Fatalf("sampler.NewMessageSampler error:%s", err)
+	}
+
+	// The anonymizer anonymizes the exported addresses, or is nil if anonymization is disabled
+	anonymizer, err := anonymize.NewFromFlags(cliFlags)
+	if err != nil {
+		log.Fatalf("anonymize.NewFromFlags error:%s", err)
+	}
+
+	// The exportSinks filter the exported records and fields per sink, or are nil if everything is exported
+	exportSinks, err := exportfilter.NewSinks(cliFlags)
+	if err != nil {
+		log.Fatalf("exportfilter.NewSinks error:%s", err)
+	}
+
+	// The topTracker ranks the worst sockets of each poll, or is nil if topN is disabled
+	topTracker, err := topn.NewFromFlags(cliFlags, exportSinks)
+	if err != nil {
+		log.Fatalf("topn.NewFromFlags error:%s", err)
+	}
+	if topTracker != nil && adminAPI != nil {
+		adminAPI.HandleFunc(http.DefaultServeMux, "/admin/top", http.MethodGet, topTracker.ServeHTTP)
+		logger.Info("Admin API top sockets enabled", "path", "/admin/top", "topN", *cliFlags.TopN, "metrics", topTracker.Metrics())
+	}
+
+	// The sockMetrics observes the sockets into the Prometheus socket metrics, or is nil if socketMetricsPorts is empty
+	sockMetrics, err := sockmetrics.NewFromFlags(cliFlags)
+	if err != nil {
+		log.Fatalf("sockmetrics.NewFromFlags error:%s", err)
+	}
+	if sockMetrics != nil {
+		logger.Info("Main socket metrics enabled", "socketMetricsPorts", *cliFlags.SocketMetricsPorts)
+	}
+
+	// The serviceMapper resolves the service names of the sockets, or is nil if the services flags are all disabled
+	serviceMapper, err := services.NewFromFlags(cliFlags)
+	if err != nil {
+		log.Fatalf("services.NewFromFlags error:%s", err)
+	}
+	var servicesWG sync.WaitGroup
+	if serviceMapper != nil && *cliFlags.ServicesLearn > 0 {
+		servicesWG.Add(1)
+		go serviceMapper.Run(ctx, xtcpnl.OpenSocketTransport, "/proc", *cliFlags.ServicesLearn, &servicesWG)
+	}
+	if serviceMapper != nil {
+		logger.Info("Main service names enabled", "servicesFile", *cliFlags.ServicesFile, "servicesEtc", *cliFlags.ServicesEtc, "servicesLearn", *cliFlags.ServicesLearn)
+	}
+
+	// The tagger tags the records, or is nil if there aren't any tags or tagRules
+	tagger, err := tagging.NewFromFlags(cliFlags)
+	if err != nil {
+		log.Fatalf("tagging.NewFromFlags error:%s", err)
+	}
+	if tagger != nil {
+		logger.Info("Main tagging enabled", "tags", *cliFlags.Tags, "tagRules", *cliFlags.TagRules)
+	}
+
+	// The geoEnricher adds the geo location of the destinations to the records, or is nil if there aren't any geoip databases
+	geoEnricher, err := geoip.NewFromFlags(cliFlags)
+	if err != nil {
+		log.Fatalf("geoip.NewFromFlags error:%s", err)
+	}
+	var geoipWG sync.WaitGroup
+	if geoEnricher != nil && *cliFlags.GeoIPReload > 0 {
+		geoipWG.Add(1)
+		go geoEnricher.Run(ctx, *cliFlags.GeoIPReload, &geoipWG)
+	}
+	if geoEnricher != nil {
+		logger.Info("Main geoip enabled", "geoipCity", *cliFlags.GeoIPCity, "geoipASN", *cliFlags.GeoIPASN, "geoipReload", *cliFlags.GeoIPReload)
+	}
+
+	// The alertEngine evaluates the alert rules, or is nil if there aren't any.  The dispatcher sends the events.
+	alertEngine, err := alerts.NewFromFlags(cliFlags, hostname, anonymizer)
+	if err != nil {
+		log.Fatalf("alerts.NewFromFlags error:%s", err)
+	}
+	var alertsWG sync.WaitGroup
+	if alertEngine != nil {
+		alertsWG.Add(1)
+		go alerts.Dispatch(alertEngine.Events(), cliFlags, &alertsWG)
+		logger.Info("Main alerts enabled", "alertRules", *cliFlags.AlertRules)
+	}
+
+	// The stages the inetdiagers run on the sockets and records, which are shared by the pollers of both address families
+	stages := &inetdiager.Stages{
+		ServiceMapper: serviceMapper,
+		SockMetrics:   sockMetrics,
+		Tagger:        tagger,
+		GeoEnricher:   geoEnricher,
+		AlertEngine:   alertEngine,
+		Anonymizer:    anonymizer,
+		TopTracker:    topTracker,
+		ExportSinks:   exportSinks,
+	}
+
+	// The capture file is shared by the pollers of both address families
+	var captureWriter *capture.Writer
+	if *cliFlags.Capture != "" {
+		captureWriter, err = capture.Create(*cliFlags.Capture)
+		if err != nil {
+			log.Fatalf("capture.Create error:%s", err)
+		}
+		logger.Info("Main capturing netlink packets", "capture", *cliFlags.Capture)
+	}
+
+	// The pcap file is also shared by the pollers of both address families
+	var pcapWriter *nlpcap.Writer
+	if *cliFlags.Pcap != "" {
+		pcapWriter, err = nlpcap.Create(*cliFlags.Pcap, *cliFlags.PcapMaxBytes, *cliFlags.PcapFiles)
+		if err != nil {
+			log.Fatalf("nlpcap.Create error:%s", err)
 		}
+		logger.Info("Main writing netlink pcap", "pcap", *cliFlags.Pcap, "pcapMaxBytes", *cliFlags.PcapMaxBytes, "pcapFiles", *cliFlags.PcapFiles)
+	}
+
+	// Start poller per address family, or the replay of a capture file, which takes the place of the pollers
+	var pollerWG sync.WaitGroup
+	var replayErr error
+	pollerErrCh := make(chan error, len(addressFamilies))
+	if *cliFlags.Replay != "" {
+		logger.Info("Main starting replay", "replay", *cliFlags.Replay, "replaySpeed", *cliFlags.ReplaySpeed)
 		pollerWG.Add(1)
-		go poller.Poller(addressFamily, &hostname, cliFlags, &pollerWG, pollerStaterCh, netlinkerStaterCh, inetdiagerStaterCh)
+		go func() {
+			defer pollerWG.Done()
+			_, replayErr = replay.Replay(ctx, *cliFlags.Replay, hostname, cliFlags, netlinkerStaterCh, inetdiagerStaterCh, recordStreamer, ctl, msgSampler, stages)
+		}()
+	} else {
+		for _, addressFamily := range addressFamilies {
+			logger.Info("Main starting poller", "af", misc.KernelEnumToString[addressFamily])
+			pollerWG.Add(1)
+			go func(addressFamily uint8) {
+				if err := poller.Poller(ctx, addressFamily, &hostname, cliFlags, &pollerWG, pollerStaterCh, netlinkerStaterCh, inetdiagerStaterCh, recordStreamer, ctl, msgSampler, stages, captureWriter, pcapWriter, xtcpnl.OpenSocketTransport); err != nil {
+					// Without its netlink socket the address family isn't polled, so shut everything down, and exit(1)
+					logger.Error("Main poller error", "af", misc.KernelEnumToString[addressFamily], "err", err)
+					pollerErrCh <- err
+					stop()
+				}
+			}(addressFamily)
+		}
 	}
-	pollerWG.Wait()
 
-	if debugLevel > 10 {
-		fmt.Println("Main done")
+	// Block until the pollers are done, either because of maxLoops, or SIGTERM/SIGINT
+	closeStaters := func() {
+		// The pollers are done, so the last polls are evaluated, and the dispatcher sends the remaining events
+		alertEngine.Close()
+		alertsWG.Wait()
+		topTracker.Close()
+		stop() // the xtcpstater, the services learning, and the geoip reloading stop on ctx, rather than a channel
+		servicesWG.Wait()
+		geoipWG.Wait()
+		close(pollerStaterCh)
+		close(netlinkerStaterCh)
+		close(inetdiagerStaterCh)
+	}
+	err = shutdown(ctx, *cliFlags.ShutdownTimeout, &pollerWG, closeStaters, &staterWG)
+	if captureWriter != nil {
+		if cerr := captureWriter.Close(); cerr != nil {
+			logger.Error("Main capture close error", "err", cerr)
+		}
+	}
+	if pcapWriter != nil {
+		if cerr := pcapWriter.Close(); cerr != nil {
+			logger.Error("Main pcap close error", "err", cerr)
+		}
+	}
+	if err != nil {
+		logger.Error("Main shutdown error", "err", err)
+		os.Exit(1)
+	}
+	if replayErr != nil {
+		logger.Error("Main replay error", "err", replayErr)
+		os.Exit(1)
 	}
+	if len(pollerErrCh) > 0 {
+		logger.Error("Main exiting, because a poller failed", "err", <-pollerErrCh)
+		os.Exit(1)
+	}
+
+	logger.Info("Main done")
 	return
 }
+
+// shutdown waits for the pipeline to drain and the stats to be flushed, in this order:
+// 1. The pollers finish (or abort with shutdownAbortDump) the in-flight dump, and wait for the netlinkers
+// 2. The pollers close netlinkerCh, and the inetdiagers drain it, send the final records, and the final stats
+// 3. The staters channels are closed, so the staters record the final stats, and close the statsd sockets
+// Steps 1 and 2 are covered by pollerWG, because each poller waits for its inetdiagers before wg.Done()
+//
+// Without a signal, this waits as long as it takes (e.g. for maxLoops).  Once ctx is cancelled by a signal,
+// everything must be complete within the timeout, otherwise an error is returned so main can exit(1).
+func shutdown(ctx context.Context, timeout time.Duration, pollerWG *sync.WaitGroup, closeStaters func(), staterWG *sync.WaitGroup) error {
+
+	logger := logging.Logger("main")
+
+	done := make(chan struct{})
+	go func() {
+		pollerWG.Wait()
+		logger.Info("shutdown pollers done, closing the staters")
+		closeStaters()
+		staterWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		logger.Info("shutdown signal received, draining", "timeout", timeout)
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("pipeline did not drain within shutdownTimeout:%s", timeout)
+	}
+}
+
+// reloadOnSIGHUP reloads the configuration on each SIGHUP
+// The settings tagged reload:"true" are applied via the Controller, and any other changes are only
+// logged, because they need a restart
+func reloadOnSIGHUP(cliFlags cliflags.CliFlags, configFile string, ctl *admin.Controller) {
+
+	logger := logging.Logger("config")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	current := cliFlags
+	for range sigCh {
+
+		reloaded, err := config.Reload(flag.CommandLine, configFile)
+		if err != nil {
+			logger.Error("SIGHUP config reload error, keeping the current config", "err", err)
+			continue
+		}
+
+		applyReload(logger, ctl, &current, reloaded)
+	}
+}
+
+// applyReload applies the reloadable changes of the reloaded config, and updates current with the changes applied.
+// Changes which need a restart, or which fail, are logged, and stay changes on the next reload.
+func applyReload(logger *slog.Logger, ctl *admin.Controller, current *cliflags.CliFlags, reloaded cliflags.CliFlags) {
+
+	for _, change := range config.Changes(*current, reloaded) {
+		if !change.Reloadable {
+			logger.Warn("SIGHUP config changed, but requires a restart", "name", change.Name, "old", change.Old, "new", change.New)
+			continue
+		}
+		var err error
+		switch change.Name {
+		case "frequency":
+			err = ctl.SetPollingFrequency(*reloaded.PollingFrequency)
+		case "samplingModulus":
+			err = ctl.SetSamplingModulus(*reloaded.SamplingModulus)
+		case "logLevel", "logLevels":
+			err = logging.SetLevels(*reloaded.LogLevel, *reloaded.LogLevels)
+		}
+		if err != nil {
+			logger.Error("SIGHUP config", "name", change.Name, "err", err)
+			continue
+		}
+		config.Update(current, reloaded, change.Name)
+		logger.Info("SIGHUP config changed", "name", change.Name, "old", change.Old, "new", change.New)
+	}
+}
+
+// toggleTraceOnSIGUSR1 sets every subsystem to trace on SIGUSR1, and restores the previous levels on the next SIGUSR1
+func toggleTraceOnSIGUSR1() {
+
+	logger := logging.Logger("main")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	for range sigCh {
+		tracing := logging.ToggleTrace()
+		logger.Info("SIGUSR1 toggled trace logging", "tracing", tracing, "levels", logging.SortedLevels())
+	}
+}
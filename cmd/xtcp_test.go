@@ -1,3 +1,138 @@
 package main
 
-// TODO
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/logging"
+)
+
+// fakePipeline stands in for the pollers and staters, recording the order things happen in
+type fakePipeline struct {
+	mu     sync.Mutex
+	events []string
+
+	pollerWG sync.WaitGroup
+	staterWG sync.WaitGroup
+}
+
+func (f *fakePipeline) event(e string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, e)
+}
+
+// start runs a fake poller which takes pollerTime to drain after ctx is cancelled (or maxLoops if there is no signal),
+// and a fake stater which takes staterTime to flush after its channel is closed
+func (f *fakePipeline) start(ctx context.Context, maxLoops bool, pollerTime time.Duration, staterTime time.Duration) (closeStaters func()) {
+
+	staterCh := make(chan struct{})
+
+	f.pollerWG.Add(1)
+	go func() {
+		defer f.pollerWG.Done()
+		if !maxLoops {
+			<-ctx.Done()
+		}
+		time.Sleep(pollerTime)
+		f.event("poller drained")
+	}()
+
+	f.staterWG.Add(1)
+	go func() {
+		defer f.staterWG.Done()
+		for range staterCh {
+		}
+		time.Sleep(staterTime)
+		f.event("stater flushed")
+	}()
+
+	return func() {
+		f.event("staters closed")
+		close(staterCh)
+	}
+}
+
+// TestShutdown checks the shutdown sequence order, and the deadline
+func TestShutdown(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		maxLoops   bool
+		pollerTime time.Duration
+		staterTime time.Duration
+		timeout    time.Duration
+		expectErr  bool
+		expected   []string
+	}{
+		{"maxLoops no deadline", true, 50 * time.Millisecond, 0, 10 * time.Millisecond, false, []string{"poller drained", "staters closed", "stater flushed"}},
+		{"signal within deadline", false, 10 * time.Millisecond, 10 * time.Millisecond, time.Second, false, []string{"poller drained", "staters closed", "stater flushed"}},
+		{"signal slow poller", false, time.Second, 0, 50 * time.Millisecond, true, nil},
+		{"signal slow stater", false, 0, time.Second, 50 * time.Millisecond, true, []string{"poller drained", "staters closed"}},
+	}
+
+	for i, test := range tests {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		f := &fakePipeline{}
+		closeStaters := f.start(ctx, test.maxLoops, test.pollerTime, test.staterTime)
+
+		if !test.maxLoops {
+			cancel()
+		}
+		err := shutdown(ctx, test.timeout, &f.pollerWG, closeStaters, &f.staterWG)
+		cancel()
+
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+		}
+
+		f.mu.Lock()
+		events := append([]string(nil), f.events...)
+		f.mu.Unlock()
+		if len(events) != len(test.expected) {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expected, events)
+			continue
+		}
+		for j := range test.expected {
+			if events[j] != test.expected[j] {
+				t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expected, events)
+				break
+			}
+		}
+	}
+}
+
+// TestApplyReload checks only the changes which were applied are in the current config, so a failed change is
+// retried on the next reload, and the startup cliFlags are unchanged
+func TestApplyReload(t *testing.T) {
+
+	startup := config.Register(flag.NewFlagSet("startup", flag.ContinueOnError))
+	ctl := admin.NewController(startup)
+
+	fs := flag.NewFlagSet("reloaded", flag.ContinueOnError)
+	reloaded := config.Register(fs)
+	if err := fs.Parse([]string{"-frequency", "20s", "-logLevels", "kernel=debug", "-netlinkers4", "6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	current := startup
+	applyReload(logging.Logger("config"), ctl, &current, reloaded)
+
+	var names []string
+	for _, change := range config.Changes(current, reloaded) {
+		names = append(names, change.Name)
+	}
+	if fmt.Sprint(names) != "[netlinkers4 logLevels]" {
+		t.Errorf("expected the changes still to apply:[netlinkers4 logLevels]\tresult:%v", names)
+	}
+	if ctl.PollingFrequency() != 20*time.Second || *current.PollingFrequency != 20*time.Second || *startup.PollingFrequency != 30*time.Second {
+		t.Errorf("expected frequency ctl:20s current:20s startup:30s\tresult:%s %s %s", ctl.PollingFrequency(), *current.PollingFrequency, *startup.PollingFrequency)
+	}
+}
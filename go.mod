@@ -1,6 +1,6 @@
 module github.com/Edgio/xtcp
 
-go 1.16
+go 1.21
 
 replace github.com/Edgio/xtcp/pkg/misc => ./pkg/misc
 
@@ -22,10 +22,28 @@ replace github.com/Edgio/xtcp/pkg/netlinkerstater => ./pkg/netlinkerstater
 
 require (
 	github.com/go-cmd/cmd v1.3.0
-	github.com/golang/protobuf v1.5.2
-	github.com/nsqio/go-nsq v1.1.0 // indirect
+	github.com/golang/protobuf v1.5.3
+	github.com/maxmind/mmdbwriter v1.0.0
+	github.com/nsqio/go-nsq v1.1.0
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/pkg/profile v1.6.0
 	github.com/prometheus/client_golang v1.11.0
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
-	google.golang.org/protobuf v1.28.1
+	golang.org/x/sys v0.10.0
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 )
@@ -0,0 +1,237 @@
+// Package admin contains the runtime Controller and the admin HTTP API of xtcp
+//
+// The Controller holds the settings which can be changed while xtcp is running, and the
+// channels the pollers select on to allow an immediate poll.  It is shared by the pollers,
+// the netlinkers, and the HTTP handlers.
+//
+// The admin HTTP API is served on the same listener as the Prometheus metrics, and every
+// request must carry the token from the token file as "Authorization: Bearer <token>".
+// Every change is recorded in the audit log.
+//
+// e.g.
+// curl -H "Authorization: Bearer $(cat /etc/xtcp/admin_token)" -X POST http://127.0.0.1:9000/admin/poll?af=v4
+package admin
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/misc"
+)
+
+// WorkerState is the current state of a single poller, netlinker, or inetdiager
+// Count is loops for pollers, packets for netlinkers, and messages for inetdiagers
+type WorkerState struct {
+	Kind  string    `json:"kind"`
+	Af    string    `json:"af"`
+	ID    int       `json:"id"`
+	State string    `json:"state"`
+	Count int       `json:"count"`
+	Since time.Time `json:"since"`
+}
+
+// Controller holds the runtime state shared between the admin API and the workers
+type Controller struct {
+	samplingModulus  int64
+	pollingFrequency int64 // time.Duration
+	paused           int32
+	disabled         int32
+
+	// effective samplingModulus per address family, which the adaptive sampler moves within its bounds
+	effectiveSamplingModulus map[uint8]*int64
+
+	// per address family channels, which the pollers select on
+	pollTriggerCh map[uint8]chan struct{}
+	frequencyCh   map[uint8]chan time.Duration
+
+	workersMu sync.Mutex
+	workers   map[string]*WorkerState
+}
+
+// NewController creates the Controller with the starting values from the cliFlags
+func NewController(cliFlags cliflags.CliFlags) *Controller {
+
+	ctl := &Controller{
+		samplingModulus:          int64(*cliFlags.SamplingModulus),
+		pollingFrequency:         int64(*cliFlags.PollingFrequency),
+		effectiveSamplingModulus: make(map[uint8]*int64),
+		pollTriggerCh:            make(map[uint8]chan struct{}),
+		frequencyCh:              make(map[uint8]chan time.Duration),
+		workers:                  make(map[string]*WorkerState),
+	}
+	for af := range misc.KernelEnumToString {
+		modulus := int64(*cliFlags.SamplingModulus)
+		ctl.effectiveSamplingModulus[af] = &modulus
+		ctl.pollTriggerCh[af] = make(chan struct{}, 1)
+		ctl.frequencyCh[af] = make(chan time.Duration, 1)
+	}
+	return ctl
+}
+
+// SamplingModulus returns the current netlinker samplingModulus
+func (ctl *Controller) SamplingModulus() int {
+	return int(atomic.LoadInt64(&ctl.samplingModulus))
+}
+
+// SetSamplingModulus changes the netlinker samplingModulus, which applies from the next poll
+// This also resets the effective samplingModulus of every address family, so with adaptive sampling
+// the sampler starts again from this value
+func (ctl *Controller) SetSamplingModulus(modulus int) error {
+	if modulus < 1 {
+		return fmt.Errorf("samplingModulus must be >= 1, got:%d", modulus)
+	}
+	atomic.StoreInt64(&ctl.samplingModulus, int64(modulus))
+	for _, effective := range ctl.effectiveSamplingModulus {
+		atomic.StoreInt64(effective, int64(modulus))
+	}
+	return nil
+}
+
+// EffectiveSamplingModulus returns the samplingModulus the netlinkers use for the address family
+// Without adaptive sampling, this is always the SamplingModulus
+func (ctl *Controller) EffectiveSamplingModulus(af uint8) int {
+	effective, ok := ctl.effectiveSamplingModulus[af]
+	if !ok {
+		return ctl.SamplingModulus()
+	}
+	return int(atomic.LoadInt64(effective))
+}
+
+// SetEffectiveSamplingModulus changes the samplingModulus for one address family, which is used by the adaptive sampler
+func (ctl *Controller) SetEffectiveSamplingModulus(af uint8, modulus int) error {
+	effective, ok := ctl.effectiveSamplingModulus[af]
+	if !ok {
+		return fmt.Errorf("unknown address family:%d", af)
+	}
+	if modulus < 1 {
+		return fmt.Errorf("samplingModulus must be >= 1, got:%d", modulus)
+	}
+	atomic.StoreInt64(effective, int64(modulus))
+	return nil
+}
+
+// EffectiveSamplingModuli returns the effective samplingModulus of each address family, by the af name (v4, v6)
+func (ctl *Controller) EffectiveSamplingModuli() map[string]int {
+	moduli := make(map[string]int)
+	for af := range ctl.effectiveSamplingModulus {
+		moduli[misc.KernelEnumToString[af]] = ctl.EffectiveSamplingModulus(af)
+	}
+	return moduli
+}
+
+// PollingFrequency returns the current polling frequency
+func (ctl *Controller) PollingFrequency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ctl.pollingFrequency))
+}
+
+// SetPollingFrequency changes the polling frequency, and notifies the pollers so they can reset their tickers
+func (ctl *Controller) SetPollingFrequency(frequency time.Duration) error {
+	if frequency < time.Millisecond {
+		return fmt.Errorf("polling frequency must be >= 1ms, got:%s", frequency)
+	}
+	atomic.StoreInt64(&ctl.pollingFrequency, int64(frequency))
+	for _, ch := range ctl.frequencyCh {
+		// replace any pending change that the poller hasn't picked up yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- frequency
+	}
+	return nil
+}
+
+// FrequencyCh is the channel the poller selects on for polling frequency changes
+func (ctl *Controller) FrequencyCh(af uint8) <-chan time.Duration {
+	return ctl.frequencyCh[af]
+}
+
+// TriggerPoll requests an immediate poll for the address family
+// Multiple triggers before the poller gets to them are coalesced into one poll
+func (ctl *Controller) TriggerPoll(af uint8) error {
+	ch, ok := ctl.pollTriggerCh[af]
+	if !ok {
+		return fmt.Errorf("unknown address family:%d", af)
+	}
+	if ctl.Paused() {
+		return fmt.Errorf("polling is paused")
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PollTriggerCh is the channel the poller selects on for immediate polls
+func (ctl *Controller) PollTriggerCh(af uint8) <-chan struct{} {
+	return ctl.pollTriggerCh[af]
+}
+
+// Pause stops the pollers from polling, from the next tick
+func (ctl *Controller) Pause() {
+	atomic.StoreInt32(&ctl.paused, 1)
+}
+
+// Resume allows the pollers to poll again, from the next tick
+func (ctl *Controller) Resume() {
+	atomic.StoreInt32(&ctl.paused, 0)
+}
+
+// Paused returns true if polling is paused, either via Pause or by the disabler
+func (ctl *Controller) Paused() bool {
+	return atomic.LoadInt32(&ctl.paused) == 1 || ctl.Disabled()
+}
+
+// SetDisabled is used by the disabler's pause action.  This is separate from Pause/Resume, so
+// the disabler re-enabling xtcp doesn't resume polling that was paused via the admin API, and
+// Resume doesn't override the disabler
+func (ctl *Controller) SetDisabled(disabled bool) {
+	var v int32
+	if disabled {
+		v = 1
+	}
+	atomic.StoreInt32(&ctl.disabled, v)
+}
+
+// Disabled returns true if the disabler has paused polling
+func (ctl *Controller) Disabled() bool {
+	return atomic.LoadInt32(&ctl.disabled) == 1
+}
+
+// SetWorkerState records the current state of a worker
+// This takes a lock, so workers should only call this on state changes, not per message
+func (ctl *Controller) SetWorkerState(kind string, af uint8, id int, state string, count int) {
+
+	key := fmt.Sprintf("%s/%s/%d", kind, misc.KernelEnumToString[af], id)
+
+	ctl.workersMu.Lock()
+	defer ctl.workersMu.Unlock()
+
+	w, ok := ctl.workers[key]
+	if !ok {
+		w = &WorkerState{Kind: kind, Af: misc.KernelEnumToString[af], ID: id}
+		ctl.workers[key] = w
+	}
+	if w.State != state {
+		w.Since = time.Now()
+	}
+	w.State = state
+	w.Count = count
+}
+
+// WorkerStates returns a copy of the current worker states
+func (ctl *Controller) WorkerStates() []WorkerState {
+
+	ctl.workersMu.Lock()
+	defer ctl.workersMu.Unlock()
+
+	states := make([]WorkerState, 0, len(ctl.workers))
+	for _, w := range ctl.workers {
+		states = append(states, *w)
+	}
+	return states
+}
@@ -0,0 +1,224 @@
+package admin_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+)
+
+const (
+	testToken = "s3cret"
+)
+
+// testAPI creates a Controller and API, with the token and audit log in a temp directory
+func testAPI(t *testing.T) (*admin.Controller, *httptest.Server, string) {
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auditLog := filepath.Join(dir, "audit.log")
+
+	samplingModulus := 2
+	pollingFrequency := 30 * time.Second
+	var cliFlags cliflags.CliFlags
+	cliFlags.SamplingModulus = &samplingModulus
+	cliFlags.PollingFrequency = &pollingFrequency
+
+	ctl := admin.NewController(cliFlags)
+	api, err := admin.NewAPI(ctl, cliFlags, tokenFile, auditLog)
+	if err != nil {
+		t.Fatalf("NewAPI error:%v", err)
+	}
+	mux := http.NewServeMux()
+	api.Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return ctl, srv, auditLog
+}
+
+// do is a small helper to make a request, optionally with the token
+func do(t *testing.T, method string, url string, token string) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestAPIStatusCodes checks the auth, methods, and argument validation
+func TestAPIStatusCodes(t *testing.T) {
+
+	_, srv, _ := testAPI(t)
+
+	var tests = []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"no token", http.MethodPost, "/admin/poll", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "/admin/poll", "nope", http.StatusUnauthorized},
+		{"wrong method", http.MethodGet, "/admin/poll", testToken, http.StatusMethodNotAllowed},
+		{"poll both", http.MethodPost, "/admin/poll", testToken, http.StatusOK},
+		{"poll v4", http.MethodPost, "/admin/poll?af=v4", testToken, http.StatusOK},
+		{"poll bad af", http.MethodPost, "/admin/poll?af=v5", testToken, http.StatusBadRequest},
+		{"config", http.MethodGet, "/admin/config", testToken, http.StatusOK},
+		{"workers", http.MethodGet, "/admin/workers", testToken, http.StatusOK},
+		{"sampling", http.MethodPost, "/admin/sampling?modulus=10", testToken, http.StatusOK},
+		{"sampling zero", http.MethodPost, "/admin/sampling?modulus=0", testToken, http.StatusBadRequest},
+		{"sampling not a number", http.MethodPost, "/admin/sampling?modulus=x", testToken, http.StatusBadRequest},
+		{"frequency", http.MethodPost, "/admin/frequency?frequency=10s", testToken, http.StatusOK},
+		{"frequency bad", http.MethodPost, "/admin/frequency?frequency=10", testToken, http.StatusBadRequest},
+		{"loglevel", http.MethodPost, "/admin/loglevel?subsystem=netlinker&level=debug", testToken, http.StatusOK},
+		{"loglevel bad subsystem", http.MethodPost, "/admin/loglevel?subsystem=kernel&level=debug", testToken, http.StatusBadRequest},
+		{"loglevel bad level", http.MethodPost, "/admin/loglevel?subsystem=netlinker&level=loud", testToken, http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		if output := do(t, test.method, srv.URL+test.path, test.token); output != test.expected {
+			t.Errorf("test:%d %s\texpected:%d\tresult:%d", i, test.name, test.expected, output)
+		}
+	}
+
+	// The token must have the "Bearer " prefix
+	for i, authorization := range []string{testToken, "bearer " + testToken, "Bearer" + testToken} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/admin/poll", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authorization)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("test:%d Authorization:%q\texpected:%d\tresult:%d", i, authorization, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+}
+
+// TestAPIControls checks the changes made via the API reach the Controller and the poller channels
+func TestAPIControls(t *testing.T) {
+
+	ctl, srv, auditLog := testAPI(t)
+
+	do(t, http.MethodPost, srv.URL+"/admin/poll?af=v6", testToken)
+	select {
+	case <-ctl.PollTriggerCh(10):
+	default:
+		t.Errorf("expected a poll trigger for v6")
+	}
+	select {
+	case <-ctl.PollTriggerCh(2):
+		t.Errorf("unexpected poll trigger for v4")
+	default:
+	}
+
+	// the adaptive sampler's per address family changes are reset by the admin API
+	if err := ctl.SetEffectiveSamplingModulus(10, 50); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.EffectiveSamplingModulus(10) != 50 || ctl.EffectiveSamplingModulus(2) != 2 {
+		t.Errorf("expected effective samplingModulus v4:2 v6:50\tresult:%v", ctl.EffectiveSamplingModuli())
+	}
+	do(t, http.MethodPost, srv.URL+"/admin/sampling?modulus=7", testToken)
+	if ctl.SamplingModulus() != 7 || ctl.EffectiveSamplingModulus(10) != 7 {
+		t.Errorf("expected samplingModulus:7\tresult:%d\teffective:%v", ctl.SamplingModulus(), ctl.EffectiveSamplingModuli())
+	}
+
+	// two changes before the poller reads only leaves the latest
+	do(t, http.MethodPost, srv.URL+"/admin/frequency?frequency=5s", testToken)
+	do(t, http.MethodPost, srv.URL+"/admin/frequency?frequency=15s", testToken)
+	if f := <-ctl.FrequencyCh(2); f != 15*time.Second {
+		t.Errorf("expected frequency:15s\tresult:%s", f)
+	}
+
+	do(t, http.MethodPost, srv.URL+"/admin/pause", testToken)
+	if !ctl.Paused() {
+		t.Errorf("expected paused")
+	}
+	if code := do(t, http.MethodPost, srv.URL+"/admin/poll", testToken); code != http.StatusConflict {
+		t.Errorf("expected poll while paused:%d\tresult:%d", http.StatusConflict, code)
+	}
+	do(t, http.MethodPost, srv.URL+"/admin/resume", testToken)
+	if ctl.Paused() {
+		t.Errorf("expected resumed")
+	}
+
+	f, err := os.Open(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var actions []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("audit line not JSON:%s", scanner.Text())
+		}
+		actions = append(actions, rec["action"].(string))
+	}
+	expected := []string{"poll", "sampling", "frequency", "frequency", "pause", "poll", "resume"}
+	if len(actions) != len(expected) {
+		t.Fatalf("expected audit actions:%v\tresult:%v", expected, actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("audit line:%d expected:%s\tresult:%s", i, expected[i], actions[i])
+		}
+	}
+}
+
+// TestAPIConfig checks the config shows the settings in effect, rather than the startup cliFlags
+func TestAPIConfig(t *testing.T) {
+
+	_, srv, _ := testAPI(t)
+
+	if err := logging.SetLevels("info", ""); err != nil {
+		t.Fatal(err)
+	}
+	do(t, http.MethodPost, srv.URL+"/admin/loglevel?subsystem=netlinker&level=debug", testToken)
+	do(t, http.MethodPost, srv.URL+"/admin/frequency?frequency=10s", testToken)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var config map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config["PollingFrequency"] != "10s" || config["LogLevel"] != "info" || config["LogLevels"] != "netlinker=debug" {
+		t.Errorf("expected PollingFrequency:10s LogLevel:info LogLevels:netlinker=debug\tresult:%v %v %v", config["PollingFrequency"], config["LogLevel"], config["LogLevels"])
+	}
+}
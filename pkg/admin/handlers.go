@@ -0,0 +1,272 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/misc"
+)
+
+// stringToKernelEnum maps the human address family strings back to the kernel enum
+var stringToKernelEnum = map[string]uint8{
+	"v4": uint8(2),
+	"v6": uint8(10),
+	"4":  uint8(2),
+	"6":  uint8(10),
+}
+
+// API serves the admin HTTP endpoints
+type API struct {
+	ctl      *Controller
+	cliFlags cliflags.CliFlags
+	token    []byte
+
+	auditMu sync.Mutex
+	audit   *os.File
+}
+
+// auditRecord is a single line in the audit log (JSON lines)
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+	Result string    `json:"result"`
+}
+
+// NewAPI reads the token file, and opens the audit log (append only)
+// An empty audit log path means the audit records only go to stdout
+func NewAPI(ctl *Controller, cliFlags cliflags.CliFlags, tokenFile string, auditLog string) (*API, error) {
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("admin token file:%w", err)
+	}
+	token = []byte(strings.TrimSpace(string(token)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin token file %s is empty", tokenFile)
+	}
+
+	api := &API{
+		ctl:      ctl,
+		cliFlags: cliFlags,
+		token:    token,
+	}
+
+	if auditLog != "" {
+		api.audit, err = os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("admin audit log:%w", err)
+		}
+	}
+	return api, nil
+}
+
+// Register adds the admin endpoints to the mux
+func (api *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/poll", api.auth(http.MethodPost, api.handlePoll))
+	mux.HandleFunc("/admin/config", api.auth(http.MethodGet, api.handleConfig))
+	mux.HandleFunc("/admin/workers", api.auth(http.MethodGet, api.handleWorkers))
+	mux.HandleFunc("/admin/sampling", api.auth(http.MethodPost, api.handleSampling))
+	mux.HandleFunc("/admin/frequency", api.auth(http.MethodPost, api.handleFrequency))
+	mux.HandleFunc("/admin/pause", api.auth(http.MethodPost, api.handlePause))
+	mux.HandleFunc("/admin/resume", api.auth(http.MethodPost, api.handleResume))
+	mux.HandleFunc("/admin/loglevel", api.auth(http.MethodPost, api.handleLogLevel))
+}
+
+// HandleFunc adds another package's endpoint to the mux, with the same method and bearer token checks
+func (api *API) HandleFunc(mux *http.ServeMux, pattern string, method string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, api.auth(method, handler))
+}
+
+// auth wraps the handlers checking the method and the bearer token.  The token must be presented as
+// "Authorization: Bearer <token>", so the bare token is unauthorized.
+func (api *API) auth(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), api.token) != 1 {
+			api.record(r, "auth", r.URL.Path, "denied")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// record writes the audit record to the audit log (if configured) and stdout
+func (api *API) record(r *http.Request, action string, detail string, result string) {
+
+	line, err := json.Marshal(auditRecord{
+		Time:   time.Now(),
+		Remote: r.RemoteAddr,
+		Action: action,
+		Detail: detail,
+		Result: result,
+	})
+	if err != nil {
+		return
+	}
+
+	logging.Logger("admin").Info("audit", "remote", r.RemoteAddr, "action", action, "detail", detail, "result", result)
+
+	if api.audit != nil {
+		api.auditMu.Lock()
+		defer api.auditMu.Unlock()
+		if _, err := api.audit.Write(append(line, '\n')); err != nil {
+			logging.Logger("admin").Error("audit log write error", "err", err)
+		}
+	}
+}
+
+// writeJSON is a small helper to write the response body
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handlePoll triggers an immediate poll.  ?af=v4 or ?af=v6, or both if af is not set
+func (api *API) handlePoll(w http.ResponseWriter, r *http.Request) {
+
+	var afs []uint8
+	if afString := r.URL.Query().Get("af"); afString != "" {
+		af, ok := stringToKernelEnum[afString]
+		if !ok {
+			http.Error(w, "af must be v4 or v6", http.StatusBadRequest)
+			return
+		}
+		afs = append(afs, af)
+	} else {
+		afs = append(afs, uint8(2), uint8(10))
+	}
+
+	for _, af := range afs {
+		if err := api.ctl.TriggerPoll(af); err != nil {
+			api.record(r, "poll", misc.KernelEnumToString[af], err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		api.record(r, "poll", misc.KernelEnumToString[af], "ok")
+	}
+	writeJSON(w, map[string]string{"result": "ok"})
+}
+
+// handleConfig shows the effective configuration, which is the cliFlags with the runtime changes applied, by the
+// admin API, SIGHUP, and SIGUSR1, to the reloadable settings
+func (api *API) handleConfig(w http.ResponseWriter, r *http.Request) {
+
+	config := make(map[string]interface{})
+	v := reflect.ValueOf(api.cliFlags)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
+			config[v.Type().Field(i).Name] = field.Elem().Interface()
+		}
+	}
+	config["SamplingModulus"] = api.ctl.SamplingModulus()
+	config["EffectiveSamplingModulus"] = api.ctl.EffectiveSamplingModuli()
+	config["PollingFrequency"] = api.ctl.PollingFrequency().String()
+	config["LogLevel"], config["LogLevels"] = logging.CurrentLevels()
+	config["Paused"] = api.ctl.Paused()
+	config["Disabled"] = api.ctl.Disabled()
+
+	writeJSON(w, config)
+}
+
+// handleWorkers shows the per worker state, sorted by kind, af, and id
+func (api *API) handleWorkers(w http.ResponseWriter, r *http.Request) {
+
+	states := api.ctl.WorkerStates()
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Kind != states[j].Kind {
+			return states[i].Kind < states[j].Kind
+		}
+		if states[i].Af != states[j].Af {
+			return states[i].Af < states[j].Af
+		}
+		return states[i].ID < states[j].ID
+	})
+	writeJSON(w, states)
+}
+
+// handleSampling changes the samplingModulus.  ?modulus=N
+func (api *API) handleSampling(w http.ResponseWriter, r *http.Request) {
+
+	modulusString := r.URL.Query().Get("modulus")
+	modulus, err := strconv.Atoi(modulusString)
+	if err == nil {
+		err = api.ctl.SetSamplingModulus(modulus)
+	}
+	if err != nil {
+		api.record(r, "sampling", modulusString, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.record(r, "sampling", modulusString, "ok")
+	writeJSON(w, map[string]int{"samplingModulus": api.ctl.SamplingModulus()})
+}
+
+// handleFrequency changes the polling frequency.  ?frequency=10s
+func (api *API) handleFrequency(w http.ResponseWriter, r *http.Request) {
+
+	frequencyString := r.URL.Query().Get("frequency")
+	frequency, err := time.ParseDuration(frequencyString)
+	if err == nil {
+		err = api.ctl.SetPollingFrequency(frequency)
+	}
+	if err != nil {
+		api.record(r, "frequency", frequencyString, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.record(r, "frequency", frequencyString, "ok")
+	writeJSON(w, map[string]string{"pollingFrequency": api.ctl.PollingFrequency().String()})
+}
+
+// handlePause pauses polling
+func (api *API) handlePause(w http.ResponseWriter, r *http.Request) {
+	api.ctl.Pause()
+	api.record(r, "pause", "", "ok")
+	writeJSON(w, map[string]bool{"paused": api.ctl.Paused()})
+}
+
+// handleResume resumes polling
+func (api *API) handleResume(w http.ResponseWriter, r *http.Request) {
+	api.ctl.Resume()
+	api.record(r, "resume", "", "ok")
+	writeJSON(w, map[string]bool{"paused": api.ctl.Paused()})
+}
+
+// handleLogLevel changes a subsystem's log level.  ?subsystem=netlinker&level=trace
+func (api *API) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+
+	subsystem := r.URL.Query().Get("subsystem")
+	level := r.URL.Query().Get("level")
+	detail := subsystem + "=" + level
+	if err := logging.SetLevel(subsystem, level); err != nil {
+		api.record(r, "loglevel", detail, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.record(r, "loglevel", detail, "ok")
+	writeJSON(w, logging.Levels())
+}
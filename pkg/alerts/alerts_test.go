@@ -0,0 +1,391 @@
+package alerts_test
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/alerts"
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// socket is the synthetic socket of a record
+type socket struct {
+	destination  string
+	port         uint32 // source port
+	state        uint32
+	uid          uint32
+	sndWnd       uint32
+	totalRetrans uint32
+	segsOut      uint32
+	modulus      uint32
+}
+
+func (s socket) record() *xtcppb.XtcpRecord {
+	ip := net.ParseIP(s.destination)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	modulus := s.modulus
+	if modulus == 0 {
+		modulus = 1
+	}
+	return &xtcppb.XtcpRecord{
+		SamplingModulus: proto.Uint32(modulus),
+		InetDiagMsg: &xtcppb.InetDiagMsg{
+			State: proto.Uint32(s.state),
+			UID:   proto.Uint32(s.uid),
+			SocketID: &xtcppb.SocketID{
+				Source:      net.IPv4(192, 0, 2, 1).To4(),
+				SourcePort:  proto.Uint32(s.port),
+				Destination: ip,
+			},
+		},
+		TcpInfo: &xtcppb.TcpInfo{
+			SndWnd:       proto.Uint32(s.sndWnd),
+			TotalRetrans: proto.Uint32(s.totalRetrans),
+			SegsOut:      proto.Uint32(s.segsOut),
+		},
+	}
+}
+
+func f(v float64) *float64 {
+	return &v
+}
+
+// pollTime is the time of poll i
+func pollTime(i int) syscall.Timespec {
+	return syscall.Timespec{Sec: int64(1700000000 + 10*i)}
+}
+
+// collect closes the engine, and returns the events
+func collect(engine *alerts.Engine) []alerts.Event {
+	engine.Close()
+	var events []alerts.Event
+	for event := range engine.Events() {
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestRules checks the example rules against a single poll of synthetic sockets
+func TestRules(t *testing.T) {
+
+	truncate, err := anonymize.New(anonymize.Config{Source: anonymize.None, Destination: anonymize.Truncate, Prefix4: 16, Prefix6: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zeroWindow := alerts.Rule{Name: "zero_window", Filter: "snd_wnd == 0", GroupBy: []string{"destination/24"}, Above: f(2)}
+	retransmits := alerts.Rule{Name: "retransmits", Filter: "source_port == 443", Value: "ratio:total_retrans/segs_out", Above: f(0.05), Severity: alerts.Critical}
+	closeWait := alerts.Rule{Name: "close_wait", Filter: "inet_diag_msg.state == 8", GroupBy: []string{"u_i_d"}, Above: f(3)}
+
+	var tests = []struct {
+		name       string
+		rule       alerts.Rule
+		anonymizer *anonymize.Anonymizer
+		sockets    []socket
+		expected   []alerts.Event
+	}{
+		{
+			"zero window to the same /24", zeroWindow, nil,
+			[]socket{
+				{destination: "198.51.100.1"}, {destination: "198.51.100.2"}, {destination: "198.51.100.3"},
+				{destination: "203.0.113.1"}, {destination: "203.0.113.2"},
+				{destination: "198.51.100.4", sndWnd: 65535},
+			},
+			[]alerts.Event{{Rule: "zero_window", State: alerts.Firing, Severity: alerts.Warning, Group: map[string]string{"inet_diag_msg.socket_i_d.destination": "198.51.100.0/24"}, Value: 3, Threshold: 2}},
+		},
+		{
+			"zero window anonymized", zeroWindow, truncate,
+			[]socket{{destination: "198.51.100.1"}, {destination: "198.51.100.2"}, {destination: "198.51.100.3"}},
+			[]alerts.Event{{Rule: "zero_window", State: alerts.Firing, Severity: alerts.Warning, Group: map[string]string{"inet_diag_msg.socket_i_d.destination": "198.51.0.0/24"}, Value: 3, Threshold: 2}},
+		},
+		{
+			"zero window ipv6 default /64", zeroWindow, nil,
+			[]socket{{destination: "2001:db8:0:1::1"}, {destination: "2001:db8:0:1::2"}, {destination: "2001:db8:0:1::3"}, {destination: "2001:db8:0:2::1"}},
+			[]alerts.Event{{Rule: "zero_window", State: alerts.Firing, Severity: alerts.Warning, Group: map[string]string{"inet_diag_msg.socket_i_d.destination": "2001:db8:0:1::/64"}, Value: 3, Threshold: 2}},
+		},
+		{
+			"retransmit ratio on 443", retransmits, nil,
+			[]socket{
+				{port: 443, sndWnd: 1, totalRetrans: 10, segsOut: 100},
+				{port: 443, sndWnd: 1, totalRetrans: 0, segsOut: 50},
+				{port: 80, sndWnd: 1, totalRetrans: 100, segsOut: 100},
+			},
+			[]alerts.Event{{Rule: "retransmits", State: alerts.Firing, Severity: alerts.Critical, Value: 10.0 / 150, Threshold: 0.05}},
+		},
+		{
+			"retransmit ratio on 443 below", retransmits, nil,
+			[]socket{{port: 443, totalRetrans: 1, segsOut: 100}, {port: 80, totalRetrans: 100, segsOut: 100}},
+			nil,
+		},
+		{
+			"close_wait per uid, scaled by the sampling modulus", closeWait, nil,
+			[]socket{
+				{state: 8, uid: 1000, modulus: 2}, {state: 8, uid: 1000, modulus: 2},
+				{state: 8, uid: 1001}, {state: 8, uid: 1001}, {state: 8, uid: 1001},
+				{state: 1, uid: 1001},
+			},
+			[]alerts.Event{{Rule: "close_wait", State: alerts.Firing, Severity: alerts.Warning, Group: map[string]string{"inet_diag_msg.u_i_d": "1000"}, Value: 4, Threshold: 3}},
+		},
+	}
+
+	for i, test := range tests {
+		engine, err := alerts.New([]alerts.Rule{test.rule}, "test", test.anonymizer)
+		if err != nil {
+			t.Fatalf("test:%d %s\terr:%v", i, test.name, err)
+		}
+		shard := engine.Shard(unix.AF_INET)
+		for _, s := range test.sockets {
+			shard.Observe(pollTime(1), s.record())
+		}
+		events := collect(engine)
+
+		for j := range test.expected {
+			test.expected[j].Time = time.Unix(pollTime(1).Sec, 0).UTC()
+			test.expected[j].Hostname = "test"
+			test.expected[j].Af = "v4"
+		}
+		if !reflect.DeepEqual(events, test.expected) {
+			t.Errorf("test:%d %s\texpected:%+v\tresult:%+v", i, test.name, test.expected, events)
+		}
+	}
+}
+
+// TestHysteresis checks the for, clear, and deduplication over a sequence of polls
+func TestHysteresis(t *testing.T) {
+
+	rule := alerts.Rule{Name: "busy", GroupBy: []string{"destination"}, Above: f(2), Clear: f(1), For: 2}
+	engine, err := alerts.New([]alerts.Rule{rule}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sockets to 198.51.100.1 in each poll, spread over two inetdiagers' shards
+	shards := []*alerts.Shard{engine.Shard(unix.AF_INET), engine.Shard(unix.AF_INET)}
+	polls := []int{3, 3, 3, 2, 1, 3, 0, 3, 3, 0}
+	for i, sockets := range polls {
+		engine.Poll(unix.AF_INET, time.Unix(pollTime(i).Sec, 0))
+		for s := 0; s < sockets; s++ {
+			shards[s%2].Observe(pollTime(i), socket{destination: "198.51.100.1"}.record())
+		}
+		// a late record of the previous poll is ignored
+		if i > 0 {
+			shards[i%2].Observe(pollTime(i-1), socket{destination: "198.51.100.1"}.record())
+		}
+	}
+	events := collect(engine)
+
+	var tests = []struct {
+		poll  int
+		state string
+		value float64
+	}{
+		{1, alerts.Firing, 3},   // breached for two polls
+		{4, alerts.Resolved, 1}, // not resolved at 2, because clear is 1
+		{8, alerts.Firing, 3},   // pending was reset by no sockets at poll 6
+		{9, alerts.Resolved, 0}, // no sockets
+	}
+	if len(events) != len(tests) {
+		t.Fatalf("expected events:%d\tresult:%d %+v", len(tests), len(events), events)
+	}
+	for i, test := range tests {
+		event := events[i]
+		if event.State != test.state || event.Value != test.value || !event.Time.Equal(time.Unix(pollTime(test.poll).Sec, 0)) {
+			t.Errorf("test:%d\texpected:%s %g poll:%d\tresult:%s %g %s", i, test.state, test.value, test.poll, event.State, event.Value, event.Time)
+		}
+	}
+}
+
+// TestShards checks the shards of concurrent inetdiagers are merged when they close
+func TestShards(t *testing.T) {
+
+	rule := alerts.Rule{Name: "busy", GroupBy: []string{"destination"}, Above: f(99)}
+	engine, err := alerts.New([]alerts.Rule{rule}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each inetdiager observes 25 sockets to each destination, and closes its shard
+	var wg sync.WaitGroup
+	for d := 0; d < 4; d++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shard := engine.Shard(unix.AF_INET)
+			defer shard.Close()
+			for s := 0; s < 25; s++ {
+				shard.Observe(pollTime(0), socket{destination: "198.51.100.1"}.record())
+				shard.Observe(pollTime(0), socket{destination: "198.51.100.2"}.record())
+			}
+		}()
+	}
+	wg.Wait()
+	events := collect(engine)
+
+	// 100 sockets to each destination
+	if len(events) != 2 {
+		t.Fatalf("expected events:2\tresult:%d %+v", len(events), events)
+	}
+	for i, event := range events {
+		if event.Value != 100 || event.State != alerts.Firing {
+			t.Errorf("test:%d\texpected:firing 100\tresult:%s %g %v", i, event.State, event.Value, event.Group)
+		}
+	}
+}
+
+// TestBelow checks a rule without group_by, which has a value even when there aren't any sockets
+func TestBelow(t *testing.T) {
+
+	rule := alerts.Rule{Name: "few", Filter: "source_port == 443", Below: f(2)}
+	engine, err := alerts.New([]alerts.Rule{rule}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := engine.Shard(unix.AF_INET6)
+	shard.Observe(pollTime(0), socket{destination: "2001:db8::1", port: 443}.record())
+	shard.Observe(pollTime(0), socket{destination: "2001:db8::2", port: 443}.record())
+	engine.Poll(unix.AF_INET6, time.Unix(pollTime(1).Sec, 0))
+	events := collect(engine)
+
+	if len(events) != 1 || events[0].State != alerts.Firing || events[0].Value != 0 || events[0].Af != "v6" {
+		t.Errorf("expected firing with the value 0 for poll 1\tresult:%+v", events)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		rule alerts.Rule
+	}{
+		{"no name", alerts.Rule{Above: f(1)}},
+		{"bad filter", alerts.Rule{Name: "x", Filter: "rtt >", Above: f(1)}},
+		{"unknown group_by", alerts.Rule{Name: "x", GroupBy: []string{"nope"}, Above: f(1)}},
+		{"ambiguous group_by", alerts.Rule{Name: "x", GroupBy: []string{"state"}, Above: f(1)}},
+		{"message group_by", alerts.Rule{Name: "x", GroupBy: []string{"tcp_info"}, Above: f(1)}},
+		{"prefix on a number", alerts.Rule{Name: "x", GroupBy: []string{"u_i_d/24"}, Above: f(1)}},
+		{"bad prefix", alerts.Rule{Name: "x", GroupBy: []string{"destination/33"}, Above: f(1)}},
+		{"bad value", alerts.Rule{Name: "x", Value: "median:rtt", Above: f(1)}},
+		{"ratio of one field", alerts.Rule{Name: "x", Value: "ratio:rtt", Above: f(1)}},
+		{"sum of an address", alerts.Rule{Name: "x", Value: "sum:destination", Above: f(1)}},
+		{"no threshold", alerts.Rule{Name: "x"}},
+		{"above and below", alerts.Rule{Name: "x", Above: f(1), Below: f(1)}},
+		{"clear above the threshold", alerts.Rule{Name: "x", Above: f(1), Clear: f(2)}},
+		{"clear below the threshold", alerts.Rule{Name: "x", Below: f(1), Clear: f(0)}},
+		{"negative for", alerts.Rule{Name: "x", Above: f(1), For: -1}},
+		{"unknown severity", alerts.Rule{Name: "x", Above: f(1), Severity: "page"}},
+	}
+	for i, test := range tests {
+		if _, err := alerts.New([]alerts.Rule{test.rule}, "test", nil); err == nil {
+			t.Errorf("test:%d %s\texpected an error", i, test.name)
+		}
+	}
+
+	if _, err := alerts.New([]alerts.Rule{{Name: "x", Above: f(1)}, {Name: "x", Below: f(1)}}, "test", nil); err == nil {
+		t.Errorf("expected an error for the duplicated rule")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write("rules.yaml", `
+rules:
+  - name: zero_window
+    filter: snd_wnd == 0
+    group_by: [destination/24]
+    above: 50
+    clear: 20
+    for: 2
+  - name: retransmits
+    filter: source_port == 443
+    value: ratio:total_retrans/segs_out
+    above: 0.05
+    severity: critical
+`)
+	rules, err := alerts.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || *rules[0].Clear != 20 || rules[0].For != 2 || rules[1].Value != "ratio:total_retrans/segs_out" {
+		t.Errorf("unexpected rules:%+v", rules)
+	}
+	if _, err := alerts.New(rules, "test", nil); err != nil {
+		t.Errorf("alerts.New err:%v", err)
+	}
+
+	for _, content := range []string{"", "rules: [", "rules:\n  - name: [1, 2]\n"} {
+		if _, err := alerts.ReadFile(write("bad.yaml", content)); err == nil {
+			t.Errorf("expected an error for:%q", content)
+		}
+	}
+	if _, err := alerts.ReadFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("expected an error for the missing file")
+	}
+}
+
+// TestDispatchWebhook checks the events are POSTed to the webhook as JSON
+func TestDispatchWebhook(t *testing.T) {
+
+	var mu sync.Mutex
+	var received []alerts.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event alerts.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("json.Unmarshal err:%v", err)
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-alertWebhook", server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := alerts.New([]alerts.Rule{{Name: "any", Above: f(0)}}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go alerts.Dispatch(engine.Events(), cliFlags, &wg)
+
+	engine.Shard(unix.AF_INET).Observe(pollTime(0), socket{destination: "198.51.100.1"}.record())
+	engine.Poll(unix.AF_INET, time.Unix(pollTime(1).Sec, 0))
+	engine.Close()
+	wg.Wait()
+
+	if len(received) != 2 || received[0].Rule != "any" || received[0].State != alerts.Firing || received[0].Value != 1 ||
+		received[1].State != alerts.Resolved || received[1].Hostname != "test" {
+		t.Errorf("expected firing and resolved\tresult:%+v", received)
+	}
+}
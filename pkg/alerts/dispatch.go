@@ -0,0 +1,96 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/nsqio/go-nsq"
+)
+
+// webhookTimeout is the maximum time for each webhook POST
+const webhookTimeout = 5 * time.Second
+
+// Webhook POSTs the events as JSON
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send POSTs the event.  Non 2xx responses are errors.
+func (w Webhook) Send(body []byte) error {
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook http status:%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Dispatch sends the events to the log, the alertWebhook, and the alertNSQTopic, until the events channel is closed
+// The events are always logged, at warn when firing, and info when resolved.  The webhook and NSQ are optional.
+// A slow webhook backs up the events queue, and then the Engine drops the events (xtcp_alerts_dropped).
+func Dispatch(events <-chan Event, cliFlags cliflags.CliFlags, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	logger := logging.Logger("alerts")
+
+	var webhook *Webhook
+	if *cliFlags.AlertWebhook != "" {
+		webhook = &Webhook{URL: *cliFlags.AlertWebhook, Client: &http.Client{Timeout: webhookTimeout}}
+	}
+
+	var producer *nsq.Producer
+	if *cliFlags.NSQ != "" && *cliFlags.AlertNSQTopic != "" {
+		var err error
+		producer, err = nsq.NewProducer(*cliFlags.NSQ, nsq.NewConfig())
+		if err != nil {
+			logger.Error("nsq.NewProducer", "nsq", *cliFlags.NSQ, "err", err)
+		} else {
+			defer producer.Stop()
+		}
+	}
+
+	for event := range events {
+
+		level := slog.LevelInfo
+		if event.State == Firing {
+			level = slog.LevelWarn
+		}
+		logger.Log(context.Background(), level, "alert "+event.State, "rule", event.Rule, "severity", event.Severity, "af", event.Af,
+			"group", event.Group, "value", event.Value, "threshold", event.Threshold)
+
+		if webhook == nil && producer == nil {
+			continue
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			logger.Error("json.Marshal(event)", "err", err)
+			continue
+		}
+		if webhook != nil {
+			if err := webhook.Send(body); err != nil {
+				logger.Error("alert webhook", "url", webhook.URL, "err", err)
+				promDropped.WithLabelValues("webhook").Inc()
+			}
+		}
+		if producer != nil {
+			if err := producer.Publish(*cliFlags.AlertNSQTopic, body); err != nil {
+				logger.Error("alert nsq publish", "topic", *cliFlags.AlertNSQTopic, "err", err)
+				promDropped.WithLabelValues("nsq").Inc()
+			}
+		}
+	}
+	logger.Debug("alerts dispatch done")
+}
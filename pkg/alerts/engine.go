@@ -0,0 +1,605 @@
+// Package alerts evaluates the alert rules against the sockets of each poll, and emits the alert events
+//
+// Each rule selects the sockets with an exportfilter expression, groups them by the group_by fields,
+// and combines each group into a value, which is compared to the threshold once the poll is complete, e.g.
+// - more than 50 sockets with a zero window to the same /24
+// - a retransmit ratio above 5% on port 443
+// - more than 1000 CLOSE_WAIT sockets for a UID (needs -states established,close_wait)
+//
+// The counts and sums are scaled by the sampling_modulus, so they estimate all the sockets.
+//
+// The alerts have hysteresis, and are deduplicated:
+// - a group fires once it has breached the threshold for "for" consecutive polls
+// - a firing group only emits the one firing event, and then stays firing until the value is back past "clear"
+// - a resolved event is emitted when it clears, or the group has no sockets anymore
+//
+// The rules are evaluated per address family, on the records before they are anonymized, so the filters and
+// the groups see the real addresses.  The address group labels in the events are anonymized like the records.
+package alerts
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The event states
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+const (
+	// eventsChSize is how many events can be queued for Dispatch, before they are dropped
+	eventsChSize = 1000
+	// maxGroups limits the groups of each rule per poll, so a group_by on e.g. the destination can't use all the memory
+	maxGroups = 10000
+	// keySeparator separates the group labels in the group key
+	keySeparator = "\x00"
+)
+
+// Event is an alert event, which is sent to the log, the webhook, and NSQ as JSON
+type Event struct {
+	Time        time.Time         `json:"time"` // the poll time
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"` // firing or resolved
+	Severity    string            `json:"severity"`
+	Description string            `json:"description,omitempty"`
+	Hostname    string            `json:"hostname"`
+	Af          string            `json:"af"`
+	Group       map[string]string `json:"group,omitempty"` // group_by field name to the label
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+}
+
+// The metrics are package level, so they are only registered once
+var (
+	promEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "alerts",
+			Name:      "events",
+			Help:      "alerts events, by rule and state (firing or resolved)",
+		},
+		[]string{"rule", "state"},
+	)
+	promFiring = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "alerts",
+			Name:      "firing",
+			Help:      "alerts groups currently firing, by address family and rule",
+		},
+		[]string{"af", "rule"},
+	)
+	promLate = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "alerts",
+			Name:      "late",
+			Help:      "alerts records which arrived after their poll was evaluated, so they were ignored",
+		},
+		[]string{"af"},
+	)
+	promOverflow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "alerts",
+			Name:      "overflow",
+			Help:      "alerts records ignored because the rule already had the maximum groups in the poll",
+		},
+		[]string{"rule"},
+	)
+	promDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "alerts",
+			Name:      "dropped",
+			Help:      "alerts events dropped, by where (queue is the events queue being full, webhook, or nsq)",
+		},
+		[]string{"where"},
+	)
+)
+
+// aggregate is the sockets of a group in a poll
+type aggregate struct {
+	count float64 // sockets, scaled by the sampling_modulus
+	sum   float64 // scaled by the sampling_modulus
+	den   float64 // the ratio denominator, scaled by the sampling_modulus
+	max   float64
+	n     int // records
+}
+
+// add adds the record to the aggregate
+func (a *aggregate) add(r *rule, record *xtcppb.XtcpRecord, modulus float64) {
+	a.count += modulus
+	if r.aggregation == aggCount {
+		return
+	}
+	v := r.fields[0].Number(record)
+	a.sum += v * modulus
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	if r.aggregation == aggRatio {
+		a.den += r.fields[1].Number(record) * modulus
+	}
+	a.n++
+}
+
+// merge adds the other aggregate of the same group, e.g. from another Shard
+func (a *aggregate) merge(other *aggregate) {
+	a.count += other.count
+	a.sum += other.sum
+	a.den += other.den
+	if other.n > 0 && (a.n == 0 || other.max > a.max) {
+		a.max = other.max
+	}
+	a.n += other.n
+}
+
+// value is the value of the aggregate, which is false if there isn't one (e.g. the average of nothing)
+func (r *rule) value(a *aggregate) (float64, bool) {
+	switch r.aggregation {
+	case aggSum:
+		return a.sum, true
+	case aggAvg:
+		return a.sum / a.count, a.count > 0
+	case aggMax:
+		return a.max, a.n > 0
+	case aggRatio:
+		return a.sum / a.den, a.den > 0
+	}
+	return a.count, true
+}
+
+// key is the group key of the record
+func (r *rule) key(record *xtcppb.XtcpRecord) string {
+	if len(r.groupBy) == 0 {
+		return ""
+	}
+	labels := make([]string, len(r.groupBy))
+	for i, g := range r.groupBy {
+		labels[i] = g.label(record)
+	}
+	return strings.Join(labels, keySeparator)
+}
+
+// alertState is the hysteresis state of a group
+type alertState struct {
+	pending int // consecutive polls breached
+	firing  bool
+}
+
+// afState is the Shards, the current poll, and the alert states, of an address family
+type afState struct {
+	sync.Mutex
+	af       uint8
+	shards   []*Shard
+	pollTime int64                    // unix nanoseconds of the poll being aggregated, zero before the first
+	window   []map[string]*aggregate  // per rule, the groups of the poll, merged from the Shards
+	alerts   []map[string]*alertState // per rule, the groups which are pending or firing
+}
+
+// Engine evaluates the rules.  Each inetdiager aggregates its records in its own Shard, so the inetdiagers don't
+// contend on a lock, and the Shards are merged when the next poll starts (see Poll), like the topn package.
+// A nil Engine does nothing.
+type Engine struct {
+	rules      []*rule
+	hostname   string
+	anonymizer *anonymize.Anonymizer
+	events     chan Event
+
+	mu     sync.Mutex
+	afs    map[uint8]*afState
+	closed bool
+}
+
+// New creates the Engine for the rules
+func New(rules []Rule, hostname string, anonymizer *anonymize.Anonymizer) (*Engine, error) {
+	e := &Engine{
+		hostname:   hostname,
+		anonymizer: anonymizer,
+		events:     make(chan Event, eventsChSize),
+		afs:        make(map[uint8]*afState),
+	}
+	names := make(map[string]bool)
+	for _, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("alert rule:%s is duplicated", c.Name)
+		}
+		names[c.Name] = true
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+// NewFromFlags creates the Engine from the alertRules file, or returns nil if there isn't one
+func NewFromFlags(cliFlags cliflags.CliFlags, hostname string, anonymizer *anonymize.Anonymizer) (*Engine, error) {
+	if *cliFlags.AlertRules == "" {
+		return nil, nil
+	}
+	rules, err := ReadFile(*cliFlags.AlertRules)
+	if err != nil {
+		return nil, err
+	}
+	return New(rules, hostname, anonymizer)
+}
+
+// Events is the channel of the alert events, which is closed by Close
+func (e *Engine) Events() <-chan Event {
+	return e.events
+}
+
+// state returns the address family's state, creating it the first time
+func (e *Engine) state(af uint8) *afState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, ok := e.afs[af]
+	if !ok {
+		s = &afState{af: af, alerts: make([]map[string]*alertState, len(e.rules))}
+		for i := range s.alerts {
+			s.alerts[i] = make(map[string]*alertState)
+		}
+		e.afs[af] = s
+	}
+	return s
+}
+
+// open starts aggregating the poll at pollTime
+func (s *afState) open(pollTime int64) {
+	s.pollTime = pollTime
+	s.window = make([]map[string]*aggregate, len(s.alerts))
+	for i := range s.window {
+		s.window[i] = make(map[string]*aggregate)
+	}
+}
+
+// Shard creates a Shard for an inetdiager of the address family.  A nil Engine returns a nil Shard.
+func (e *Engine) Shard(af uint8) *Shard {
+	if e == nil {
+		return nil
+	}
+	sh := &Shard{engine: e, af: af}
+	s := e.state(af)
+	s.Lock()
+	s.shards = append(s.shards, sh)
+	s.Unlock()
+	return sh
+}
+
+// shards returns a copy of the address family's Shards, so they can be flushed without holding the afState lock
+func (s *afState) copyShards() []*Shard {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Shard(nil), s.shards...)
+}
+
+// Poll is called at the start of each poll.  The Shards' aggregates of the previous poll of the address family
+// are merged and evaluated, and the records of the new poll are aggregated from now on.
+func (e *Engine) Poll(af uint8, pollTime time.Time) {
+	if e == nil {
+		return
+	}
+	now := pollTime.UnixNano()
+	s := e.state(af)
+	for _, sh := range s.copyShards() {
+		sh.flush(now)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if now > s.pollTime {
+		e.evaluate(s)
+		s.open(now)
+	}
+}
+
+// merge adds the aggregates of a Shard's poll.  The aggregates of a newer poll than the current one also
+// evaluate the current poll, so Poll is optional.  The aggregates of polls which are already evaluated are ignored.
+func (e *Engine) merge(af uint8, pollTime int64, window []map[string]*aggregate, records int) {
+	s := e.state(af)
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case pollTime > s.pollTime:
+		e.evaluate(s)
+		s.open(pollTime)
+	case pollTime < s.pollTime:
+		promLate.WithLabelValues(misc.KernelEnumToString[af]).Add(float64(records))
+		return
+	}
+	for i, r := range e.rules {
+		for key, agg := range window[i] {
+			merged, ok := s.window[i][key]
+			if !ok {
+				if len(s.window[i]) >= maxGroups {
+					promOverflow.WithLabelValues(r.Name).Inc()
+					continue
+				}
+				s.window[i][key] = agg
+				continue
+			}
+			merged.merge(agg)
+		}
+	}
+}
+
+// Close evaluates the current polls, and closes the events channel
+// The inetdiagers must be done before Close.
+func (e *Engine) Close() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	afs := make([]*afState, 0, len(e.afs))
+	for _, s := range e.afs {
+		afs = append(afs, s)
+	}
+	e.mu.Unlock()
+	sort.Slice(afs, func(i, j int) bool { return afs[i].af < afs[j].af })
+
+	for _, s := range afs {
+		for _, sh := range s.copyShards() {
+			sh.flush(math.MaxInt64)
+		}
+		s.Lock()
+		e.evaluate(s)
+		s.window = nil
+		s.Unlock()
+	}
+	e.mu.Lock()
+	e.closed = true
+	close(e.events)
+	e.mu.Unlock()
+}
+
+// Shard is an inetdiager's aggregates of the current poll
+type Shard struct {
+	engine *Engine
+	af     uint8
+
+	mu       sync.Mutex
+	pollTime int64
+	window   []map[string]*aggregate // per rule, the groups of the poll
+	records  int
+}
+
+// Observe adds the record of the poll at pollTime.  Records of polls which are already merged are ignored.
+// A nil Shard does nothing.
+func (sh *Shard) Observe(pollTime syscall.Timespec, record *xtcppb.XtcpRecord) {
+	if sh == nil {
+		return
+	}
+	now := pollTime.Nano()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if now < sh.pollTime {
+		// a late record of a poll which was already merged by Engine.Poll
+		promLate.WithLabelValues(misc.KernelEnumToString[sh.af]).Inc()
+		return
+	}
+	if now > sh.pollTime {
+		// The first record of a new poll, and Engine.Poll hasn't merged the previous poll yet
+		previous, window, records := sh.take(now)
+		sh.mu.Unlock()
+		if records > 0 {
+			sh.engine.merge(sh.af, previous, window, records)
+		}
+		sh.mu.Lock()
+	}
+
+	modulus := float64(record.GetSamplingModulus())
+	if modulus < 1 {
+		modulus = 1
+	}
+	sh.records++
+	for i, r := range sh.engine.rules {
+		if r.filter != nil && !r.filter.Match(record) {
+			continue
+		}
+		key := r.key(record)
+		agg, ok := sh.window[i][key]
+		if !ok {
+			if len(sh.window[i]) >= maxGroups {
+				promOverflow.WithLabelValues(r.Name).Inc()
+				continue
+			}
+			agg = &aggregate{}
+			sh.window[i][key] = agg
+		}
+		agg.add(r, record, modulus)
+	}
+}
+
+// take returns the aggregates of the current poll, and starts the poll at pollTime
+// The caller must hold the lock
+func (sh *Shard) take(pollTime int64) (int64, []map[string]*aggregate, int) {
+	previous, window, records := sh.pollTime, sh.window, sh.records
+	sh.pollTime, sh.records = pollTime, 0
+	sh.window = make([]map[string]*aggregate, len(sh.engine.rules))
+	for i := range sh.window {
+		sh.window[i] = make(map[string]*aggregate)
+	}
+	return previous, window, records
+}
+
+// flush merges the polls before pollTime into the Engine
+func (sh *Shard) flush(pollTime int64) {
+	sh.mu.Lock()
+	if sh.pollTime >= pollTime {
+		sh.mu.Unlock()
+		return
+	}
+	previous, window, records := sh.take(pollTime)
+	if pollTime == math.MaxInt64 {
+		// closing, so the Shard's current poll is kept as the poll
+		sh.pollTime = previous
+	}
+	sh.mu.Unlock()
+	if records > 0 {
+		sh.engine.merge(sh.af, previous, window, records)
+	}
+}
+
+// Close merges the Shard's current poll into the Engine, and removes the Shard, when its inetdiager is done
+func (sh *Shard) Close() {
+	if sh == nil {
+		return
+	}
+	sh.flush(math.MaxInt64)
+	s := sh.engine.state(sh.af)
+	s.Lock()
+	defer s.Unlock()
+	for i, other := range s.shards {
+		if other == sh {
+			s.shards = append(s.shards[:i], s.shards[i+1:]...)
+			break
+		}
+	}
+}
+
+// evaluate compares the groups of the poll to the thresholds, and emits the firing and resolved events
+// The groups which were firing, but have no sockets in this poll, are resolved.
+func (e *Engine) evaluate(s *afState) {
+
+	if s.window == nil {
+		return
+	}
+
+	for i, r := range e.rules {
+		groups := s.window[i]
+		alerts := s.alerts[i]
+
+		// Without group_by, the rule has a value every poll, even without any sockets (e.g. count below)
+		if len(r.groupBy) == 0 && groups[""] == nil {
+			groups[""] = &aggregate{}
+		}
+
+		keys := make([]string, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value, ok := r.value(groups[key])
+			state := alerts[key]
+			if ok && r.breached(value) {
+				if state == nil {
+					state = &alertState{}
+					alerts[key] = state
+				}
+				state.pending++
+				if !state.firing && state.pending >= r.forPolls {
+					state.firing = true
+					e.emit(s, r, key, Firing, value)
+				}
+				continue
+			}
+			if state == nil {
+				continue
+			}
+			if state.firing && ok && !r.cleared(value) {
+				// between the threshold and clear, so it keeps firing
+				continue
+			}
+			if state.firing {
+				e.emit(s, r, key, Resolved, value)
+			}
+			delete(alerts, key)
+		}
+
+		absent := make([]string, 0)
+		for key := range alerts {
+			if _, ok := groups[key]; !ok {
+				absent = append(absent, key)
+			}
+		}
+		sort.Strings(absent)
+		for _, key := range absent {
+			if alerts[key].firing {
+				e.emit(s, r, key, Resolved, 0)
+			}
+			delete(alerts, key)
+		}
+
+		var firing int
+		for _, state := range alerts {
+			if state.firing {
+				firing++
+			}
+		}
+		promFiring.WithLabelValues(misc.KernelEnumToString[s.af], r.Name).Set(float64(firing))
+	}
+}
+
+// emit queues the event for Dispatch, dropping it if the queue is full
+func (e *Engine) emit(s *afState, r *rule, key string, state string, value float64) {
+
+	event := Event{
+		Time:        time.Unix(0, s.pollTime).UTC(),
+		Rule:        r.Name,
+		State:       state,
+		Severity:    r.Severity,
+		Description: r.Description,
+		Hostname:    e.hostname,
+		Af:          misc.KernelEnumToString[s.af],
+		Value:       value,
+		Threshold:   r.threshold,
+	}
+	if len(r.groupBy) > 0 {
+		event.Group = make(map[string]string, len(r.groupBy))
+		for i, label := range strings.Split(key, keySeparator) {
+			g := r.groupBy[i]
+			if g.field.IsAddress() {
+				label = e.anonymizeLabel(g, label)
+			}
+			event.Group[g.field.Name()] = label
+		}
+	}
+	promEvents.WithLabelValues(r.Name, state).Inc()
+
+	select {
+	case e.events <- event:
+	default:
+		promDropped.WithLabelValues("queue").Inc()
+	}
+}
+
+// anonymizeLabel anonymizes the address of the label (e.g. 192.0.2.0/24), keeping the prefix length
+func (e *Engine) anonymizeLabel(g groupBy, label string) string {
+	ip, ipNet, err := net.ParseCIDR(label)
+	if err != nil || e.anonymizer == nil {
+		return label
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	var anonymized []byte
+	if strings.HasSuffix(g.field.Name(), "destination") {
+		anonymized = e.anonymizer.Destination(ip)
+	} else {
+		anonymized = e.anonymizer.Source(ip)
+	}
+	if len(anonymized) != len(ip) {
+		return ""
+	}
+	return (&net.IPNet{IP: net.IP(anonymized).Mask(ipNet.Mask), Mask: ipNet.Mask}).String()
+}
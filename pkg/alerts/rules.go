@@ -0,0 +1,248 @@
+package alerts
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"gopkg.in/yaml.v3"
+)
+
+// The severities
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// defaultPrefix6 is the IPv6 prefix length of the address group_by fields, when only the IPv4 prefix is given
+const defaultPrefix6 = 64
+
+// File is the alertRules YAML file
+type File struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is an alert rule, as written in the alertRules file
+//
+//   - name: zero_window
+//     description: many sockets with a zero window to the same /24
+//     filter: snd_wnd == 0
+//     group_by: [destination/24]
+//     value: count
+//     above: 50
+//     clear: 20
+//     for: 2
+//     severity: critical
+type Rule struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Filter      string   `yaml:"filter"`   // exportfilter expression, which sockets are included.  Empty is every socket
+	GroupBy     []string `yaml:"group_by"` // fields, and the address fields can have /prefix4[/prefix6], e.g. destination/24
+	Value       string   `yaml:"value"`    // count (the default), sum:field, avg:field, max:field, or ratio:field/field
+	Above       *float64 `yaml:"above"`    // fires when the value is above, or
+	Below       *float64 `yaml:"below"`    // fires when the value is below
+	Clear       *float64 `yaml:"clear"`    // resolves when the value is back past clear, which defaults to above/below
+	For         int      `yaml:"for"`      // consecutive polls the threshold must be breached before firing, default 1
+	Severity    string   `yaml:"severity"` // info, warning (the default), or critical
+}
+
+// aggregation is how the sockets of a group are combined into the value
+type aggregation int
+
+const (
+	aggCount aggregation = iota
+	aggSum
+	aggAvg
+	aggMax
+	aggRatio
+)
+
+// groupBy is a group_by field, with the prefix lengths for the address fields
+type groupBy struct {
+	field   *exportfilter.Field
+	prefix4 int
+	prefix6 int
+}
+
+// label is the group label of the record, with the addresses masked to the prefix, e.g. 192.0.2.0/24
+func (g groupBy) label(record *xtcppb.XtcpRecord) string {
+	if !g.field.IsAddress() {
+		return g.field.String(record)
+	}
+	ip := g.field.Bytes(record)
+	bits := g.prefix6
+	if len(ip) == net.IPv4len {
+		bits = g.prefix4
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return ""
+	}
+	ipNet := net.IPNet{IP: net.IP(ip).Mask(net.CIDRMask(bits, 8*len(ip))), Mask: net.CIDRMask(bits, 8*len(ip))}
+	return ipNet.String()
+}
+
+// rule is the compiled Rule
+type rule struct {
+	Rule
+	filter      *exportfilter.Filter
+	groupBy     []groupBy
+	aggregation aggregation
+	fields      [2]*exportfilter.Field // the value field, and the ratio denominator
+	above       bool
+	threshold   float64
+	clear       float64
+	forPolls    int
+}
+
+// breached is true if the value is past the threshold
+func (r *rule) breached(value float64) bool {
+	if r.above {
+		return value > r.threshold
+	}
+	return value < r.threshold
+}
+
+// cleared is true if the value is back past the clear level
+func (r *rule) cleared(value float64) bool {
+	if r.above {
+		return value <= r.clear
+	}
+	return value >= r.clear
+}
+
+// ReadFile reads the rules from the YAML file
+func ReadFile(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("alert rules:%s %w", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("alert rules:%s has no rules", path)
+	}
+	return file.Rules, nil
+}
+
+// compile validates the rule, resolving the fields
+func compile(r Rule) (*rule, error) {
+
+	if r.Name == "" {
+		return nil, fmt.Errorf("alert rule without a name")
+	}
+	c := &rule{Rule: r, forPolls: r.For}
+
+	if r.Filter != "" {
+		filter, err := exportfilter.Compile(r.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule:%s filter %w", r.Name, err)
+		}
+		c.filter = filter
+	}
+
+	for _, g := range r.GroupBy {
+		parts := strings.Split(g, "/")
+		field, err := exportfilter.ResolveField(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("alert rule:%s group_by %w", r.Name, err)
+		}
+		gb := groupBy{field: field, prefix4: 8 * net.IPv4len, prefix6: 8 * net.IPv6len}
+		if len(parts) > 1 {
+			if !field.IsAddress() || len(parts) > 3 {
+				return nil, fmt.Errorf("alert rule:%s group_by:%s only the addresses have prefixes, e.g. destination/24/64", r.Name, g)
+			}
+			gb.prefix6 = defaultPrefix6
+			if gb.prefix4, err = strconv.Atoi(parts[1]); err != nil || gb.prefix4 < 0 || gb.prefix4 > 8*net.IPv4len {
+				return nil, fmt.Errorf("alert rule:%s group_by:%s IPv4 prefix must be 0-32", r.Name, g)
+			}
+			if len(parts) == 3 {
+				if gb.prefix6, err = strconv.Atoi(parts[2]); err != nil || gb.prefix6 < 0 || gb.prefix6 > 8*net.IPv6len {
+					return nil, fmt.Errorf("alert rule:%s group_by:%s IPv6 prefix must be 0-128", r.Name, g)
+				}
+			}
+		}
+		c.groupBy = append(c.groupBy, gb)
+	}
+
+	if err := c.compileValue(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r.Above != nil && r.Below == nil:
+		c.above, c.threshold = true, *r.Above
+	case r.Below != nil && r.Above == nil:
+		c.threshold = *r.Below
+	default:
+		return nil, fmt.Errorf("alert rule:%s needs one of above or below", r.Name)
+	}
+	c.clear = c.threshold
+	if r.Clear != nil {
+		c.clear = *r.Clear
+		if (c.above && c.clear > c.threshold) || (!c.above && c.clear < c.threshold) {
+			return nil, fmt.Errorf("alert rule:%s clear:%g must be on the other side of the threshold:%g", r.Name, c.clear, c.threshold)
+		}
+	}
+
+	if c.forPolls == 0 {
+		c.forPolls = 1
+	}
+	if c.forPolls < 0 {
+		return nil, fmt.Errorf("alert rule:%s for:%d must be >= 1", r.Name, r.For)
+	}
+	switch c.Severity {
+	case "":
+		c.Severity = Warning
+	case Info, Warning, Critical:
+	default:
+		return nil, fmt.Errorf("alert rule:%s unknown severity:%s", r.Name, r.Severity)
+	}
+	return c, nil
+}
+
+// compileValue parses the value, e.g. ratio:tcp_info.total_retrans/tcp_info.segs_out
+func (c *rule) compileValue() error {
+
+	kind, arg, _ := strings.Cut(c.Value, ":")
+	switch kind {
+	case "", "count":
+		c.aggregation = aggCount
+		return nil
+	case "sum":
+		c.aggregation = aggSum
+	case "avg":
+		c.aggregation = aggAvg
+	case "max":
+		c.aggregation = aggMax
+	case "ratio":
+		c.aggregation = aggRatio
+	default:
+		return fmt.Errorf("alert rule:%s unknown value:%s, use count, sum:field, avg:field, max:field, or ratio:field/field", c.Name, c.Value)
+	}
+
+	names := []string{arg}
+	if c.aggregation == aggRatio {
+		names = strings.Split(arg, "/")
+		if len(names) != 2 {
+			return fmt.Errorf("alert rule:%s value:%s ratio needs two fields, e.g. ratio:total_retrans/segs_out", c.Name, c.Value)
+		}
+	}
+	for i, name := range names {
+		field, err := exportfilter.ResolveField(name)
+		if err != nil {
+			return fmt.Errorf("alert rule:%s value %w", c.Name, err)
+		}
+		if field.IsAddress() {
+			return fmt.Errorf("alert rule:%s value field:%s is an address", c.Name, field.Name())
+		}
+		c.fields[i] = field
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// Package anonymize anonymizes the IP addresses, and optionally the ports, of the records before they are exported
+//
+// Each address (source and destination) has its own mode:
+// - none       the address is unchanged
+// - drop       the address is removed from the record
+// - truncate   the address is truncated to anonymizePrefix4 or anonymizePrefix6 bits, e.g. 192.0.2.0 for a /24
+// - hmac       the address is replaced by the keyed HMAC-SHA256 of the address, truncated to the address length.
+// ..           This is consistent, so the same address can be followed, but the prefixes are lost.
+// - cryptopan  the address is encrypted with Crypto-PAn, which preserves the prefixes (see CryptoPAn)
+//
+// hmac and cryptopan use the key from anonymizeKeyFile, so the anonymized addresses are consistent across hosts.
+//
+// The anonymization is the last step before the records are exported, so the sampling, and anything else using
+// the addresses, still sees the real addresses.
+package anonymize
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// Mode is how an address is anonymized
+type Mode string
+
+// The Modes, which are the anonymizeSource and anonymizeDestination flag values
+const (
+	None      Mode = "none"
+	Drop      Mode = "drop"
+	Truncate  Mode = "truncate"
+	HMAC      Mode = "hmac"
+	CryptoPAN Mode = "cryptopan"
+)
+
+// wellKnownPorts are below this, and aren't bucketed, because they're the services rather than the clients
+const wellKnownPorts = 1024
+
+// Config is the Anonymizer configuration
+type Config struct {
+	Source      Mode
+	Destination Mode
+	Prefix4     int    // truncate IPv4 prefix length
+	Prefix6     int    // truncate IPv6 prefix length
+	Key         []byte // hmac and cryptopan key
+	PortBucket  int    // bucket the ports >= 1024 to multiples of this.  Zero (0) is disabled
+}
+
+// Anonymizer anonymizes the records.  A nil Anonymizer doesn't change the records.
+type Anonymizer struct {
+	config    Config
+	mask4     net.IPMask
+	mask6     net.IPMask
+	cryptoPAn *CryptoPAn
+}
+
+// New creates the Anonymizer
+func New(config Config) (*Anonymizer, error) {
+
+	a := &Anonymizer{config: config}
+	for _, mode := range []Mode{config.Source, config.Destination} {
+		switch mode {
+		case None, Drop:
+		case Truncate:
+			if config.Prefix4 < 0 || config.Prefix4 > 8*net.IPv4len || config.Prefix6 < 0 || config.Prefix6 > 8*net.IPv6len {
+				return nil, fmt.Errorf("anonymize truncate prefix4:%d must be 0-32, and prefix6:%d must be 0-128", config.Prefix4, config.Prefix6)
+			}
+			a.mask4 = net.CIDRMask(config.Prefix4, 8*net.IPv4len)
+			a.mask6 = net.CIDRMask(config.Prefix6, 8*net.IPv6len)
+		case HMAC:
+			if len(config.Key) == 0 {
+				return nil, fmt.Errorf("anonymize mode:%s requires a key", mode)
+			}
+		case CryptoPAN:
+			cryptoPAn, err := NewCryptoPAn(config.Key)
+			if err != nil {
+				return nil, err
+			}
+			a.cryptoPAn = cryptoPAn
+		default:
+			return nil, fmt.Errorf("unknown anonymize mode:%s", mode)
+		}
+	}
+	if config.PortBucket < 0 {
+		return nil, fmt.Errorf("anonymize port bucket:%d must be >= 0", config.PortBucket)
+	}
+	return a, nil
+}
+
+// NewFromFlags creates the Anonymizer from the cli flags, reading the anonymizeKeyFile
+// It returns nil if nothing is anonymized
+func NewFromFlags(cliFlags cliflags.CliFlags) (*Anonymizer, error) {
+
+	config := Config{
+		Source:      Mode(*cliFlags.AnonymizeSource),
+		Destination: Mode(*cliFlags.AnonymizeDestination),
+		Prefix4:     *cliFlags.AnonymizePrefix4,
+		Prefix6:     *cliFlags.AnonymizePrefix6,
+		PortBucket:  *cliFlags.AnonymizePortBucket,
+	}
+	if config.Source == None && config.Destination == None && config.PortBucket == 0 {
+		return nil, nil
+	}
+	if *cliFlags.AnonymizeKeyFile != "" {
+		key, err := ReadKeyFile(*cliFlags.AnonymizeKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Key = key
+	}
+	return New(config)
+}
+
+// ReadKeyFile reads the key, which is either the raw bytes, or hex (e.g. from "openssl rand -hex 32")
+func ReadKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(b)
+	if key, err := hex.DecodeString(string(trimmed)); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	return b, nil
+}
+
+// Anonymize anonymizes the record's addresses and ports, in place
+func (a *Anonymizer) Anonymize(record *xtcppb.XtcpRecord) {
+	if a == nil {
+		return
+	}
+	id := record.GetInetDiagMsg().GetSocketID()
+	if id == nil {
+		return
+	}
+	id.Source = a.Address(a.config.Source, id.Source)
+	id.Destination = a.Address(a.config.Destination, id.Destination)
+	if a.config.PortBucket > 0 {
+		id.SourcePort = a.port(id.SourcePort)
+		id.DestinationPort = a.port(id.DestinationPort)
+	}
+}
+
+// Source anonymizes a source address, the same as the records' source addresses.  A nil Anonymizer returns the ip.
+func (a *Anonymizer) Source(ip []byte) []byte {
+	if a == nil {
+		return ip
+	}
+	return a.Address(a.config.Source, ip)
+}
+
+// Destination anonymizes a destination address, the same as the records' destination addresses
+func (a *Anonymizer) Destination(ip []byte) []byte {
+	if a == nil {
+		return ip
+	}
+	return a.Address(a.config.Destination, ip)
+}
+
+// Address anonymizes the 4 byte IPv4 or 16 byte IPv6 address with the mode
+// The ip isn't modified, so it's safe to use with addresses shared with other records
+func (a *Anonymizer) Address(mode Mode, ip []byte) []byte {
+
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return ip
+	}
+
+	switch mode {
+	case Drop:
+		return nil
+	case Truncate:
+		mask := a.mask6
+		if len(ip) == net.IPv4len {
+			mask = a.mask4
+		}
+		truncated := make([]byte, len(ip))
+		for i := range ip {
+			truncated[i] = ip[i] & mask[i]
+		}
+		return truncated
+	case HMAC:
+		mac := hmac.New(sha256.New, a.config.Key)
+		mac.Write(ip)
+		return mac.Sum(nil)[:len(ip)]
+	case CryptoPAN:
+		return a.cryptoPAn.Anonymize(ip)
+	}
+	return ip
+}
+
+// port buckets the port, leaving the well known ports
+func (a *Anonymizer) port(port *uint32) *uint32 {
+	if port == nil || *port < wellKnownPorts {
+		return port
+	}
+	bucketed := *port - *port%uint32(a.config.PortBucket)
+	return &bucketed
+}
@@ -0,0 +1,180 @@
+package anonymize_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// key is the key from the original Crypto-PAn sample
+var key = []byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+
+func TestCryptoPAn(t *testing.T) {
+
+	cryptoPAn, err := anonymize.NewCryptoPAn(key)
+	if err != nil {
+		t.Fatalf("NewCryptoPAn error:%s", err)
+	}
+
+	// from the original Crypto-PAn sample_trace_raw.dat and sample_trace_sanitized.dat
+	var tests = []struct {
+		ip       string
+		expected string
+	}{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+	}
+
+	for i, test := range tests {
+		result := net.IP(cryptoPAn.Anonymize(net.ParseIP(test.ip).To4()))
+		if result.String() != test.expected {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%s", i, test.ip, test.expected, result)
+		}
+	}
+
+	// prefixes are preserved for IPv6 too
+	a := cryptoPAn.Anonymize(net.ParseIP("2001:db8:1:2::1"))
+	b := cryptoPAn.Anonymize(net.ParseIP("2001:db8:1:3::1"))
+	if !bytes.Equal(a[:7], b[:7]) || a[7] == b[7] {
+		t.Errorf("ipv6 prefix not preserved\texpected:first 7 bytes equal\tresult:%x %x", a, b)
+	}
+
+	if _, err := anonymize.NewCryptoPAn(key[:16]); err == nil {
+		t.Errorf("short key\texpected:error\tresult:nil")
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+
+	var tests = []struct {
+		name        string
+		config      anonymize.Config
+		source      string
+		destination string
+		sourcePort  uint32
+		destPort    uint32
+		expectedSrc string
+		expectedDst string
+		expectedSP  uint32
+		expectedDP  uint32
+	}{
+		{"none", anonymize.Config{Source: anonymize.None, Destination: anonymize.None}, "192.0.2.10", "198.51.100.20", 443, 51234, "192.0.2.10", "198.51.100.20", 443, 51234},
+		{"drop destination", anonymize.Config{Source: anonymize.None, Destination: anonymize.Drop}, "192.0.2.10", "198.51.100.20", 443, 51234, "192.0.2.10", "<nil>", 443, 51234},
+		{"truncate v4", anonymize.Config{Source: anonymize.None, Destination: anonymize.Truncate, Prefix4: 24, Prefix6: 48}, "192.0.2.10", "198.51.100.20", 443, 51234, "192.0.2.10", "198.51.100.0", 443, 51234},
+		{"truncate v6", anonymize.Config{Source: anonymize.Truncate, Destination: anonymize.Truncate, Prefix4: 24, Prefix6: 48}, "2001:db8::1", "2001:db8:1:2::20", 443, 51234, "2001:db8::", "2001:db8:1::", 443, 51234},
+		{"cryptopan", anonymize.Config{Source: anonymize.None, Destination: anonymize.CryptoPAN, Key: key}, "192.0.2.10", "128.11.68.132", 443, 51234, "192.0.2.10", "135.242.180.132", 443, 51234},
+		{"port bucket", anonymize.Config{Source: anonymize.None, Destination: anonymize.None, PortBucket: 1024}, "192.0.2.10", "198.51.100.20", 443, 51234, "192.0.2.10", "198.51.100.20", 443, 51200},
+	}
+
+	for i, test := range tests {
+
+		anonymizer, err := anonymize.New(test.config)
+		if err != nil {
+			t.Fatalf("test:%d %s\tNew error:%s", i, test.name, err)
+		}
+
+		source, destination := ip(test.source), ip(test.destination)
+		sourcePort, destPort := test.sourcePort, test.destPort
+		record := &xtcppb.XtcpRecord{
+			InetDiagMsg: &xtcppb.InetDiagMsg{
+				SocketID: &xtcppb.SocketID{
+					Source:          source,
+					Destination:     destination,
+					SourcePort:      &sourcePort,
+					DestinationPort: &destPort,
+				},
+			},
+		}
+		original := append([]byte{}, destination...)
+
+		anonymizer.Anonymize(record)
+
+		id := record.GetInetDiagMsg().GetSocketID()
+		if net.IP(id.GetSource()).String() != test.expectedSrc || net.IP(id.GetDestination()).String() != test.expectedDst ||
+			id.GetSourcePort() != test.expectedSP || id.GetDestinationPort() != test.expectedDP {
+			t.Errorf("test:%d %s\texpected:%s:%d %s:%d\tresult:%s:%d %s:%d", i, test.name,
+				test.expectedSrc, test.expectedSP, test.expectedDst, test.expectedDP,
+				net.IP(id.GetSource()), id.GetSourcePort(), net.IP(id.GetDestination()), id.GetDestinationPort())
+		}
+		// the record shares the addresses and ports with the socket, so they must not be modified in place
+		if !bytes.Equal(destination, original) || destPort != test.destPort {
+			t.Errorf("test:%d %s\texpected original unchanged:%s:%d\tresult:%s:%d", i, test.name, net.IP(original), test.destPort, net.IP(destination), destPort)
+		}
+	}
+}
+
+func TestAnonymizeHMAC(t *testing.T) {
+
+	anonymizer, err := anonymize.New(anonymize.Config{Source: anonymize.HMAC, Destination: anonymize.None, Key: []byte("secret")})
+	if err != nil {
+		t.Fatalf("New error:%s", err)
+	}
+
+	a := anonymizer.Address(anonymize.HMAC, ip("192.0.2.10"))
+	b := anonymizer.Address(anonymize.HMAC, ip("192.0.2.10"))
+	c := anonymizer.Address(anonymize.HMAC, ip("192.0.2.11"))
+	v6 := anonymizer.Address(anonymize.HMAC, ip("2001:db8::1"))
+	if len(a) != 4 || !bytes.Equal(a, b) || bytes.Equal(a, c) || len(v6) != 16 {
+		t.Errorf("expected consistent 4 and 16 byte results\tresult:%x %x %x %x", a, b, c, v6)
+	}
+
+	var nilAnonymizer *anonymize.Anonymizer
+	nilAnonymizer.Anonymize(&xtcppb.XtcpRecord{})
+}
+
+func TestNewErrors(t *testing.T) {
+
+	var tests = []struct {
+		name   string
+		config anonymize.Config
+	}{
+		{"unknown mode", anonymize.Config{Source: "blur", Destination: anonymize.None}},
+		{"hmac without key", anonymize.Config{Source: anonymize.HMAC, Destination: anonymize.None}},
+		{"cryptopan short key", anonymize.Config{Source: anonymize.None, Destination: anonymize.CryptoPAN, Key: []byte("short")}},
+		{"prefix4 too long", anonymize.Config{Source: anonymize.Truncate, Destination: anonymize.None, Prefix4: 33, Prefix6: 48}},
+		{"prefix6 too long", anonymize.Config{Source: anonymize.Truncate, Destination: anonymize.None, Prefix4: 24, Prefix6: 129}},
+	}
+
+	for i, test := range tests {
+		if _, err := anonymize.New(test.config); err == nil {
+			t.Errorf("test:%d %s\texpected:error\tresult:nil", i, test.name)
+		}
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+
+	dir := t.TempDir()
+	hexFile := filepath.Join(dir, "hex")
+	rawFile := filepath.Join(dir, "raw")
+	if err := os.WriteFile(hexFile, []byte("1522178d33a4cf80130a5b1649907d10d8988f837979652762574c2d2a842202\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rawFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, path := range []string{hexFile, rawFile} {
+		result, err := anonymize.ReadKeyFile(path)
+		if err != nil || !bytes.Equal(result, key) {
+			t.Errorf("test:%d %s\texpected:%x\tresult:%x %v", i, path, key, result, err)
+		}
+	}
+}
+
+func ip(s string) []byte {
+	parsed := net.ParseIP(s)
+	if v4 := parsed.To4(); v4 != nil {
+		return v4
+	}
+	return parsed
+}
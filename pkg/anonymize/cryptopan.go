@@ -0,0 +1,65 @@
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// CryptoPAnKeySize is the Crypto-PAn key size, which is the 16 byte AES key followed by the 16 byte pad
+const CryptoPAnKeySize = 32
+
+// CryptoPAn is the Crypto-PAn prefix-preserving IP address encryption
+// https://en.wikipedia.org/wiki/Crypto-PAn
+//
+// Two addresses sharing a prefix of n bits are encrypted to two addresses which also share a prefix of n bits,
+// so the anonymized addresses can still be aggregated by prefix.  The same key always gives the same result,
+// so the anonymized addresses are consistent across hosts, and across restarts.
+//
+// This is compatible with the original C++ implementation, and extends it to IPv6 with the same construction.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// NewCryptoPAn creates the Crypto-PAn with the 32 byte key
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != CryptoPAnKeySize {
+		return nil, fmt.Errorf("crypto-pan key is %d bytes, must be %d", len(key), CryptoPAnKeySize)
+	}
+	block, err := aes.NewCipher(key[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[aes.BlockSize:])
+	return c, nil
+}
+
+// Anonymize encrypts the 4 byte IPv4 or 16 byte IPv6 address
+//
+// Bit i of the result is bit i of the address, XORed with the most significant bit of the AES encryption of
+// the first i bits of the address, followed by the pad.  So each bit only depends on the bits before it,
+// which is what preserves the prefixes.
+func (c *CryptoPAn) Anonymize(ip []byte) []byte {
+
+	result := make([]byte, len(ip))
+	var in, out [aes.BlockSize]byte
+
+	for pos := 0; pos < len(ip)*8; pos++ {
+		in = c.pad
+		full := pos / 8
+		copy(in[:full], ip[:full])
+		if partial := pos % 8; partial > 0 {
+			mask := byte(0xff << (8 - partial))
+			in[full] = ip[full]&mask | c.pad[full]&^mask
+		}
+		c.block.Encrypt(out[:], in[:])
+		result[full] |= (out[0] >> 7) << (7 - pos%8)
+	}
+
+	for i := range result {
+		result[i] ^= ip[i]
+	}
+	return result
+}
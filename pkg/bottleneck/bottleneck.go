@@ -0,0 +1,191 @@
+// Package bottleneck classifies what limits each socket, from the tcp_info, which is the first question
+// every performance ticket asks
+//
+// The classes, in order of precedence, are:
+// - LOSS_RECOVERY   the congestion control state (ca_state) is Recovery (fast retransmit) or Loss (RTO)
+// - RWND_LIMITED    at least bottleneckRatio of the busy_time was rwnd_limited, the receiver's advertised window
+// - SNDBUF_LIMITED  at least bottleneckRatio of the busy_time was sndbuf_limited, the send buffer
+// - CWND_LIMITED    the congestion window is full (unacked >= snd_cwnd), or the ca_state is CWR (ECN or local congestion)
+// - APP_LIMITED     the last delivery rate sample was app limited, or there's no unsent data (not_sent_bytes == 0),
+// ..                so the application isn't writing fast enough to fill the window
+// - BOTTLENECK_UNKNOWN  no tcp_info, or none of the above
+//
+// busy_time, rwnd_limited, and sndbuf_limited are the total times since the socket was created, which hide
+// what's happening now on long lived sockets.  So the Classifier keeps the previous values of each socket,
+// by socket cookie, and uses the deltas since the previous poll.  The first time a socket is seen, and for
+// kernels without the socket cookie, the totals are used.
+package bottleneck
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// ClassCount is the number of classes, so the counts can be arrays indexed by the class
+const ClassCount = 6
+
+// The kernel tcp_ca_state values
+// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/tcp.h#L183
+const (
+	tcpCACWR      = 2
+	tcpCARecovery = 3
+	tcpCALoss     = 4
+)
+
+const (
+	// shards splits the previous samples, so the inetdiagers don't all contend on one lock
+	shards = 64
+	// maxAgePolls is how many polling periods the previous samples are kept for, so closed sockets are forgotten
+	// Each shard is swept when it's used, so on a busy host the closed sockets are forgotten within maxAgePolls
+	maxAgePolls = 4
+)
+
+// Chrono is the time (usec) the socket was busy sending, and the time of that it was limited by the
+// receive window, and by the send buffer.  This is the kernel's "chrono" accounting.
+type Chrono struct {
+	Busy   uint64
+	Rwnd   uint64
+	Sndbuf uint64
+}
+
+// sample is the previous chrono of a socket
+type sample struct {
+	pollTime int64 // unix nanoseconds
+	chrono   Chrono
+}
+
+type shard struct {
+	sync.Mutex
+	previous  map[uint64]sample
+	lastSweep int64
+}
+
+// Classifier classifies the sockets, keeping the previous chrono of each socket for the deltas
+// The Classifier is safe for the inetdiagers to use concurrently.
+type Classifier struct {
+	ratio  float64
+	ctl    *admin.Controller
+	shards [shards]shard
+}
+
+// NewClassifier creates the Classifier, or returns nil if noBottleneck
+//
+// The previous samples are kept for maxAgePolls polling periods, so sockets which aren't sampled for
+// longer than that are classified using the totals.  The polling period is the controller's, so it follows the
+// changes by the admin API and SIGHUP.
+func NewClassifier(cliFlags cliflags.CliFlags, ctl *admin.Controller) *Classifier {
+	if *cliFlags.NoBottleneck {
+		return nil
+	}
+	c := &Classifier{
+		ratio: *cliFlags.BottleneckRatio,
+		ctl:   ctl,
+	}
+	for i := range c.shards {
+		c.shards[i].previous = make(map[uint64]sample)
+	}
+	return c
+}
+
+// Classify classifies the socket, which was dumped by the poll at pollTime
+func (c *Classifier) Classify(socket *inetdiag.Socket, pollTime syscall.Timespec) xtcppb.XtcpRecordBottleneck {
+
+	info := socket.TCPInfo
+	if info == nil {
+		return xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN
+	}
+
+	current := Chrono{Busy: info.BusyTime, Rwnd: info.RwndLimited, Sndbuf: info.SndbufLimited}
+	chrono := current
+
+	cookie := socket.InetDiagMsg.SocketID.Cookie
+	if cookie != 0 {
+		now := pollTime.Nano()
+		s := &c.shards[cookie%shards]
+		s.Lock()
+		previous, ok := s.previous[cookie]
+		if !ok || previous.pollTime < now {
+			s.previous[cookie] = sample{pollTime: now, chrono: current}
+		}
+		if maxAge := int64(maxAgePolls * c.ctl.PollingFrequency()); now-s.lastSweep > maxAge {
+			for k, v := range s.previous {
+				if now-v.pollTime > maxAge {
+					delete(s.previous, k)
+				}
+			}
+			s.lastSweep = now
+		}
+		s.Unlock()
+
+		// The counters only go backwards if the cookie was reused
+		if ok && previous.pollTime < now && current.Busy >= previous.chrono.Busy &&
+			current.Rwnd >= previous.chrono.Rwnd && current.Sndbuf >= previous.chrono.Sndbuf {
+			chrono = Chrono{
+				Busy:   current.Busy - previous.chrono.Busy,
+				Rwnd:   current.Rwnd - previous.chrono.Rwnd,
+				Sndbuf: current.Sndbuf - previous.chrono.Sndbuf,
+			}
+		}
+	}
+
+	return Classify(info, socket.DeliveryRateAppLimited != 0, chrono, c.ratio)
+}
+
+// Classify classifies the tcp_info, with the chrono either since the previous poll, or the totals
+// ratio is the fraction of the busy time which must be rwnd or sndbuf limited for the socket to be classified as such
+func Classify(info *inetdiag.TCPInfo54, appLimited bool, chrono Chrono, ratio float64) xtcppb.XtcpRecordBottleneck {
+
+	if info.CaState == tcpCARecovery || info.CaState == tcpCALoss {
+		return xtcppb.XtcpRecord_LOSS_RECOVERY
+	}
+
+	if chrono.Busy > 0 {
+		rwnd := float64(chrono.Rwnd) / float64(chrono.Busy)
+		sndbuf := float64(chrono.Sndbuf) / float64(chrono.Busy)
+		if rwnd >= ratio && rwnd >= sndbuf {
+			return xtcppb.XtcpRecord_RWND_LIMITED
+		}
+		if sndbuf >= ratio {
+			return xtcppb.XtcpRecord_SNDBUF_LIMITED
+		}
+	}
+
+	if info.CaState == tcpCACWR || (info.SndCwnd > 0 && info.Unacked >= info.SndCwnd) {
+		return xtcppb.XtcpRecord_CWND_LIMITED
+	}
+
+	if appLimited || info.NotSentBytes == 0 {
+		return xtcppb.XtcpRecord_APP_LIMITED
+	}
+
+	return xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN
+}
+
+// Len returns the number of sockets with previous samples
+func (c *Classifier) Len() (n int) {
+	for i := range c.shards {
+		c.shards[i].Lock()
+		n += len(c.shards[i].previous)
+		c.shards[i].Unlock()
+	}
+	return n
+}
+
+// String is the Prometheus class label, e.g. "app_limited"
+func String(class xtcppb.XtcpRecordBottleneck) string {
+	return classNames[class]
+}
+
+var classNames = [ClassCount]string{
+	xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN: "unknown",
+	xtcppb.XtcpRecord_APP_LIMITED:        "app_limited",
+	xtcppb.XtcpRecord_RWND_LIMITED:       "rwnd_limited",
+	xtcppb.XtcpRecord_SNDBUF_LIMITED:     "sndbuf_limited",
+	xtcppb.XtcpRecord_CWND_LIMITED:       "cwnd_limited",
+	xtcppb.XtcpRecord_LOSS_RECOVERY:      "loss_recovery",
+}
@@ -0,0 +1,110 @@
+package bottleneck_test
+
+import (
+	"flag"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/bottleneck"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+func TestClassify(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		info       inetdiag.TCPInfo54
+		appLimited bool
+		chrono     bottleneck.Chrono
+		expected   xtcppb.XtcpRecordBottleneck
+	}{
+		{"recovery", inetdiag.TCPInfo54{CaState: 3, SndCwnd: 10, Unacked: 10}, false, bottleneck.Chrono{Busy: 1000, Rwnd: 900}, xtcppb.XtcpRecord_LOSS_RECOVERY},
+		{"loss", inetdiag.TCPInfo54{CaState: 4}, false, bottleneck.Chrono{}, xtcppb.XtcpRecord_LOSS_RECOVERY},
+		{"rwnd", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 10}, false, bottleneck.Chrono{Busy: 1000, Rwnd: 600}, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"sndbuf", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 10}, false, bottleneck.Chrono{Busy: 1000, Sndbuf: 500}, xtcppb.XtcpRecord_SNDBUF_LIMITED},
+		{"rwnd and sndbuf equal", inetdiag.TCPInfo54{}, false, bottleneck.Chrono{Busy: 1000, Rwnd: 500, Sndbuf: 500}, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"rwnd below ratio", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 10}, false, bottleneck.Chrono{Busy: 1000, Rwnd: 400}, xtcppb.XtcpRecord_CWND_LIMITED},
+		{"cwnd full", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 12, NotSentBytes: 1000}, false, bottleneck.Chrono{Busy: 1000}, xtcppb.XtcpRecord_CWND_LIMITED},
+		{"cwr", inetdiag.TCPInfo54{CaState: 2, SndCwnd: 10, Unacked: 2}, true, bottleneck.Chrono{}, xtcppb.XtcpRecord_CWND_LIMITED},
+		{"app limited flag", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 2, NotSentBytes: 1000}, true, bottleneck.Chrono{Busy: 1000}, xtcppb.XtcpRecord_APP_LIMITED},
+		{"nothing to send", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 2}, false, bottleneck.Chrono{}, xtcppb.XtcpRecord_APP_LIMITED},
+		{"unknown", inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 2, NotSentBytes: 1000}, false, bottleneck.Chrono{Busy: 1000}, xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN},
+	}
+
+	for i, test := range tests {
+		if result := bottleneck.Classify(&test.info, test.appLimited, test.chrono, 0.5); result != test.expected {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%s", i, test.name, test.expected, result)
+		}
+	}
+}
+
+// TestClassifierDeltas checks a long lived socket, which was rwnd limited for most of its life,
+// is classified by what happened since the previous poll
+func TestClassifierDeltas(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-frequency", "10s"}); err != nil {
+		t.Fatal(err)
+	}
+	ctl := admin.NewController(cliFlags)
+	classifier := bottleneck.NewClassifier(cliFlags, ctl)
+
+	socket := func(cookie uint64, busy, rwnd uint64) *inetdiag.Socket {
+		s := &inetdiag.Socket{TCPInfo: &inetdiag.TCPInfo54{SndCwnd: 10, Unacked: 2, NotSentBytes: 1000, BusyTime: busy, RwndLimited: rwnd}}
+		s.InetDiagMsg.SocketID.Cookie = cookie
+		return s
+	}
+
+	var tests = []struct {
+		name     string
+		socket   *inetdiag.Socket
+		pollTime int64
+		expected xtcppb.XtcpRecordBottleneck
+	}{
+		{"first poll uses the totals", socket(1, 100e6, 90e6), 10, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"no longer rwnd limited", socket(1, 110e6, 90e6), 20, xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN},
+		{"rwnd limited again", socket(1, 120e6, 98e6), 30, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"same poll again uses the previous poll", socket(1, 120e6, 98e6), 30, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"cookie reused", socket(1, 1e6, 0), 40, xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN},
+		{"no cookie uses the totals", socket(0, 100e6, 90e6), 40, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"no cookie again uses the totals", socket(0, 110e6, 90e6), 50, xtcppb.XtcpRecord_RWND_LIMITED},
+		{"another socket", socket(2, 100e6, 0), 50, xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN},
+		{"no tcp_info", &inetdiag.Socket{}, 50, xtcppb.XtcpRecord_BOTTLENECK_UNKNOWN},
+	}
+
+	for i, test := range tests {
+		result := classifier.Classify(test.socket, syscall.Timespec{Sec: test.pollTime})
+		if result != test.expected {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%s", i, test.name, test.expected, result)
+		}
+	}
+	if classifier.Len() != 2 {
+		t.Errorf("expected 2 sockets\tresult:%d", classifier.Len())
+	}
+
+	// sockets not seen for maxAgePolls (4) polling periods are forgotten, when their shard is next used
+	classifier.Classify(socket(1+64, 1, 0), syscall.Timespec{Sec: 200})
+	classifier.Classify(socket(2+64, 1, 0), syscall.Timespec{Sec: 200})
+	if classifier.Len() != 2 {
+		t.Errorf("expected sockets 1 and 2 swept, leaving 65 and 66\tresult:%d", classifier.Len())
+	}
+
+	// the polling period is the controller's, so after the frequency is changed to 1h, 65 and 66 are kept
+	if err := ctl.SetPollingFrequency(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	classifier.Classify(socket(1+128, 1, 0), syscall.Timespec{Sec: 1000})
+	classifier.Classify(socket(2+128, 1, 0), syscall.Timespec{Sec: 1000})
+	if classifier.Len() != 4 {
+		t.Errorf("expected sockets 65, 66, 129, and 130\tresult:%d", classifier.Len())
+	}
+
+	if bottleneck.NewClassifier(cliFlags, ctl) == nil || bottleneck.String(xtcppb.XtcpRecord_RWND_LIMITED) != "rwnd_limited" {
+		t.Errorf("expected a classifier, and the rwnd_limited label")
+	}
+}
@@ -0,0 +1,172 @@
+// Package capture reads and writes the xtcp netlink capture files
+//
+// A capture file is the raw netlink packets exactly as the netlinkers read them from the kernel
+// (the syscall.Recvfrom buffers), so a capture from a production host can be replayed through
+// the netlinker to inetdiager pipeline later (see the replay package), e.g. to reproduce
+// parsing bugs, build regression fixtures, or benchmark the parsing on a laptop.
+//
+// The file format is the magic "XTCPCAP1", followed by the records, all little endian:
+// - poll time   int64, unix nanoseconds the netlink dump request was sent
+// - time        int64, unix nanoseconds the packet was received
+// - af          uint8, address family of the dump (2 = AF_INET, 10 = AF_INET6)
+// - length      uint32, length of the packet
+// - packet      []byte
+//
+// The poll time groups the packets into the polls, and is also the time stamped into the records,
+// so a replay produces the same records as the original poll.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Magic is the first bytes of every capture file, which includes the format version
+	Magic = "XTCPCAP1"
+	// recordHeaderSize is the poll time, time, af, and length
+	recordHeaderSize = 8 + 8 + 1 + 4
+	// maxPacketSize guards against allocating a silly amount of memory for a corrupt length
+	maxPacketSize = 16 << 20
+)
+
+// Record is a single netlink packet
+type Record struct {
+	PollTime time.Time
+	Time     time.Time
+	Af       uint8
+	Packet   []byte
+}
+
+// Writer writes the capture records.  It's safe to use from all the netlinkers concurrently.
+type Writer struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	header [recordHeaderSize]byte
+}
+
+// Create creates (or truncates) the capture file, and writes the magic
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+	return w, nil
+}
+
+// NewWriter writes the magic to w, and returns a Writer for the records
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriter(w)}
+	if _, err := cw.w.WriteString(Magic); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Write writes a single record.  The packet is copied into the buffer, so the caller can reuse it.
+func (w *Writer) Write(r Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	binary.LittleEndian.PutUint64(w.header[0:], uint64(r.PollTime.UnixNano()))
+	binary.LittleEndian.PutUint64(w.header[8:], uint64(r.Time.UnixNano()))
+	w.header[16] = r.Af
+	binary.LittleEndian.PutUint32(w.header[17:], uint32(len(r.Packet)))
+	if _, err := w.w.Write(w.header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(r.Packet)
+	return err
+}
+
+// Close flushes the buffered records, and closes the file if the Writer was created with Create
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.w.Flush()
+	if w.closer != nil {
+		if cerr := w.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Reader reads the capture records, in the order they were written
+type Reader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	header [recordHeaderSize]byte
+}
+
+// Open opens the capture file, and checks the magic
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.closer = f
+	return r, nil
+}
+
+// NewReader checks the magic, and returns a Reader for the records
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil || string(magic) != Magic {
+		return nil, errors.New("not an xtcp capture file")
+	}
+	return cr, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the file
+// A file that ends part way through a record (e.g. xtcp was killed) returns io.ErrUnexpectedEOF
+func (r *Reader) Next() (Record, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return Record{}, err
+	}
+	length := binary.LittleEndian.Uint32(r.header[17:])
+	if length > maxPacketSize {
+		return Record{}, fmt.Errorf("corrupt capture record length:%d", length)
+	}
+	record := Record{
+		PollTime: time.Unix(0, int64(binary.LittleEndian.Uint64(r.header[0:]))),
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(r.header[8:]))),
+		Af:       r.header[16],
+		Packet:   make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, record.Packet); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return record, nil
+}
+
+// Close closes the file, if the Reader was created with Open
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package capture_test
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/capture"
+)
+
+// TestRoundTrip checks the records read back are the records written, in order
+func TestRoundTrip(t *testing.T) {
+
+	pollTime := time.Unix(1700000000, 123456789)
+	var tests = []capture.Record{
+		{PollTime: pollTime, Time: pollTime.Add(time.Millisecond), Af: 2, Packet: []byte{1, 2, 3}},
+		{PollTime: pollTime, Time: pollTime.Add(2 * time.Millisecond), Af: 2, Packet: []byte{}},
+		{PollTime: pollTime.Add(time.Second), Time: pollTime.Add(time.Second), Af: 10, Packet: bytes.Repeat([]byte{0xff}, 8192)},
+	}
+
+	path := filepath.Join(t.TempDir(), "test.xtcpcap")
+	w, err := capture.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range tests {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := capture.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i, test := range tests {
+		result, err := r.Next()
+		if err != nil {
+			t.Fatalf("test:%d\tunexpected error:%v", i, err)
+		}
+		if !result.PollTime.Equal(test.PollTime) || !result.Time.Equal(test.Time) || result.Af != test.Af || !bytes.Equal(result.Packet, test.Packet) {
+			t.Errorf("test:%d\texpected:%v %v %d %d bytes\tresult:%v %v %d %d bytes", i, test.PollTime, test.Time, test.Af, len(test.Packet), result.PollTime, result.Time, result.Af, len(result.Packet))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end\tresult:%v", err)
+	}
+}
+
+// TestBadFiles checks files which aren't captures, or are truncated, are errors rather than garbage records
+func TestBadFiles(t *testing.T) {
+
+	var full bytes.Buffer
+	w, _ := capture.NewWriter(&full)
+	w.Write(capture.Record{PollTime: time.Now(), Time: time.Now(), Af: 2, Packet: []byte{1, 2, 3, 4}})
+	w.Close()
+
+	var tests = []struct {
+		name         string
+		file         []byte
+		expectOpen   bool
+		expectedNext error
+	}{
+		{"empty", []byte{}, false, nil},
+		{"not a capture", []byte("GIF89a......"), false, nil},
+		{"magic only", []byte(capture.Magic), true, io.EOF},
+		{"truncated header", full.Bytes()[:len(capture.Magic)+10], true, io.ErrUnexpectedEOF},
+		{"truncated packet", full.Bytes()[:full.Len()-1], true, io.ErrUnexpectedEOF},
+	}
+
+	for i, test := range tests {
+		r, err := capture.NewReader(bytes.NewReader(test.file))
+		if (err == nil) != test.expectOpen {
+			t.Errorf("test:%d %s\texpected open:%t\tresult:%v", i, test.name, test.expectOpen, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := r.Next(); err != test.expectedNext {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expectedNext, err)
+		}
+	}
+}
@@ -2,51 +2,119 @@
 //
 // # This is kind of like how python passes the flags
 //
-// In the longer term, we might move all this to a config file of some type
+// The struct tags are the single source of truth for the configuration. The config package
+// uses them to register the command line flags, read the config file and the environment variables,
+// validate the values, and print the defaults.
+//
+//	flag:     the command line flag name, which is also the config file key, and the environment
+//	          variable name after upper casing and prefixing with XTCP_ (e.g. XTCP_SAMPLINGMODULUS)
+//	default:  the default value, in the same format as the command line
+//	usage:    the command line help
+//	min:      optional minimum value for numbers (and durations)
+//	oneof:    optional space separated list of the allowed values for strings
+//	reload:   "true" if the value can be changed by SIGHUP without restarting xtcp
+//	deprecated: "true" if the setting is only kept so the existing configurations still work, which leaves it
+//	          out of the default configuration (see config.Dump)
+//
+// Fields without a flag tag are not configurable, and are left nil.
 package cliflags
 
 import "time"
 
 // CliFlags struct to make it easier to pass all the cli flags
 type CliFlags struct {
-	No4                       *bool
-	No6                       *bool
-	Timeout                   *int64
-	PollingFrequency          *time.Duration
-	PollingSafetyBuffer       *float64
-	MaxLoops                  *int
-	ShutdownWorkers           *bool
-	Netlinkers4               *int
-	Netlinkers6               *int
-	Inetdiagers4              *int
-	Inetdiagers6              *int
-	Single                    *bool
-	NlmsgSeq                  *int
-	PacketSize                *int
-	PacketSizeMply            *int
-	NetlinkerChSize           *int
-	SamplingModulus           *int
-	InetdiagerReportModulus   *int
-	InetdiagerStatsRatio      *float64
-	GoMaxProcs                *int
-	UDPSendDest               *string
-	PromListen                *string
-	PromPath                  *string
-	PromPollerChSize          *int
-	PromNetlinkerChSize       *int
-	PromInetdiagerChSize      *int
-	StatsdDst                 *string
-	NoStatsd                  *bool
-	HappyPollerReportModulus  *int
-	HappyIstaterReportModulus *int
-	NoDisabler                *bool
-	DisablerFrequency         *time.Duration
-	DisablerCommand           *string
-	DisablerArgument1         *string
-	DisablerArgument2         *string
-	XTCPStaterFrequency       *time.Duration
-	XTCPStaterSystemctlPath   *string
-	XTCPStaterPsPath          *string
+	No4                       *bool          `flag:"no4" default:"false" usage:"no IPv4, false = IPv4 enabled"`
+	No6                       *bool          `flag:"no6" default:"false" usage:"no IPv6, false = IPv6 enabled"`
+	Timeout                   *int64         `flag:"timeout" default:"50" min:"0" usage:"Netlink socket timeout in milliseconds.  Zero(0) for no timeout"` // can be increased to 100ms if needed
+	PollingFrequency          *time.Duration `flag:"frequency" default:"30s" min:"1ms" reload:"true" usage:"Polling frequency"`                            // TODO make default 10s
+	PollingSafetyBuffer       *float64       `flag:"pollingSafetyBuffer" default:"0.8" min:"0" usage:"pollingSafetyBuffer defines the point at which warnings about long polling duration are generated, defined as a percentage of pollingFrequencySeconds (0.8 = 80%)"`
+	MaxLoops                  *int           `flag:"maxLoops" default:"0" min:"0" usage:"Maximum number of loops, or zero (0) for forever"`
+	ShutdownWorkers           *bool          `flag:"shutdownWorkers" default:"false" usage:"Option to allow shutting down workers between polls"`
+	Netlinkers4               *int           `flag:"netlinkers4" default:"4" min:"1" usage:"Number of IPv4 netlinkers"`
+	Netlinkers6               *int           `flag:"netlinkers6" default:"2" min:"1" usage:"Number of IPv6 netlinkers"`
+	Inetdiagers4              *int           `flag:"inetdiagers4" default:"10" min:"1" usage:"Number of IPv4 inetdiagers"`
+	Inetdiagers6              *int           `flag:"inetdiagers6" default:"4" min:"1" usage:"Number of IPv6 inetdiagers"`
+	DumpShards                *int           `flag:"dumpShards" default:"1" min:"1" usage:"Number of concurrent dumps per poll, each on its own netlink socket, with its own netlinker, sharded by a bytecode filter on dumpShardPorts of dumpShardBy.  One (1) is a single dump"`
+	DumpShardBy               *string        `flag:"dumpShardBy" default:"dport" oneof:"dport sport" usage:"Port the dumpShards are split by. dport = destination (remote) port, which suits servers, sport = source (local) port, which suits clients"`
+	DumpShardPorts            *string        `flag:"dumpShardPorts" default:"1024-65535" usage:"Port range split evenly into the dumpShards.  The first shard also has the ports below, and the last shard the ports above"`
+	DumpShardRanges           *string        `flag:"dumpShardRanges" default:"" usage:"Explicit dump shards, instead of dumpShards. Comma separated shards of + separated conditions sport:<low>-<high>, dport:<low>-<high>, src:<prefix>, dst:<prefix>, or rest for the sockets not in any other shard.  e.g. dst:10.0.0.0/8,dport:1024-32767,rest"`
+	Single                    *bool          `flag:"single" default:"false" usage:"Single means only one (1) of each worker type (which helps debug with less concurrency)"`
+	NlmsgSeq                  *int           `flag:"nlmsgSeq" default:"666" min:"0" usage:"nlmsgSeq sequence number (start), which should be uint32"`
+	PacketSize                *int           `flag:"packetSize" default:"0" min:"0" usage:"netlinker packetSize.  buffer size = packetSize * packetSizeMply. Use zero (0) for syscall.Getpagesize()"`
+	PacketSizeMply            *int           `flag:"packetSizeMply" default:"8" min:"1" usage:"netlinker packetSize multiplier.  buffer size = packetSize * packetSizeMply"`
+	NetlinkerChPackets        *int           `flag:"netlinkerChPackets" default:"2" min:"0" usage:"netlinkerChPackets is the channel size between the netlinkers and the inetdiagers, in netlink packets (~70 inetdiag messages each), which replaces netlinkerChSize (in messages)"`
+	NetlinkerChSize           *int           `flag:"netlinkerChSize" default:"0" min:"0" deprecated:"true" usage:"Deprecated, use netlinkerChPackets.  netlinkerChSize was the channel size in inetdiag messages, and is converted to netlinkerChPackets (divided by ~70), unless netlinkerChPackets is also set.  Zero (0) = not set"`
+	SamplingModulus           *int           `flag:"samplingModulus" default:"2" min:"1" reload:"true" usage:"samplingModulus.  Netlinker will sample every Xth inetdiag messages to send to inetdiager"` //TODO make default 1
+	SamplingMode              *string        `flag:"samplingMode" default:"modulus" oneof:"modulus hash" usage:"Netlinker sampling mode. modulus = every samplingModulus'th message, which samples different sockets every poll. hash = a stable 1/samplingModulus of the sockets, by a hash of samplingHashKey, so the same sockets are followed across polls"`
+	SamplingHashKey           *string        `flag:"samplingHashKey" default:"tuple" oneof:"tuple cookie" usage:"Socket identity hashed by samplingMode hash. tuple = ports and addresses, cookie = the kernel socket cookie"`
+	SamplingStrata            *string        `flag:"samplingStrata" default:"" usage:"Sampling strata with their own samplingModulus, so low volume services aren't sampled away.  Comma separated port:<local port>=<modulus> or prefix:<destination cidr>=<modulus>, first match wins. e.g. port:22=1,prefix:10.0.0.0/8=10"`
+	SamplingAdaptive          *bool          `flag:"samplingAdaptive" default:"false" usage:"Adaptive sampling raises and lowers the samplingModulus per address family, between samplingModulusMin and samplingModulusMax, to keep the polls within samplingTarget of the polling frequency"`
+	SamplingModulusMin        *int           `flag:"samplingModulusMin" default:"1" min:"1" usage:"Adaptive sampling minimum samplingModulus"`
+	SamplingModulusMax        *int           `flag:"samplingModulusMax" default:"1000" min:"1" usage:"Adaptive sampling maximum samplingModulus"`
+	SamplingTarget            *float64       `flag:"samplingTarget" default:"0.5" min:"0.01" usage:"Adaptive sampling target poll duration, as a percentage of the polling frequency (0.5 = 50%).  The samplingModulus is raised above the target, and lowered below half of the target"`
+	SamplingQueueHigh         *float64       `flag:"samplingQueueHigh" default:"0.8" min:"0.01" usage:"Adaptive sampling raises the samplingModulus if the netlinkerCh is fuller than this when the dump completes (0.8 = 80%)"`
+	NormalizeV4Mapped         *bool          `flag:"normalizeV4Mapped" default:"false" usage:"Normalize the IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) of IPv4 clients on dual stack sockets to IPv4, with the record original_family = 10 (AF_INET6)"`
+	AnonymizeSource           *string        `flag:"anonymizeSource" default:"none" oneof:"none drop truncate hmac cryptopan" usage:"Anonymize the source (local) addresses of the exported records. drop = remove, truncate = to anonymizePrefix4/6, hmac = keyed HMAC, cryptopan = prefix-preserving Crypto-PAn"`
+	AnonymizeDestination      *string        `flag:"anonymizeDestination" default:"none" oneof:"none drop truncate hmac cryptopan" usage:"Anonymize the destination (remote) addresses of the exported records. drop = remove, truncate = to anonymizePrefix4/6, hmac = keyed HMAC, cryptopan = prefix-preserving Crypto-PAn"`
+	AnonymizePrefix4          *int           `flag:"anonymizePrefix4" default:"24" min:"0" usage:"Anonymize truncate IPv4 prefix length, 0-32"`
+	AnonymizePrefix6          *int           `flag:"anonymizePrefix6" default:"48" min:"0" usage:"Anonymize truncate IPv6 prefix length, 0-128"`
+	AnonymizeKeyFile          *string        `flag:"anonymizeKeyFile" default:"" usage:"Anonymize key file for hmac and cryptopan, raw or hex.  cryptopan requires 32 bytes, e.g. openssl rand -hex 32"`
+	AnonymizePortBucket       *int           `flag:"anonymizePortBucket" default:"0" min:"0" usage:"Anonymize the ports >= 1024 to multiples of this, e.g. 1024.  Zero (0) = disabled"`
+	Filter                    *string        `flag:"filter" default:"" usage:"Export only the records matching the filter expression to all the sinks, e.g. 'rtt > 50ms or total_retrans > 0'.  See the exportfilter package"`
+	FilterStream              *string        `flag:"filterStream" default:"" usage:"Filter expression for the gRPC stream, overriding -filter"`
+	FilterNSQ                 *string        `flag:"filterNSQ" default:"" usage:"Filter expression for NSQ, overriding -filter"`
+	FilterUDP                 *string        `flag:"filterUDP" default:"" usage:"Filter expression for UDP, overriding -filter"`
+	Fields                    *string        `flag:"fields" default:"" usage:"Export only these comma separated record fields to all the sinks, e.g. 'hostname,epoch_time,socket_i_d,tcp_info.rtt'.  Default all fields"`
+	FieldsStream              *string        `flag:"fieldsStream" default:"" usage:"Fields for the gRPC stream, overriding -fields"`
+	FieldsNSQ                 *string        `flag:"fieldsNSQ" default:"" usage:"Fields for NSQ, overriding -fields"`
+	FieldsUDP                 *string        `flag:"fieldsUDP" default:"" usage:"Fields for UDP, overriding -fields"`
+	States                    *string        `flag:"states" default:"established" usage:"Comma separated TCP states to dump, e.g. established,close_wait, or all.  See xtcpnl.TCPStates"`
+	NoBottleneck              *bool          `flag:"noBottleneck" default:"false" usage:"no bottleneck classification of the sockets, false = classification enabled"`
+	BottleneckRatio           *float64       `flag:"bottleneckRatio" default:"0.5" min:"0.01" usage:"Bottleneck classification: a socket is rwnd or sndbuf limited if at least this fraction of the busy time since the previous poll was rwnd or sndbuf limited (0.5 = 50%)"`
+	TopN                      *int           `flag:"topN" default:"0" min:"0" usage:"Rank the N worst sockets of each poll by each of the topNMetrics, served on the admin API /admin/top. Zero(0) = disabled"`
+	TopNMetrics               *string        `flag:"topNMetrics" default:"rtt,total_retrans,not_sent_bytes,rwnd_limited" usage:"Comma separated record fields to rank the topN sockets by, highest first"`
+	TopNRecordModulus         *int           `flag:"topNRecordModulus" default:"0" min:"0" usage:"Export the topN sockets as records tagged topn:<metric>:<rank> to UDP and NSQ, every N polls. Zero(0) = disabled"`
+	Tags                      *string        `flag:"tags" default:"" usage:"Comma separated key=value tags of every record, e.g. dc=lhr1,role=edge,cluster=c7"`
+	TagRules                  *string        `flag:"tagRules" default:"" usage:"Tag rules YAML file, adding tags to the records by prefix, port, mark, class_id, or UID.  See the tagging package"`
+	GeoIPCity                 *string        `flag:"geoipCity" default:"" usage:"GeoIP2/GeoLite2 City or Country mmdb file, for the destination country, region, and city. Empty = disabled"`
+	GeoIPASN                  *string        `flag:"geoipASN" default:"" usage:"GeoIP2/GeoLite2 ASN mmdb file, for the destination ASN and organization. Empty = disabled"`
+	GeoIPCacheSize            *int           `flag:"geoipCacheSize" default:"65536" min:"1" usage:"GeoIP lookups cached, by address.  The cache is cleared when it's full"`
+	GeoIPReload               *time.Duration `flag:"geoipReload" default:"60s" usage:"Check the geoip mmdb files for changes, and reload them, every geoipReload. Zero(0) = never"`
+	ServicesFile              *string        `flag:"servicesFile" default:"" usage:"Services YAML file, mapping the local ports and UIDs to the record's service name.  See the services package"`
+	ServicesEtc               *bool          `flag:"servicesEtc" default:"false" usage:"Map the local ports and UIDs to the record's service name with /etc/services and /etc/passwd"`
+	ServicesLearn             *time.Duration `flag:"servicesLearn" default:"0s" usage:"Learn which process is listening on each local port every servicesLearn, for the record's service name. Zero(0) = disabled"`
+	SocketMetricsPorts        *string        `flag:"socketMetricsPorts" default:"" usage:"Comma separated local service ports (e.g. 80,443) to label the Prometheus socket rtt and delivery rate histograms by. Other ports are labelled other. Empty = disabled"`
+	InetdiagerReportModulus   *int           `flag:"inetdiagerReportModulus" default:"2000" min:"1" usage:"inetdiagerReportModulus. Report every X inetd messages to Kafka"` //TODO make default 1000
+	InetdiagerStatsRatio      *float64       `flag:"inetdiagerStatsRatio" default:"0.9" min:"0" usage:"inetdiagerStatsRatio controls the how often the inetdiagers send summary stats, which is as a percentage of the pollingFrequencySeconds (0.9 = 90%)"`
+	GoMaxProcs                *int           `flag:"goMaxProcs" default:"4" min:"0" usage:"goMaxProcs = https://golang.org/pkg/runtime/#GOMAXPROCS. 0 = golang default"`
+	UDPSendDest               *string        `flag:"udpSendDest" default:"127.0.0.1:13000" usage:"UDP socket send destination"`
+	PromListen                *string        `flag:"promListen" default:"127.0.0.1:9000" usage:"Prometheus http listening socket. Use 0.0.0.0:9000 for all interfaces"`
+	PromPath                  *string        `flag:"promPath" default:"/metrics" usage:"Prometheus http path"`
+	PromPollerChSize          *int           `flag:"promPollerChSize" default:"4" min:"0" usage:"promPollerChSize is the channel size for the pollerStaterCh"`
+	PromNetlinkerChSize       *int           `flag:"promNetlinkerChSize" default:"10" min:"0" usage:"promChSize is the channel size for the netlinkerStaterCh"`
+	PromInetdiagerChSize      *int           `flag:"promInetdiagerChSize" default:"100" min:"0" usage:"promChSize is the channel size for the inetdiagerStaterCh"`
+	StatsdDst                 *string        `flag:"statdDst" default:"127.0.0.1:8125" usage:"Statds UDP socket destination"`
+	NoStatsd                  *bool          `flag:"noStatsd" default:"false" usage:"no statsd, false = statsd enabled"`
+	HappyPollerReportModulus  *int           `flag:"happyPollerReportModulus" default:"1000" min:"1" usage:"xtcp poller emits some non-error/happy log messages, and this modules controls the rate"`
+	HappyIstaterReportModulus *int           `flag:"happyIstaterReportModulus" default:"10000" min:"1" usage:"xtcp inetdiagstater emits some non-error/happy log messages, and this modules controls the rate"`
+	NoDisabler                *bool          `flag:"noDisabler" default:"false" usage:"Flag to disable the Disabler poller, false = Disabler enabled"`
+	DisablerFrequency         *time.Duration `flag:"disablerFrequency" default:"60s" min:"1ms" usage:"Disabler polling frequency"`
+	DisablerSource            *string        `flag:"disablerSource" default:"command" oneof:"command file http env" usage:"Disabler check source. command runs disablerCommand, file checks disablerFile, http gets disablerURL, env reads disablerEnv. A response of \"1\" means disabled"`
+	DisablerAction            *string        `flag:"disablerAction" default:"exit" oneof:"exit pause" usage:"Disabler action when disabled. exit = exit(0), pause = stop polling but keep the metrics endpoint, and resume when enabled again"`
+	DisablerErrorAction       *string        `flag:"disablerErrorAction" default:"exit" oneof:"exit keep" usage:"Disabler action when the source check fails. exit = exit(1), keep = count the error in xtcp_disabler_errors, and keep the disable state"`
+	DisablerCommand           *string        `flag:"disablerCommand" default:"echo" usage:"Command to run/poll to check if xtcp should be disabled"`
+	DisablerArgument1         *string        `flag:"disablerArgument1" default:"$XTCP_DISABLED" usage:"Argument to disablerCommand"`
+	DisablerArgument2         *string        `flag:"disablerArgument2" default:"" usage:"Second argument to disablerCommand. Empty = not passed"`
+	DisablerArgs              *string        `flag:"disablerArgs" default:"" usage:"Arguments to disablerCommand, which replace disablerArgument1 and disablerArgument2, split like the shell with 'single' or \"double\" quotes and backslash escapes, but without any expansion. e.g. \"is-active --quiet xtcp-maintenance\""`
+	DisablerFile              *string        `flag:"disablerFile" default:"/run/xtcp/disabled" usage:"Disabler flag file. Disabled if the file exists and is empty, or contains \"1\""`
+	DisablerURL               *string        `flag:"disablerURL" default:"" usage:"Disabler HTTP endpoint. Disabled if the response body is \"1\". e.g. http://127.0.0.1:8080/xtcp/disabled"`
+	DisablerEnv               *string        `flag:"disablerEnv" default:"XTCP_DISABLED" usage:"Disabler environment variable. Disabled if the value is \"1\""`
+	XTCPStaterFrequency       *time.Duration `flag:"xTCPStaterFrequencySeconds" default:"60s" min:"1ms" usage:"XTCP stater reporting frequency"`
+	XTCPStaterSource          *string        `flag:"xTCPStaterSource" default:"proc" oneof:"proc systemctl" usage:"XTCP stater self monitoring source. proc reads /proc and the cgroup files directly, systemctl is the fallback which runs systemctl and ps"`
+	XTCPStaterProcPath        *string        `flag:"xTCPStaterProcPath" default:"/proc" usage:"Path to the proc filesystem, for the proc xTCPStaterSource"`
+	XTCPStaterCgroupPath      *string        `flag:"xTCPStaterCgroupPath" default:"/sys/fs/cgroup" usage:"Path to the cgroup filesystem, for the proc xTCPStaterSource"`
+	XTCPStaterSystemctlPath   *string        `flag:"xTCPStaterSystemctlPath" default:"/bin/systemctl" usage:"Full system path to systemctl, for the systemctl xTCPStaterSource"`
+	XTCPStaterPsPath          *string        `flag:"xTCPStaterPsPath" default:"/bin/ps" usage:"Full system path to ps, for the systemctl xTCPStaterSource"`
 	NoLLDPer                  *bool
 	LLDPOutputhPath           *string
 	NoTrie                    *bool
@@ -54,5 +122,25 @@ type CliFlags struct {
 	TrieCSV6                  *string
 	NoLoopback                *bool
 	IPPath                    *string
-	NSQ                       *string
+	NSQ                       *string        `flag:"nsq" default:"" usage:"Write to NSQ IP:Port"`
+	AlertRules                *string        `flag:"alertRules" default:"" usage:"Alert rules YAML file. Empty = alerts disabled.  See the alerts package"`
+	AlertWebhook              *string        `flag:"alertWebhook" default:"" usage:"URL to POST the alert events to as JSON. Empty = disabled"`
+	AlertNSQTopic             *string        `flag:"alertNSQTopic" default:"xtcp_alerts" usage:"NSQ topic for the alert events, with -nsq. Empty = disabled"`
+	GRPCListen                *string        `flag:"grpcListen" default:"" usage:"gRPC streaming listening socket for live record subscriptions. e.g. 127.0.0.1:9001. Empty = disabled"`
+	GRPCSubscriberBuffer      *int           `flag:"grpcSubscriberBuffer" default:"1000" min:"1" usage:"gRPC maximum records buffered per subscriber, after which records are dropped for that subscriber"`
+	GRPCMaxSubscribers        *int           `flag:"grpcMaxSubscribers" default:"10" min:"0" usage:"gRPC maximum concurrent subscribers"`
+	AdminTokenFile            *string        `flag:"adminTokenFile" default:"" usage:"File containing the bearer token for the admin HTTP API on the promListen socket. Empty = admin API disabled"`
+	AdminAuditLog             *string        `flag:"adminAuditLog" default:"" usage:"File to append the admin HTTP API audit log to. Empty = stdout only"`
+	ShutdownTimeout           *time.Duration `flag:"shutdownTimeout" default:"10s" min:"1ms" usage:"On SIGTERM/SIGINT, the maximum time to drain the pipeline and flush the stats, after which xtcp exits(1)"`
+	ShutdownAbortDump         *bool          `flag:"shutdownAbortDump" default:"false" usage:"On SIGTERM/SIGINT, abort the in-flight netlink dump, rather than finishing it"`
+	Capture                   *string        `flag:"capture" default:"" usage:"Write the raw netlink packets, with the poll times and address family, to this capture file for replay.  Empty = disabled.  The file grows every poll, so use with maxLoops"`
+	Replay                    *string        `flag:"replay" default:"" usage:"Replay this capture file through the netlinkers and inetdiagers, instead of polling the kernel, and exit.  Empty = disabled"`
+	ReplaySpeed               *float64       `flag:"replaySpeed" default:"0" min:"0" usage:"Replay speed, relative to the capture. 1 = original speed, 10 = ten times faster, 0 = as fast as possible"`
+	Pcap                      *string        `flag:"pcap" default:"" usage:"Write the netlink dump requests and responses to this pcap file, with the NETLINK (nlmon) link type, for Wireshark.  Empty = disabled"`
+	PcapMaxBytes              *int64         `flag:"pcapMaxBytes" default:"100000000" min:"0" usage:"pcap file size at which it is rotated to <pcap>.1, <pcap>.2, etc.  Zero (0) = never rotate"`
+	PcapFiles                 *int           `flag:"pcapFiles" default:"5" min:"1" usage:"Number of pcap files to keep, including the current file"`
+	LogFormat                 *string        `flag:"logFormat" default:"text" oneof:"text json journald" usage:"Log format. text = key=value, json, or journald = key=value with the syslog priority prefix and no time"`
+	LogLevel                  *string        `flag:"logLevel" default:"info" oneof:"trace debug info warn error" reload:"true" usage:"Log level for all the subsystems"`
+	LogLevels                 *string        `flag:"logLevels" default:"" reload:"true" usage:"Per subsystem log levels, which override logLevel. e.g. netlinker=trace,poller=debug. Subsystems: main config admin disabler poller netlinker inetdiager staters streamer alerts"`
+	LogRateLimit              *time.Duration `flag:"logRateLimit" default:"10s" min:"0s" usage:"Repeated warnings and errors with the same message are logged once per logRateLimit per subsystem, with the suppressed count. 0 = no limit"`
 }
@@ -0,0 +1,358 @@
+// Package config builds the cliflags.CliFlags from the command line flags, the config file, and the environment
+//
+// The CliFlags struct tags are the single source of truth (see the cliflags package), so adding a
+// new setting is just adding a field with tags.  Nothing else needs to change.
+//
+// The precedence is (lowest to highest):
+// 1. The "default" struct tag
+// 2. The YAML config file (-config)
+// 3. The environment variables (XTCP_<FLAG NAME UPPER CASE>, e.g. XTCP_SAMPLINGMODULUS=4)
+// 4. The command line flags
+//
+// e.g. Config file
+//
+//	frequency: 10s
+//	samplingModulus: 4
+//	nsq: 127.0.0.1:4150
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is the prefix for the environment variable overrides
+	EnvPrefix = "XTCP_"
+	// messagesPerPacket is about the number of inetdiag messages in a netlink packet, which converts the deprecated
+	// netlinkerChSize (in messages) to netlinkerChPackets
+	messagesPerPacket = 70
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Change is a single setting which differs between two CliFlags, see Changes
+type Change struct {
+	Name       string
+	Old        string
+	New        string
+	Reloadable bool
+}
+
+// EnvName returns the environment variable name for the flag name
+// e.g. samplingModulus = XTCP_SAMPLINGMODULUS
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, ".", "_"))
+}
+
+// fields calls fn for each configurable field of the CliFlags (the ones with a flag tag)
+func fields(cliFlags *cliflags.CliFlags, fn func(field reflect.StructField, value reflect.Value)) {
+	v := reflect.ValueOf(cliFlags).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("flag") == "" {
+			continue
+		}
+		fn(field, v.Field(i))
+	}
+}
+
+// Register allocates the configurable CliFlags fields, and registers them as flags in the FlagSet
+// with the defaults from the struct tags.  The values are updated in place as the FlagSet is parsed.
+func Register(fs *flag.FlagSet) cliflags.CliFlags {
+
+	var cliFlags cliflags.CliFlags
+	fields(&cliFlags, func(field reflect.StructField, value reflect.Value) {
+
+		name := field.Tag.Get("flag")
+		usage := field.Tag.Get("usage")
+		if field.Tag.Get("reload") == "true" {
+			usage += " (reloadable with SIGHUP)"
+		}
+
+		value.Set(reflect.New(field.Type.Elem()))
+		switch p := value.Interface().(type) {
+		case *bool:
+			fs.BoolVar(p, name, false, usage)
+		case *int:
+			fs.IntVar(p, name, 0, usage)
+		case *int64:
+			fs.Int64Var(p, name, 0, usage)
+		case *float64:
+			fs.Float64Var(p, name, 0, usage)
+		case *string:
+			fs.StringVar(p, name, "", usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, 0, usage)
+		default:
+			panic(fmt.Sprintf("config: CliFlags.%s has unsupported type %s", field.Name, field.Type))
+		}
+
+		// Setting the default via the flag.Value means the default tag is parsed exactly like the command line
+		f := fs.Lookup(name)
+		def := field.Tag.Get("default")
+		if err := f.Value.Set(def); err != nil {
+			panic(fmt.Sprintf("config: CliFlags.%s default %q is invalid: %s", field.Name, def, err))
+		}
+		f.DefValue = f.Value.String()
+	})
+	return cliFlags
+}
+
+// Apply applies the config file and then the environment variables to the flags in the FlagSet,
+// and validates the result.  Flags which were set on the command line are not changed.
+// Call this after fs.Parse.  An empty path means no config file.
+func Apply(fs *flag.FlagSet, cliFlags cliflags.CliFlags, path string) error {
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	// set are the flags set by the command line, the config file, or the environment
+	set := make(map[string]bool)
+	for name := range explicit {
+		set[name] = true
+	}
+
+	if path != "" {
+		values, err := ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := applyValues(fs, cliFlags, values, explicit, path); err != nil {
+			return err
+		}
+		for key := range values {
+			set[key] = true
+		}
+	}
+
+	var err error
+	fields(&cliFlags, func(field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("flag")
+		env, ok := os.LookupEnv(EnvName(name))
+		if !ok || explicit[name] || err != nil {
+			return
+		}
+		set[name] = true
+		// f.Value.Set (not fs.Set) so the flag is not marked as set on the command line
+		if setErr := fs.Lookup(name).Value.Set(env); setErr != nil {
+			err = fmt.Errorf("environment %s=%q: %w", EnvName(name), env, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Shortcut for single (x1) worker of each type (which helps debug with less concurrency)
+	if *cliFlags.Single {
+		*cliFlags.Netlinkers4 = 1
+		*cliFlags.Netlinkers6 = 1
+		*cliFlags.Inetdiagers4 = 1
+		*cliFlags.Inetdiagers6 = 1
+	}
+
+	// netlinkerChSize is deprecated, so the existing configurations keep working, with the size converted to packets
+	if *cliFlags.NetlinkerChSize > 0 {
+		logger := logging.Logger("config")
+		if set["netlinkerChPackets"] {
+			logger.Warn("netlinkerChSize is deprecated, and ignored because netlinkerChPackets is set", "netlinkerChSize", *cliFlags.NetlinkerChSize, "netlinkerChPackets", *cliFlags.NetlinkerChPackets)
+		} else {
+			*cliFlags.NetlinkerChPackets = (*cliFlags.NetlinkerChSize + messagesPerPacket - 1) / messagesPerPacket
+			logger.Warn("netlinkerChSize is deprecated, use netlinkerChPackets", "netlinkerChSize", *cliFlags.NetlinkerChSize, "netlinkerChPackets", *cliFlags.NetlinkerChPackets)
+		}
+	}
+
+	return Validate(cliFlags)
+}
+
+// ReadFile reads the YAML config file into a map of flag name to value
+func ReadFile(path string) (map[string]interface{}, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file:%w", err)
+	}
+
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, fmt.Errorf("config file %s:%w", path, err)
+	}
+	return values, nil
+}
+
+// applyValues checks each config file key is a known flag, and sets the values which were not set on the command line
+func applyValues(fs *flag.FlagSet, cliFlags cliflags.CliFlags, values map[string]interface{}, explicit map[string]bool, path string) error {
+
+	known := make(map[string]bool)
+	fields(&cliFlags, func(field reflect.StructField, value reflect.Value) {
+		known[field.Tag.Get("flag")] = true
+	})
+
+	for key, raw := range values {
+		if !known[key] {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		switch raw.(type) {
+		case map[string]interface{}, []interface{}:
+			return fmt.Errorf("config file %s: key %q must be a single value", path, key)
+		}
+		if explicit[key] {
+			logging.Logger("config").Info("config file value is overridden by the command line", "key", key)
+			continue
+		}
+		s := ""
+		if raw != nil {
+			s = fmt.Sprint(raw)
+		}
+		if err := fs.Lookup(key).Value.Set(s); err != nil {
+			return fmt.Errorf("config file %s: key %q value %q: %w", path, key, s, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the values against the min and oneof struct tags
+func Validate(cliFlags cliflags.CliFlags) error {
+
+	var err error
+	fields(&cliFlags, func(field reflect.StructField, value reflect.Value) {
+
+		if oneof, ok := field.Tag.Lookup("oneof"); ok && err == nil {
+			allowed := strings.Fields(oneof)
+			s := fmt.Sprint(value.Elem().Interface())
+			found := false
+			for _, a := range allowed {
+				if s == a {
+					found = true
+				}
+			}
+			if !found {
+				err = fmt.Errorf("%s must be one of %v, got:%s", field.Tag.Get("flag"), allowed, s)
+			}
+		}
+
+		minTag, ok := field.Tag.Lookup("min")
+		if !ok || err != nil {
+			return
+		}
+		name := field.Tag.Get("flag")
+		elem := value.Elem()
+
+		switch {
+		case field.Type.Elem() == durationType:
+			min, parseErr := time.ParseDuration(minTag)
+			if parseErr == nil && time.Duration(elem.Int()) < min {
+				err = fmt.Errorf("%s must be >= %s, got:%s", name, min, time.Duration(elem.Int()))
+			}
+		case elem.Kind() == reflect.Int || elem.Kind() == reflect.Int64:
+			min, parseErr := strconv.ParseInt(minTag, 10, 64)
+			if parseErr == nil && elem.Int() < min {
+				err = fmt.Errorf("%s must be >= %d, got:%d", name, min, elem.Int())
+			}
+		case elem.Kind() == reflect.Float64:
+			min, parseErr := strconv.ParseFloat(minTag, 64)
+			if parseErr == nil && elem.Float() < min {
+				err = fmt.Errorf("%s must be >= %g, got:%g", name, min, elem.Float())
+			}
+		}
+	})
+	return err
+}
+
+// Reload builds a fresh CliFlags from the defaults, the config file, and the environment, with the
+// flags set on the original command line (in fs) still taking precedence
+func Reload(fs *flag.FlagSet, path string) (cliflags.CliFlags, error) {
+
+	reloadFS := flag.NewFlagSet("reload", flag.ContinueOnError)
+	cliFlags := Register(reloadFS)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if reloadFS.Lookup(f.Name) == nil || err != nil {
+			return
+		}
+		err = reloadFS.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return cliFlags, err
+	}
+
+	return cliFlags, Apply(reloadFS, cliFlags, path)
+}
+
+// Changes lists the configurable settings which differ between the old and new CliFlags
+func Changes(old cliflags.CliFlags, new cliflags.CliFlags) []Change {
+
+	newValue := reflect.ValueOf(new)
+
+	var changes []Change
+	fields(&old, func(field reflect.StructField, value reflect.Value) {
+		o := fmt.Sprint(value.Elem().Interface())
+		n := fmt.Sprint(newValue.FieldByName(field.Name).Elem().Interface())
+		if o != n {
+			changes = append(changes, Change{
+				Name:       field.Tag.Get("flag"),
+				Old:        o,
+				New:        n,
+				Reloadable: field.Tag.Get("reload") == "true",
+			})
+		}
+	})
+	return changes
+}
+
+// Update sets the setting of the flag name in current to the reloaded value, once the change is applied, so only the
+// changes which were applied are in the current configuration
+func Update(current *cliflags.CliFlags, reloaded cliflags.CliFlags, name string) {
+	reloadedValue := reflect.ValueOf(reloaded)
+	fields(current, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("flag") == name {
+			// The pointer is replaced, rather than the value, because the current pointers are shared with the startup cliFlags
+			value.Set(reloadedValue.FieldByName(field.Name))
+		}
+	})
+}
+
+// Defaults writes the default configuration, as a YAML config file with the usage as comments
+func Defaults(w io.Writer) error {
+	return Dump(w, Register(flag.NewFlagSet("defaults", flag.ContinueOnError)))
+}
+
+// Dump writes the configuration as a YAML config file, with the usage as comments
+// The output can be used as the -config file.  The deprecated settings are left out.
+func Dump(w io.Writer, cliFlags cliflags.CliFlags) error {
+
+	var err error
+	fields(&cliFlags, func(field reflect.StructField, value reflect.Value) {
+		if err != nil || field.Tag.Get("deprecated") == "true" {
+			return
+		}
+		var v interface{}
+		if value.IsNil() {
+			v = ""
+		} else {
+			v = value.Elem().Interface()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		var b []byte
+		b, err = yaml.Marshal(map[string]interface{}{field.Tag.Get("flag"): v})
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "# %s\n%s", field.Tag.Get("usage"), b)
+	})
+	return err
+}
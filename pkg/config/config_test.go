@@ -0,0 +1,222 @@
+package config_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/config"
+)
+
+// writeConfig writes the YAML to a temp config file
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "xtcp.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestPrecedence checks default < config file < environment < flags
+func TestPrecedence(t *testing.T) {
+
+	path := writeConfig(t, "frequency: 10s\nsamplingModulus: 3\nnetlinkers4: 8\nnsq: 127.0.0.1:4150\n")
+	os.Setenv(config.EnvName("samplingModulus"), "5")
+	os.Setenv(config.EnvName("netlinkers4"), "6")
+	defer os.Unsetenv(config.EnvName("samplingModulus"))
+	defer os.Unsetenv(config.EnvName("netlinkers4"))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-netlinkers4", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(fs, cliFlags, path); err != nil {
+		t.Fatalf("Apply error:%v", err)
+	}
+
+	var tests = []struct {
+		name     string
+		result   interface{}
+		expected interface{}
+	}{
+		{"default", *cliFlags.Netlinkers6, 2},
+		{"file", *cliFlags.PollingFrequency, 10 * time.Second},
+		{"file string", *cliFlags.NSQ, "127.0.0.1:4150"},
+		{"env over file", *cliFlags.SamplingModulus, 5},
+		{"flag over env and file", *cliFlags.Netlinkers4, 2},
+	}
+
+	for i, test := range tests {
+		if test.result != test.expected {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expected, test.result)
+		}
+	}
+}
+
+// TestNetlinkerChSize checks the deprecated netlinkerChSize is converted to netlinkerChPackets, unless
+// netlinkerChPackets is set too
+func TestNetlinkerChSize(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		args     []string
+		yaml     string
+		env      string // XTCP_NETLINKERCHPACKETS
+		expected int
+	}{
+		{"default", nil, "", "", 2},
+		{"flag", []string{"-netlinkerChSize", "100"}, "", "", 2},
+		{"flag large", []string{"-netlinkerChSize", "1000"}, "", "", 15},
+		{"flag small", []string{"-netlinkerChSize", "10"}, "", "", 1},
+		{"config file", nil, "netlinkerChSize: 700\n", "", 10},
+		{"netlinkerChPackets flag", []string{"-netlinkerChSize", "1000", "-netlinkerChPackets", "4"}, "", "", 4},
+		{"netlinkerChPackets config file", []string{"-netlinkerChSize", "1000"}, "netlinkerChPackets: 3\n", "", 3},
+		{"netlinkerChPackets environment", []string{"-netlinkerChSize", "1000"}, "", "5", 5},
+	}
+
+	for i, test := range tests {
+		if test.env != "" {
+			os.Setenv(config.EnvName("netlinkerChPackets"), test.env)
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cliFlags := config.Register(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("test:%d %s\tParse error:%v", i, test.name, err)
+		}
+		path := ""
+		if test.yaml != "" {
+			path = writeConfig(t, test.yaml)
+		}
+		err := config.Apply(fs, cliFlags, path)
+		os.Unsetenv(config.EnvName("netlinkerChPackets"))
+		if err != nil {
+			t.Fatalf("test:%d %s\tApply error:%v", i, test.name, err)
+		}
+		if *cliFlags.NetlinkerChPackets != test.expected {
+			t.Errorf("test:%d %s\texpected netlinkerChPackets:%d\tresult:%d", i, test.name, test.expected, *cliFlags.NetlinkerChPackets)
+		}
+	}
+
+	// The deprecated netlinkerChSize isn't in the default configuration
+	var buf bytes.Buffer
+	if err := config.Defaults(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("netlinkerChSize:")) {
+		t.Errorf("expected netlinkerChSize to be left out of the defaults")
+	}
+}
+
+// TestApplyErrors checks the config file schema and validation errors
+func TestApplyErrors(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		yaml string
+		env  string
+	}{
+		{"unknown key", "samplingModulo: 3\n", ""},
+		{"wrong type", "samplingModulus: lots\n", ""},
+		{"bad duration", "frequency: 10\n", ""},
+		{"nested", "frequency:\n  v4: 10s\n", ""},
+		{"below min", "samplingModulus: 0\n", ""},
+		{"duration below min", "frequency: 0s\n", ""},
+		{"bad env", "", "banana"},
+		{"not oneof", "xTCPStaterSource: ps\n", ""},
+		{"not yaml", "frequency: [10s\n", ""},
+	}
+
+	for i, test := range tests {
+		if test.env != "" {
+			os.Setenv(config.EnvName("maxLoops"), test.env)
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cliFlags := config.Register(fs)
+		if err := config.Apply(fs, cliFlags, writeConfig(t, test.yaml)); err == nil {
+			t.Errorf("test:%d %s\texpected error, got nil", i, test.name)
+		}
+		os.Unsetenv(config.EnvName("maxLoops"))
+	}
+}
+
+// TestDumpRoundTrip checks the dumped config can be read back as a config file
+func TestDumpRoundTrip(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-frequency", "7s", "-nsq", "nsq:4150", "-pollingSafetyBuffer", "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(fs, cliFlags, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := config.Dump(&buf, cliFlags); err != nil {
+		t.Fatal(err)
+	}
+
+	readFS := flag.NewFlagSet("read", flag.ContinueOnError)
+	readFlags := config.Register(readFS)
+	if err := config.Apply(readFS, readFlags, writeConfig(t, buf.String())); err != nil {
+		t.Fatalf("Apply of the dump error:%v\n%s", err, buf.String())
+	}
+	if changes := config.Changes(cliFlags, readFlags); len(changes) != 0 {
+		t.Errorf("expected no changes after round trip, got:%v", changes)
+	}
+}
+
+// TestReload checks the reload picks up file changes, keeps the command line flags, and marks the reloadable settings
+func TestReload(t *testing.T) {
+
+	path := writeConfig(t, "frequency: 10s\nsamplingModulus: 3\n")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-nsq", "nsq:4150"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(fs, cliFlags, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("frequency: 20s\nsamplingModulus: 3\nnetlinkers4: 6\nnsq: other:4150\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := config.Reload(fs, path)
+	if err != nil {
+		t.Fatalf("Reload error:%v", err)
+	}
+
+	expected := map[string]bool{
+		"frequency":   true,
+		"netlinkers4": false,
+	}
+	changes := config.Changes(cliFlags, reloaded)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected changes:%v\tresult:%v", expected, changes)
+	}
+	for _, change := range changes {
+		reloadable, ok := expected[change.Name]
+		if !ok || reloadable != change.Reloadable {
+			t.Errorf("unexpected change:%v", change)
+		}
+	}
+	if *reloaded.NSQ != "nsq:4150" {
+		t.Errorf("expected the command line nsq to be kept, result:%s", *reloaded.NSQ)
+	}
+
+	// Once the frequency is applied, only netlinkers4 is still a change, and the startup cliFlags are unchanged
+	current := cliFlags
+	config.Update(&current, reloaded, "frequency")
+	if changes := config.Changes(current, reloaded); len(changes) != 1 || changes[0].Name != "netlinkers4" {
+		t.Errorf("expected the netlinkers4 change\tresult:%v", changes)
+	}
+	if *current.PollingFrequency != 20*time.Second || *cliFlags.PollingFrequency != 10*time.Second {
+		t.Errorf("expected current frequency:20s startup:10s\tresult:%s %s", *current.PollingFrequency, *cliFlags.PollingFrequency)
+	}
+}
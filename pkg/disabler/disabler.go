@@ -1,5 +1,20 @@
-// Package disabler contains a go routine that polls system variable at a regular interval
-// and will kill xtcp if the stdout response is "1\n"
+// Package disabler contains a go routine that polls a disable source at a regular interval
+// and will stop xtcp if the response is "1"
+//
+// The sources are (disablerSource):
+// - command: runs the disablerCommand with the disablerArgs (or disablerArgument1 and disablerArgument2), checking stdout
+// - file:    checks the disablerFile. Disabled if it exists and is empty, or contains "1"
+// - http:    gets the disablerURL, checking the response body
+// - env:     reads the disablerEnv environment variable
+//
+// The actions are (disablerAction):
+// - exit:  os.Exit(0) - a clean exit, which is the original behavior
+// - pause: stops polling via the admin.Controller, but keeps the metrics endpoint alive, and resumes automatically
+// when the source reports enabled again.  This is intended for maintenance windows.
+//
+// If the source fails (e.g. the command fails, or the http server is down), the failure is counted, and xtcp exits(1),
+// which is the original behavior.  With disablerErrorAction keep, the disable state is left as it was instead.
+// The current disable state is exported as the gauge xtcp_disabler_disabled.
 //
 // This go routine can be disabled via cli flag.
 //
@@ -12,93 +27,318 @@ package disabler
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
-	debugLevel int = 11
+	// maxResponseBytes limits how much of the command output or http body is read
+	maxResponseBytes = 64
 )
 
-// Disabler polls a command, and if the stdout response is "1\n", the calls os.Exit(0) - a clean exit
-// It goes return bool, for when using for testing.  Disabler == true means it would os.Exit(0) if not testing
-func Disabler(cliFlags cliflags.CliFlags, done chan<- struct{}, testing bool) bool {
+// The metrics are package level, so they are only registered once, even if the Disabler is restarted (e.g. tests)
+var (
+	promDisabled = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "disabler",
+			Name:      "disabled",
+			Help:      "disabler state, 1 = disabled, 0 = enabled",
+		},
+	)
+	promChecks = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "disabler",
+			Name:      "checks",
+			Help:      "disabler source checks",
+		},
+	)
+	promErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "disabler",
+			Name:      "errors",
+			Help:      "disabler source check errors",
+		},
+	)
+)
 
-	ticker := time.NewTicker(*cliFlags.DisablerFrequency)
+// Source is somewhere the disabler can check if xtcp should be disabled
+type Source interface {
+	Disabled(ctx context.Context) (bool, error)
+	String() string
+}
+
+// CommandSource runs the command, and is disabled if stdout is "1"
+type CommandSource struct {
+	Command string
+	Args    []string
+}
 
-	if debugLevel > 100 {
-		fmt.Println("Disabler start")
+// Disabled runs the command
+func (s CommandSource) Disabled(ctx context.Context) (bool, error) {
+	response, err := exec.CommandContext(ctx, s.Command, s.Args...).Output()
+	if err != nil {
+		return false, err
 	}
+	return isDisabled(response), nil
+}
 
-	//if !misc.CheckFilePermissions(*cliFlags.DisablerCommand, "0755") {
-	//	if debugLevel > 10 {
-	//		fmt.Println("DisablerCommand does not have 0755 permissions:", *cliFlags.DisablerCommand) // extra log cos the fatal log messages doesn't make it to the systemd journal for some reason
-	//		log.Fatal("DisablerCommand does not have 0755 permissions:", *cliFlags.DisablerCommand)
-	//	}
-	//}
+func (s CommandSource) String() string {
+	return "command " + strings.Join(append([]string{s.Command}, s.Args...), " ")
+}
 
-	for pollingLoops := 0; misc.MaxLoopsOrForEver(pollingLoops, *cliFlags.MaxLoops); pollingLoops++ {
+// FileSource is disabled if the file exists and is empty, or if the file contains "1"
+// A missing file is enabled
+type FileSource struct {
+	Path string
+}
 
-		response, err := exec.Command(*cliFlags.DisablerCommand, *cliFlags.DisablerArgument1).Output()
-		fmt.Println("*response")
-		if err != nil {
-			if testing {
-				if debugLevel > 10 {
-					fmt.Println("*cliFlags.DisablerCommand failed, and this would normally be bad, but this is a test, so it's ok.")
-				}
-				return true
+// Disabled checks the file
+func (s FileSource) Disabled(ctx context.Context) (bool, error) {
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return true, nil
+	}
+	return isDisabled(b), nil
+}
+
+func (s FileSource) String() string {
+	return "file " + s.Path
+}
+
+// HTTPSource gets the URL, and is disabled if the response body is "1"
+// Non 200 responses are errors
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+// Disabled gets the URL
+func (s HTTPSource) Disabled(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("disabler http status:%d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return false, err
+	}
+	return isDisabled(body), nil
+}
+
+func (s HTTPSource) String() string {
+	return "http " + s.URL
+}
+
+// EnvSource is disabled if the environment variable is "1"
+// Please note the environment of a running process doesn't change, so this is only useful at startup
+type EnvSource struct {
+	Name string
+}
+
+// Disabled reads the environment variable
+func (s EnvSource) Disabled(ctx context.Context) (bool, error) {
+	return isDisabled([]byte(os.Getenv(s.Name))), nil
+}
+
+func (s EnvSource) String() string {
+	return "env " + s.Name
+}
+
+// isDisabled is true if the response is "1", ignoring white space (e.g. "1\n")
+func isDisabled(response []byte) bool {
+	return string(bytes.TrimSpace(response)) == "1"
+}
+
+// NewSource creates the Source selected by cliFlags.DisablerSource
+func NewSource(cliFlags cliflags.CliFlags) (Source, error) {
+
+	switch *cliFlags.DisablerSource {
+	case "command":
+		s := CommandSource{Command: *cliFlags.DisablerCommand}
+		if cliFlags.DisablerArgs != nil && *cliFlags.DisablerArgs != "" {
+			args, err := splitArgs(*cliFlags.DisablerArgs)
+			if err != nil {
+				return nil, fmt.Errorf("disablerArgs:%w", err)
 			}
-			if debugLevel > 10 {
-				log.Fatal("Disabler exec.Command err:", err)
+			s.Args = args
+			return s, nil
+		}
+		for _, arg := range []*string{cliFlags.DisablerArgument1, cliFlags.DisablerArgument2} {
+			if arg != nil && *arg != "" {
+				s.Args = append(s.Args, *arg)
 			}
 		}
-		if debugLevel > 100 {
-			fmt.Print("Disabler:\tstring(response):", string(response))
+		return s, nil
+	case "file":
+		return FileSource{Path: *cliFlags.DisablerFile}, nil
+	case "http":
+		if *cliFlags.DisablerURL == "" {
+			return nil, fmt.Errorf("disablerSource http requires disablerURL")
 		}
-		if string(bytes.TrimSpace(response)) == "1" {
-			if testing {
-				if debugLevel > 10 {
-					fmt.Println("xtcp is disabled, but this is a test, so it's ok.")
+		return HTTPSource{URL: *cliFlags.DisablerURL, Client: &http.Client{Timeout: *cliFlags.DisablerFrequency}}, nil
+	case "env":
+		return EnvSource{Name: *cliFlags.DisablerEnv}, nil
+	}
+	return nil, fmt.Errorf("unknown disablerSource:%s", *cliFlags.DisablerSource)
+}
+
+// splitArgs splits the disablerArgs into the argv, with the shell's quoting, but nothing else of the shell
+// - the arguments are separated by whitespace
+// - 'single quotes' are literal, so they can contain spaces, double quotes, and backslashes
+// - "double quotes" can contain spaces and single quotes, and backslash only escapes " and \
+// - outside the quotes, backslash escapes the next character
+// There's no expansion of variables, globs, or ~, and the unterminated quotes and a trailing backslash are errors.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ' at:%d", i)
+			}
+			arg.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) && (s[j+1] == '"' || s[j+1] == '\\') {
+					j++
 				}
-				return true
+				arg.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated \" at:%d", i)
 			}
-			if debugLevel > 10 {
-				fmt.Println("xtcp is disabled, so exiting cleanly (exit(0)). err:", err)
+			i = j
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing \\")
 			}
-			os.Exit(0) // Exit for real!
+			i++
+			arg.WriteByte(s[i])
+		default:
+			arg.WriteByte(c)
 		}
+		inArg = true
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Disabler polls the source, and if it reports disabled, performs the disablerAction
+// - exit calls os.Exit(0) - a clean exit
+// - pause stops polling via ctl.SetDisabled, and resumes when the source reports enabled again
+// If the source fails, the disablerErrorAction exit calls os.Exit(1), and keep keeps the disable state
+//
+// done is notified after the first check, so main can block until we know if we're disabled
+// It returns the disable state at the last check, and when testing, returns true instead of os.Exit(0) or os.Exit(1)
+func Disabler(ctx context.Context, cliFlags cliflags.CliFlags, source Source, ctl *admin.Controller, done chan<- struct{}, testing bool) bool {
+
+	ticker := time.NewTicker(*cliFlags.DisablerFrequency)
+	defer ticker.Stop()
 
-		if pollingLoops == 0 && !testing {
-			if debugLevel > 10 {
-				fmt.Println("xtcp is enabled")
+	logger := logging.Logger("disabler").With("source", source.String())
+	logger.Debug("Disabler start")
+
+	var disabled bool
+	for pollingLoops := 0; misc.MaxLoopsOrForEver(pollingLoops, *cliFlags.MaxLoops); pollingLoops++ {
+
+		checkCtx, cancel := context.WithTimeout(ctx, *cliFlags.DisablerFrequency)
+		d, err := source.Disabled(checkCtx)
+		cancel()
+		promChecks.Inc()
+		if err != nil {
+			promErrors.Inc()
+			if *cliFlags.DisablerErrorAction != "keep" {
+				if testing {
+					logger.Error("Disabler source error, and this would normally be bad, but this is a test, so it's ok.", "err", err)
+					return true
+				}
+				logger.Error("Disabler source error, so exiting (exit(1))", "err", err)
+				os.Exit(1)
 			}
-			done <- struct{}{}
-			if debugLevel > 100 {
-				fmt.Println("Disabler notified main.")
+			logger.Warn("Disabler source error, keeping the disable state", "err", err, "disabled", disabled)
+		} else {
+			logger.Debug("Disabler check", "disabled", d)
+			if d != disabled {
+				logger.Info("Disabler state changed", "disabled", d, "action", *cliFlags.DisablerAction)
 			}
+			disabled = d
 		}
 
-		<-ticker.C
-		if debugLevel > 100 {
-			fmt.Println("Disabler tick")
+		if disabled {
+			promDisabled.Set(1)
+		} else {
+			promDisabled.Set(0)
 		}
 
-		// // select not really required, but we could add a HTTP hook or signal handler here
-		// select {
-		// case <-ticker.C:
-		// 	if debugLevel > 100 {
-		// 		fmt.Println("Disabler tick")
-		// 	}
-		// 	break
-		// 	// default:
-		// 	// 	//nothing
-		// }
+		switch *cliFlags.DisablerAction {
+		case "pause":
+			ctl.SetDisabled(disabled)
+		default:
+			if disabled {
+				if testing {
+					logger.Info("xtcp is disabled, but this is a test, so it's ok.")
+					return true
+				}
+				logger.Info("xtcp is disabled, so exiting cleanly (exit(0))")
+				os.Exit(0) // Exit for real!
+			}
+		}
+
+		if pollingLoops == 0 && done != nil {
+			logger.Info("Disabler first check complete", "disabled", disabled)
+			done <- struct{}{}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return disabled
+		}
 	}
-	return true
+	return disabled
 }
@@ -1,17 +1,20 @@
-// Package disabler_test is a basic test of the disabler go routine
-
-// Please note the completion time is quite long (around >6 seconds) and is expected
-
+// Package disabler_test is a basic test of the disabler go routine, and the disable sources
 package disabler_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
 	"github.com/Edgio/xtcp/pkg/cliflags"
 	"github.com/Edgio/xtcp/pkg/disabler"
 )
@@ -20,8 +23,20 @@ const (
 	debugLevel int = 11
 )
 
-// TestDisabler does some basic checks for the disabler.Disabler function
-// This leverages a bash script (TODO rewrite in go) and runs a little slowly
+// testCliFlags returns the cliFlags the disabler uses, with the default disablerErrorAction exit
+// Please note maxLoops is the number of checks minus one, because misc.MaxLoopsOrForEver includes maxLoops
+func testCliFlags(frequency time.Duration, loops int, action string) cliflags.CliFlags {
+	var cliFlags cliflags.CliFlags
+	errorAction := "exit"
+	cliFlags.DisablerFrequency = &frequency
+	cliFlags.MaxLoops = &loops
+	cliFlags.DisablerAction = &action
+	cliFlags.DisablerErrorAction = &errorAction
+	return cliFlags
+}
+
+// TestDisabler does some basic checks for the disabler.Disabler function with the command source
+// This leverages a bash script (TODO rewrite in go), which returns "1" once it has run more than argument2 times
 func TestDisabler(t *testing.T) {
 	var tests = []struct {
 		frequency time.Duration
@@ -35,32 +50,39 @@ func TestDisabler(t *testing.T) {
 		{500 * time.Millisecond, "./testdata/return_one_after_X_runs.bash", "--default=0", "3", int(4), true},
 		{500 * time.Millisecond, "./testdata/return_one_after_X_runs.bash", "--default=0", "4", int(5), true},
 		{500 * time.Millisecond, "/bin/false", "--default=0", "blah", int(10), true},
+		{10 * time.Millisecond, "./testdata/return_one_after_X_runs.bash", "--default=0", "2", int(2), false},
+		{10 * time.Millisecond, "./testdata/return_one_after_X_runs.bash", "--default=0", "0", int(1), true},
 	}
 
 	if debugLevel > 10 {
 		fmt.Println("TestDisabler should take just over 5> seconds <10 (expected)")
 	}
 
-	for _, test := range tests {
+	for i, test := range tests {
 
-		var cliFlags cliflags.CliFlags
-		cliFlags.DisablerFrequency = &test.frequency
-		cliFlags.MaxLoops = &test.loops
+		cliFlags := testCliFlags(test.frequency, test.loops, "exit")
+		source := "command"
+		cliFlags.DisablerSource = &source
 		cliFlags.DisablerCommand = &test.command
 		cliFlags.DisablerArgument1 = &test.argument1
 		cliFlags.DisablerArgument2 = &test.argument2
 
 		err := os.Remove("./testdata/tmp_counter") // remove a single file
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			fmt.Println(err)
 		}
-		if debugLevel > 10 {
+		if debugLevel > 100 {
 			fmt.Println("test:\t", test)
 		}
 
-		// note the buffered channel, which needs to be at least a large as the number of tests, so we don't need to worry about draining
-		disablerCheckComplete := make(chan struct{}, 10)
-		if output := disabler.Disabler(cliFlags, disablerCheckComplete, true); output != test.expected {
+		s, err := disabler.NewSource(cliFlags)
+		if err != nil {
+			t.Fatalf("test:%d NewSource error:%v", i, err)
+		}
+
+		// note the buffered channel, so we don't need to worry about draining
+		disablerCheckComplete := make(chan struct{}, 1)
+		if output := disabler.Disabler(context.Background(), cliFlags, s, nil, disablerCheckComplete, true); output != test.expected {
 			// https://golang.org/pkg/testing/#B.Error
 			t.Errorf("Test Failed: frequency %s, command %s, argument1 %s, argument2 %s, loops %s, expected %s, output %s",
 				fmt.Sprint(test.frequency),
@@ -70,16 +92,187 @@ func TestDisabler(t *testing.T) {
 				fmt.Sprint(test.loops),
 				strconv.FormatBool(test.expected),
 				strconv.FormatBool(output))
-		} else {
-			if debugLevel > 100 {
-				fmt.Println("test:\tSuccess")
-			}
 		}
+	}
+	os.Remove("./testdata/tmp_counter")
+}
 
-		if debugLevel > 100 {
-			fmt.Println("Disable check complete")
+// TestDisablerErrorKeep checks the disablerErrorAction keep counts the source errors, and keeps the disable state,
+// rather than exiting
+func TestDisablerErrorKeep(t *testing.T) {
+
+	cliFlags := testCliFlags(time.Millisecond, 2, "exit")
+	*cliFlags.DisablerErrorAction = "keep"
+
+	disablerCheckComplete := make(chan struct{}, 1)
+	if disabled := disabler.Disabler(context.Background(), cliFlags, disabler.CommandSource{Command: "/bin/false"}, nil, disablerCheckComplete, true); disabled {
+		t.Errorf("expected the source errors to keep xtcp enabled")
+	}
+	select {
+	case <-disablerCheckComplete:
+	default:
+		t.Errorf("expected the first check to complete, despite the error")
+	}
+}
+
+// TestSources checks each of the disable sources
+func TestSources(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name string, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/disabled":
+			fmt.Fprintln(w, "1")
+		case "/enabled":
+			fmt.Fprintln(w, "0")
+		default:
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("XTCP_TEST_DISABLED", "1")
+	defer os.Unsetenv("XTCP_TEST_DISABLED")
+
+	var tests = []struct {
+		name      string
+		source    disabler.Source
+		expected  bool
+		expectErr bool
+	}{
+		{"command 1", disabler.CommandSource{Command: "echo", Args: []string{"1"}}, true, false},
+		{"command 0", disabler.CommandSource{Command: "echo", Args: []string{"0"}}, false, false},
+		{"command fails", disabler.CommandSource{Command: "/bin/false"}, false, true},
+		{"file missing", disabler.FileSource{Path: filepath.Join(dir, "missing")}, false, false},
+		{"file empty", disabler.FileSource{Path: write("empty", "")}, true, false},
+		{"file 1", disabler.FileSource{Path: write("one", "1\n")}, true, false},
+		{"file 0", disabler.FileSource{Path: write("zero", "0\n")}, false, false},
+		{"http 1", disabler.HTTPSource{URL: server.URL + "/disabled", Client: server.Client()}, true, false},
+		{"http 0", disabler.HTTPSource{URL: server.URL + "/enabled", Client: server.Client()}, false, false},
+		{"http 500", disabler.HTTPSource{URL: server.URL + "/error", Client: server.Client()}, false, true},
+		{"env 1", disabler.EnvSource{Name: "XTCP_TEST_DISABLED"}, true, false},
+		{"env unset", disabler.EnvSource{Name: "XTCP_TEST_UNSET"}, false, false},
+	}
+
+	for i, test := range tests {
+		disabled, err := test.source.Disabled(context.Background())
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+			continue
+		}
+		if disabled != test.expected {
+			t.Errorf("test:%d %s\texpected:%t\tresult:%t", i, test.name, test.expected, disabled)
+		}
+	}
+}
+
+// TestDisablerArgs checks the disablerArgs are split into the argv with the shell's quoting, and are run as is
+func TestDisablerArgs(t *testing.T) {
+	var tests = []struct {
+		args     string
+		expected string // the argv joined by "|", or "error"
+	}{
+		{"is-active --quiet xtcp-maintenance", "is-active|--quiet|xtcp-maintenance"},
+		{"  -c\t'echo 1'  ", "-c|echo 1"},
+		{`-c "echo \"it's 1\""`, `-c|echo "it's 1"`},
+		{`a\ b 'c\d' "e\f"`, `a b|c\d|e\f`},
+		{`'' x""y`, `|xy`},
+		{`$HOME *`, `$HOME|*`},
+		{`'unterminated`, "error"},
+		{`"unterminated`, "error"},
+		{`trailing\`, "error"},
+	}
+	for i, test := range tests {
+		cliFlags := testCliFlags(time.Second, 0, "exit")
+		source, command := "command", "sh"
+		cliFlags.DisablerSource = &source
+		cliFlags.DisablerCommand = &command
+		cliFlags.DisablerArgs = &test.args
+
+		s, err := disabler.NewSource(cliFlags)
+		result := "error"
+		if err == nil {
+			result = strings.Join(s.(disabler.CommandSource).Args, "|")
+		}
+		if result != test.expected {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%s err:%v", i, test.args, test.expected, result, err)
 		}
 	}
+
+	// The quoted script is a single argument to sh
+	cliFlags := testCliFlags(time.Second, 0, "exit")
+	source, command, args := "command", "sh", `-c 'echo "$0"' 1`
+	cliFlags.DisablerSource = &source
+	cliFlags.DisablerCommand = &command
+	cliFlags.DisablerArgs = &args
+	s, err := disabler.NewSource(cliFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := s.Disabled(context.Background()); !disabled || err != nil {
+		t.Errorf("expected disabled\tresult:%t %v", disabled, err)
+	}
+}
+
+// scriptedSource returns the scripted disable states in order, recording if polling was paused before each check
+type scriptedSource struct {
+	states []bool
+	ctl    *admin.Controller
+	paused []bool
+}
+
+func (s *scriptedSource) Disabled(ctx context.Context) (bool, error) {
+	s.paused = append(s.paused, s.ctl.Paused())
+	state := s.states[0]
+	s.states = s.states[1:]
+	return state, nil
+}
+
+func (s *scriptedSource) String() string {
+	return "scripted"
+}
+
+// TestDisablerPause checks the pause action pauses polling, and resumes when enabled again,
+// without overriding a pause from the admin API
+func TestDisablerPause(t *testing.T) {
+
+	cliFlags := testCliFlags(time.Millisecond, 3, "pause")
+	modulus := 1
+	frequency := time.Second
+	cliFlags.SamplingModulus = &modulus
+	cliFlags.PollingFrequency = &frequency
+	ctl := admin.NewController(cliFlags)
+
+	source := &scriptedSource{states: []bool{false, true, true, false}, ctl: ctl}
+	disablerCheckComplete := make(chan struct{}, 1)
+	if disabled := disabler.Disabler(context.Background(), cliFlags, source, ctl, disablerCheckComplete, true); disabled {
+		t.Errorf("expected enabled after the last check")
+	}
+
+	expected := []bool{false, false, true, true}
+	if fmt.Sprint(source.paused) != fmt.Sprint(expected) {
+		t.Errorf("expected paused:%v\tresult:%v", expected, source.paused)
+	}
+	if ctl.Paused() || ctl.Disabled() {
+		t.Errorf("expected polling to resume")
+	}
+
+	// the disabler re-enabling doesn't resume an admin pause
+	ctl.Pause()
+	source = &scriptedSource{states: []bool{true, false}, ctl: ctl}
+	*cliFlags.MaxLoops = 1
+	disabler.Disabler(context.Background(), cliFlags, source, ctl, make(chan struct{}, 1), true)
+	if !ctl.Paused() {
+		t.Errorf("expected the admin pause to be kept")
+	}
 }
 
 // The following were some quick benchmarks to help decide if we should TrimSpace or not.  = We should TrimSpace.
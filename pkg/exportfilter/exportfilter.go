@@ -0,0 +1,100 @@
+// Package exportfilter filters which records are exported, and projects which fields are exported, per sink
+//
+// Each sink (the gRPC stream, NSQ, and UDP) has an optional filter expression (see Filter), so only the
+// "interesting" sockets are exported, e.g. "rtt > 50ms or total_retrans > 0", and an optional list of fields
+// (see Projection), so only the fields needed are exported, e.g. "hostname,epoch_time,socket_i_d,rtt".
+//
+// The -filter and -fields flags apply to all the sinks, and the per sink flags (e.g. -filterUDP) override them.
+package exportfilter
+
+import (
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// The sinks
+const (
+	Stream = iota
+	NSQ
+	UDP
+	SinkCount
+)
+
+// SinkNames are the names of the sinks, which are the Prometheus sink label
+var SinkNames = [SinkCount]string{"stream", "nsq", "udp"}
+
+// Sink is the filter and projection of one sink.  Either can be nil, which exports everything.
+type Sink struct {
+	Filter     *Filter
+	Projection *Projection
+}
+
+// Sinks are the filters and projections of all the sinks.  A nil Sinks exports everything.
+type Sinks [SinkCount]Sink
+
+// NewSinks compiles the filters and projections from the cli flags
+// It returns nil if there are no filters or projections
+func NewSinks(cliFlags cliflags.CliFlags) (*Sinks, error) {
+
+	filters := [SinkCount]string{*cliFlags.FilterStream, *cliFlags.FilterNSQ, *cliFlags.FilterUDP}
+	fields := [SinkCount]string{*cliFlags.FieldsStream, *cliFlags.FieldsNSQ, *cliFlags.FieldsUDP}
+
+	var sinks Sinks
+	configured := false
+	for i := range sinks {
+		filter := filters[i]
+		if filter == "" {
+			filter = *cliFlags.Filter
+		}
+		if filter != "" {
+			f, err := Compile(filter)
+			if err != nil {
+				return nil, err
+			}
+			sinks[i].Filter = f
+			configured = true
+		}
+
+		field := fields[i]
+		if field == "" {
+			field = *cliFlags.Fields
+		}
+		if field != "" {
+			p, err := NewProjection(field)
+			if err != nil {
+				return nil, err
+			}
+			sinks[i].Projection = p
+			configured = true
+		}
+	}
+	if !configured {
+		return nil, nil
+	}
+	return &sinks, nil
+}
+
+// Apply returns the record to export to the sink, or false if the filter drops it
+// If there is a projection, the record is a projected copy, otherwise it's the same record
+func (s *Sinks) Apply(sink int, record *xtcppb.XtcpRecord) (*xtcppb.XtcpRecord, bool) {
+	if !s.Match(sink, record) {
+		return nil, false
+	}
+	return s.Project(sink, record), true
+}
+
+// Match returns if the sink's filter matches the record, which is true if the sink has no filter
+// The inetdiagers match the decoded record, before it's anonymized, and then Project the anonymized record, so the
+// filters see the real addresses and ports
+func (s *Sinks) Match(sink int, record *xtcppb.XtcpRecord) bool {
+	return s == nil || s[sink].Filter == nil || s[sink].Filter.Match(record)
+}
+
+// Project returns the record to export to the sink, which is a projected copy if there is a projection, otherwise
+// it's the same record
+func (s *Sinks) Project(sink int, record *xtcppb.XtcpRecord) *xtcppb.XtcpRecord {
+	if s == nil {
+		return record
+	}
+	return s[sink].Projection.Project(record)
+}
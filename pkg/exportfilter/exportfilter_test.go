@@ -0,0 +1,213 @@
+package exportfilter_test
+
+import (
+	"flag"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+func record(rtt, totalRetrans uint32, destination string) *xtcppb.XtcpRecord {
+	hostname := "host1"
+	family, state := uint32(2), uint32(1)
+	congestion := xtcppb.XtcpRecord_BBR1
+	sourcePort, destinationPort := uint32(443), uint32(51234)
+	return &xtcppb.XtcpRecord{
+		Hostname:                &hostname,
+		CongestionAlgorithmEnum: &congestion,
+		InetDiagMsg: &xtcppb.InetDiagMsg{
+			Family: &family,
+			State:  &state,
+			SocketID: &xtcppb.SocketID{
+				SourcePort:      &sourcePort,
+				DestinationPort: &destinationPort,
+				Source:          net.ParseIP("192.0.2.1").To4(),
+				Destination:     net.ParseIP(destination).To4(),
+			},
+		},
+		TcpInfo: &xtcppb.TcpInfo{Rtt: &rtt, TotalRetrans: &totalRetrans},
+		Tags:    []*xtcppb.KeyValue{{Key: proto.String("dc"), Value: proto.String("lhr1")}},
+	}
+}
+
+func TestCompile(t *testing.T) {
+
+	slow := record(80000, 0, "198.51.100.7")
+	retrans := record(1000, 3, "203.0.113.9")
+	fast := record(1000, 0, "198.51.100.8")
+	noTCPInfo := record(0, 0, "198.51.100.9")
+	noTCPInfo.TcpInfo = nil
+
+	var tests = []struct {
+		name       string
+		expression string
+		expected   [4]bool // slow, retrans, fast, noTCPInfo
+	}{
+		{"duration", "rtt > 50ms", [4]bool{true, false, false, false}},
+		{"or", "rtt > 50ms or total_retrans > 0", [4]bool{true, true, false, false}},
+		{"symbols", "tcp_info.rtt >= 50000 || tcp_info.total_retrans != 0", [4]bool{true, true, false, false}},
+		{"and", "rtt < 2ms and total_retrans == 0", [4]bool{false, false, true, true}},
+		{"not and parentheses", "not (rtt > 50ms or total_retrans > 0)", [4]bool{false, false, true, true}},
+		{"precedence", "total_retrans > 0 or rtt > 50ms and rtt < 60ms", [4]bool{false, true, false, false}},
+		{"bang", "!(total_retrans > 0)", [4]bool{true, false, true, true}},
+		{"unset is zero", "rtt == 0", [4]bool{false, false, false, true}},
+		{"prefix", "destination in 198.51.100.0/24", [4]bool{true, false, true, true}},
+		{"address", "destination == 203.0.113.9", [4]bool{false, true, false, false}},
+		{"ipv6 prefix", "destination in 2001:db8::/32", [4]bool{false, false, false, false}},
+		{"string", `hostname == "host1"`, [4]bool{true, true, true, true}},
+		{"unquoted string", "hostname != host1", [4]bool{false, false, false, false}},
+		{"enum", "congestion_algorithm_enum == bbr1", [4]bool{true, true, true, true}},
+		{"enum number", "congestion_algorithm_enum != 2", [4]bool{false, false, false, false}},
+		{"full name of ambiguous field", "inet_diag_msg.state == 1 AND tcp_info.state == 0", [4]bool{true, true, true, true}},
+		{"float", "rtt > 79999.5", [4]bool{true, false, false, false}},
+		{"negative", "total_retrans > -1", [4]bool{true, true, true, true}},
+	}
+
+	records := [4]*xtcppb.XtcpRecord{slow, retrans, fast, noTCPInfo}
+	for i, test := range tests {
+		filter, err := exportfilter.Compile(test.expression)
+		if err != nil {
+			t.Errorf("test:%d %s\texpected:no error\tresult:%s", i, test.name, err)
+			continue
+		}
+		var result [4]bool
+		for j, r := range records {
+			result[j] = filter.Match(r)
+		}
+		if result != test.expected {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expected, result)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+
+	var tests = []struct {
+		name       string
+		expression string
+		expected   string
+	}{
+		{"empty", "", "expected a field"},
+		{"unknown field", "nope > 1", "unknown field"},
+		{"ambiguous field", "state == 1", "ambiguous field"},
+		{"missing value", "rtt >", "expected a value"},
+		{"missing operator", "rtt", "expected an operator"},
+		{"bad operator", "rtt = 1", "unexpected"},
+		{"bad number", "rtt > fast", "invalid number"},
+		{"unterminated string", `hostname == "host1`, "unterminated string"},
+		{"unbalanced", "(rtt > 1", "expected )"},
+		{"trailing", "rtt > 1 rtt", "unexpected"},
+		{"message", "tcp_info == 1", "can't be compared"},
+		{"repeated", `tags == "dc"`, "can't be compared"},
+		{"repeated field", `tags.key == "dc"`, "unknown field"},
+		{"in number", "rtt in 10.0.0.0/8", "isn't an address"},
+		{"bad prefix", "destination in 10.0.0.0/33", "invalid prefix"},
+		{"bad address", "destination == host", "invalid address"},
+		{"string less than", "hostname < a", "can only use"},
+		{"unknown enum", "congestion_algorithm_enum == reno", "unknown enum"},
+	}
+
+	for i, test := range tests {
+		_, err := exportfilter.Compile(test.expression)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%v", i, test.name, test.expected, err)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		fields   string
+		expected string
+	}{
+		{"leaf", "hostname,rtt", `hostname:"host1" tcp_info:{rtt:80000}`},
+		{"message", "socket_i_d", `inet_diag_msg:{socket_i_d:{source_port:443 destination_port:51234 source:"\xc0\x00\x02\x01" destination:"\xc63d\x07"}}`},
+		{"nested", "inet_diag_msg.socket_i_d.destination_port, total_retrans", `inet_diag_msg:{socket_i_d:{destination_port:51234}} tcp_info:{total_retrans:0}`},
+		{"repeated", "hostname,tags", `hostname:"host1" tags:{key:"dc" value:"lhr1"}`},
+	}
+
+	for i, test := range tests {
+		original := record(80000, 0, "198.51.100.7")
+		before := proto.Clone(original)
+
+		p, err := exportfilter.NewProjection(test.fields)
+		if err != nil {
+			t.Fatalf("test:%d %s\tNewProjection error:%s", i, test.name, err)
+		}
+		result := p.Project(original)
+
+		expected := &xtcppb.XtcpRecord{}
+		if err := prototext.Unmarshal([]byte(test.expected), expected); err != nil {
+			t.Fatalf("test:%d %s\tprototext.Unmarshal error:%s", i, test.name, err)
+		}
+		if !proto.Equal(result, expected) {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, expected, result)
+		}
+		// the other sinks still need the whole record
+		if !proto.Equal(original, before) {
+			t.Errorf("test:%d %s\texpected:original unchanged\tresult:%v", i, test.name, original)
+		}
+	}
+
+	for i, fields := range []string{"", " , ", "nope", "state", "tags.key"} {
+		if _, err := exportfilter.NewProjection(fields); err == nil {
+			t.Errorf("test:%d %q\texpected:error\tresult:nil", i, fields)
+		}
+	}
+}
+
+func TestSinks(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-filter", "total_retrans > 0", "-filterUDP", "rtt > 50ms", "-fieldsNSQ", "rtt"}); err != nil {
+		t.Fatal(err)
+	}
+	sinks, err := exportfilter.NewSinks(cliFlags)
+	if err != nil {
+		t.Fatalf("NewSinks error:%s", err)
+	}
+
+	slow := record(80000, 0, "198.51.100.7")
+	retrans := record(1000, 3, "203.0.113.9")
+
+	var tests = []struct {
+		name       string
+		sink       int
+		record     *xtcppb.XtcpRecord
+		expected   bool
+		sameRecord bool
+	}{
+		{"stream default filter drops", exportfilter.Stream, slow, false, false},
+		{"stream default filter matches", exportfilter.Stream, retrans, true, true},
+		{"udp filter matches", exportfilter.UDP, slow, true, true},
+		{"udp filter drops", exportfilter.UDP, retrans, false, false},
+		{"nsq projection", exportfilter.NSQ, retrans, true, false},
+	}
+
+	for i, test := range tests {
+		result, ok := sinks.Apply(test.sink, test.record)
+		if ok != test.expected || (result == test.record) != test.sameRecord {
+			t.Errorf("test:%d %s\texpected:%t same:%t\tresult:%t same:%t", i, test.name, test.expected, test.sameRecord, ok, result == test.record)
+		}
+	}
+
+	var none *exportfilter.Sinks
+	if result, ok := none.Apply(exportfilter.UDP, slow); !ok || result != slow {
+		t.Errorf("nil sinks\texpected:the record\tresult:%v %t", result, ok)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags = config.Register(fs)
+	if sinks, err := exportfilter.NewSinks(cliFlags); sinks != nil || err != nil {
+		t.Errorf("no flags\texpected:nil sinks\tresult:%v %v", sinks, err)
+	}
+}
@@ -0,0 +1,404 @@
+package exportfilter
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Filter is a compiled filter expression
+//
+// The grammar is:
+//
+//	expression = and { ("or" | "||") and }
+//	and        = unary { ("and" | "&&") unary }
+//	unary      = ("not" | "!") unary | "(" expression ")" | comparison
+//	comparison = field ("==" | "!=" | "<" | "<=" | ">" | ">=") value | field "in" prefix
+//
+// The fields are the XtcpRecord protobuf field names, either the full dotted name (e.g. tcp_info.rtt),
+// or just the last part of the name, if that's unique (e.g. rtt).
+//
+// The values depend on the field:
+// - numbers, e.g. total_retrans > 0.  Durations are converted to microseconds, which is the unit of the
+// ..tcp_info rtt, rtt_var, min_rtt, rto, and ato, e.g. rtt > 50ms is rtt > 50000.  (The tcp_info last_* are milliseconds)
+// - strings, quoted or not, e.g. hostname == "host1"
+// - enum names or numbers, e.g. congestion_algorithm_enum == BBR1
+// - addresses, e.g. destination == 192.0.2.1, or destination in 192.0.2.0/24
+//
+// Fields which aren't set are the zero value, so rtt > 50ms is false for a socket without tcp_info
+type Filter struct {
+	expression string
+	root       node
+}
+
+// node is the parsed expression tree
+type node interface {
+	eval(m protoreflect.Message) bool
+}
+
+type orNode struct{ left, right node }
+type andNode struct{ left, right node }
+type notNode struct{ node node }
+
+func (n orNode) eval(m protoreflect.Message) bool  { return n.left.eval(m) || n.right.eval(m) }
+func (n andNode) eval(m protoreflect.Message) bool { return n.left.eval(m) && n.right.eval(m) }
+func (n notNode) eval(m protoreflect.Message) bool { return !n.node.eval(m) }
+
+type operator int
+
+const (
+	opEQ operator = iota
+	opNE
+	opLT
+	opLE
+	opGT
+	opGE
+	opIn
+)
+
+var operators = map[string]operator{
+	"==": opEQ,
+	"!=": opNE,
+	"<":  opLT,
+	"<=": opLE,
+	">":  opGT,
+	">=": opGE,
+	"in": opIn,
+}
+
+// comparison compares a field with the value, which is converted to the field type when the filter is compiled
+type comparison struct {
+	field   *field
+	op      operator
+	integer bool   // the value is a non-negative integer, so unsigned fields are compared exactly
+	uint    uint64 // numbers
+	number  float64
+	text    string                  // strings
+	enum    protoreflect.EnumNumber // enums
+	ip      net.IP                  // addresses
+	ipNet   *net.IPNet
+}
+
+// Compile parses the filter expression
+func Compile(expression string) (*Filter, error) {
+
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, fmt.Errorf("filter:%q %w", expression, err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.expression()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected:%q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter:%q %w", expression, err)
+	}
+	return &Filter{expression: expression, root: root}, nil
+}
+
+// String returns the filter expression
+func (f *Filter) String() string {
+	return f.expression
+}
+
+// Match returns true if the record matches the filter
+func (f *Filter) Match(record *xtcppb.XtcpRecord) bool {
+	return f.root.eval(record.ProtoReflect())
+}
+
+//-----------------------------------------------------------------------------
+// lexer
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// lex splits the expression into the tokens, which are the parentheses, the operators, quoted strings,
+// and words, which are everything else up to a space, a parenthesis, or an operator
+// (so addresses like 2001:db8::/32 and durations like 1.5ms are single words)
+func lex(expression string) ([]token, error) {
+
+	var tokens []token
+	for i := 0; i < len(expression); {
+		c := expression[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '"':
+			end := strings.IndexByte(expression[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at:%d", i)
+			}
+			tokens = append(tokens, token{text: expression[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.HasPrefix(expression[i:], "&&") || strings.HasPrefix(expression[i:], "||") ||
+			strings.HasPrefix(expression[i:], "==") || strings.HasPrefix(expression[i:], "!=") ||
+			strings.HasPrefix(expression[i:], "<=") || strings.HasPrefix(expression[i:], ">="):
+			tokens = append(tokens, token{text: expression[i : i+2]})
+			i += 2
+		case c == '<' || c == '>' || c == '!':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '&' || c == '|' || c == '=':
+			return nil, fmt.Errorf("unexpected:%q at:%d", c, i)
+		default:
+			start := i
+			for i < len(expression) && !unicode.IsSpace(rune(expression[i])) && !strings.ContainsRune(`()"&|=<>!`, rune(expression[i])) {
+				i++
+			}
+			tokens = append(tokens, token{text: expression[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+//-----------------------------------------------------------------------------
+// parser
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// accept consumes the next token, if it is one of the (unquoted, case insensitive) keywords
+func (p *parser) accept(keywords ...string) bool {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return false
+	}
+	for _, keyword := range keywords {
+		if strings.EqualFold(p.tokens[p.pos].text, keyword) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) next(what string) (token, error) {
+	if p.pos >= len(p.tokens) {
+		return token{}, fmt.Errorf("expected %s, at the end", what)
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *parser) expression() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or", "||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and", "&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("not", "!") {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	if p.accept("(") {
+		n, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected )")
+		}
+		return n, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+
+	name, err := p.next("a field")
+	if err != nil {
+		return nil, err
+	}
+	f, err := resolve(name.text)
+	if err != nil {
+		return nil, err
+	}
+	opToken, err := p.next("an operator")
+	if err != nil {
+		return nil, err
+	}
+	op, ok := operators[strings.ToLower(opToken.text)]
+	if !ok || opToken.quoted {
+		return nil, fmt.Errorf("expected an operator after:%s, got:%q", f.name, opToken.text)
+	}
+	value, err := p.next("a value")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &comparison{field: f, op: op}
+	if err := c.setValue(value.text); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setValue converts the value to the field type
+func (c *comparison) setValue(value string) error {
+
+	fd := c.field.leaf()
+	kind := fd.Kind()
+
+	if fd.IsList() || kind == protoreflect.MessageKind || kind == protoreflect.GroupKind {
+		return fmt.Errorf("field:%s can't be compared", c.field.name)
+	}
+	if c.op == opIn && kind != protoreflect.BytesKind {
+		return fmt.Errorf("field:%s isn't an address, so can't use in", c.field.name)
+	}
+
+	switch kind {
+	case protoreflect.StringKind:
+		if c.op != opEQ && c.op != opNE {
+			return fmt.Errorf("field:%s is a string, so can only use == or !=", c.field.name)
+		}
+		c.text = value
+
+	case protoreflect.EnumKind:
+		if c.op != opEQ && c.op != opNE {
+			return fmt.Errorf("field:%s is an enum, so can only use == or !=", c.field.name)
+		}
+		if v := fd.Enum().Values().ByName(protoreflect.Name(strings.ToUpper(value))); v != nil {
+			c.enum = v.Number()
+			return nil
+		}
+		number, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("field:%s unknown enum value:%q", c.field.name, value)
+		}
+		c.enum = protoreflect.EnumNumber(number)
+
+	case protoreflect.BytesKind:
+		if c.op == opIn {
+			ip, ipNet, err := net.ParseCIDR(value)
+			if err != nil {
+				return fmt.Errorf("field:%s invalid prefix:%q", c.field.name, value)
+			}
+			if v4 := ip.To4(); v4 != nil {
+				ipNet.IP = ipNet.IP.To4()
+			}
+			c.ipNet = ipNet
+			return nil
+		}
+		if c.op != opEQ && c.op != opNE {
+			return fmt.Errorf("field:%s is an address, so can only use ==, !=, or in", c.field.name)
+		}
+		c.ip = net.ParseIP(value)
+		if c.ip == nil {
+			return fmt.Errorf("field:%s invalid address:%q", c.field.name, value)
+		}
+
+	case protoreflect.BoolKind:
+		return fmt.Errorf("field:%s bool isn't supported", c.field.name)
+
+	default:
+		return c.setNumber(value)
+	}
+	return nil
+}
+
+// setNumber parses the number, or the duration, which is converted to microseconds
+func (c *comparison) setNumber(value string) error {
+
+	if u, err := strconv.ParseUint(value, 10, 64); err == nil {
+		c.integer, c.uint, c.number = true, u, float64(u)
+		return nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		c.number = f
+	} else if d, err := time.ParseDuration(value); err == nil {
+		c.number = float64(d) / float64(time.Microsecond)
+	} else {
+		return fmt.Errorf("field:%s invalid number or duration:%q", c.field.name, value)
+	}
+	if c.number >= 0 && c.number == math.Trunc(c.number) && c.number < math.MaxUint64 {
+		c.integer, c.uint = true, uint64(c.number)
+	}
+	return nil
+}
+
+func (c *comparison) eval(m protoreflect.Message) bool {
+
+	v := c.field.value(m)
+
+	switch c.field.leaf().Kind() {
+	case protoreflect.StringKind:
+		return (v.String() == c.text) == (c.op == opEQ)
+	case protoreflect.EnumKind:
+		return (v.Enum() == c.enum) == (c.op == opEQ)
+	case protoreflect.BytesKind:
+		ip := net.IP(v.Bytes())
+		if c.op == opIn {
+			return len(ip) > 0 && c.ipNet.Contains(ip)
+		}
+		return ip.Equal(c.ip) == (c.op == opEQ)
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		if c.integer {
+			return compare(c.op, v.Uint(), c.uint)
+		}
+		return compare(c.op, float64(v.Uint()), c.number)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return compare(c.op, v.Float(), c.number)
+	}
+	return compare(c.op, float64(v.Int()), c.number)
+}
+
+func compare[T cmp.Ordered](op operator, a, b T) bool {
+	switch op {
+	case opEQ:
+		return a == b
+	case opNE:
+		return a != b
+	case opLT:
+		return a < b
+	case opLE:
+		return a <= b
+	case opGT:
+		return a > b
+	case opGE:
+		return a >= b
+	}
+	return false
+}
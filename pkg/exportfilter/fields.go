@@ -0,0 +1,164 @@
+package exportfilter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// field is a resolved XtcpRecord field, which is the path of field descriptors from the record
+// e.g. tcp_info.rtt is [tcp_info, rtt]
+type field struct {
+	name string
+	path []protoreflect.FieldDescriptor
+}
+
+// fieldIndex is all the XtcpRecord fields, by full dotted name, and by the last part of the name
+type fieldIndex struct {
+	byName map[string][]protoreflect.FieldDescriptor
+	byLeaf map[string][]string
+}
+
+var (
+	index     fieldIndex
+	indexOnce sync.Once
+)
+
+// fields returns the index of the XtcpRecord fields, which is built once from the protobuf descriptor
+func fields() *fieldIndex {
+	indexOnce.Do(func() {
+		index = fieldIndex{
+			byName: make(map[string][]protoreflect.FieldDescriptor),
+			byLeaf: make(map[string][]string),
+		}
+		index.add((&xtcppb.XtcpRecord{}).ProtoReflect().Descriptor(), "", nil)
+		for _, names := range index.byLeaf {
+			sort.Strings(names)
+		}
+	})
+	return &index
+}
+
+func (idx *fieldIndex) add(md protoreflect.MessageDescriptor, prefix string, parent []protoreflect.FieldDescriptor) {
+	fds := md.Fields()
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		name := prefix + string(fd.Name())
+		path := append(append([]protoreflect.FieldDescriptor{}, parent...), fd)
+		idx.byName[name] = path
+		idx.byLeaf[string(fd.Name())] = append(idx.byLeaf[string(fd.Name())], name)
+		// The repeated messages (e.g. tags) are only kept or dropped as a whole by the projections
+		if fd.Kind() == protoreflect.MessageKind && !fd.IsList() {
+			idx.add(fd.Message(), name+".", path)
+		}
+	}
+}
+
+// resolve finds the field by the full dotted name (e.g. tcp_info.rtt), or by the last part of the name,
+// if that's unique (e.g. rtt).  Ambiguous names (e.g. state is in inet_diag_msg and tcp_info) need the full name.
+func resolve(name string) (*field, error) {
+
+	idx := fields()
+
+	if path, ok := idx.byName[name]; ok {
+		return &field{name: name, path: path}, nil
+	}
+
+	names := idx.byLeaf[name]
+	switch len(names) {
+	case 0:
+		return nil, fmt.Errorf("unknown field:%q", name)
+	case 1:
+		return &field{name: names[0], path: idx.byName[names[0]]}, nil
+	}
+	return nil, fmt.Errorf("ambiguous field:%q, use one of:%s", name, strings.Join(names, ","))
+}
+
+// leaf is the descriptor of the last field in the path
+func (f *field) leaf() protoreflect.FieldDescriptor {
+	return f.path[len(f.path)-1]
+}
+
+// value returns the field value of the record.  Fields which aren't set, including the fields
+// of sub-messages which aren't set (e.g. tcp_info without INET_DIAG_INFO), are the default (zero) value.
+func (f *field) value(m protoreflect.Message) protoreflect.Value {
+	for _, fd := range f.path[:len(f.path)-1] {
+		if !m.Has(fd) {
+			return f.leaf().Default()
+		}
+		m = m.Get(fd).Message()
+	}
+	return m.Get(f.leaf())
+}
+
+// Field is an XtcpRecord field, resolved by name the same way as the filter fields,
+// for the other packages which look up the record fields by name
+type Field struct {
+	field *field
+}
+
+// ResolveField resolves the field by the full dotted name (e.g. tcp_info.rtt), or the unique last part (e.g. rtt)
+func ResolveField(name string) (*Field, error) {
+	f, err := resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fd := f.leaf(); fd.IsList() || fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		return nil, fmt.Errorf("field:%s is a message", f.name)
+	}
+	return &Field{field: f}, nil
+}
+
+// Name is the full dotted name, e.g. tcp_info.rtt
+func (f *Field) Name() string {
+	return f.field.name
+}
+
+// IsAddress is true for the bytes fields, which are the addresses
+func (f *Field) IsAddress() bool {
+	return f.field.leaf().Kind() == protoreflect.BytesKind
+}
+
+// Number returns the numeric value of the field, which is zero for strings and addresses
+func (f *Field) Number(record *xtcppb.XtcpRecord) float64 {
+	v := f.field.value(record.ProtoReflect())
+	switch f.field.leaf().Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.BoolKind:
+		return 0
+	case protoreflect.EnumKind:
+		return float64(v.Enum())
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	}
+	return float64(v.Int())
+}
+
+// Bytes returns the value of an address field
+func (f *Field) Bytes(record *xtcppb.XtcpRecord) []byte {
+	if !f.IsAddress() {
+		return nil
+	}
+	return f.field.value(record.ProtoReflect()).Bytes()
+}
+
+// String formats the value of the field, with the enum names, and the addresses as IPs
+func (f *Field) String(record *xtcppb.XtcpRecord) string {
+	fd := f.field.leaf()
+	v := f.field.value(record.ProtoReflect())
+	switch fd.Kind() {
+	case protoreflect.BytesKind:
+		return net.IP(v.Bytes()).String()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+	}
+	return v.String()
+}
@@ -0,0 +1,77 @@
+package exportfilter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Projection is the list of the fields to export, and all the other fields are cleared
+//
+// The fields are named the same way as the Filter fields, e.g. tcp_info.rtt or rtt.  Listing a message field
+// (e.g. tcp_info) keeps the whole message, and listing fields inside a message (e.g. rtt) keeps the message
+// with just those fields.
+type Projection struct {
+	keep    map[string]bool // the fields to keep, including all their fields
+	parents map[string]bool // the messages with fields to keep
+}
+
+// NewProjection parses the comma separated list of fields
+func NewProjection(fields string) (*Projection, error) {
+
+	p := &Projection{
+		keep:    make(map[string]bool),
+		parents: make(map[string]bool),
+	}
+	for _, name := range strings.Split(fields, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, err := resolve(name)
+		if err != nil {
+			return nil, fmt.Errorf("fields:%q %w", fields, err)
+		}
+		p.keep[f.name] = true
+		for i := strings.LastIndexByte(f.name, '.'); i > 0; i = strings.LastIndexByte(f.name[:i], '.') {
+			p.parents[f.name[:i]] = true
+		}
+	}
+	if len(p.keep) == 0 {
+		return nil, fmt.Errorf("fields:%q no fields", fields)
+	}
+	return p, nil
+}
+
+// Project returns a copy of the record, with only the projected fields
+// The record is copied, because the same record is exported to the other sinks.  A nil Projection returns the record.
+func (p *Projection) Project(record *xtcppb.XtcpRecord) *xtcppb.XtcpRecord {
+	if p == nil {
+		return record
+	}
+	projected := proto.Clone(record).(*xtcppb.XtcpRecord)
+	p.prune(projected.ProtoReflect(), "")
+	return projected
+}
+
+func (p *Projection) prune(m protoreflect.Message, prefix string) {
+
+	var cleared []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		name := prefix + string(fd.Name())
+		switch {
+		case p.keep[name]:
+		case p.parents[name]:
+			p.prune(v.Message(), name+".")
+		default:
+			cleared = append(cleared, fd)
+		}
+		return true
+	})
+	for _, fd := range cleared {
+		m.Clear(fd)
+	}
+}
@@ -0,0 +1,179 @@
+package fakenetlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"golang.org/x/sys/unix"
+)
+
+// The inet_diag bytecode filter of the dump request, which is checked and run like the kernel does
+// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/net/ipv4/inet_diag.c
+
+// inetDiagReqV2Len is the nlmsghdr and the inet_diag_req_v2, which the attributes follow
+const inetDiagReqV2Len = 72
+
+// requestBytecode returns the INET_DIAG_REQ_BYTECODE attribute of the dump request, or nil
+func requestBytecode(request []byte) []byte {
+	length := int(binary.LittleEndian.Uint32(request[0:4]))
+	if length > len(request) {
+		length = len(request)
+	}
+	for offset := inetDiagReqV2Len; offset+4 <= length; {
+		nlaLen := int(binary.LittleEndian.Uint16(request[offset:]))
+		nlaType := binary.LittleEndian.Uint16(request[offset+2:])
+		if nlaLen < 4 || offset+nlaLen > length {
+			return nil
+		}
+		if nlaType == xtcpnl.INET_DIAG_REQ_BYTECODE {
+			return request[offset+4 : offset+nlaLen]
+		}
+		offset += align(nlaLen)
+	}
+	return nil
+}
+
+// audit is inet_diag_bc_audit, which is why the kernel replies EINVAL to bad bytecode
+func audit(bc []byte) bool {
+	if len(bc) < 4 {
+		return false
+	}
+	offset, remaining := 0, len(bc)
+	for remaining > 0 {
+		if remaining < 4 {
+			return false
+		}
+		code, yes, no := bc[offset], int(bc[offset+1]), int(binary.LittleEndian.Uint16(bc[offset+2:]))
+		minLen := 4
+		switch code {
+		case xtcpnl.INET_DIAG_BC_S_COND, xtcpnl.INET_DIAG_BC_D_COND:
+			// valid_hostcond
+			if remaining < minLen+8 {
+				return false
+			}
+			var addrLen int
+			switch bc[offset+4] {
+			case unix.AF_UNSPEC:
+			case unix.AF_INET:
+				addrLen = net.IPv4len
+			case unix.AF_INET6:
+				addrLen = net.IPv6len
+			default:
+				return false
+			}
+			minLen += 8 + addrLen
+			if remaining < minLen || int(bc[offset+5]) > 8*addrLen {
+				return false
+			}
+		case xtcpnl.INET_DIAG_BC_S_GE, xtcpnl.INET_DIAG_BC_S_LE, xtcpnl.INET_DIAG_BC_D_GE, xtcpnl.INET_DIAG_BC_D_LE:
+			// valid_port_comparison
+			minLen += 4
+			if remaining < minLen {
+				return false
+			}
+		case xtcpnl.INET_DIAG_BC_NOP, xtcpnl.INET_DIAG_BC_JMP:
+		default:
+			return false
+		}
+		if code != xtcpnl.INET_DIAG_BC_NOP {
+			if no < minLen || no > remaining+4 || no&3 != 0 {
+				return false
+			}
+			if no < remaining && !validCC(bc, remaining-no) {
+				return false
+			}
+		}
+		if yes < minLen || yes > remaining+4 || yes&3 != 0 {
+			return false
+		}
+		offset += yes
+		remaining -= yes
+	}
+	return remaining == 0
+}
+
+// validCC is valid_cc, which checks the jump lands on an op, cc bytes from the end
+func validCC(bc []byte, cc int) bool {
+	offset, remaining := 0, len(bc)
+	for remaining >= 0 {
+		if cc > remaining {
+			return false
+		}
+		if cc == remaining {
+			return true
+		}
+		yes := int(bc[offset+1])
+		if yes < 4 || yes&3 != 0 {
+			return false
+		}
+		offset += yes
+		remaining -= yes
+	}
+	return false
+}
+
+// run is inet_diag_bc_run, and returns true if the socket is dumped
+func run(bc []byte, af uint8, sourcePort uint16, destinationPort uint16, source net.IP, destination net.IP) bool {
+	offset, remaining := 0, len(bc)
+	for remaining > 0 {
+		code, yes, no := bc[offset], int(bc[offset+1]), int(binary.LittleEndian.Uint16(bc[offset+2:]))
+		match := true
+		switch code {
+		case xtcpnl.INET_DIAG_BC_JMP:
+			match = false
+		case xtcpnl.INET_DIAG_BC_S_GE:
+			match = sourcePort >= binary.LittleEndian.Uint16(bc[offset+6:])
+		case xtcpnl.INET_DIAG_BC_S_LE:
+			match = sourcePort <= binary.LittleEndian.Uint16(bc[offset+6:])
+		case xtcpnl.INET_DIAG_BC_D_GE:
+			match = destinationPort >= binary.LittleEndian.Uint16(bc[offset+6:])
+		case xtcpnl.INET_DIAG_BC_D_LE:
+			match = destinationPort <= binary.LittleEndian.Uint16(bc[offset+6:])
+		case xtcpnl.INET_DIAG_BC_S_COND, xtcpnl.INET_DIAG_BC_D_COND:
+			port, addr := sourcePort, source
+			if code == xtcpnl.INET_DIAG_BC_D_COND {
+				port, addr = destinationPort, destination
+			}
+			family, prefixLen := bc[offset+4], int(bc[offset+5])
+			condPort := int32(binary.LittleEndian.Uint32(bc[offset+8:]))
+			condAddr := bc[offset+12:]
+			switch {
+			case condPort != -1 && condPort != int32(port):
+				match = false
+			case family != unix.AF_UNSPEC && family != af:
+				// The IPv4 conditions match the IPv4-mapped IPv6 addresses
+				match = af == unix.AF_INET6 && family == unix.AF_INET && bytes.HasPrefix(addr, v4MappedPrefix) && bitstringMatch(addr[12:], condAddr, prefixLen)
+			case prefixLen > 0:
+				match = bitstringMatch(addr, condAddr, prefixLen)
+			}
+		}
+		if match {
+			offset += yes
+			remaining -= yes
+		} else {
+			offset += no
+			remaining -= no
+		}
+	}
+	return remaining == 0
+}
+
+var v4MappedPrefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// bitstringMatch is true if the first bits of a and b are the same
+func bitstringMatch(a []byte, b []byte, bits int) bool {
+	if len(a)*8 < bits || len(b)*8 < bits {
+		return false
+	}
+	whole, rest := bits/8, bits%8
+	if !bytes.Equal(a[:whole], b[:whole]) {
+		return false
+	}
+	if rest == 0 {
+		return true
+	}
+	mask := byte(0xFF) << (8 - rest)
+	return a[whole]&mask == b[whole]&mask
+}
@@ -0,0 +1,341 @@
+// Package fakenetlink is an in memory kernel netlink endpoint, which replies to the inet_diag dump requests
+// with realistic multi-part SOCK_DIAG_BY_FAMILY responses, so the whole poller to netlinker to inetdiager
+// pipeline can be tested with "go test", and without any privileges.
+//
+// The responses are built like the kernel builds them:
+// - nlmsghdr + inet_diag_msg + the netlink attributes, for each socket
+// - MessagesPerPacket messages per packet, each message flagged NLM_F_MULTI
+// - a final packet with the NLMSG_DONE
+//
+// The Config also allows the unhappy cases, which are hard to trigger on a real kernel:
+// - Errno replies NLMSG_ERROR to the request, rather than the dump
+// - DumpIntr flags the messages NLM_F_DUMP_INTR, like the kernel does if the sockets change during the dump
+// - TimeoutAfter stops the dump after that many packets, without the NLMSG_DONE, like the kernel not responding
+//
+// The dump request's inet_diag bytecode filter (INET_DIAG_REQ_BYTECODE) is checked and run like the kernel does,
+// so only the matching sockets are dumped, and bad bytecode is replied NLMSG_ERROR EINVAL.  The request's
+// idiag_states is also honoured, so the established Sockets are only dumped for TCP_ESTABLISHED, and the
+// Listening sockets only for TCP_LISTEN.
+//
+// Each socket is deterministic, so the tests can check the records, see Socket.
+package fakenetlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sockDiagByFamily is SOCK_DIAG_BY_FAMILY in uapi/linux/sock_diag.h
+	sockDiagByFamily = 20
+	// tcpEstablished is TCP_ESTABLISHED in include/net/tcp_states.h
+	tcpEstablished = 1
+	// tcpListen is TCP_LISTEN in include/net/tcp_states.h
+	tcpListen = 10
+)
+
+// DefaultAttributes are the attributes the kernel sends for the xtcp dump request
+var DefaultAttributes = []uint16{inetdiag.INET_DIAG_MEMINFO, inetdiag.INET_DIAG_INFO, inetdiag.INET_DIAG_CONG, inetdiag.INET_DIAG_TOS, inetdiag.INET_DIAG_SKMEMINFO, inetdiag.INET_DIAG_SHUTDOWN}
+
+// Config is the sockets, and the behaviour, of the fake kernel
+type Config struct {
+	Sockets           int      // sockets in each dump, per address family
+	MessagesPerPacket int      // messages in each packet.  Zero (0) is 10
+	Attributes        []uint16 // attributes for each socket.  nil is DefaultAttributes
+	Congestion        string   // INET_DIAG_CONG.  Empty is "cubic"
+	Errno             syscall.Errno
+	DumpIntr          bool
+	TimeoutAfter      int           // stop the dump after this many packets, without the NLMSG_DONE.  Zero (0) is never
+	Delay             time.Duration // delay before each packet, e.g. to simulate a busy kernel
+	Listening         []Listener    // LISTEN sockets, which are dumped after the established Sockets
+}
+
+// Listener is a LISTEN socket of the fake kernel.  Like the kernel, it's dumped without any attributes, and with
+// the unspecified source and destination addresses.
+type Listener struct {
+	Af    uint8 // unix.AF_INET or unix.AF_INET6
+	Port  uint16
+	Inode uint32
+	UID   uint32
+}
+
+// Fake is the fake kernel.  Each Open is a new netlink socket, like xtcpnl.OpenSocketTransport, so the pollers
+// for each address family have their own
+type Fake struct {
+	config   Config
+	requests int64
+}
+
+// New creates the fake kernel
+func New(config Config) *Fake {
+	if config.MessagesPerPacket == 0 {
+		config.MessagesPerPacket = 10
+	}
+	if config.Attributes == nil {
+		config.Attributes = DefaultAttributes
+	}
+	if config.Congestion == "" {
+		config.Congestion = "cubic"
+	}
+	return &Fake{config: config}
+}
+
+// Open is the xtcpnl.OpenTransport for the fake
+func (f *Fake) Open(timeout int64) (xtcpnl.Transport, error) {
+	return &Transport{fake: f}, nil
+}
+
+// Requests is the number of dump requests received, by all the Transports
+func (f *Fake) Requests() int {
+	return int(atomic.LoadInt64(&f.requests))
+}
+
+// Transport is a single fake netlink socket
+type Transport struct {
+	fake    *Fake
+	mu      sync.Mutex
+	packets [][]byte
+	closed  bool
+}
+
+// Send receives the dump request, and queues the response packets
+func (t *Transport) Send(request []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return syscall.EBADF
+	}
+	if len(request) < unix.NLMSG_HDRLEN+2 {
+		return syscall.EINVAL
+	}
+	atomic.AddInt64(&t.fake.requests, 1)
+
+	var header inetdiag.NlMsgHdr
+	binary.Read(bytes.NewReader(request), binary.LittleEndian, &header)
+	af := request[unix.NLMSG_HDRLEN]
+	// The idiag_states follows the family, protocol, idiag_ext, and pad.  The short requests are all the states.
+	states := ^uint32(0)
+	if len(request) >= unix.NLMSG_HDRLEN+8 {
+		states = binary.LittleEndian.Uint32(request[unix.NLMSG_HDRLEN+4:])
+	}
+
+	t.packets = t.fake.response(header, af, states, requestBytecode(request))
+	return nil
+}
+
+// Recvfrom returns the next packet of the response, or syscall.EAGAIN (the socket timeout) if there are no more
+func (t *Transport) Recvfrom(packetBuffer []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return -1, syscall.EBADF
+	}
+	if len(t.packets) == 0 {
+		return -1, syscall.EAGAIN
+	}
+	if t.fake.config.Delay > 0 {
+		time.Sleep(t.fake.config.Delay)
+	}
+	packet := t.packets[0]
+	t.packets = t.packets[1:]
+	// Like a real datagram socket, if the packetBuffer is too small the rest of the packet is lost
+	return copy(packetBuffer, packet), nil
+}
+
+// Close closes the fake socket
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errors.New("already closed")
+	}
+	t.closed = true
+	return nil
+}
+
+// response builds the packets replying to the dump request, with only the sockets in the states, and matching the
+// bytecode (nil = all)
+func (f *Fake) response(request inetdiag.NlMsgHdr, af uint8, states uint32, bytecode []byte) [][]byte {
+
+	errno := f.config.Errno
+	if bytecode != nil && !audit(bytecode) {
+		errno = syscall.EINVAL
+	}
+	if errno != 0 {
+		// struct nlmsgerr { int error; struct nlmsghdr msg; }
+		body := make([]byte, 4+unix.NLMSG_HDRLEN)
+		binary.LittleEndian.PutUint32(body[0:], uint32(-int32(errno)))
+		binary.LittleEndian.PutUint32(body[4:], request.Length)
+		binary.LittleEndian.PutUint16(body[8:], request.Type)
+		binary.LittleEndian.PutUint16(body[10:], request.Flags)
+		binary.LittleEndian.PutUint32(body[12:], request.Sequence)
+		return [][]byte{message(unix.NLMSG_ERROR, 0, request.Sequence, body)}
+	}
+
+	var flags uint16 = unix.NLM_F_MULTI
+	if f.config.DumpIntr {
+		flags |= unix.NLM_F_DUMP_INTR
+	}
+
+	var packets [][]byte
+	var packet []byte
+	var messages int
+	add := func(body []byte) {
+		packet = append(packet, message(sockDiagByFamily, flags, request.Sequence, body)...)
+		messages++
+		if messages%f.config.MessagesPerPacket == 0 {
+			packets = append(packets, packet)
+			packet = nil
+		}
+	}
+	for i := 0; states&(1<<tcpEstablished) != 0 && i < f.config.Sockets; i++ {
+		if bytecode != nil {
+			source, destination, destinationPort, _, _, _ := Socket(af, i)
+			if !run(bytecode, af, 443, destinationPort, source, destination) {
+				continue
+			}
+		}
+		add(f.socket(af, i))
+	}
+	for _, listener := range f.config.Listening {
+		if states&(1<<tcpListen) == 0 || listener.Af != af {
+			continue
+		}
+		unspecified := net.IPv6zero
+		if af == unix.AF_INET {
+			unspecified = net.IPv4zero.To4()
+		}
+		if bytecode != nil && !run(bytecode, af, listener.Port, 0, unspecified, unspecified) {
+			continue
+		}
+		add(listening(listener))
+	}
+	if packet != nil {
+		packets = append(packets, packet)
+	}
+
+	if f.config.TimeoutAfter > 0 && len(packets) >= f.config.TimeoutAfter {
+		return packets[:f.config.TimeoutAfter]
+	}
+	// NLMSG_DONE has the int "len" of the dump, which is zero
+	return append(packets, message(unix.NLMSG_DONE, flags, request.Sequence, make([]byte, 4)))
+}
+
+// message is the nlmsghdr and the body, padded to NLMSG_ALIGNTO
+func message(msgType uint16, flags uint16, sequence uint32, body []byte) []byte {
+	m := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+align(len(body)))
+	binary.LittleEndian.PutUint32(m[0:], uint32(unix.NLMSG_HDRLEN+len(body)))
+	binary.LittleEndian.PutUint16(m[4:], msgType)
+	binary.LittleEndian.PutUint16(m[6:], flags)
+	binary.LittleEndian.PutUint32(m[8:], sequence)
+	m = append(m, body...)
+	return append(m, make([]byte, align(len(body))-len(body))...)
+}
+
+// attribute is the nlattr and the data, padded to NLA_ALIGNTO
+func attribute(attrType uint16, data []byte) []byte {
+	a := make([]byte, 4, 4+align(len(data)))
+	binary.LittleEndian.PutUint16(a[0:], uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(a[2:], attrType)
+	a = append(a, data...)
+	return append(a, make([]byte, align(len(data))-len(data))...)
+}
+
+// align rounds up to 4 bytes, which is both NLMSG_ALIGNTO and NLA_ALIGNTO
+func align(length int) int {
+	return (length + 3) &^ 3
+}
+
+// Socket returns the identity and the key metrics of the fake socket i, so the tests can check the records
+// - source 10.0.0.1:443 or [2001:db8::1]:443
+// - destination 192.0.2.0 + i or 2001:db8:1:: + i, port 30000 + i
+// - inode 1000 + i, cookie i + 1
+// - rtt 1000 + i microseconds, snd_cwnd 10 + i%100
+func Socket(af uint8, i int) (source net.IP, destination net.IP, destinationPort uint16, inode uint32, rtt uint32, sndCwnd uint32) {
+	if af == unix.AF_INET6 {
+		source = net.ParseIP("2001:db8::1")
+		destination = make(net.IP, net.IPv6len)
+		copy(destination, net.ParseIP("2001:db8:1::"))
+		binary.BigEndian.PutUint32(destination[12:], uint32(i))
+	} else {
+		source = net.IPv4(10, 0, 0, 1).To4()
+		destination = net.IPv4(192, 0, byte(2+i>>8), byte(i)).To4()
+	}
+	return source, destination, uint16(30000 + i), uint32(1000 + i), uint32(1000 + i), uint32(10 + i%100)
+}
+
+// socket builds the inet_diag_msg and the attributes for the socket i
+func (f *Fake) socket(af uint8, i int) []byte {
+
+	source, destination, destinationPort, inode, rtt, sndCwnd := Socket(af, i)
+
+	var msg inetdiag.InetDiagMsg
+	msg.Family = af
+	msg.State = tcpEstablished
+	// The ports are big endian, and the struct is written little endian, so they're swapped here
+	msg.SocketID.SourcePort = swap(443)
+	msg.SocketID.DestinationPort = swap(destinationPort)
+	copy(msg.SocketID.Source[:], source)
+	copy(msg.SocketID.Destination[:], destination)
+	msg.SocketID.Cookie = uint64(i + 1)
+	msg.UID = 1000
+	msg.Inode = inode
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &msg)
+
+	for _, attrType := range f.config.Attributes {
+		var data bytes.Buffer
+		switch attrType {
+		case inetdiag.INET_DIAG_MEMINFO:
+			binary.Write(&data, binary.LittleEndian, &inetdiag.MemInfo{Rmem: 0, Wmem: 0, Fmem: 4096, Tmem: 0})
+		case inetdiag.INET_DIAG_INFO:
+			info := inetdiag.TCPInfo415{State: tcpEstablished, Rto: 204000, SndMss: 1448, RcvMss: 536, Rtt: rtt, Rttvar: rtt / 2, SndCwnd: sndCwnd, AdvMss: 1448, MinRtt: rtt / 2}
+			binary.Write(&data, binary.LittleEndian, &info)
+		case inetdiag.INET_DIAG_CONG:
+			data.WriteString(f.config.Congestion)
+			data.WriteByte(0)
+		case inetdiag.INET_DIAG_TOS, inetdiag.INET_DIAG_TCLASS, inetdiag.INET_DIAG_SHUTDOWN:
+			data.WriteByte(0)
+		case inetdiag.INET_DIAG_SKMEMINFO:
+			binary.Write(&data, binary.LittleEndian, &inetdiag.SkMemInfo{RcvBuf: 131072, SndBuf: 87040})
+		case inetdiag.INET_DIAG_MARK, inetdiag.INET_DIAG_CLASS_ID:
+			binary.Write(&data, binary.LittleEndian, uint32(i))
+		}
+		b.Write(attribute(attrType, data.Bytes()))
+	}
+	return b.Bytes()
+}
+
+// listening builds the inet_diag_msg for the LISTEN socket
+func listening(listener Listener) []byte {
+	var msg inetdiag.InetDiagMsg
+	msg.Family = listener.Af
+	msg.State = tcpListen
+	msg.SocketID.SourcePort = swap(listener.Port)
+	msg.SocketID.Cookie = uint64(listener.Inode)
+	msg.UID = listener.UID
+	msg.Inode = listener.Inode
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &msg)
+	return b.Bytes()
+}
+
+// swap swaps the bytes of the uint16, like inetdiager.SwapUint16
+func swap(u uint16) uint16 {
+	return u<<8 | u>>8
+}
@@ -0,0 +1,318 @@
+// Package geoip enriches the records with the geo location and the ASN of the destination address, from the
+// local MaxMind GeoIP2 or GeoLite2 database files
+//
+// The City (or Country) database gives the country (ISO code), the region (the ISO code of the first
+// subdivision), and the city (English name).  The ASN database gives the ASN and the organization.  Either
+// database is optional.  The results are the socket_i_d dest_* fields, which are fields like any other, so they
+// can be used by the export filters and the alerts group_by, e.g. group_by: [dest_country].
+//
+// The lookups are cached per address, and the cache is cleared when it's full.  The database files are checked
+// every geoipReload, and reloaded if they have changed, which also clears the cache.  MaxMind updates the files
+// by replacing them, so the old database stays valid until the new one is loaded.
+//
+// The lookups use the real addresses, before the anonymization.
+//
+// The databases are read into memory, and decoded by the maxminddb library, which checks the files as they're
+// loaded, so a corrupt file is an error rather than a lookup crashing.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics are package level, so they are only registered once
+var (
+	promLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "geoip",
+			Name:      "lookups",
+			Help:      "geoip lookups, by result (hit is the cache, found or not_found in the databases, or error)",
+		},
+		[]string{"result"},
+	)
+	promReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "geoip",
+			Name:      "reloads",
+			Help:      "geoip database reloads, by database (city or asn) and result (ok or error)",
+		},
+		[]string{"database", "result"},
+	)
+)
+
+// Location is the geo location and ASN of an address.  The empty fields weren't found.
+type Location struct {
+	Country      string
+	Region       string
+	City         string
+	ASN          uint32
+	Organization string
+}
+
+// cityRecord is the fields of the City (or Country) database which are used
+type cityRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// asnRecord is the fields of the ASN database
+type asnRecord struct {
+	ASN          uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// database is a database file, and when it was loaded
+type database struct {
+	path    string
+	name    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// state is the databases and the cache, which are replaced together on reload
+type state struct {
+	city *database
+	asn  *database
+
+	mu    sync.RWMutex
+	cache map[[16]byte]*Location
+}
+
+// Enricher looks up the destinations.  The Enricher is shared by all the inetdiagers.
+// A nil Enricher does nothing, which is how the enrichment is disabled.
+type Enricher struct {
+	cacheSize int
+	state     atomic.Pointer[state]
+
+	// reloadMu serializes the reloads, but never blocks the lookups
+	reloadMu sync.Mutex
+}
+
+// New opens the City and ASN database files (empty = none), with cacheSize addresses cached
+func New(cityPath string, asnPath string, cacheSize int) (*Enricher, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, fmt.Errorf("no geoip databases")
+	}
+	e := &Enricher{cacheSize: cacheSize}
+	s := &state{cache: make(map[[16]byte]*Location)}
+	var err error
+	if cityPath != "" {
+		if s.city, err = load(cityPath, "city"); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if s.asn, err = load(asnPath, "asn"); err != nil {
+			return nil, err
+		}
+	}
+	e.state.Store(s)
+	return e, nil
+}
+
+// NewFromFlags creates the Enricher, or returns nil if geoipCity and geoipASN are empty
+func NewFromFlags(cliFlags cliflags.CliFlags) (*Enricher, error) {
+	if *cliFlags.GeoIPCity == "" && *cliFlags.GeoIPASN == "" {
+		return nil, nil
+	}
+	return New(*cliFlags.GeoIPCity, *cliFlags.GeoIPASN, *cliFlags.GeoIPCacheSize)
+}
+
+func load(path string, name string) (*database, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// The file is read into memory, rather than mmap'ed, so an old database can be dropped on reload while it's
+	// still being used by lookups, and is garbage collected after them
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// Verify checks the search tree and the data section, so a corrupt file fails here, and is never used
+	if err := reader.Verify(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &database{path: path, name: name, reader: reader, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Lookup returns the Location of the address, or nil if it isn't in either database
+func (e *Enricher) Lookup(ip net.IP) *Location {
+	if e == nil || ip == nil {
+		return nil
+	}
+	s := e.state.Load()
+
+	var key [16]byte
+	copy(key[:], ip.To16())
+	s.mu.RLock()
+	location, ok := s.cache[key]
+	s.mu.RUnlock()
+	if ok {
+		promLookups.WithLabelValues("hit").Inc()
+		return location
+	}
+
+	location, err := s.lookup(ip)
+	switch {
+	case err != nil:
+		promLookups.WithLabelValues("error").Inc()
+	case location == nil:
+		promLookups.WithLabelValues("not_found").Inc()
+	default:
+		promLookups.WithLabelValues("found").Inc()
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= e.cacheSize {
+		s.cache = make(map[[16]byte]*Location)
+	}
+	s.cache[key] = location
+	s.mu.Unlock()
+	return location
+}
+
+// lookup looks the address up in the databases
+func (s *state) lookup(ip net.IP) (*Location, error) {
+	var location Location
+	found := false
+	if s.city != nil {
+		var record cityRecord
+		_, ok, err := s.city.reader.LookupNetwork(ip, &record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = true
+			location.Country = record.Country.ISOCode
+			location.City = record.City.Names["en"]
+			if len(record.Subdivisions) > 0 {
+				location.Region = record.Subdivisions[0].ISOCode
+			}
+		}
+	}
+	if s.asn != nil {
+		var record asnRecord
+		_, ok, err := s.asn.reader.LookupNetwork(ip, &record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = true
+			location.ASN = record.ASN
+			location.Organization = record.Organization
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return &location, nil
+}
+
+// Enrich sets the dest_* fields of the record, from its destination address
+func (e *Enricher) Enrich(record *xtcppb.XtcpRecord) {
+	if e == nil {
+		return
+	}
+	id := record.GetInetDiagMsg().GetSocketID()
+	if id == nil {
+		return
+	}
+	location := e.Lookup(net.IP(id.GetDestination()))
+	if location == nil {
+		return
+	}
+	if location.Country != "" {
+		id.DestCountry = &location.Country
+	}
+	if location.Region != "" {
+		id.DestRegion = &location.Region
+	}
+	if location.City != "" {
+		id.DestCity = &location.City
+	}
+	if location.ASN != 0 {
+		asn := uint64(location.ASN)
+		id.DestAsn = &asn
+	}
+	if location.Organization != "" {
+		id.DestAsOrganization = &location.Organization
+	}
+}
+
+// Reload reloads the databases which have changed (modification time or size), and clears the cache
+// It returns true if anything was reloaded.  If a database can't be loaded, the old one is kept.
+func (e *Enricher) Reload() bool {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	logger := logging.Logger("main").With("geoip", true)
+	old := e.state.Load()
+	s := &state{city: old.city, asn: old.asn, cache: make(map[[16]byte]*Location)}
+	reloaded := false
+	for _, db := range []**database{&s.city, &s.asn} {
+		if *db == nil {
+			continue
+		}
+		info, err := os.Stat((*db).path)
+		if err != nil || (info.ModTime().Equal((*db).modTime) && info.Size() == (*db).size) {
+			continue
+		}
+		loaded, err := load((*db).path, (*db).name)
+		if err != nil {
+			promReloads.WithLabelValues((*db).name, "error").Inc()
+			logger.Warn("geoip reload", "database", (*db).name, "path", (*db).path, "err", err)
+			continue
+		}
+		promReloads.WithLabelValues((*db).name, "ok").Inc()
+		logger.Info("geoip reloaded", "database", (*db).name, "path", (*db).path, "build_epoch", loaded.reader.Metadata.BuildEpoch)
+		*db = loaded
+		reloaded = true
+	}
+	if reloaded {
+		e.state.Store(s)
+	}
+	return reloaded
+}
+
+// Run checks the databases for changes every interval, until ctx is cancelled
+func (e *Enricher) Run(ctx context.Context, interval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.Reload()
+		}
+	}
+}
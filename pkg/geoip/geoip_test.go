@@ -0,0 +1,203 @@
+package geoip_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/geoip"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var cityNetworks = []network{
+	{"192.0.2.0/24", city("GB", "ENG", "London")},
+	{"198.51.100.0/25", city("US", "CA", "Los Angeles")},
+	{"2001:db8::/32", city("DE", "BE", "Berlin")},
+}
+
+var asnNetworks = []network{
+	{"192.0.2.0/24", asn(64500, "Example Transit")},
+	{"203.0.113.0/24", asn(64501, "Example Hosting")},
+	{"2001:db8::/48", asn(64502, "Example Cloud")},
+}
+
+// TestLookup looks up the addresses in the City database with each record size
+func TestLookup(t *testing.T) {
+
+	var tests = []struct {
+		ip      string
+		city    string
+		country string
+	}{
+		{"192.0.2.1", "London", "GB"},
+		{"192.0.2.255", "London", "GB"},
+		{"198.51.100.127", "Los Angeles", "US"},
+		{"198.51.100.128", "", ""},
+		{"203.0.113.1", "", ""},
+		{"2001:db8:1::1", "Berlin", "DE"},
+		{"2001:db9::1", "", ""},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		path := filepath.Join(t.TempDir(), "city.mmdb")
+		writeMMDB(t, path, recordSize, "GeoIP2-City", cityNetworks)
+		e, err := geoip.New(path, "", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, test := range tests {
+			var cityName, country string
+			if location := e.Lookup(net.ParseIP(test.ip)); location != nil {
+				cityName, country = location.City, location.Country
+			}
+			if cityName != test.city || country != test.country {
+				t.Errorf("record size:%d test:%d %s\texpected:%s %s\tresult:%s %s", recordSize, i, test.ip, test.city, test.country, cityName, country)
+			}
+		}
+	}
+}
+
+// TestCorrupt checks the corrupt databases are rejected when they're loaded, including a pointer loop in the data
+// section, which the maxminddb library bounds by the data structure depth
+func TestCorrupt(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "city.mmdb")
+	writeMMDB(t, path, 24, "GeoIP2-City", cityNetworks)
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := maxminddb.FromBytes(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The data section starts after the search tree, and the 16 byte separator
+	dataStart := reader.Metadata.NodeCount*reader.Metadata.RecordSize/4 + 16
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+	var tests = []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"not a database", []byte("not a database")},
+		{"metadata marker only", []byte("\xAB\xCD\xEFMaxMind.com\xe0")},
+		{"search tree cut off", corrupt(func(b []byte) []byte { return b[len(b)/2:] })},
+		{"search tree zeroed", corrupt(func(b []byte) []byte {
+			for i := uint(0); i < dataStart; i++ {
+				b[i] = 0
+			}
+			return b
+		})},
+		{"pointer loop", corrupt(func(b []byte) []byte {
+			// the first data is a pointer to itself
+			b[dataStart], b[dataStart+1] = 0x20, 0x00
+			return b
+		})},
+	}
+	for i, test := range tests {
+		corruptPath := filepath.Join(dir, "corrupt.mmdb")
+		if err := os.WriteFile(corruptPath, test.b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := geoip.New(corruptPath, "", 100); err == nil {
+			t.Errorf("test:%d %s\texpected an error", i, test.name)
+		}
+	}
+}
+
+// TestEnrich checks the dest_* fields, with both databases
+func TestEnrich(t *testing.T) {
+
+	dir := t.TempDir()
+	writeMMDB(t, filepath.Join(dir, "city.mmdb"), 28, "GeoIP2-City", cityNetworks)
+	writeMMDB(t, filepath.Join(dir, "asn.mmdb"), 24, "GeoLite2-ASN", asnNetworks)
+	e, err := geoip.New(filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		destination string
+		expected    geoip.Location
+	}{
+		{"192.0.2.7", geoip.Location{Country: "GB", Region: "ENG", City: "London", ASN: 64500, Organization: "Example Transit"}},
+		{"198.51.100.7", geoip.Location{Country: "US", Region: "CA", City: "Los Angeles"}},
+		{"203.0.113.7", geoip.Location{ASN: 64501, Organization: "Example Hosting"}},
+		{"2001:db8::7", geoip.Location{Country: "DE", Region: "BE", City: "Berlin", ASN: 64502, Organization: "Example Cloud"}},
+		{"2001:db8:1::7", geoip.Location{Country: "DE", Region: "BE", City: "Berlin"}},
+		{"10.0.0.1", geoip.Location{}},
+	}
+	// Twice, so the second time is mostly from the cache, which is smaller than the tests
+	for j := 0; j < 2; j++ {
+		for i, test := range tests {
+			destination := net.ParseIP(test.destination)
+			if ip4 := destination.To4(); ip4 != nil {
+				destination = ip4
+			}
+			record := &xtcppb.XtcpRecord{InetDiagMsg: &xtcppb.InetDiagMsg{SocketID: &xtcppb.SocketID{Destination: destination}}}
+			e.Enrich(record)
+			id := record.GetInetDiagMsg().GetSocketID()
+			result := geoip.Location{Country: id.GetDestCountry(), Region: id.GetDestRegion(), City: id.GetDestCity(), ASN: uint32(id.GetDestAsn()), Organization: id.GetDestAsOrganization()}
+			if result != test.expected {
+				t.Errorf("test:%d %s\texpected:%+v\tresult:%+v", i, test.destination, test.expected, result)
+			}
+		}
+	}
+
+	var nilEnricher *geoip.Enricher
+	nilEnricher.Enrich(&xtcppb.XtcpRecord{})
+	if _, err := geoip.New("", "", 1); err == nil {
+		t.Errorf("expected an error without any databases")
+	}
+	if _, err := geoip.New(filepath.Join(dir, "nope.mmdb"), "", 1); err == nil {
+		t.Errorf("expected an error for a missing database")
+	}
+}
+
+// TestReload checks a changed database is reloaded, and a broken one is ignored
+func TestReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	writeMMDB(t, path, 24, "GeoLite2-ASN", asnNetworks)
+	e, err := geoip.New("", path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	if l := e.Lookup(ip); l == nil || l.ASN != 64500 {
+		t.Fatalf("unexpected location:%+v", l)
+	}
+	if e.Reload() {
+		t.Errorf("expected no reload, the file hasn't changed")
+	}
+
+	// The new database moves 192.0.2.0/24 to another ASN
+	writeMMDB(t, path, 24, "GeoLite2-ASN", []network{{"192.0.2.0/24", asn(64510, "Example Renumbered")}})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Reload() {
+		t.Errorf("expected a reload")
+	}
+	if l := e.Lookup(ip); l == nil || l.ASN != 64510 || l.Organization != "Example Renumbered" {
+		t.Errorf("expected the new ASN, not the cached one\tresult:%+v", l)
+	}
+
+	// A broken file keeps the loaded database
+	if err := os.WriteFile(path, []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if e.Reload() {
+		t.Errorf("expected no reload of a broken file")
+	}
+	if l := e.Lookup(ip); l == nil || l.ASN != 64510 {
+		t.Errorf("expected the loaded database\tresult:%+v", l)
+	}
+}
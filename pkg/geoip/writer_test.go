@@ -0,0 +1,66 @@
+package geoip_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// The test databases are written by MaxMind's mmdbwriter, with the same layout as the GeoIP2 and GeoLite2 databases
+
+// network is a prefix of the test database, and its data
+type network struct {
+	prefix string
+	data   mmdbtype.Map
+}
+
+// writeMMDB writes the test database, with the record size (24, 28, or 32 bits)
+func writeMMDB(t *testing.T, path string, recordSize int, databaseType string, networks []network) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		BuildEpoch:              1700000000,
+		DatabaseType:            databaseType,
+		Description:             map[string]string{"en": "xtcp test " + databaseType},
+		IPVersion:               6,
+		RecordSize:              recordSize,
+		IncludeReservedNetworks: true, // the test networks are the documentation prefixes
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range networks {
+		_, prefix, err := net.ParseCIDR(n.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(prefix, n.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// city is the GeoIP2 City data
+func city(country string, region string, name string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"city":         mmdbtype.Map{"geoname_id": mmdbtype.Uint32(1), "names": mmdbtype.Map{"en": mmdbtype.String(name)}},
+		"country":      mmdbtype.Map{"iso_code": mmdbtype.String(country), "names": mmdbtype.Map{"en": mmdbtype.String(country)}},
+		"subdivisions": mmdbtype.Slice{mmdbtype.Map{"iso_code": mmdbtype.String(region), "names": mmdbtype.Map{"en": mmdbtype.String(region)}}},
+		"location":     mmdbtype.Map{"latitude": mmdbtype.Float64(51.5), "longitude": mmdbtype.Float64(-0.1), "accuracy_radius": mmdbtype.Uint16(100)},
+		"traits":       mmdbtype.Map{"is_anycast": mmdbtype.Bool(true)},
+	}
+}
+
+// asn is the GeoLite2 ASN data
+func asn(number uint32, organization string) mmdbtype.Map {
+	return mmdbtype.Map{"autonomous_system_number": mmdbtype.Uint32(number), "autonomous_system_organization": mmdbtype.String(organization)}
+}
@@ -0,0 +1,289 @@
+package inetdiag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// The INET_DIAG attribute types
+// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/inet_diag.h#L133
+const (
+	INET_DIAG_NONE      = 0
+	INET_DIAG_MEMINFO   = 1
+	INET_DIAG_INFO      = 2
+	INET_DIAG_VEGASINFO = 3
+	INET_DIAG_CONG      = 4
+	INET_DIAG_TOS       = 5
+	INET_DIAG_TCLASS    = 6
+	INET_DIAG_SKMEMINFO = 7
+	INET_DIAG_SHUTDOWN  = 8
+	INET_DIAG_DCINFO    = 9
+	INET_DIAG_PROTOCOL  = 10
+	INET_DIAG_SKV6ONLY  = 11
+	INET_DIAG_LOCALS    = 12
+	INET_DIAG_PEERS     = 13
+	INET_DIAG_PAD       = 14
+	INET_DIAG_MARK      = 15
+	INET_DIAG_BBRINFO   = 16
+	INET_DIAG_CLASS_ID  = 17
+	INET_DIAG_MD5SIG    = 18
+)
+
+var (
+	// ErrShortMessage is returned if the message is smaller than the inet_diag_msg
+	ErrShortMessage = errors.New("inetdiag: message shorter than inet_diag_msg")
+	// ErrBadAttribute is returned if a netlink attribute length is invalid, or overruns the message
+	ErrBadAttribute = errors.New("inetdiag: bad netlink attribute")
+)
+
+// Attribute is a netlink attribute which Decode doesn't decode, preserved as the raw bytes
+type Attribute struct {
+	Type uint16
+	Data []byte
+}
+
+// Socket is a single decoded SOCK_DIAG_BY_FAMILY response, which is the inet_diag_msg and the netlink attributes
+//
+// The attribute pointers are nil if the kernel didn't send the attribute, so the zero values
+// can be distinguished from the missing ones.
+type Socket struct {
+	// InetDiagMsg is the inet_diag_msg, with the ports converted to host byte order
+	InetDiagMsg InetDiagMsg
+	// Source and Destination are 4 bytes for AF_INET, and 16 bytes for AF_INET6
+	Source      net.IP
+	Destination net.IP
+
+	MemInfo *MemInfo // INET_DIAG_MEMINFO
+	// TCPInfo is INET_DIAG_INFO.  Older kernels send less than the full struct, in which case the rest is zero,
+	// and TCPInfoLength is the number of bytes the kernel sent
+	TCPInfo       *TCPInfo54
+	TCPInfoLength int
+	// The tcp_info bit fields
+	SndWscale              uint8
+	RcvWscale              uint8
+	DeliveryRateAppLimited uint8
+	FastOpenClientFail     uint8
+
+	Congestion string     // INET_DIAG_CONG, or empty
+	TOS        *uint8     // INET_DIAG_TOS
+	TClass     *uint8     // INET_DIAG_TCLASS
+	SkMemInfo  *SkMemInfo // INET_DIAG_SKMEMINFO
+	Shutdown   *uint8     // INET_DIAG_SHUTDOWN
+	Mark       *uint32    // INET_DIAG_MARK
+	BBRInfo    *BBRInfo   // INET_DIAG_BBRINFO
+	ClassID    *uint32    // INET_DIAG_CLASS_ID
+	// V6Only is INET_DIAG_SKV6ONLY, which the kernel only sends for IPv6 LISTEN and CLOSE sockets
+	V6Only *uint8
+
+	// V4Mapped is true for AF_INET6 sockets with IPv4-mapped IPv6 addresses (::ffff:a.b.c.d), which are
+	// IPv4 clients of dual stack listeners
+	V4Mapped bool
+	// OriginalFamily is AF_INET6 if NormalizeV4Mapped converted the socket to AF_INET, otherwise zero (0)
+	OriginalFamily uint8
+
+	// Unknown are the attributes not decoded above, in the order they were received
+	Unknown []Attribute
+	// Padding is the number of bytes skipped, for the attribute alignment, and any kernel structs larger than ours
+	Padding int
+}
+
+// Decode decodes a SOCK_DIAG_BY_FAMILY message body (after the nlmsghdr), which is the inet_diag_msg
+// followed by the netlink attributes
+//
+// Decode doesn't keep references to b, so b can be reused after Decode returns.
+func Decode(b []byte) (*Socket, error) {
+
+	var socket Socket
+	msgSize := binary.Size(socket.InetDiagMsg)
+	if len(b) < msgSize {
+		return nil, fmt.Errorf("%w: %d < %d bytes", ErrShortMessage, len(b), msgSize)
+	}
+	if err := binary.Read(bytes.NewReader(b[:msgSize]), binary.LittleEndian, &socket.InetDiagMsg); err != nil {
+		return nil, err
+	}
+
+	// The ports are the only big endian (network byte order) fields in the struct
+	// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/inet_diag.h#L13
+	id := &socket.InetDiagMsg.SocketID
+	id.SourcePort = id.SourcePort>>8 | id.SourcePort<<8
+	id.DestinationPort = id.DestinationPort>>8 | id.DestinationPort<<8
+
+	// inet_diag_sockid encodes IPv4 addresses in the first 4 bytes of the 16 byte arrays
+	switch socket.InetDiagMsg.Family {
+	case unix.AF_INET:
+		socket.Source = net.IP(append([]byte(nil), id.Source[:net.IPv4len]...))
+		socket.Destination = net.IP(append([]byte(nil), id.Destination[:net.IPv4len]...))
+	default:
+		socket.Source = net.IP(append([]byte(nil), id.Source[:]...))
+		socket.Destination = net.IP(append([]byte(nil), id.Destination[:]...))
+	}
+
+	if socket.InetDiagMsg.Family == unix.AF_INET6 {
+		// Listeners have the unspecified destination
+		socket.V4Mapped = isV4Mapped(socket.Source) && (isV4Mapped(socket.Destination) || socket.Destination.IsUnspecified())
+	}
+
+	for attributes := b[msgSize:]; len(attributes) > 0; {
+
+		var nlattr Nlattr
+		headerSize := binary.Size(nlattr)
+		if len(attributes) < headerSize {
+			return nil, fmt.Errorf("%w: %d trailing bytes", ErrBadAttribute, len(attributes))
+		}
+		nlattr.NlaLen = binary.LittleEndian.Uint16(attributes[0:])
+		nlattr.NlaType = binary.LittleEndian.Uint16(attributes[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if int(nlattr.NlaLen) < headerSize || int(nlattr.NlaLen) > len(attributes) {
+			return nil, fmt.Errorf("%w: type:%d length:%d remaining:%d", ErrBadAttribute, nlattr.NlaType, nlattr.NlaLen, len(attributes))
+		}
+		data := attributes[headerSize:nlattr.NlaLen]
+
+		used, err := socket.decodeAttribute(nlattr.NlaType, data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Attributes are aligned to 4 bytes (NLA_ALIGNTO), but the last one doesn't have to be padded
+		aligned := (int(nlattr.NlaLen) + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(attributes) {
+			aligned = len(attributes)
+		}
+		socket.Padding += len(data) - used + aligned - int(nlattr.NlaLen)
+		attributes = attributes[aligned:]
+	}
+
+	return &socket, nil
+}
+
+// decodeAttribute decodes a single attribute into the socket, returning the number of data bytes used
+func (s *Socket) decodeAttribute(attrType uint16, data []byte) (used int, err error) {
+
+	switch attrType {
+	case INET_DIAG_MEMINFO:
+		s.MemInfo = &MemInfo{}
+		return readStruct(attrType, data, s.MemInfo)
+
+	case INET_DIAG_INFO:
+		// The payload is specific to the address family.  For TCP sockets, it is the struct tcp_info.
+		s.TCPInfo = &TCPInfo54{}
+		s.TCPInfoLength = len(data)
+		used, err = readStruct(attrType, data, s.TCPInfo)
+		// __u8 tcpi_snd_wscale : 4, tcpi_rcv_wscale : 4;
+		// __u8 tcpi_delivery_rate_app_limited:1, tcpi_fastopen_client_fail:2;
+		s.SndWscale = s.TCPInfo.ScaleTemp >> 4
+		s.RcvWscale = s.TCPInfo.ScaleTemp & 0x0F
+		s.DeliveryRateAppLimited = s.TCPInfo.FlagsTemp & 0x1
+		s.FastOpenClientFail = s.TCPInfo.FlagsTemp >> 1 & 0x3
+		return used, err
+
+	case INET_DIAG_CONG:
+		// The congestion algorithm is a variable length null terminated C string
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			s.Congestion = string(data[:i])
+		} else {
+			s.Congestion = string(data)
+		}
+		return len(data), nil
+
+	case INET_DIAG_TOS:
+		s.TOS, used, err = readUint8(attrType, data)
+		return used, err
+
+	case INET_DIAG_TCLASS:
+		s.TClass, used, err = readUint8(attrType, data)
+		return used, err
+
+	case INET_DIAG_SKMEMINFO:
+		s.SkMemInfo = &SkMemInfo{}
+		return readStruct(attrType, data, s.SkMemInfo)
+
+	case INET_DIAG_SHUTDOWN:
+		s.Shutdown, used, err = readUint8(attrType, data)
+		return used, err
+
+	case INET_DIAG_MARK:
+		s.Mark, used, err = readUint32(attrType, data)
+		return used, err
+
+	case INET_DIAG_BBRINFO:
+		s.BBRInfo = &BBRInfo{}
+		return readStruct(attrType, data, s.BBRInfo)
+
+	case INET_DIAG_CLASS_ID:
+		s.ClassID, used, err = readUint32(attrType, data)
+		return used, err
+
+	case INET_DIAG_SKV6ONLY:
+		s.V6Only, used, err = readUint8(attrType, data)
+		return used, err
+
+	case INET_DIAG_PAD:
+		return 0, nil
+	}
+
+	s.Unknown = append(s.Unknown, Attribute{Type: attrType, Data: append([]byte(nil), data...)})
+	return len(data), nil
+}
+
+// NormalizeV4Mapped converts a V4Mapped socket to AF_INET, with the 4 byte IPv4 addresses, so it can be aggregated
+// with the IPv4 sockets.  OriginalFamily records that it was AF_INET6.  It returns true if the socket was converted.
+func (s *Socket) NormalizeV4Mapped() bool {
+	if !s.V4Mapped || s.OriginalFamily != 0 {
+		return false
+	}
+	s.OriginalFamily = s.InetDiagMsg.Family
+	s.InetDiagMsg.Family = unix.AF_INET
+	s.Source = s.Source.To4()
+	if s.Destination.IsUnspecified() {
+		s.Destination = net.IPv4zero.To4()
+	} else {
+		s.Destination = s.Destination.To4()
+	}
+	return true
+}
+
+// isV4Mapped is true for the 16 byte ::ffff:a.b.c.d addresses
+func isV4Mapped(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() != nil
+}
+
+// readStruct reads the kernel struct from the attribute data
+// The kernel structs grow over time, so if the data is shorter than the struct the rest of the struct is zero,
+// and if the data is longer the extra fields are ignored (and counted as padding)
+func readStruct(attrType uint16, data []byte, v interface{}) (used int, err error) {
+	size := binary.Size(v)
+	buf := data
+	if len(data) < size {
+		buf = make([]byte, size)
+		copy(buf, data)
+	}
+	if err := binary.Read(bytes.NewReader(buf[:size]), binary.LittleEndian, v); err != nil {
+		return 0, fmt.Errorf("inetdiag: attribute type:%d: %w", attrType, err)
+	}
+	if len(data) < size {
+		return len(data), nil
+	}
+	return size, nil
+}
+
+// readUint8 reads the __u8 attribute
+func readUint8(attrType uint16, data []byte) (*uint8, int, error) {
+	if len(data) < 1 {
+		return nil, 0, fmt.Errorf("%w: type:%d is empty", ErrBadAttribute, attrType)
+	}
+	v := data[0]
+	return &v, 1, nil
+}
+
+// readUint32 reads the __u32 attribute
+func readUint32(attrType uint16, data []byte) (*uint32, int, error) {
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("%w: type:%d length:%d is shorter than a __u32", ErrBadAttribute, attrType, len(data))
+	}
+	v := binary.LittleEndian.Uint32(data)
+	return &v, 4, nil
+}
@@ -0,0 +1,208 @@
+package inetdiag_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"golang.org/x/sys/unix"
+)
+
+// attribute is the nlattr and the data, padded to 4 bytes unless unpadded
+func attribute(attrType uint16, data []byte, unpadded bool) []byte {
+	a := make([]byte, 4)
+	binary.LittleEndian.PutUint16(a[0:], uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(a[2:], attrType)
+	a = append(a, data...)
+	if unpadded {
+		return a
+	}
+	return append(a, make([]byte, (4-len(data)%4)%4)...)
+}
+
+// structBytes is the kernel struct, little endian
+func structBytes(v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	return b.Bytes()
+}
+
+// message is the inet_diag_msg, with the ports in network byte order like the kernel, followed by the attributes
+func message(af uint8, source net.IP, destination net.IP, attributes ...[]byte) []byte {
+	var msg inetdiag.InetDiagMsg
+	msg.Family = af
+	msg.State = 1
+	copy(msg.SocketID.Source[:], source)
+	copy(msg.SocketID.Destination[:], destination)
+	msg.SocketID.Cookie = 12345
+	msg.Inode = 99
+	b := structBytes(&msg)
+	// idiag_sport and idiag_dport follow the four (4) __u8s
+	binary.BigEndian.PutUint16(b[4:], 443)
+	binary.BigEndian.PutUint16(b[6:], 40000)
+	for _, a := range attributes {
+		b = append(b, a...)
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+
+	v4Source, v4Destination := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(192, 0, 2, 7).To4()
+	v6Source, v6Destination := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	tcpinfo415 := structBytes(&inetdiag.TCPInfo415{Rtt: 1500, SndCwnd: 10, ScaleTemp: 7<<4 | 9, FlagsTemp: 1})
+	tcpinfo54 := structBytes(&inetdiag.TCPInfo54{Rtt: 2500, SndCwnd: 20, Delivered: 77, SndWnd: 65535})
+	bbrinfo := structBytes(&inetdiag.BBRInfo{BwLo: 1000, MinRtt: 800})
+	skmeminfo := structBytes(&inetdiag.SkMemInfo{RcvBuf: 131072, SndBuf: 87040, Drops: 3})
+
+	var tests = []struct {
+		name          string
+		b             []byte
+		source        net.IP
+		destination   net.IP
+		rtt           uint32
+		delivered     uint32
+		congestion    string
+		wscale        [2]uint8
+		bbr           bool
+		unknown       []uint16
+		padding       int
+		expectedError error
+	}{
+		{"v4 cubic", message(unix.AF_INET, v4Source, v4Destination,
+			attribute(inetdiag.INET_DIAG_INFO, tcpinfo415, false),
+			attribute(inetdiag.INET_DIAG_CONG, []byte("cubic\x00"), false),
+			attribute(inetdiag.INET_DIAG_SKMEMINFO, skmeminfo, false)),
+			v4Source, v4Destination, 1500, 0, "cubic", [2]uint8{7, 9}, false, nil, 2, nil},
+		{"v6 bbr 5.4 tcp_info", message(unix.AF_INET6, v6Source, v6Destination,
+			attribute(inetdiag.INET_DIAG_INFO, tcpinfo54, false),
+			attribute(inetdiag.INET_DIAG_CONG, []byte("bbr\x00"), false),
+			attribute(inetdiag.INET_DIAG_BBRINFO, bbrinfo, false)),
+			v6Source, v6Destination, 2500, 77, "bbr", [2]uint8{}, true, nil, 0, nil},
+		{"newer kernel tcp_info", message(unix.AF_INET, v4Source, v4Destination,
+			attribute(inetdiag.INET_DIAG_INFO, append(tcpinfo54, make([]byte, 16)...), false)),
+			v4Source, v4Destination, 2500, 77, "", [2]uint8{}, false, nil, 16, nil},
+		{"unknown attributes", message(unix.AF_INET6, v6Source, v6Destination,
+			attribute(inetdiag.INET_DIAG_SKV6ONLY, []byte{1}, false),
+			attribute(inetdiag.INET_DIAG_PAD, []byte{}, false),
+			attribute(99, []byte{1, 2, 3, 4, 5}, false)),
+			v6Source, v6Destination, 0, 0, "", [2]uint8{}, false, []uint16{99}, 6, nil},
+		{"last attribute unpadded", message(unix.AF_INET, v4Source, v4Destination,
+			attribute(inetdiag.INET_DIAG_CONG, []byte("reno\x00"), true)),
+			v4Source, v4Destination, 0, 0, "reno", [2]uint8{}, false, nil, 0, nil},
+		{"short message", message(unix.AF_INET, v4Source, v4Destination)[:20], nil, nil, 0, 0, "", [2]uint8{}, false, nil, 0, inetdiag.ErrShortMessage},
+		{"short attribute header", append(message(unix.AF_INET, v4Source, v4Destination), 8, 0), nil, nil, 0, 0, "", [2]uint8{}, false, nil, 0, inetdiag.ErrBadAttribute},
+		{"attribute overrun", message(unix.AF_INET, v4Source, v4Destination, attribute(inetdiag.INET_DIAG_INFO, tcpinfo415, false)[:100]), nil, nil, 0, 0, "", [2]uint8{}, false, nil, 0, inetdiag.ErrBadAttribute},
+		{"empty tos", message(unix.AF_INET, v4Source, v4Destination, attribute(inetdiag.INET_DIAG_TOS, []byte{}, false)), nil, nil, 0, 0, "", [2]uint8{}, false, nil, 0, inetdiag.ErrBadAttribute},
+	}
+
+	for i, test := range tests {
+
+		socket, err := inetdiag.Decode(test.b)
+		if !errors.Is(err, test.expectedError) {
+			t.Errorf("test:%d %s\texpected error:%v\tresult:%v", i, test.name, test.expectedError, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		id := socket.InetDiagMsg.SocketID
+		if !socket.Source.Equal(test.source) || !socket.Destination.Equal(test.destination) || len(socket.Source) != len(test.source) ||
+			id.SourcePort != 443 || id.DestinationPort != 40000 || id.Cookie != 12345 || socket.InetDiagMsg.Inode != 99 {
+			t.Errorf("test:%d %s\texpected %s:443 -> %s:40000 cookie:12345 inode:99\tresult:%s:%d -> %s:%d cookie:%d inode:%d",
+				i, test.name, test.source, test.destination, socket.Source, id.SourcePort, socket.Destination, id.DestinationPort, id.Cookie, socket.InetDiagMsg.Inode)
+		}
+
+		var rtt, delivered uint32
+		if socket.TCPInfo != nil {
+			rtt, delivered = socket.TCPInfo.Rtt, socket.TCPInfo.Delivered
+		}
+		if rtt != test.rtt || delivered != test.delivered || socket.Congestion != test.congestion ||
+			socket.SndWscale != test.wscale[0] || socket.RcvWscale != test.wscale[1] || (socket.BBRInfo != nil) != test.bbr {
+			t.Errorf("test:%d %s\texpected rtt:%d delivered:%d congestion:%q wscale:%v bbr:%t\tresult:%d %d %q [%d %d] %t",
+				i, test.name, test.rtt, test.delivered, test.congestion, test.wscale, test.bbr, rtt, delivered, socket.Congestion, socket.SndWscale, socket.RcvWscale, socket.BBRInfo != nil)
+		}
+
+		var unknown []uint16
+		for _, attribute := range socket.Unknown {
+			unknown = append(unknown, attribute.Type)
+		}
+		if len(unknown) != len(test.unknown) || (len(unknown) > 0 && unknown[len(unknown)-1] != test.unknown[len(test.unknown)-1]) || socket.Padding != test.padding {
+			t.Errorf("test:%d %s\texpected unknown:%v padding:%d\tresult:%v %d", i, test.name, test.unknown, test.padding, unknown, socket.Padding)
+		}
+	}
+}
+
+// TestDecodeDoesNotAlias checks the socket doesn't share memory with the message, so the buffers can be reused
+func TestDecodeDoesNotAlias(t *testing.T) {
+	b := message(unix.AF_INET, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(192, 0, 2, 7).To4(), attribute(99, []byte{1, 2, 3, 4}, false))
+	socket, err := inetdiag.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range b {
+		b[i] = 0xff
+	}
+	if !socket.Source.Equal(net.IPv4(10, 0, 0, 1)) || !bytes.Equal(socket.Unknown[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("expected source:10.0.0.1 unknown:[1 2 3 4]\tresult:%s %v", socket.Source, socket.Unknown[0].Data)
+	}
+}
+
+func TestNormalizeV4Mapped(t *testing.T) {
+
+	v6only := attribute(inetdiag.INET_DIAG_SKV6ONLY, []byte{0}, false)
+
+	var tests = []struct {
+		name              string
+		af                uint8
+		source            net.IP
+		destination       net.IP
+		attributes        [][]byte
+		expectV4Mapped    bool
+		expectSource      net.IP
+		expectDestination net.IP
+		expectV6Only      bool
+	}{
+		{"v4 client of a dual stack listener", unix.AF_INET6, net.ParseIP("::ffff:10.0.0.1"), net.ParseIP("::ffff:192.0.2.7"), nil,
+			true, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(192, 0, 2, 7).To4(), false},
+		{"dual stack listener", unix.AF_INET6, net.ParseIP("::ffff:10.0.0.1"), net.IPv6unspecified, [][]byte{v6only},
+			true, net.IPv4(10, 0, 0, 1).To4(), net.IPv4zero.To4(), true},
+		{"v6", unix.AF_INET6, net.ParseIP("2001:db8::1"), net.ParseIP("::ffff:192.0.2.7"), nil,
+			false, net.ParseIP("2001:db8::1"), net.ParseIP("::ffff:192.0.2.7"), false},
+		{"v6 listener", unix.AF_INET6, net.ParseIP("2001:db8::1"), net.IPv6unspecified, [][]byte{v6only},
+			false, net.ParseIP("2001:db8::1"), net.IPv6unspecified, true},
+		{"v4", unix.AF_INET, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(192, 0, 2, 7).To4(), nil,
+			false, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(192, 0, 2, 7).To4(), false},
+	}
+
+	for i, test := range tests {
+
+		socket, err := inetdiag.Decode(message(test.af, test.source, test.destination, test.attributes...))
+		if err != nil {
+			t.Fatalf("test:%d %s\tDecode error:%v", i, test.name, err)
+		}
+		if socket.V4Mapped != test.expectV4Mapped || (socket.V6Only != nil) != test.expectV6Only {
+			t.Errorf("test:%d %s\texpected v4Mapped:%t v6Only:%t\tresult:%t %t", i, test.name, test.expectV4Mapped, test.expectV6Only, socket.V4Mapped, socket.V6Only != nil)
+		}
+
+		normalized := socket.NormalizeV4Mapped()
+		expectFamily, expectOriginalFamily := test.af, uint8(0)
+		if test.expectV4Mapped {
+			expectFamily, expectOriginalFamily = unix.AF_INET, unix.AF_INET6
+		}
+		if normalized != test.expectV4Mapped || socket.InetDiagMsg.Family != expectFamily || socket.OriginalFamily != expectOriginalFamily ||
+			!bytes.Equal(socket.Source, test.expectSource) || !bytes.Equal(socket.Destination, test.expectDestination) {
+			t.Errorf("test:%d %s\texpected normalized:%t family:%d originalFamily:%d %s -> %s\tresult:%t %d %d %s -> %s", i, test.name,
+				test.expectV4Mapped, expectFamily, expectOriginalFamily, test.expectSource, test.expectDestination,
+				normalized, socket.InetDiagMsg.Family, socket.OriginalFamily, socket.Source, socket.Destination)
+		}
+		if socket.NormalizeV4Mapped() {
+			t.Errorf("test:%d %s\texpected the second NormalizeV4Mapped to do nothing", i, test.name)
+		}
+	}
+}
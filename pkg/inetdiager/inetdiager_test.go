@@ -1,9 +1,28 @@
 package inetdiager_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
 	"github.com/Edgio/xtcp/pkg/inetdiager"
+	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/netlinker"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSwapUint16(t *testing.T) {
@@ -25,3 +44,182 @@ func TestSwapUint16(t *testing.T) {
 		}
 	}
 }
+
+// TestInetdiagerDrain checks that on shutdown the inetdiager keeps reading until the channel is closed,
+// so everything queued in netlinkerCh is consumed, and then flushes the final stats
+func TestInetdiagerDrain(t *testing.T) {
+
+	cliFlags := config.Register(flag.NewFlagSet("test", flag.ContinueOnError))
+	ctl := admin.NewController(cliFlags)
+
+	af := uint8(2)
+	queued := 50
+	in := make(chan *netlinker.Batch, queued)
+	for i := 0; i < queued; i++ {
+		batch := netlinker.NewBatch(0)
+		batch.Add(nil, 1)
+		in <- batch
+	}
+	statsCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 10)
+
+	// Shutdown is signalled before the inetdiager even starts, and the poller closes the channel
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	close(in)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go inetdiager.Inetdiager(ctx, 0, &af, in, &wg, "test", cliFlags, statsCh, nil, ctl, nil)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("inetdiager did not finish draining")
+	}
+
+	if len(in) != 0 {
+		t.Errorf("expected netlinkerCh to be drained, %d messages left", len(in))
+	}
+	select {
+	case stats := <-statsCh:
+		if stats.Af != af || stats.ID != 0 {
+			t.Errorf("unexpected final stats:%v", stats)
+		}
+	default:
+		t.Errorf("expected the final stats to be flushed")
+	}
+	for _, w := range ctl.WorkerStates() {
+		if w.Kind == "inetdiager" && w.State != "done" {
+			t.Errorf("expected inetdiager state done, result:%s", w.State)
+		}
+	}
+}
+
+// TestInetdiagerStatsFrequency checks the stats interval follows the polling frequency, when it's changed at runtime
+func TestInetdiagerStatsFrequency(t *testing.T) {
+
+	cliFlags := config.Register(flag.NewFlagSet("test", flag.ContinueOnError))
+	pollingFrequency := time.Hour
+	cliFlags.PollingFrequency = &pollingFrequency
+	ctl := admin.NewController(cliFlags)
+
+	af := uint8(2)
+	in := make(chan *netlinker.Batch, 1)
+	statsCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go inetdiager.Inetdiager(context.Background(), 0, &af, in, &wg, "test", cliFlags, statsCh, nil, ctl, nil)
+	defer func() {
+		close(in)
+		wg.Wait()
+	}()
+
+	if err := ctl.SetPollingFrequency(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// The stats are sent while reading the batches
+	timeout := time.After(5 * time.Second)
+	for {
+		batch := netlinker.NewBatch(0)
+		batch.Add(nil, 1)
+		in <- batch
+		select {
+		case <-statsCh:
+			return
+		case <-timeout:
+			t.Fatal("expected the stats at the new polling frequency")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// inetDiagMsg is the raw inet_diag_msg of an IPv4 socket to the destination port 443, without any attributes
+func inetDiagMsg(destination string, inode uint32) []byte {
+	var msg inetdiag.InetDiagMsg
+	msg.Family = unix.AF_INET
+	msg.State = 1
+	msg.SocketID.DestinationPort = inetdiager.SwapUint16(443)
+	copy(msg.SocketID.Source[:], net.ParseIP("192.0.2.1").To4())
+	copy(msg.SocketID.Destination[:], net.ParseIP(destination).To4())
+	msg.Inode = inode
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &msg)
+	return b.Bytes()
+}
+
+// TestInetdiagerFilterAnonymized checks the export filters match the real addresses, before the anonymization,
+// and the exported records are still anonymized
+func TestInetdiagerFilterAnonymized(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var tests = []struct {
+		anonymize string
+		filter    string
+		expected  []uint32 // the inodes exported
+	}{
+		{"drop", "destination in 10.0.0.0/8", []uint32{1, 2}},
+		{"truncate", "destination == 10.0.0.2", []uint32{2}},
+		{"drop", "not destination in 10.0.0.0/8", []uint32{3}},
+		{"none", "destination in 10.0.0.0/8", []uint32{1, 2}},
+	}
+
+	for i, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cliFlags := config.Register(fs)
+		if err := fs.Parse([]string{"-anonymizeDestination", test.anonymize, "-anonymizePrefix4", "8", "-filter", test.filter, "-inetdiagerReportModulus", "1", "-udpSendDest", conn.LocalAddr().String()}); err != nil {
+			t.Fatal(err)
+		}
+		anonymizer, err := anonymize.NewFromFlags(cliFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sinks, err := exportfilter.NewSinks(cliFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		af := uint8(unix.AF_INET)
+		in := make(chan *netlinker.Batch, 1)
+		batch := netlinker.NewBatch(0)
+		for inode, destination := range []string{"10.0.0.1", "10.0.0.2", "198.51.100.1"} {
+			batch.Add(inetDiagMsg(destination, uint32(inode+1)), 1)
+		}
+		in <- batch
+		close(in)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		inetdiager.Inetdiager(context.Background(), 0, &af, in, &wg, "test", cliFlags, make(chan inetdiagerstater.InetdiagerStatsWrapper, 10), nil, admin.NewController(cliFlags), &inetdiager.Stages{Anonymizer: anonymizer, ExportSinks: sinks})
+
+		var inodes []uint32
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			var record xtcppb.XtcpRecord
+			if err := proto.Unmarshal(buf[:n], &record); err != nil {
+				t.Fatal(err)
+			}
+			inodes = append(inodes, record.GetInetDiagMsg().GetInode())
+			if destination := net.IP(record.GetInetDiagMsg().GetSocketID().GetDestination()); test.anonymize != "none" && destination.Equal(net.ParseIP("10.0.0.2")) {
+				t.Errorf("test:%d %s %s\texpected the exported destination to be anonymized\tresult:%s", i, test.anonymize, test.filter, destination)
+			}
+		}
+		sort.Slice(inodes, func(a, b int) bool { return inodes[a] < inodes[b] })
+		if fmt.Sprint(inodes) != fmt.Sprint(test.expected) {
+			t.Errorf("test:%d %s %s\texpected inodes:%v\tresult:%v", i, test.anonymize, test.filter, test.expected, inodes)
+		}
+	}
+}
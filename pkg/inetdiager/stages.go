@@ -0,0 +1,61 @@
+package inetdiager
+
+import (
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/alerts"
+	"github.com/Edgio/xtcp/pkg/anonymize"
+	"github.com/Edgio/xtcp/pkg/bottleneck"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/geoip"
+	"github.com/Edgio/xtcp/pkg/services"
+	"github.com/Edgio/xtcp/pkg/sockmetrics"
+	"github.com/Edgio/xtcp/pkg/tagging"
+	"github.com/Edgio/xtcp/pkg/topn"
+)
+
+// Stages are the optional processing stages of the inetdiagers.  Each stage is nil when it's disabled, and a nil
+// *Stages disables them all.  main builds the Stages once, and the pollers (or the replay) pass them to their
+// inetdiagers, with a Classifier per address family (see WithClassifier).
+//
+// For every socket, the inetdiagers run the Classifier (bottleneck), the ServiceMapper (services), and the
+// SockMetrics (sockmetrics).  Then for every record, the Tagger (tagging), the GeoEnricher (geoip), the
+// AlertEngine (alerts), and the ExportSinks filters (exportfilter), which see the original addresses, then the
+// Anonymizer (anonymize), and then the TopTracker (topn), and the ExportSinks projections, which see the
+// anonymized records.
+//
+// The AlertEngine and the TopTracker give each inetdiager its own Shard, so the inetdiagers don't contend, and the
+// shards are merged when the next poll starts (see Poll).
+type Stages struct {
+	Classifier    *bottleneck.Classifier
+	ServiceMapper *services.Mapper
+	SockMetrics   *sockmetrics.Recorder
+	Tagger        *tagging.Tagger
+	GeoEnricher   *geoip.Enricher
+	AlertEngine   *alerts.Engine
+	Anonymizer    *anonymize.Anonymizer
+	TopTracker    *topn.Tracker
+	ExportSinks   *exportfilter.Sinks // nil = export everything
+}
+
+// WithClassifier returns a copy of the Stages with the classifier, which keeps the previous tcp_info of the sockets
+// of one address family, so each poller has its own
+func (s *Stages) WithClassifier(classifier *bottleneck.Classifier) *Stages {
+	var stages Stages
+	if s != nil {
+		stages = *s
+	}
+	stages.Classifier = classifier
+	return &stages
+}
+
+// Poll tells the stages which aggregate over a poll that the address family's next poll has started at pollTime,
+// which completes the previous poll
+func (s *Stages) Poll(af uint8, pollTime time.Time) {
+	if s == nil {
+		return
+	}
+	s.AlertEngine.Poll(af, pollTime)
+	s.TopTracker.Poll(af, pollTime)
+	s.SockMetrics.Poll(af, pollTime)
+}
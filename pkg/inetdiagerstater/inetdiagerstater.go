@@ -7,16 +7,17 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 
+	"github.com/Edgio/xtcp/pkg/bottleneck"
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const (
-	debugLevel int = 11
-)
-
 // TODO move to misc
 var (
 	// Map kernel enum to human string for the IP protocol
@@ -39,9 +40,14 @@ type InetdiagerStats struct {
 	InetdiagMsgCount          int
 	InetdiagMsgBytesReadTotal int
 	PadBufferTotal            int
+	DecodeErrorsTotal         int
+	V4MappedTotal             int
 	UDPWritesTotal            int
 	UDPBytesWrittenTotal      int
 	UDPErrorsTotal            int
+	FilterMatchedTotal        [exportfilter.SinkCount]int // records exported, by sink
+	FilterDroppedTotal        [exportfilter.SinkCount]int // records dropped by the sink's filter, by sink
+	BottleneckTotal           [bottleneck.ClassCount]int  // sockets classified, by bottleneck class
 	StatsBlocked              int
 }
 
@@ -51,7 +57,12 @@ type InetdiagerStats struct {
 // TODO Consider an alternative strategy where the poller could signal the inetdiagers via a channel that the polling cycle is done,
 // and then inetdiagers could start a timed loop to check for no more messages, and then report.  This would help find when the polling is done,
 // and all the messages from the netlinkers have been processed.
-func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFlags) {
+// wg.Done is called once the channel is closed and the last stats are sent, which main waits for on shutdown
+func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFlags, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	logger := logging.Logger("staters")
 
 	//---------------------------------
 	// Register Prometheus metrics
@@ -116,6 +127,51 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 		},
 		[]string{"af", "id"},
 	)
+	inetdiagerDecodeErrors := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "decode_errors",
+			Help:      "inetdiager messages inetdiag.Decode failed to decode, which are dropped, by address family, by worker id",
+		},
+		[]string{"af", "id"},
+	)
+	inetdiagerV4Mapped := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "v4_mapped",
+			Help:      "inetdiager IPv4-mapped IPv6 sockets, which are IPv4 clients of dual stack sockets, by address family, by worker id",
+		},
+		[]string{"af", "id"},
+	)
+	inetdiagerFilterMatched := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "filter_matched",
+			Help:      "inetdiager records matching the export filter, which are exported, by address family, by worker id, by sink (stream, nsq, udp)",
+		},
+		[]string{"af", "id", "sink"},
+	)
+	inetdiagerFilterDropped := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "filter_dropped",
+			Help:      "inetdiager records not matching the export filter, which are not exported, by address family, by worker id, by sink (stream, nsq, udp)",
+		},
+		[]string{"af", "id", "sink"},
+	)
+	inetdiagerBottleneck := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "bottleneck_sockets",
+			Help:      "inetdiager sockets classified, by address family, by bottleneck class.  The increase over one polling period is the number of sampled sockets of each class",
+		},
+		[]string{"af", "class"},
+	)
 	inetdiagerUDPs := promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "xtcp",
@@ -163,6 +219,15 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 		},
 		[]string{"af"},
 	)
+	inetdiagerV4MappedTotal := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "inetdiager",
+			Name:      "v4_mapped_total",
+			Help:      "inetdiager total IPv4-mapped IPv6 sockets, which are IPv4 clients of dual stack sockets, by address family",
+		},
+		[]string{"af"},
+	)
 	inetdiagerUDPsTotal := promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "xtcp",
@@ -224,9 +289,7 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 	if *cliFlags.NoStatsd == false {
 		udpConn, dialerr = net.Dial("udp", *cliFlags.StatsdDst)
 		if dialerr != nil {
-			if debugLevel > 10 {
-				fmt.Println("pollerStater:\tnet.Dial(\"udp\", ", *cliFlags.StatsdDst, ") error:", dialerr)
-			}
+			logger.Error("inetdiagerStater net.Dial error", "statsdDst", *cliFlags.StatsdDst, "err", dialerr)
 		}
 		defer udpConn.Close()
 	}
@@ -260,9 +323,7 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 
 		inetdiagerStaterMsg.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af]).Inc()
 
-		if debugLevel > 100 {
-			fmt.Println("inetdiagerStater Af:", inetdiagerStatsWrapper.Af, "\tID:", inetdiagerStatsWrapper.ID, "\tinetdiagerStatsLoops:", inetdiagerStatsLoops, "\tafInetdiagerStatsLoops[inetdiagerStatsWrapper.Af]:", afInetdiagerStatsLoops[inetdiagerStatsWrapper.Af], "\tin:", inetdiagerStatsWrapper)
-		}
+		logger.Debug("inetdiagerStater in", "af", kernelEnumToString[inetdiagerStatsWrapper.Af], "id", inetdiagerStatsWrapper.ID, "inetdiagerStatsLoops", inetdiagerStatsLoops, "afInetdiagerStatsLoops", afInetdiagerStatsLoops[inetdiagerStatsWrapper.Af], "stats", inetdiagerStatsWrapper.Stats)
 
 		oldStats := oldStatsMap[inetdiagerStatsWrapper.Af][inetdiagerStatsWrapper.ID]
 		//oldStats, ok := oldStatsMap[inetdiagerStatsWrapper.Af][inetdiagerStatsWrapper.ID]
@@ -277,27 +338,42 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 		diffStats.InetdiagMsgCount = inetdiagerStatsWrapper.Stats.InetdiagMsgCount - oldStats.InetdiagMsgCount
 		diffStats.InetdiagMsgBytesReadTotal = inetdiagerStatsWrapper.Stats.InetdiagMsgBytesReadTotal - oldStats.InetdiagMsgBytesReadTotal
 		diffStats.PadBufferTotal = inetdiagerStatsWrapper.Stats.PadBufferTotal - oldStats.PadBufferTotal
+		diffStats.DecodeErrorsTotal = inetdiagerStatsWrapper.Stats.DecodeErrorsTotal - oldStats.DecodeErrorsTotal
+		diffStats.V4MappedTotal = inetdiagerStatsWrapper.Stats.V4MappedTotal - oldStats.V4MappedTotal
 		diffStats.UDPWritesTotal = inetdiagerStatsWrapper.Stats.UDPWritesTotal - oldStats.UDPWritesTotal
 		diffStats.UDPBytesWrittenTotal = inetdiagerStatsWrapper.Stats.UDPBytesWrittenTotal - oldStats.UDPBytesWrittenTotal
 		diffStats.UDPErrorsTotal = inetdiagerStatsWrapper.Stats.UDPErrorsTotal - oldStats.UDPErrorsTotal
+		for sink := range diffStats.FilterMatchedTotal {
+			diffStats.FilterMatchedTotal[sink] = inetdiagerStatsWrapper.Stats.FilterMatchedTotal[sink] - oldStats.FilterMatchedTotal[sink]
+			diffStats.FilterDroppedTotal[sink] = inetdiagerStatsWrapper.Stats.FilterDroppedTotal[sink] - oldStats.FilterDroppedTotal[sink]
+		}
+		for class := range diffStats.BottleneckTotal {
+			diffStats.BottleneckTotal[class] = inetdiagerStatsWrapper.Stats.BottleneckTotal[class] - oldStats.BottleneckTotal[class]
+		}
 		diffStats.StatsBlocked = inetdiagerStatsWrapper.Stats.StatsBlocked - oldStats.StatsBlocked
 
-		if debugLevel > 100 {
-			fmt.Println("inetdiagerStater AF:", kernelEnumToString[inetdiagerStatsWrapper.Af], "\tID:", inetdiagerStatsWrapper.ID, "\tstats:\t\t", inetdiagerStatsWrapper.Stats)
-			fmt.Println("inetdiagerStater AF:", kernelEnumToString[inetdiagerStatsWrapper.Af], "\tID:", inetdiagerStatsWrapper.ID, "\toldStats:\t", oldStats)
-			fmt.Println("inetdiagerStater AF:", kernelEnumToString[inetdiagerStatsWrapper.Af], "\tID:", inetdiagerStatsWrapper.ID, "\tdiffStats:\t", diffStats)
-		}
+		logger.Debug("inetdiagerStater diff", "af", kernelEnumToString[inetdiagerStatsWrapper.Af], "id", inetdiagerStatsWrapper.ID, "stats", inetdiagerStatsWrapper.Stats, "oldStats", oldStats, "diffStats", diffStats)
 
 		inetdiagerIn.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.InetdiagMsgInSizeTotal))
 		inetdiagerMsgs.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.InetdiagMsgCount))
 		inetdiagerRead.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.InetdiagMsgBytesReadTotal))
 		inetdiagerPad.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.PadBufferTotal))
+		inetdiagerDecodeErrors.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.DecodeErrorsTotal))
+		inetdiagerV4Mapped.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.V4MappedTotal))
 		inetdiagerUDPs.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.UDPWritesTotal))
 		inetdiagerUDPBytes.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.UDPBytesWrittenTotal))
 		inetdiagerUDPErrors.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.UDPErrorsTotal))
+		for sink, name := range exportfilter.SinkNames {
+			inetdiagerFilterMatched.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10), name).Add(float64(diffStats.FilterMatchedTotal[sink]))
+			inetdiagerFilterDropped.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10), name).Add(float64(diffStats.FilterDroppedTotal[sink]))
+		}
+		for class, count := range diffStats.BottleneckTotal {
+			inetdiagerBottleneck.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], bottleneck.String(xtcppb.XtcpRecordBottleneck(class))).Add(float64(count))
+		}
 		inetdiagerStatsBlocked.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af], strconv.FormatInt(int64(inetdiagerStatsWrapper.ID), 10)).Add(float64(diffStats.StatsBlocked))
 
 		inetdiagerMsgsTotal.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af]).Add(float64(diffStats.InetdiagMsgCount))
+		inetdiagerV4MappedTotal.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af]).Add(float64(diffStats.V4MappedTotal))
 		inetdiagerUDPsTotal.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af]).Add(float64(diffStats.UDPWritesTotal))
 		totalInetdiagerMsgs += diffStats.InetdiagMsgCount
 		totalInetdiagerUDPs += diffStats.UDPWritesTotal
@@ -308,9 +384,7 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 			// Just sending the totals for the moment
 			if *cliFlags.NoStatsd == false {
 				updateString = fmt.Sprintf("xtcp_%s_inetdiager_total_msgs:%d|g\nxtcp_%s_inetdiager_total_udps:%d|g", kernelEnumToString[inetdiagerStatsWrapper.Af], totalInetdiagerMsgs, kernelEnumToString[inetdiagerStatsWrapper.Af], totalInetdiagerUDPs)
-				if debugLevel > 100 {
-					fmt.Println("iStater AF:", kernelEnumToString[inetdiagerStatsWrapper.Af], "\tupdateString:\n", updateString)
-				}
+				logger.Debug("inetdiagerStater statsd", "af", kernelEnumToString[inetdiagerStatsWrapper.Af], "updateString", updateString)
 				udpBytesWritten, udpWriteErr = fmt.Fprintf(udpConn, updateString)
 				if udpWriteErr != nil {
 					inetdiagerStaterUDPErrors.WithLabelValues(kernelEnumToString[inetdiagerStatsWrapper.Af]).Inc()
@@ -321,9 +395,7 @@ func InetdiagerStater(in <-chan InetdiagerStatsWrapper, cliFlags cliflags.CliFla
 		}
 
 		if *cliFlags.HappyIstaterReportModulus == 1 || afInetdiagerStatsLoops[inetdiagerStatsWrapper.Af]%*cliFlags.HappyIstaterReportModulus == 1 {
-			if debugLevel > 10 {
-				fmt.Println("iStater afInetdiagerStatsLoops:", afInetdiagerStatsLoops[inetdiagerStatsWrapper.Af], "\tAF:", kernelEnumToString[inetdiagerStatsWrapper.Af], "\ttotalInetdiagerMsgs:\t", diffStats.InetdiagMsgCount, "/", totalInetdiagerMsgs, "\ttotalInetdiagerUDPs:", diffStats.UDPWritesTotal, "/", totalInetdiagerUDPs)
-			}
+			logger.Info("inetdiagerStater", "af", kernelEnumToString[inetdiagerStatsWrapper.Af], "afInetdiagerStatsLoops", afInetdiagerStatsLoops[inetdiagerStatsWrapper.Af], "msgs", diffStats.InetdiagMsgCount, "totalInetdiagerMsgs", totalInetdiagerMsgs, "udps", diffStats.UDPWritesTotal, "totalInetdiagerUDPs", totalInetdiagerUDPs)
 		}
 
 		// store the metrics for next time
@@ -0,0 +1,412 @@
+// Package logging is the structured, leveled logging for xtcp, using log/slog
+//
+// Each subsystem has its own level, which can be changed while xtcp is running (SIGHUP config reload,
+// SIGUSR1, or the admin API), so an on-call engineer can turn on netlinker tracing on one host without redeploying.
+//
+// Levels are trace, debug, info, warn, and error.  trace is below slog.LevelDebug, and is for the per message
+// logging in the hot paths (e.g. every netlink packet), which is far too much to leave on.
+//
+// Formats are:
+// - text:     slog.TextHandler key=value
+// - json:     slog.JSONHandler
+// - journald: key=value with the sd-daemon "<N>" priority prefix, and no time, because journald adds the time
+//
+// Repeated warnings and errors (same subsystem and message) are rate limited to one per logRateLimit,
+// and the next one logged includes the "suppressed" count.
+//
+// e.g.
+// logger := logging.Logger("netlinker").With("af", "v4", "id", id)
+//
+//	if logging.Tracing(logger) {
+//		logging.Trace(logger, "packet", "bytes", n)
+//	}
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+)
+
+// LevelTrace is more verbose than slog.LevelDebug
+const LevelTrace = slog.Level(-8)
+
+// Subsystems are the names passed to Logger, which each have their own level
+var Subsystems = []string{"main", "config", "admin", "disabler", "poller", "netlinker", "inetdiager", "staters", "streamer", "alerts"}
+
+var levelNames = map[slog.Level]string{
+	LevelTrace:      "trace",
+	slog.LevelDebug: "debug",
+	slog.LevelInfo:  "info",
+	slog.LevelWarn:  "warn",
+	slog.LevelError: "error",
+}
+
+var (
+	mu         sync.Mutex
+	output     slog.Handler          = newHandler(os.Stdout, "text")
+	levels                           = make(map[string]*slog.LevelVar)
+	savedLevel map[string]slog.Level // levels saved by ToggleTrace, nil when not tracing
+	limiter    = &rateLimiter{last: make(map[string]*rateEntry)}
+)
+
+func init() {
+	for _, s := range Subsystems {
+		levels[s] = new(slog.LevelVar)
+	}
+}
+
+// Setup configures the output from the cliFlags logFormat, logLevel, logLevels, and logRateLimit
+// Loggers use the new output immediately, even if they were created before Setup
+func Setup(w io.Writer, cliFlags cliflags.CliFlags) error {
+	if err := SetLevels(*cliFlags.LogLevel, *cliFlags.LogLevels); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	output = newHandler(w, *cliFlags.LogFormat)
+	limiter.setInterval(*cliFlags.LogRateLimit)
+	return nil
+}
+
+// Logger returns the logger for the subsystem, which must be one of the Subsystems
+func Logger(subsystem string) *slog.Logger {
+	level, ok := levels[subsystem]
+	if !ok {
+		panic("logging: unknown subsystem " + subsystem)
+	}
+	return slog.New(&handler{subsystem: subsystem, level: level})
+}
+
+// Tracing is true if the logger is at the trace level.  This guards the hot path trace logging,
+// so the arguments aren't built when tracing is off.
+func Tracing(logger *slog.Logger) bool {
+	return logger.Enabled(context.Background(), LevelTrace)
+}
+
+// Trace logs at LevelTrace
+func Trace(logger *slog.Logger, msg string, args ...any) {
+	logger.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// ParseLevel parses trace, debug, info, warn, or error
+func ParseLevel(s string) (slog.Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level:%q, expected trace, debug, info, warn, or error", s)
+}
+
+// SetLevels sets all the subsystems to level, and then the per subsystem overrides
+// e.g. SetLevels("info", "netlinker=trace,poller=debug")
+// Nothing is changed if there is an error
+func SetLevels(level string, subsystemLevels string) error {
+
+	all, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	newLevels := make(map[string]slog.Level)
+	for _, s := range Subsystems {
+		newLevels[s] = all
+	}
+
+	for _, override := range strings.Split(subsystemLevels, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("log levels:%q should be subsystem=level", override)
+		}
+		if _, ok := levels[parts[0]]; !ok {
+			return fmt.Errorf("log levels unknown subsystem:%q, expected one of:%s", parts[0], strings.Join(Subsystems, " "))
+		}
+		l, err := ParseLevel(parts[1])
+		if err != nil {
+			return err
+		}
+		newLevels[parts[0]] = l
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	savedLevel = nil
+	for s, l := range newLevels {
+		levels[s].Set(l)
+	}
+	return nil
+}
+
+// SetLevel sets one subsystem's level, leaving the others
+func SetLevel(subsystem string, level string) error {
+	v, ok := levels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown subsystem:%q, expected one of:%s", subsystem, strings.Join(Subsystems, " "))
+	}
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	savedLevel = nil
+	v.Set(l)
+	return nil
+}
+
+// Levels returns the current level name of each subsystem
+func Levels() map[string]string {
+	current := make(map[string]string)
+	for s, l := range levels {
+		current[s] = levelNames[l.Level()]
+	}
+	return current
+}
+
+// CurrentLevels returns the current levels as a logLevel, the most common level, and the logLevels overrides of the
+// other subsystems, so SetLevels(CurrentLevels()) sets the same levels.  This is the configuration in effect,
+// including the changes by the admin API and SIGUSR1.
+func CurrentLevels() (string, string) {
+	counts := make(map[slog.Level]int)
+	for _, l := range levels {
+		counts[l.Level()]++
+	}
+	var level slog.Level
+	most := 0
+	for l, n := range counts {
+		if n > most || (n == most && l < level) {
+			level, most = l, n
+		}
+	}
+	var overrides []string
+	for s, l := range levels {
+		if l.Level() != level {
+			overrides = append(overrides, s+"="+levelNames[l.Level()])
+		}
+	}
+	sort.Strings(overrides)
+	return levelNames[level], strings.Join(overrides, ",")
+}
+
+// ToggleTrace sets every subsystem to trace, or restores the previous levels if already toggled
+// It returns true if tracing is now on.  This is for SIGUSR1.
+func ToggleTrace() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if savedLevel != nil {
+		for s, l := range savedLevel {
+			levels[s].Set(l)
+		}
+		savedLevel = nil
+		return false
+	}
+	savedLevel = make(map[string]slog.Level)
+	for s, l := range levels {
+		savedLevel[s] = l.Level()
+		l.Set(LevelTrace)
+	}
+	return true
+}
+
+// currentOutput returns the output handler set by Setup
+func currentOutput() slog.Handler {
+	mu.Lock()
+	defer mu.Unlock()
+	return output
+}
+
+// newHandler creates the output handler for the format
+func newHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: LevelTrace, ReplaceAttr: replaceLevel}
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	case "journald":
+		return &journaldHandler{w: w, mu: new(sync.Mutex)}
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// replaceLevel prints the level names, so trace is "TRACE" rather than "DEBUG-4"
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			if name, ok := levelNames[level]; ok {
+				a.Value = slog.StringValue(strings.ToUpper(name))
+			}
+		}
+	}
+	return a
+}
+
+// handler filters on the subsystem level, rate limits, and adds the subsystem before passing to the output
+// The attrs and groups are kept as a list of operations, so they can be applied to whichever output is current
+type handler struct {
+	subsystem string
+	level     *slog.LevelVar
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		suppressed, ok := limiter.allow(h.subsystem+"\x00"+r.Message, r.Time)
+		if !ok {
+			return nil
+		}
+		if suppressed > 0 {
+			r = r.Clone()
+			r.AddAttrs(slog.Int("suppressed", suppressed))
+		}
+	}
+	out := currentOutput().WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, level: h.level, ops: append(ops, op)}
+}
+
+// journaldHandler writes key=value lines, prefixed with the sd-daemon priority (e.g. "<3>" for errors),
+// without the time, because journald records the time itself
+// https://www.freedesktop.org/software/systemd/man/sd-daemon.html
+type journaldHandler struct {
+	w   io.Writer
+	mu  *sync.Mutex
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, _ slog.Level) bool {
+	return true
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(priority(r.Level))
+	var out slog.Handler = slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: LevelTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return replaceLevel(groups, a)
+		},
+	})
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	if err := out.Handle(ctx, r); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+func (h *journaldHandler) with(op func(slog.Handler) slog.Handler) *journaldHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &journaldHandler{w: h.w, mu: h.mu, ops: append(ops, op)}
+}
+
+// priority is the syslog priority prefix for the level
+func priority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "<3>"
+	case level >= slog.LevelWarn:
+		return "<4>"
+	case level >= slog.LevelInfo:
+		return "<6>"
+	}
+	return "<7>"
+}
+
+// rateLimiter allows each key once per interval, and counts how many were suppressed in between
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]*rateEntry
+}
+
+type rateEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+func (l *rateLimiter) setInterval(interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = interval
+}
+
+// allow returns true if the key should be logged, with the number suppressed since it was last logged
+func (l *rateLimiter) allow(key string, now time.Time) (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interval <= 0 {
+		return 0, true
+	}
+	e, found := l.last[key]
+	if !found {
+		l.last[key] = &rateEntry{logged: now}
+		return 0, true
+	}
+	if now.Sub(e.logged) < l.interval {
+		e.suppressed++
+		return 0, false
+	}
+	suppressed = e.suppressed
+	e.logged = now
+	e.suppressed = 0
+	return suppressed, true
+}
+
+// SortedLevels returns "subsystem=level" pairs sorted by subsystem, for logging the current levels
+func SortedLevels() string {
+	current := Levels()
+	pairs := make([]string, 0, len(current))
+	for s, l := range current {
+		pairs = append(pairs, s+"="+l)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
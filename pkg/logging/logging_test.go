@@ -0,0 +1,213 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/logging"
+)
+
+// setup configures the logging to write to a buffer, with the cli flag args
+func setup(t *testing.T, args ...string) (*bytes.Buffer, cliflags.CliFlags) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := logging.Setup(&buf, cliFlags); err != nil {
+		t.Fatalf("Setup error:%v", err)
+	}
+	return &buf, cliFlags
+}
+
+// TestSetLevels checks the level parsing, and the per subsystem overrides
+func TestSetLevels(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		level     string
+		levels    string
+		expectErr bool
+		expected  map[string]string
+	}{
+		{"all", "warn", "", false, map[string]string{"main": "warn", "netlinker": "warn"}},
+		{"upper case", "DEBUG", "", false, map[string]string{"poller": "debug"}},
+		{"override", "info", "netlinker=trace, poller=error", false, map[string]string{"main": "info", "netlinker": "trace", "poller": "error"}},
+		{"bad level", "loud", "", true, nil},
+		{"bad override level", "info", "netlinker=loud", true, nil},
+		{"unknown subsystem", "info", "kernel=trace", true, nil},
+		{"missing equals", "info", "netlinker", true, nil},
+	}
+
+	for i, test := range tests {
+		err := logging.SetLevels(test.level, test.levels)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+			continue
+		}
+		levels := logging.Levels()
+		for subsystem, expected := range test.expected {
+			if levels[subsystem] != expected {
+				t.Errorf("test:%d %s\t%s expected:%s\tresult:%s", i, test.name, subsystem, expected, levels[subsystem])
+			}
+		}
+	}
+}
+
+// TestCurrentLevels checks the current levels are the most common level, and the overrides, after the changes
+func TestCurrentLevels(t *testing.T) {
+
+	if err := logging.SetLevels("warn", "netlinker=trace,poller=trace"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logging.SetLevel("main", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	level, levels := logging.CurrentLevels()
+	if level != "warn" || levels != "main=debug,netlinker=trace,poller=trace" {
+		t.Errorf("expected:warn main=debug,netlinker=trace,poller=trace\tresult:%s %s", level, levels)
+	}
+
+	// the current levels set the same levels
+	before := logging.SortedLevels()
+	if err := logging.SetLevels("info", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := logging.SetLevels(level, levels); err != nil || logging.SortedLevels() != before {
+		t.Errorf("expected:%s\tresult:%s err:%v", before, logging.SortedLevels(), err)
+	}
+}
+
+// TestFormats checks the text, json, and journald output
+func TestFormats(t *testing.T) {
+
+	var tests = []struct {
+		format   string
+		level    string
+		expected []string
+	}{
+		{"text", "info", []string{"level=INFO", `msg="poll complete"`, "subsystem=poller", "af=v4", "count=3", "time="}},
+		{"json", "info", []string{`"level":"INFO"`, `"msg":"poll complete"`, `"subsystem":"poller"`, `"af":"v4"`, `"count":3`}},
+		{"journald", "info", []string{"<6>", "level=INFO", "subsystem=poller", "af=v4", "count=3"}},
+		{"journald", "error", []string{"<3>", "level=ERROR"}},
+		{"text", "trace", []string{"level=TRACE"}},
+	}
+
+	for i, test := range tests {
+		buf, _ := setup(t, "-logFormat", test.format, "-logLevel", "trace", "-logRateLimit", "0s")
+		logger := logging.Logger("poller").With("af", "v4")
+		level, _ := logging.ParseLevel(test.level)
+		logger.Log(context.Background(), level, "poll complete", "count", 3)
+		for _, expected := range test.expected {
+			if !strings.Contains(buf.String(), expected) {
+				t.Errorf("test:%d %s %s\texpected:%s\tresult:%s", i, test.format, test.level, expected, buf.String())
+			}
+		}
+		if test.format == "journald" && (strings.Contains(buf.String(), "time=") || !strings.HasPrefix(buf.String(), "<")) {
+			t.Errorf("test:%d %s\texpected the priority prefix and no time\tresult:%s", i, test.format, buf.String())
+		}
+	}
+}
+
+// TestSubsystemFiltering checks each subsystem is filtered on its own level, including loggers created before Setup
+func TestSubsystemFiltering(t *testing.T) {
+
+	netlinker := logging.Logger("netlinker").With("id", 1)
+	buf, _ := setup(t, "-logLevel", "warn", "-logLevels", "netlinker=trace")
+	poller := logging.Logger("poller")
+
+	var tests = []struct {
+		name     string
+		log      func()
+		expected bool
+	}{
+		{"netlinker trace", func() { logging.Trace(netlinker, "netlinker trace") }, true},
+		{"netlinker debug", func() { netlinker.Debug("netlinker debug") }, true},
+		{"poller info", func() { poller.Info("poller info") }, false},
+		{"poller warn", func() { poller.Warn("poller warn") }, true},
+	}
+
+	for i, test := range tests {
+		test.log()
+		if strings.Contains(buf.String(), test.name) != test.expected {
+			t.Errorf("test:%d %s\texpected logged:%t\tresult:%s", i, test.name, test.expected, buf.String())
+		}
+	}
+
+	if !logging.Tracing(netlinker) || logging.Tracing(poller) {
+		t.Errorf("expected Tracing netlinker:true poller:false\tresult:%t %t", logging.Tracing(netlinker), logging.Tracing(poller))
+	}
+
+	if err := logging.SetLevel("poller", "info"); err != nil {
+		t.Fatal(err)
+	}
+	poller.Info("poller info after SetLevel")
+	if !strings.Contains(buf.String(), "poller info after SetLevel") {
+		t.Errorf("expected the runtime level change to apply to the existing logger\tresult:%s", buf.String())
+	}
+}
+
+// TestRateLimit checks repeated warnings are suppressed, and the suppressed count is logged with the next one
+func TestRateLimit(t *testing.T) {
+
+	buf, _ := setup(t, "-logRateLimit", "100ms")
+	logger := logging.Logger("inetdiager")
+
+	for i := 0; i < 3; i++ {
+		logger.Error("rate limited error", "i", i)
+	}
+	logger.Error("different error")
+	logger.Info("info is not rate limited")
+	logger.Info("info is not rate limited")
+
+	var tests = []struct {
+		name     string
+		count    int
+		expected int
+	}{
+		{"repeated", strings.Count(buf.String(), "rate limited error"), 1},
+		{"different", strings.Count(buf.String(), "different error"), 1},
+		{"info", strings.Count(buf.String(), "info is not rate limited"), 2},
+	}
+	for i, test := range tests {
+		if test.count != test.expected {
+			t.Errorf("test:%d %s\texpected:%d\tresult:%d\n%s", i, test.name, test.expected, test.count, buf.String())
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	logger.Error("rate limited error", "i", 3)
+	if !strings.Contains(buf.String(), "i=3 suppressed=2") {
+		t.Errorf("expected suppressed=2 after the interval\tresult:%s", buf.String())
+	}
+}
+
+// TestToggleTrace checks SIGUSR1 style toggling restores the previous levels
+func TestToggleTrace(t *testing.T) {
+
+	setup(t, "-logLevel", "info", "-logLevels", "poller=error")
+
+	if !logging.ToggleTrace() {
+		t.Fatal("expected tracing on")
+	}
+	for subsystem, level := range logging.Levels() {
+		if level != "trace" {
+			t.Errorf("%s expected:trace\tresult:%s", subsystem, level)
+		}
+	}
+
+	if logging.ToggleTrace() {
+		t.Fatal("expected tracing off")
+	}
+	levels := logging.Levels()
+	if levels["main"] != "info" || levels["poller"] != "error" {
+		t.Errorf("expected the levels restored\tresult:%s", logging.SortedLevels())
+	}
+}
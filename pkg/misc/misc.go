@@ -10,10 +10,8 @@ import (
 	"log"
 	"os"
 	"runtime"
-)
 
-const (
-	debugLevel int = 11
+	"github.com/Edgio/xtcp/pkg/logging"
 )
 
 var (
@@ -41,9 +39,7 @@ func GetHostname() string {
 	if err != nil {
 		log.Fatalf("os.Hostname() error:%s", err)
 	}
-	if debugLevel > 100 {
-		fmt.Println("Hostname:", hostname)
-	}
+	logging.Logger("main").Debug("GetHostname", "hostname", hostname)
 	return hostname
 }
 
@@ -121,9 +117,7 @@ func CheckFilePermissions(filename string, permissions string) bool {
 	}
 	filePerms := fmt.Sprintf("%#o", fileStat.Mode().Perm())
 	if filePerms != permissions {
-		if debugLevel > 10 {
-			fmt.Println("filePerms:", filePerms, "\t do NOT match:", permissions)
-		}
+		logging.Logger("main").Warn("CheckFilePermissions do NOT match", "filename", filename, "filePerms", filePerms, "permissions", permissions)
 		return false
 	}
 	return true
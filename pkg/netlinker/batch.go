@@ -0,0 +1,72 @@
+package netlinker
+
+import (
+	"sync"
+	"syscall"
+)
+
+// Batch is what the netlinkers send to the inetdiagers over the channel, which is all the sampled inetdiag
+// messages of one netlink packet.  Sending a packet at a time, rather than a message at a time, cuts the channel
+// operations, and the context switching between the goroutines, by the messages per packet (~70 with 32KB packets).
+//
+// The netlink packet is received directly into the packet buffer of the Batch, and the messages are slices of the
+// packet buffer, so the messages aren't copied.  The Batches, and their packet buffers, come from a sync.Pool, so
+// they aren't allocated for every packet either.
+//
+// The inetdiager must Release the Batch once it's done with the messages, after which the messages mustn't be used,
+// because the packet buffer is reused.  inetdiag.Decode doesn't keep references to the message, so this is safe.
+type Batch struct {
+	TimeSpec syscall.Timespec //https://golang.org/pkg/syscall/#Timespec
+	Sequence uint32           // the nlmsg_seq of the dump request, which the kernel echoes, so it's the poll ID
+	Messages []Message
+	packet   []byte
+}
+
+// Message is an inetdiag message, without the netlink header, which is a slice of the Batch packet buffer
+// SamplingModulus is the samplingModulus when the message was sampled, which is stamped into the XtcpRecord
+type Message struct {
+	InetDiagMessage []byte
+	SamplingModulus int
+}
+
+//https://golang.org/pkg/syscall/#Timespec
+// type Timespec struct {
+//     Sec  int64
+//     Nsec int64
+// }
+
+// batchPool is shared by all the netlinkers.  The packet buffers are all the same size, unless packetSize is
+// changed, in which case the smaller buffers are just replaced as they come out of the pool.
+var batchPool sync.Pool
+
+// NewBatch returns an empty Batch from the pool, with a packet buffer of packetSize bytes
+func NewBatch(packetSize int) *Batch {
+	b, ok := batchPool.Get().(*Batch)
+	if !ok {
+		b = &Batch{}
+	}
+	if cap(b.packet) < packetSize {
+		b.packet = make([]byte, packetSize)
+	}
+	b.packet = b.packet[:packetSize]
+	b.Messages = b.Messages[:0]
+	b.TimeSpec = syscall.Timespec{}
+	b.Sequence = 0
+	return b
+}
+
+// Packet is the packet buffer, which the netlink packet is received into
+func (b *Batch) Packet() []byte {
+	return b.packet
+}
+
+// Add adds the message to the Batch, which must be a slice of the packet buffer, or at least not modified until
+// the Batch is released
+func (b *Batch) Add(inetDiagMessage []byte, samplingModulus int) {
+	b.Messages = append(b.Messages, Message{InetDiagMessage: inetDiagMessage, SamplingModulus: samplingModulus})
+}
+
+// Release returns the Batch to the pool.  The Batch, and its messages, mustn't be used after Release.
+func (b *Batch) Release() {
+	batchPool.Put(b)
+}
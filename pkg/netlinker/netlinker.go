@@ -1,92 +1,69 @@
 // Package netlinker is the netlinker go routine of the xtcp package
 //
 // Netlinker recieves netlink messages from the kernel and passes
-// the discrete messages to the inetdiagers workers
+// the discrete messages, a packet at a time, to the inetdiagers workers
 package netlinker
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
-	"io"
 	"net"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
 	"github.com/Edgio/xtcp/pkg/cliflags"
 	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/misc"
 	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/sampler"
 	"golang.org/x/sys/unix"
 )
 
-const (
-	debugLevel int = 11
-)
-
-// TimeSpecandInetDiagMessage struct is the message that is sent from the recvfrom to the NetLink Message workers
-// This includes the timeSpec which is the time the netlink dump request was sent (or really just before that)
-type TimeSpecandInetDiagMessage struct {
-	TimeSpec        syscall.Timespec //https://golang.org/pkg/syscall/#Timespec
-	InetDiagMessage []byte
-}
-
-// TODO move to slice of slice
-//InetDiagMessage [][]byte
-
-//https://golang.org/pkg/syscall/#Timespec
-// type Timespec struct {
-//     Sec  int64
-//     Nsec int64
-// }
+// packageLogger is for the functions without their own logger.  The level and output are looked up when logging,
+// so it's fine to create at init
+var packageLogger = logging.Logger("netlinker")
 
 // CheckNetlinkMessageType checks for netlink message types NLMSG_NOOP, NLMSG_DONE, NLMSG_ERROR, NLMSG_OVERRUN
 func CheckNetlinkMessageType(id int, af *uint8, Type uint16) (netlinkMsgComplete bool, netlinkMsgDone bool, errorCount int) {
 
+	var typeName string
 	switch Type {
 	case unix.NLMSG_NOOP:
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tunix.NLMSG_NOOP")
-		}
+		typeName = "NLMSG_NOOP"
 		errorCount++
 		netlinkMsgComplete = true
-		break
 	case unix.NLMSG_DONE:
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tunix.NLMSG_DONE") // Yay!
-		}
+		typeName = "NLMSG_DONE" // Yay!
 		netlinkMsgDone = true
 		netlinkMsgComplete = true
-		break
 	case unix.NLMSG_ERROR:
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tunix.NLMSG_ERROR")
-		}
+		typeName = "NLMSG_ERROR"
 		errorCount++
 		netlinkMsgComplete = true
-		break
 	case unix.NLMSG_OVERRUN:
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tunix.NLMSG_OVERRUN")
-		}
+		typeName = "NLMSG_OVERRUN"
 		errorCount++
 		netlinkMsgComplete = true
-		break
 	default:
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Type default")
-		}
+		typeName = "default"
+	}
+	if logging.Tracing(packageLogger) {
+		logging.Trace(packageLogger, "netlinkMsgHeader.Type", "af", misc.KernelEnumToString[*af], "id", id, "type", typeName)
 	}
 	return netlinkMsgComplete, netlinkMsgDone, errorCount
 }
 
-// Netlinker makes the syscall to read from the netlink socket
+// Netlinker makes the syscall to read from the netlink socket (via the receiver, see Receiver)
 // Then we break the netlink messages up into their Inetdiag messages, and stream to the downstream workers
 // over the channel.
 //
-// TODO - Currently we're doing a single x1 inetdiag message on the channel at a time.
-// profile.TraceProfile does show gaps between messages, so we should test batching.
-// (Probably should add a slice capability with a configurable max length)
+// The inetdiag messages are sent a packet at a time, as a Batch.  Originally this was a single x1 inetdiag
+// message on the channel at a time, with a copy of each message, and profile.TraceProfile showed gaps between
+// the messages.  Now each packet is received into a pooled packet buffer, and the messages are slices of it,
+// so there is no allocation or copy per message (see Batch, and BenchmarkNetlinker).
 //
 // For the purposes to checking to see if it's better to close the pipeline workers down between
 // netlink inet_diag dump requests, or not, I've added logic here to allow this worker to close or not
@@ -107,21 +84,38 @@ func CheckNetlinkMessageType(id int, af *uint8, Type uint16) (netlinkMsgComplete
 // or your just going to thrash with system calls.  Similarly, probably don't run too many netlinker,
 // workers.
 // With x4 workers and 5 second timeout seems reasonable.
-func Netlinker(id int, af *uint8, socketFileDescriptor int, out chan<- TimeSpecandInetDiagMessage, netlinkerRecievedDoneCh chan<- time.Time, wg *sync.WaitGroup, startTime time.Time, cliFlags cliflags.CliFlags, netlinkerStaterCh chan<- netlinkerstater.NetlinkerStatsWrapper) {
+//
+// Which messages are sent to the inetdiagers is decided by the msgSampler (see the sampler package)
+//
+// The receiver is usually the netlink socket, optionally capturing the packets (CaptureReceiver),
+// or a capture file being replayed (see the replay package)
+//
+// The netlinker which receives the NLMSG_DONE stops straight away, rather than waiting for the socket timeout,
+// which is what lets each dump shard have its own netlinker (see dumpShards in the poller)
+//
+// On shutdown (ctx cancelled) with shutdownAbortDump, the netlinker stops after the current packet,
+// so the rest of the dump is discarded.  Otherwise the dump is read to the end as normal.
+func Netlinker(ctx context.Context, id int, af *uint8, receiver Receiver, out chan<- *Batch, netlinkerRecievedDoneCh chan<- time.Time, wg *sync.WaitGroup, startTime time.Time, cliFlags cliflags.CliFlags, netlinkerStaterCh chan<- netlinkerstater.NetlinkerStatsWrapper, ctl *admin.Controller, msgSampler sampler.MessageSampler) {
 
 	defer wg.Done()
 
-	var packetBuffer []byte
+	logger := packageLogger.With("af", misc.KernelEnumToString[*af], "id", id)
+
+	var packetSize int
 	var packetsProcessed int
 	var netlinkMsgHeader inetdiag.NlMsgHdr
 	var packetBufferBytesRemaining int
 	var packetBufferBytesRead int
 	var packetBufferInSizeTotal int
 	var netlinkMsgCountTotal int
+	// sampleCounts are this netlinker's messages of the dump, for the msgSampler
+	var sampleCounts sampler.Counts
 	var packetBufferBytesReadTotal int
 	var inetdiagMsgCopyBytesTotal int
+	var batchesSent int
 	var nastyContinue int
 	var netlinkMsgErrorCount int
+	var dumpInterrupted int
 	var outBlocked int
 	var blockedStartTime time.Time
 	var blockedDuration time.Duration
@@ -129,44 +123,64 @@ func Netlinker(id int, af *uint8, socketFileDescriptor int, out chan<- TimeSpeca
 
 	//** is not double pointer.  it is multiply by pointer.
 	if *cliFlags.PacketSize == 0 {
-		packetBuffer = make([]byte, syscall.Getpagesize()**cliFlags.PacketSizeMply)
+		packetSize = syscall.Getpagesize() * *cliFlags.PacketSizeMply
 	} else {
-		packetBuffer = make([]byte, *cliFlags.PacketSize**cliFlags.PacketSizeMply)
+		packetSize = *cliFlags.PacketSize * *cliFlags.PacketSizeMply
 	}
 
-	if debugLevel > 100 {
-		fmt.Println("netlinker:", id, "\taf:", *af, "\tbinary.size(packetBuffer):", binary.Size(packetBuffer))
-	}
+	logger.Debug("packetBuffer", "size", packetSize)
+
+	// We're using timeSpec 64bit to match the kernel
+	// https://github.com/torvalds/linux/blob/458ef2a25e0cbdc216012aa2b9cf549d64133b08/include/linux/time64.h#L13
+
+	// Please UnixNano() includes the .Unix() seconds
+	// https://golang.org/pkg/time/#Time.UnixNano which includes the seconds
+	var timeSpec syscall.Timespec
+	tempTime := startTime.UnixNano()
+	timeSpec.Sec, timeSpec.Nsec = tempTime/1e9, tempTime%1e9 //note seconds, and nanos split out here
+
+	// The samplingModulus can be changed at runtime via the admin API, or by the adaptive sampler, so read it once per poll
+	var samplingModulus = ctl.EffectiveSamplingModulus(*af)
+
+	ctl.SetWorkerState("netlinker", *af, id, "receiving", 0)
+
+	// The batch is only replaced once it's sent, so packets without any sampled messages reuse the same batch
+	var batch *Batch
+	defer func() {
+		if batch != nil {
+			batch.Release()
+		}
+	}()
 
 	var packetsProcessingnetlinkerDone = false
 	for packetsProcessed = 0; !packetsProcessingnetlinkerDone; packetsProcessed++ {
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketsProcessed:", packetsProcessed, "\tsyscall.Recvfrom called")
+		if *cliFlags.ShutdownAbortDump && ctx.Err() != nil {
+			logger.Info("shutdown, aborting the dump")
+			break
 		}
-		packetBufferInSize, _, err := syscall.Recvfrom(socketFileDescriptor, packetBuffer, 0)
+		if logging.Tracing(logger) {
+			logging.Trace(logger, "syscall.Recvfrom called", "packetsProcessed", packetsProcessed)
+		}
+		if batch == nil {
+			batch = NewBatch(packetSize)
+		}
+		packetBuffer := batch.Packet()
+		packetBufferInSize, err := receiver.Recvfrom(packetBuffer)
 
 		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-			if debugLevel > 100 {
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tsyscall.Recvfrom timeout")
-			}
+			logger.Debug("syscall.Recvfrom timeout")
 			packetsProcessingnetlinkerDone = true
 			break //This is where we can break out from a timeout if the socket has timeout configured
 		}
 		if err != nil {
-			if debugLevel > 100 {
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tunix.Recvfrom:", err)
-				//log.Fatalf("unix.Recvfrom", err)
-			}
+			logger.Warn("unix.Recvfrom", "err", err)
 			nastyContinue++
 			continue // continuing is a bit nasty, but is probably safe enough
 		}
 
 		// Little sanity check
 		if packetBufferInSize < unix.NLMSG_HDRLEN {
-			if debugLevel > 100 {
-				//log.Fatalf("netlinker:", id, "\tNLMSG_HDRLEN.Recvfrom too small") // fatal
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tNLMSG_HDRLEN.Recvfrom too small")
-			}
+			logger.Warn("NLMSG_HDRLEN.Recvfrom too small", "packetBufferInSize", packetBufferInSize)
 			nastyContinue++
 			continue // continuing is a bit nasty, but is probably safe enough
 		}
@@ -174,35 +188,28 @@ func Netlinker(id int, af *uint8, socketFileDescriptor int, out chan<- TimeSpeca
 		packetBufferInSizeTotal += packetBufferInSize
 		packetBufferBytesRemaining = packetBufferInSize
 		packetBufferBytesRead = 0
-		packetReader := bytes.NewReader(packetBuffer)
-		if debugLevel > 100 {
-			fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferInSize:", packetBufferInSize, "\tpacketsProcessed:", packetsProcessed, "\tpacketBufferInSizeTotal(M):", packetBufferInSizeTotal/10^6, "\tnetlinkMsgCountTotal:", netlinkMsgCountTotal)
+		if logging.Tracing(logger) {
+			logging.Trace(logger, "packet", "packetBufferInSize", packetBufferInSize, "packetsProcessed", packetsProcessed, "packetBufferInSizeTotal", packetBufferInSizeTotal, "netlinkMsgCountTotal", netlinkMsgCountTotal)
 		}
 		var netlinkMsgComplete = false
 		for netlinkMsgCount := 0; !netlinkMsgComplete && packetBufferBytesRemaining >= syscall.NLMSG_HDRLEN; netlinkMsgCount++ {
 
-			err := binary.Read(packetReader, binary.LittleEndian, &netlinkMsgHeader)
-			if err != nil {
-				if debugLevel > 100 {
-					fmt.Println("binary.Read netlinkMsgHeader failed:", err)
-				}
-				netlinkMsgComplete = true
-				if err == io.EOF {
-					if debugLevel > 100 {
-						fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketReader EOF")
-					}
-				}
-				break
+			netlinkMsgHeader = decodeNlMsgHdr(packetBuffer[packetBufferBytesRead:])
+			if logging.Tracing(logger) {
+				logging.Trace(logger, "netlinkMsgHeader",
+					"packetBufferBytesRead", packetBufferBytesRead,
+					"packetBufferBytesRemaining", packetBufferBytesRemaining,
+					"length", netlinkMsgHeader.Length,
+					"type", netlinkMsgHeader.Type,
+					"flags", netlinkMsgHeader.Flags)
 			}
-			packetBufferBytesRead += binary.Size(netlinkMsgHeader)
-			packetBufferBytesRemaining -= binary.Size(netlinkMsgHeader)
-			if debugLevel > 100 {
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRead:", packetBufferBytesRead)
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRemaining:", packetBufferBytesRemaining)
-
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Length:", netlinkMsgHeader.Length)
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Type:", netlinkMsgHeader.Type)
-				fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Flags:", netlinkMsgHeader.Flags)
+
+			// The message must fit in what's left of the packet, otherwise the packet was truncated, or is garbage
+			netlinkMsgLength := int(netlinkMsgHeader.Length)
+			if netlinkMsgLength < syscall.NLMSG_HDRLEN || netlinkMsgLength > packetBufferBytesRemaining {
+				logger.Warn("netlinkMsgHeader.Length doesn't fit the packet", "length", netlinkMsgLength, "packetBufferBytesRemaining", packetBufferBytesRemaining)
+				netlinkMsgErrorCount++
+				break
 			}
 
 			var errorCount int
@@ -213,109 +220,88 @@ func Netlinker(id int, af *uint8, socketFileDescriptor int, out chan<- TimeSpeca
 			}
 			if netlinkMsgDone {
 				netlinkerRecievedDoneCh <- time.Now() // DONE!!
+				// The dump is complete, so there's no need to wait for the socket timeout
+				packetsProcessingnetlinkerDone = true
 			}
 			if netlinkMsgComplete {
 				break
 			}
 
-			switch netlinkMsgHeader.Flags {
+			// NLM_F_DUMP_INTR means the socket table changed during the dump, so some sockets may be missing
+			// or duplicated, but the messages are still fine to use
+			if netlinkMsgHeader.Flags&unix.NLM_F_DUMP_INTR != 0 {
+				dumpInterrupted++
+			}
+
+			switch netlinkMsgHeader.Flags &^ unix.NLM_F_DUMP_INTR {
 			case unix.NLM_F_MULTI:
-				if debugLevel > 100 {
-					fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Flags unix.NLM_F_MULTI")
-				}
 
-				// Make a copy of the data of the packet and send to the next layer in the pipeline
-				var timeSpecandInetDiagMessageCopy TimeSpecandInetDiagMessage
-				// We're using timeSpec 64bit to match the kernel
-				// https://github.com/torvalds/linux/blob/458ef2a25e0cbdc216012aa2b9cf549d64133b08/include/linux/time64.h#L13
-
-				// Please UnixNano() includes the .Unix() seconds
-				// https://golang.org/pkg/time/#Time.UnixNano which includes the seconds
-				var tempTime int64
-				tempTime = startTime.UnixNano()
-				timeSpecandInetDiagMessageCopy.TimeSpec.Sec, timeSpecandInetDiagMessageCopy.TimeSpec.Nsec = tempTime/1e9, tempTime%1e9 //note seconds, and nanos split out here
-				if debugLevel > 1000 {
-					fmt.Println("netlinker:", id, "\taf:", *af, "\ttimeSpecandInetDiagMessageCopy.TimeSpec.Sec:", timeSpecandInetDiagMessageCopy.TimeSpec.Sec)
-					fmt.Println("netlinker:", id, "\taf:", *af, "\ttimeSpecandInetDiagMessageCopy.TimeSpec.Nsec:", timeSpecandInetDiagMessageCopy.TimeSpec.Nsec)
-				}
-				timeSpecandInetDiagMessageCopy.InetDiagMessage = make([]byte, int(netlinkMsgHeader.Length)-binary.Size(netlinkMsgHeader))
-
-				err := binary.Read(packetReader, binary.LittleEndian, &timeSpecandInetDiagMessageCopy.InetDiagMessage)
-				if err != nil {
-					if debugLevel > 100 {
-						fmt.Println("netlinker:", id, "\taf:", *af, "\tbinary.Read inetdiagMsgCopy failed:", err)
-					}
-					if err == io.EOF {
-						if debugLevel > 100 {
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketReader EOF")
-						}
-						break
-					}
-				}
-				packetBufferBytesRead += binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage)
-				packetBufferBytesRemaining -= binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage)
-				packetBufferBytesReadTotal += binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage)
-
-				if *cliFlags.SamplingModulus == 1 || netlinkMsgCount%*cliFlags.SamplingModulus == 1 {
-					// This was originally just "out <- inetdiagMsgCopy", but using select per https://blog.golang.org/pipelines
-					// It's better golang practise to do this via select.  whichever is non-blocking first will proceed.
-					select {
-					// send to the next level
-					//case out <- inetdiagMsgCopy:
-					case out <- timeSpecandInetDiagMessageCopy:
-						if debugLevel > 100 {
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tsent inetdiagMsgCopy\tbinary.Size(inetdiagMsgCopy):", binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage), "\tnetlinkMsgCount:", netlinkMsgCount, "\tpacketsProcessed:", packetsProcessed)
-						}
-						if debugLevel > 100 {
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRead:", packetBufferBytesRead)
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRemaining:", packetBufferBytesRemaining)
-						}
-						inetdiagMsgCopyBytesTotal += binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage)
-						break
-						// We could include the netlinkerDone here, which would allow the worker to shutdown before finishing processing the full netlink message
-						// Not going to do that currently though, as this is cleaner.
-						// case _ = <-netlinkerDone:
-						// 	recvfromWorkernetlinkerDone = true
-						// 	break
-					default:
-						// Default will catch the case where the above send on the channel will block.
-						// This is important to track because it means we'll know if the channel size (promPollerChSize) is too small
-						blockedStartTime = time.Now()
-						outBlocked++
-						out <- timeSpecandInetDiagMessageCopy //block
-						blockedDuration = time.Since(blockedStartTime)
-						if blockedDuration > longestBlockedDuration {
-							longestBlockedDuration = blockedDuration
-						}
-						if debugLevel > 100 {
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tsent inetdiagMsgCopy\tbinary.Size(inetdiagMsgCopy):", binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage), "\tnetlinkMsgCount:", netlinkMsgCount, "\tpacketsProcessed:", packetsProcessed)
-						}
-						if debugLevel > 100 {
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRead:", packetBufferBytesRead)
-							fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRemaining:", packetBufferBytesRemaining)
-						}
-						inetdiagMsgCopyBytesTotal += binary.Size(timeSpecandInetDiagMessageCopy.InetDiagMessage)
-					}
-				}
+				// The inetdiag message is a slice of the packet buffer, so it isn't copied
+				inetDiagMessage := packetBuffer[packetBufferBytesRead+syscall.NLMSG_HDRLEN : packetBufferBytesRead+netlinkMsgLength]
+				packetBufferBytesReadTotal += len(inetDiagMessage)
 
-				if packetBufferBytesRemaining == 0 {
-					if debugLevel > 100 {
-						fmt.Println("netlinker:", id, "\taf:", *af, "\tpacketBufferBytesRemaining ZERO! Next packet please!")
-					}
-					// we don't really need to set this because of the packetBufferBytesRemaining size test, but hopefully it's more clear this way
-					netlinkMsgComplete = true
+				sampled, modulus := msgSampler.Sample(inetDiagMessage, &sampleCounts, samplingModulus)
+				if sampled {
+					batch.Sequence = netlinkMsgHeader.Sequence
+					batch.Add(inetDiagMessage, modulus)
+					inetdiagMsgCopyBytesTotal += len(inetDiagMessage)
 				}
 			default:
-				if debugLevel > 100 {
-					fmt.Println("netlinker:", id, "\taf:", *af, "\tnetlinkMsgHeader.Flags default")
-				}
+				logger.Debug("netlinkMsgHeader.Flags default", "flags", netlinkMsgHeader.Flags)
 				netlinkMsgErrorCount++ //going to increment this error counter, so we can see if this ever happens
-				break
 			}
 			//switch netlinkMsgHeader.Flags {
+
+			// The next message starts at the NLMSG_ALIGNTO boundary
+			netlinkMsgLength = nlmsgAlign(netlinkMsgLength)
+			if netlinkMsgLength > packetBufferBytesRemaining {
+				netlinkMsgLength = packetBufferBytesRemaining
+			}
+			packetBufferBytesRead += netlinkMsgLength
+			packetBufferBytesRemaining -= netlinkMsgLength
+			if packetBufferBytesRemaining == 0 {
+				if logging.Tracing(logger) {
+					logging.Trace(logger, "packetBufferBytesRemaining ZERO! Next packet please!")
+				}
+				// we don't really need to set this because of the packetBufferBytesRemaining size test, but hopefully it's more clear this way
+				netlinkMsgComplete = true
+			}
 			netlinkMsgCountTotal++
 		}
 		//for netlinkMsgCount := 0 ; !netlinkMsgComplete && packetBufferBytesRemaining >= syscall.NLMSG_HDRLEN; netlinkMsgCount++ {
+
+		if len(batch.Messages) == 0 {
+			continue
+		}
+		batch.TimeSpec = timeSpec
+
+		// This was originally just "out <- inetdiagMsgCopy", but using select per https://blog.golang.org/pipelines
+		// It's better golang practise to do this via select.  whichever is non-blocking first will proceed.
+		select {
+		// send to the next level
+		case out <- batch:
+			// We could include the netlinkerDone here, which would allow the worker to shutdown before finishing processing the full netlink message
+			// Not going to do that currently though, as this is cleaner.
+		default:
+			// Default will catch the case where the above send on the channel will block.
+			// This is important to track because it means we'll know if the channel size (promPollerChSize) is too small
+			blockedStartTime = time.Now()
+			outBlocked++
+			out <- batch //block
+			blockedDuration = time.Since(blockedStartTime)
+			if blockedDuration > longestBlockedDuration {
+				longestBlockedDuration = blockedDuration
+			}
+		}
+		if logging.Tracing(logger) {
+			logging.Trace(logger, "sent batch",
+				"messages", len(batch.Messages),
+				"packetsProcessed", packetsProcessed,
+				"packetBufferInSize", packetBufferInSize)
+		}
+		batchesSent++
+		// The inetdiager owns the batch now, and releases it
+		batch = nil
 	}
 	//for packetsProcessed := 0; !packetsProcessingnetlinkerDone; packetsProcessed++ {
 
@@ -329,13 +315,37 @@ func Netlinker(id int, af *uint8, socketFileDescriptor int, out chan<- TimeSpeca
 			NetlinkMsgCountTotal:       netlinkMsgCountTotal,
 			PacketBufferBytesReadTotal: packetBufferBytesReadTotal,
 			InetdiagMsgCopyBytesTotal:  inetdiagMsgCopyBytesTotal,
+			BatchesSent:                batchesSent,
 			NetlinkMsgErrorCount:       netlinkMsgErrorCount,
+			DumpInterrupted:            dumpInterrupted,
 			OutBlocked:                 outBlocked,
 			LongestBlockedDuration:     longestBlockedDuration,
+			SamplingModulus:            samplingModulus,
 		},
 	}
 
-	if debugLevel > 100 {
-		fmt.Println("netlinker:", id, "\taf:", *af, "\tclose")
+	if dumpInterrupted > 0 {
+		logger.Warn("dump interrupted (NLM_F_DUMP_INTR), the sockets changed during the dump, so some may be missing or duplicated", "messages", dumpInterrupted)
 	}
+
+	ctl.SetWorkerState("netlinker", *af, id, "done", packetsProcessed)
+
+	logger.Debug("close", "packetsProcessed", packetsProcessed)
+}
+
+// decodeNlMsgHdr decodes the netlink message header at the start of b, which must be at least NLMSG_HDRLEN
+// This is the same as binary.Read, without the reflection, or the allocations
+func decodeNlMsgHdr(b []byte) inetdiag.NlMsgHdr {
+	return inetdiag.NlMsgHdr{
+		Length:   binary.LittleEndian.Uint32(b[0:4]),
+		Type:     binary.LittleEndian.Uint16(b[4:6]),
+		Flags:    binary.LittleEndian.Uint16(b[6:8]),
+		Sequence: binary.LittleEndian.Uint32(b[8:12]),
+		Pid:      binary.LittleEndian.Uint32(b[12:16]),
+	}
+}
+
+// nlmsgAlign is NLMSG_ALIGN, rounding up to the NLMSG_ALIGNTO (4) byte boundary
+func nlmsgAlign(length int) int {
+	return (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
 }
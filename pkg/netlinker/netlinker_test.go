@@ -3,11 +3,24 @@ package netlinker_test
 // TODO Write more tests!!!
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"runtime"
 	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/fakenetlink"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
 	"github.com/Edgio/xtcp/pkg/netlinker"
+	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/sampler"
 	"golang.org/x/sys/unix"
 )
 
@@ -67,3 +80,272 @@ func TestCheckNetlinkMessageTypes(t *testing.T) {
 		}
 	}
 }
+
+// packets is a Receiver of the prebuilt packets, so the benchmarks don't include building the dump
+type packets struct {
+	packets [][]byte
+	next    int
+}
+
+func (p *packets) Recvfrom(packetBuffer []byte) (int, error) {
+	if p.next >= len(p.packets) {
+		return -1, syscall.EAGAIN
+	}
+	p.next++
+	return copy(packetBuffer, p.packets[p.next-1]), nil
+}
+
+// dump returns the fake kernel's packets for the dump
+func dump(tb testing.TB, af uint8, config fakenetlink.Config) [][]byte {
+	transport, _ := fakenetlink.New(config).Open(0)
+	request := make([]byte, unix.NLMSG_HDRLEN+2)
+	request[unix.NLMSG_HDRLEN] = af
+	if err := transport.Send(request); err != nil {
+		tb.Fatal(err)
+	}
+	var p [][]byte
+	for {
+		packetBuffer := make([]byte, 65536)
+		n, err := transport.Recvfrom(packetBuffer)
+		if err != nil {
+			return p
+		}
+		p = append(p, packetBuffer[:n])
+	}
+}
+
+// runner runs the netlinker over the packets, with consume called for every batch.  The flags, the controller,
+// the channels, and the consumer are set up once, so the benchmarks only time the netlinker.
+type runner struct {
+	af         uint8
+	packets    packets
+	cliFlags   cliflags.CliFlags
+	ctl        *admin.Controller
+	msgSampler sampler.MessageSampler
+	out        chan *netlinker.Batch
+	doneCh     chan time.Time
+	statsCh    chan netlinkerstater.NetlinkerStatsWrapper
+	consumed   chan struct{}
+}
+
+func newRunner(tb testing.TB, af uint8, p [][]byte, modulus int, consume func(*netlinker.Batch)) *runner {
+	cliFlags := config.Register(flag.NewFlagSet("test", flag.ContinueOnError))
+	ctl := admin.NewController(cliFlags)
+	if err := ctl.SetSamplingModulus(modulus); err != nil {
+		tb.Fatal(err)
+	}
+	r := &runner{
+		af:         af,
+		packets:    packets{packets: p},
+		cliFlags:   cliFlags,
+		ctl:        ctl,
+		msgSampler: sampler.ModulusSampler{},
+		out:        make(chan *netlinker.Batch, *cliFlags.NetlinkerChPackets),
+		doneCh:     make(chan time.Time, 1),
+		statsCh:    make(chan netlinkerstater.NetlinkerStatsWrapper, 1),
+		consumed:   make(chan struct{}),
+	}
+	// A nil batch marks the end of a run
+	go func() {
+		for batch := range r.out {
+			if batch == nil {
+				r.consumed <- struct{}{}
+				continue
+			}
+			consume(batch)
+		}
+	}()
+	return r
+}
+
+// run runs the netlinker over the packets once, waits for every batch to be consumed, and returns the stats
+func (r *runner) run() netlinkerstater.NetlinkerStats {
+	r.packets.next = 0
+	var wg sync.WaitGroup
+	wg.Add(1)
+	netlinker.Netlinker(context.Background(), 0, &r.af, &r.packets, r.out, r.doneCh, &wg, time.Unix(1700000000, 5), r.cliFlags, r.statsCh, r.ctl, r.msgSampler)
+	r.out <- nil
+	<-r.consumed
+	select {
+	case <-r.doneCh:
+	default:
+	}
+	return (<-r.statsCh).Stats
+}
+
+// close stops the consumer
+func (r *runner) close() {
+	close(r.out)
+}
+
+// run runs the netlinker once over the packets, with consume called for every batch, and returns the stats
+func run(tb testing.TB, af uint8, p [][]byte, modulus int, consume func(*netlinker.Batch)) netlinkerstater.NetlinkerStats {
+	r := newRunner(tb, af, p, modulus, consume)
+	defer r.close()
+	return r.run()
+}
+
+// TestNetlinkerBatches checks the netlinker sends a batch per packet, with the sampled messages of the packet
+func TestNetlinkerBatches(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		af          uint8
+		config      fakenetlink.Config
+		modulus     int
+		batches     []int // messages per batch
+		dumpIntr    int
+	}{
+		{"v4", unix.AF_INET, fakenetlink.Config{Sockets: 25, MessagesPerPacket: 10}, 1, []int{10, 10, 5}, 0},
+		{"v6", unix.AF_INET6, fakenetlink.Config{Sockets: 25, MessagesPerPacket: 10}, 1, []int{10, 10, 5}, 0},
+		{"one per packet", unix.AF_INET, fakenetlink.Config{Sockets: 3, MessagesPerPacket: 1}, 1, []int{1, 1, 1}, 0},
+		{"sampled", unix.AF_INET, fakenetlink.Config{Sockets: 25, MessagesPerPacket: 10}, 4, []int{3, 2, 1}, 0},
+		{"nothing sampled in the packets", unix.AF_INET, fakenetlink.Config{Sockets: 3, MessagesPerPacket: 1}, 4, []int{1}, 0},
+		{"dump interrupted", unix.AF_INET, fakenetlink.Config{Sockets: 5, MessagesPerPacket: 10, DumpIntr: true}, 1, []int{5}, 5},
+		{"no sockets", unix.AF_INET, fakenetlink.Config{}, 1, []int{}, 0},
+	}
+
+	for i, test := range tests {
+		var batches []int
+		var bytes int
+		messages := 0
+		stats := run(t, test.af, dump(t, test.af, test.config), test.modulus, func(batch *netlinker.Batch) {
+			batches = append(batches, len(batch.Messages))
+			if batch.TimeSpec.Sec != 1700000000 || batch.TimeSpec.Nsec != 5 {
+				t.Errorf("test:%d %s\tunexpected TimeSpec:%v", i, test.description, batch.TimeSpec)
+			}
+			for _, message := range batch.Messages {
+				bytes += len(message.InetDiagMessage)
+				socket, err := inetdiag.Decode(message.InetDiagMessage)
+				if err != nil {
+					t.Fatalf("test:%d %s\tDecode error:%s", i, test.description, err)
+				}
+				if message.SamplingModulus != test.modulus {
+					t.Errorf("test:%d %s\texpected modulus:%d\tresult:%d", i, test.description, test.modulus, message.SamplingModulus)
+				}
+				if test.modulus == 1 {
+					_, destination, _, inode, _, _ := fakenetlink.Socket(test.af, messages)
+					if !socket.Destination.Equal(destination) || socket.InetDiagMsg.Inode != inode {
+						t.Errorf("test:%d %s message:%d\texpected:%s %d\tresult:%s %d", i, test.description, messages, destination, inode, socket.Destination, socket.InetDiagMsg.Inode)
+					}
+				}
+				messages++
+			}
+			batch.Release()
+		})
+		if fmt.Sprint(batches) != fmt.Sprint(test.batches) {
+			t.Errorf("test:%d %s\texpected batches:%v\tresult:%v", i, test.description, test.batches, batches)
+		}
+		if stats.BatchesSent != len(test.batches) || stats.InetdiagMsgCopyBytesTotal != bytes || stats.DumpInterrupted != test.dumpIntr || stats.NetlinkMsgErrorCount != 0 {
+			t.Errorf("test:%d %s\tunexpected stats:%+v", i, test.description, stats)
+		}
+	}
+}
+
+// TestNetlinkerSampling checks the sampled fraction of the dump is 1/modulus, when the modulus is more than the
+// messages in a packet, so the records represent the modulus sockets they are stamped with
+func TestNetlinkerSampling(t *testing.T) {
+
+	var tests = []struct {
+		description string
+		af          uint8
+		sockets     int
+		perPacket   int
+		modulus     int
+		expected    int // sampled
+	}{
+		{"modulus 4", unix.AF_INET, 7000, 70, 4, 1750},
+		{"modulus above the messages per packet", unix.AF_INET, 7000, 70, 100, 70},
+		{"modulus 1000", unix.AF_INET6, 7000, 70, 1000, 7},
+		{"modulus above the sockets", unix.AF_INET, 7000, 70, 10000, 1},
+	}
+
+	for i, test := range tests {
+		sampled := 0
+		config := fakenetlink.Config{Sockets: test.sockets, MessagesPerPacket: test.perPacket}
+		run(t, test.af, dump(t, test.af, config), test.modulus, func(batch *netlinker.Batch) {
+			for _, message := range batch.Messages {
+				if message.SamplingModulus != test.modulus {
+					t.Errorf("test:%d %s\texpected modulus:%d\tresult:%d", i, test.description, test.modulus, message.SamplingModulus)
+				}
+				sampled++
+			}
+			batch.Release()
+		})
+		if sampled != test.expected {
+			t.Errorf("test:%d %s\texpected sampled:%d of %d\tresult:%d", i, test.description, test.expected, test.sockets, sampled)
+		}
+	}
+}
+
+// TestNetlinkerStrataSampling checks each stratum is sampled at its own modulus across the dump, when the stratum
+// modulus is more than the messages in a packet
+// The fake sockets are to 192.0.2.0 + i, so 192.0.2.0/24 is the first 256 of each 7000
+func TestNetlinkerStrataSampling(t *testing.T) {
+
+	strata, err := sampler.ParseStrata("prefix:192.0.2.0/24=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	af := uint8(unix.AF_INET)
+	sampled := make(map[int]int)
+	r := newRunner(t, af, dump(t, af, fakenetlink.Config{Sockets: 7000, MessagesPerPacket: 70}), 300, func(batch *netlinker.Batch) {
+		for _, message := range batch.Messages {
+			sampled[message.SamplingModulus]++
+		}
+		batch.Release()
+	})
+	defer r.close()
+	r.msgSampler = sampler.ModulusSampler{Strata: strata}
+	r.run()
+
+	// the stratum is 256 sockets, sampled 1, 101, and 201, and the other 6744 are sampled 1, 301, ... 6601
+	if expected := map[int]int{100: 3, 300: 23}; fmt.Sprint(sampled) != fmt.Sprint(expected) {
+		t.Errorf("expected sampled per modulus:%v\tresult:%v", expected, sampled)
+	}
+}
+
+// benchmarkNetlinker is a poll of the sockets, through the netlinker, and optionally decoded like the inetdiagers
+// The packets are 32KB like the kernel's (~70 messages), and each op is a whole poll, so sockets/s is the
+// throughput, and gc/op is the GC cycles per poll
+func benchmarkNetlinker(b *testing.B, sockets int, decode bool) {
+	p := dump(b, unix.AF_INET, fakenetlink.Config{Sockets: sockets, MessagesPerPacket: 70})
+	consume := func(batch *netlinker.Batch) {
+		if decode {
+			for _, message := range batch.Messages {
+				if _, err := inetdiag.Decode(message.InetDiagMessage); err != nil {
+					b.Error(err)
+				}
+			}
+		}
+		batch.Release()
+	}
+
+	r := newRunner(b, unix.AF_INET, p, 1, consume)
+	defer r.close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.run()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(sockets*b.N)/b.Elapsed().Seconds(), "sockets/s")
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+}
+
+func BenchmarkNetlinker100k(b *testing.B) {
+	benchmarkNetlinker(b, 100000, false)
+}
+
+func BenchmarkNetlinker250k(b *testing.B) {
+	benchmarkNetlinker(b, 250000, false)
+}
+
+func BenchmarkNetlinkerDecode100k(b *testing.B) {
+	benchmarkNetlinker(b, 100000, true)
+}
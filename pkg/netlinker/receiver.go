@@ -0,0 +1,57 @@
+package netlinker
+
+import (
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/capture"
+	"github.com/Edgio/xtcp/pkg/nlpcap"
+)
+
+// Receiver is where the netlinker reads the netlink packets from
+// Normally this is the poller's xtcpnl.Transport, but it can also be a capture file (see the replay package)
+//
+// Recvfrom has the same semantics as syscall.Recvfrom, in particular a timeout (syscall.EAGAIN)
+// tells the netlinker there are no more packets for this poll.
+type Receiver interface {
+	Recvfrom(packetBuffer []byte) (n int, err error)
+}
+
+// CaptureReceiver writes a copy of every packet to the capture file, as it is read
+// There is a new CaptureReceiver each poll, so the PollTime is the startTime of the poll
+type CaptureReceiver struct {
+	Receiver Receiver
+	Writer   *capture.Writer
+	Af       uint8
+	PollTime time.Time
+}
+
+// Recvfrom reads a packet, and captures it.  Capture errors are only logged, so they don't break the polling
+func (c CaptureReceiver) Recvfrom(packetBuffer []byte) (int, error) {
+	n, err := c.Receiver.Recvfrom(packetBuffer)
+	if err != nil || n <= 0 {
+		return n, err
+	}
+	record := capture.Record{PollTime: c.PollTime, Time: time.Now(), Af: c.Af, Packet: packetBuffer[:n]}
+	if werr := c.Writer.Write(record); werr != nil {
+		packageLogger.Warn("capture write failed", "err", werr)
+	}
+	return n, err
+}
+
+// PcapReceiver writes every packet to the nlmon pcap file, as it is read (see the nlpcap package)
+type PcapReceiver struct {
+	Receiver Receiver
+	Writer   *nlpcap.Writer
+}
+
+// Recvfrom reads a packet, and writes it to the pcap.  Pcap errors are only logged, so they don't break the polling
+func (p PcapReceiver) Recvfrom(packetBuffer []byte) (int, error) {
+	n, err := p.Receiver.Recvfrom(packetBuffer)
+	if err != nil || n <= 0 {
+		return n, err
+	}
+	if werr := p.Writer.Write(time.Now(), nlpcap.Incoming, packetBuffer[:n]); werr != nil {
+		packageLogger.Warn("pcap write failed", "err", werr)
+	}
+	return n, err
+}
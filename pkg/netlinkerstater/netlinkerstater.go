@@ -7,18 +7,16 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const (
-	debugLevel int = 11
-)
-
 // TODO move to misc
 var (
 	// Map kernel enum to human string for the IP protocol
@@ -43,16 +41,24 @@ type NetlinkerStats struct {
 	PacketBufferInSizeTotal    int
 	NetlinkMsgCountTotal       int
 	PacketBufferBytesReadTotal int
-	InetdiagMsgCopyBytesTotal  int
+	InetdiagMsgCopyBytesTotal  int // the bytes sent to the inetdiagers, which aren't copied anymore (see netlinker.Batch)
+	BatchesSent                int
 	NetlinkMsgErrorCount       int
+	DumpInterrupted            int
 	OutBlocked                 int
 	LongestBlockedDuration     time.Duration
+	SamplingModulus            int
 }
 
 // NetlinkerStater is responsible for incrementing prometheus stats and optionally statsd about the netlink workers
 // netlinkerStater recieves summary stats from each netlinker worker just as it completes
 // Reminder that the netlinker complettes when all packets have been processed, and the process has reached DONE or timeout
-func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags) {
+// wg.Done is called once the channel is closed and the last stats are sent, which main waits for on shutdown
+func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	logger := logging.Logger("staters")
 
 	//TOTO add packetBuffer size as static variable
 
@@ -74,15 +80,18 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 	}
 	netlinkerPacketSize.Set(float64(packetBufferSize))
 
-	netlinkerSamplingModulus := promauto.NewGauge(
+	netlinkerSamplingModulus := promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "xtcp",
 			Subsystem: "netlinker",
 			Name:      "sampling_modulus",
-			Help:      "netlinker samplingModulus will sample every X inetdiag messages to send to inetdiager.",
+			Help:      "netlinker effective samplingModulus, by address family. The netlinker will sample every X inetdiag messages to send to inetdiager.  This can be changed at runtime via the admin API, or by adaptive sampling.",
 		},
+		[]string{"af"},
 	)
-	netlinkerSamplingModulus.Set(float64(*cliFlags.SamplingModulus))
+	for _, af := range kernelEnumToString {
+		netlinkerSamplingModulus.WithLabelValues(af).Set(float64(*cliFlags.SamplingModulus))
+	}
 
 	//------------------------------
 	// netlinker
@@ -140,6 +149,24 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 		},
 		[]string{"af", "id"},
 	)
+	netlinkerDumpInterrupted := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "netlinker",
+			Name:      "dump_interrupted",
+			Help:      "netlinker messages with NLM_F_DUMP_INTR, where the sockets changed during the dump, by address family, by worker id",
+		},
+		[]string{"af", "id"},
+	)
+	netlinkerBatches := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "netlinker",
+			Name:      "batches",
+			Help:      "netlinker batches (packets of inetdiag messages) sent over the channel to inetdiagers, by address family, by worker id",
+		},
+		[]string{"af", "id"},
+	)
 	netlinkerOut := promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "xtcp",
@@ -231,9 +258,7 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 	if !*cliFlags.NoStatsd {
 		udpConn, dialerr = net.Dial("udp", *cliFlags.StatsdDst)
 		if dialerr != nil {
-			if debugLevel > 10 {
-				fmt.Println("pollerStater:\tnet.Dial(\"udp\", ", *cliFlags.StatsdDst, ") error:", dialerr)
-			}
+			logger.Error("netlinkerStater net.Dial error", "statsdDst", *cliFlags.StatsdDst, "err", dialerr)
 		}
 		defer udpConn.Close()
 	}
@@ -242,9 +267,7 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 
 		netlinkerStaterMsg.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af]).Inc()
 
-		if debugLevel > 100 {
-			fmt.Println("netlinkerStats aA:", netlinkerStatsWrapper.Af, "\tID:", netlinkerStatsWrapper.ID, "\tin\t\t:", netlinkerStatsWrapper)
-		}
+		logger.Debug("netlinkerStater in", "af", kernelEnumToString[netlinkerStatsWrapper.Af], "id", netlinkerStatsWrapper.ID, "stats", netlinkerStatsWrapper.Stats)
 
 		netlinkerPackets.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.PacketsProcessed))
 		netlinkerNasty.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.NastyContinue))
@@ -252,13 +275,14 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 		netlinkerMsgs.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.NetlinkMsgCountTotal))
 		netlinkerRead.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.PacketBufferBytesReadTotal))
 		netlinkerErrors.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.NetlinkMsgErrorCount))
+		netlinkerDumpInterrupted.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.DumpInterrupted))
+		netlinkerBatches.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.BatchesSent))
 		netlinkerOut.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.InetdiagMsgCopyBytesTotal))
 		netlinkerBlocked.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10)).Add(float64(netlinkerStatsWrapper.Stats.OutBlocked))
 		netlinkerBlockedSum.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af]).Observe(netlinkerStatsWrapper.Stats.LongestBlockedDuration.Seconds())
+		netlinkerSamplingModulus.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af]).Set(float64(netlinkerStatsWrapper.Stats.SamplingModulus))
 
-		if debugLevel > 100 {
-			fmt.Println("netlinkerStats Af:", netlinkerStatsWrapper.Af, "\tID:", netlinkerStatsWrapper.ID, "\tOutBlocked:", netlinkerStatsWrapper.Stats.OutBlocked, "\tLongestBlockedDuration:", netlinkerStatsWrapper.Stats.LongestBlockedDuration.Seconds())
-		}
+		logger.Debug("netlinkerStater blocked", "af", kernelEnumToString[netlinkerStatsWrapper.Af], "id", netlinkerStatsWrapper.ID, "outBlocked", netlinkerStatsWrapper.Stats.OutBlocked, "longestBlockedDuration", netlinkerStatsWrapper.Stats.LongestBlockedDuration)
 
 		// TODO could potentially move the UDP sending to a different work to allow inserting of some sleeps to not overwhealm stats (should be ok given the rate is now low)
 		if !*cliFlags.NoStatsd {
@@ -332,9 +356,7 @@ func NetlinkerStater(in <-chan NetlinkerStatsWrapper, cliFlags cliflags.CliFlags
 					kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10),
 					int(netlinkerStatsWrapper.Stats.OutBlocked), kernelEnumToString[netlinkerStatsWrapper.Af], strconv.FormatInt(int64(netlinkerStatsWrapper.ID), 10),
 					netlinkerStatsWrapper.Stats.LongestBlockedDuration.Seconds())
-				if debugLevel > 100 {
-					fmt.Println("netlinkerStats Af:", netlinkerStatsWrapper.Af, "\tupdateString:", updateString)
-				}
+				logger.Debug("netlinkerStater statsd", "af", kernelEnumToString[netlinkerStatsWrapper.Af], "updateString", updateString)
 				udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
 				if udpWriteErr != nil {
 					netlinkerStaterUDPErrors.WithLabelValues(kernelEnumToString[netlinkerStatsWrapper.Af]).Inc()
@@ -0,0 +1,186 @@
+// Package nlpcap writes the xtcp netlink requests and responses as pcap files, with the NETLINK (nlmon) link type
+//
+// The files open directly in Wireshark, which decodes them with the netlink sock_diag dissector
+// (see docs/diagrams/wireshark_netlink.png), without needing an nlmon interface, which requires root and the
+// nlmon kernel module.
+//
+// Each packet has the 16 byte LINKTYPE_NETLINK header, which is the same as the Linux cooked capture header:
+// https://www.tcpdump.org/linktypes/LINKTYPE_NETLINK.html
+// - packet type     uint16, 0 = to us (the kernel responses), 4 = outgoing (the xtcp dump requests)
+// - ARPHRD type     uint16, ARPHRD_NETLINK (824)
+// - address length  uint16, 0
+// - address         8 bytes, 0
+// - protocol        uint16, the netlink protocol, NETLINK_SOCK_DIAG (4)
+// followed by the netlink messages, in host byte order, exactly as they were sent or received.
+//
+// The files are rotated by size, like logrotate.  When the file reaches maxBytes it is renamed to <path>.1,
+// <path>.1 is renamed to <path>.2, and so on, keeping files in total.
+package nlpcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// magicNanoseconds is the pcap magic for nanosecond timestamps
+	magicNanoseconds = 0xa1b23c4d
+	versionMajor     = 2
+	versionMinor     = 4
+	snapLen          = 262144
+	// linkTypeNetlink is LINKTYPE_NETLINK
+	linkTypeNetlink = 253
+
+	globalHeaderSize = 24
+	recordHeaderSize = 16
+	netlinkHeaderLen = 16
+)
+
+// Direction is the LINKTYPE_NETLINK packet type
+type Direction uint16
+
+const (
+	// Incoming is a message from the kernel to xtcp (PACKET_HOST)
+	Incoming Direction = unix.PACKET_HOST
+	// Outgoing is a message from xtcp to the kernel (PACKET_OUTGOING)
+	Outgoing Direction = unix.PACKET_OUTGOING
+)
+
+// Writer writes the netlink messages to the pcap file, rotating by size.  It's safe to use from all the
+// pollers and netlinkers concurrently.
+type Writer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	files    int
+
+	f       *os.File
+	w       *bufio.Writer
+	written int64
+	header  [recordHeaderSize + netlinkHeaderLen]byte
+}
+
+// Create creates (or truncates) the pcap file, and writes the pcap global header
+// maxBytes is the size at which the file is rotated, or zero (0) to never rotate, and files is the number of files to keep
+func Create(path string, maxBytes int64, files int) (*Writer, error) {
+	if files < 1 {
+		return nil, fmt.Errorf("pcap files:%d must be >= 1", files)
+	}
+	w := &Writer{path: path, maxBytes: maxBytes, files: files}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open creates the pcap file, and writes the global header
+func (w *Writer) open() error {
+	f, err := os.Create(w.path)
+	if err != nil {
+		return err
+	}
+	w.f, w.w, w.written = f, bufio.NewWriter(f), 0
+
+	var global [globalHeaderSize]byte
+	binary.LittleEndian.PutUint32(global[0:], magicNanoseconds)
+	binary.LittleEndian.PutUint16(global[4:], versionMajor)
+	binary.LittleEndian.PutUint16(global[6:], versionMinor)
+	// thiszone and sigfigs are zero
+	binary.LittleEndian.PutUint32(global[16:], snapLen)
+	binary.LittleEndian.PutUint32(global[20:], linkTypeNetlink)
+	n, err := w.w.Write(global[:])
+	w.written += int64(n)
+	return err
+}
+
+// rotate closes the current file, shifts the old files along, and opens a new file
+func (w *Writer) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if w.files == 1 {
+		return w.open()
+	}
+	for i := w.files - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", w.path, i-1)
+		if i == 1 {
+			from = w.path
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", w.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return w.open()
+}
+
+// Write writes the netlink messages as a single packet
+// Packets larger than the snapLen are truncated, as a real capture would be
+func (w *Writer) Write(t time.Time, direction Direction, messages []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return fmt.Errorf("pcap:%s is closed", w.path)
+	}
+
+	length := netlinkHeaderLen + len(messages)
+	captured := length
+	if captured > snapLen {
+		captured = snapLen
+	}
+
+	if w.maxBytes > 0 && w.written > globalHeaderSize && w.written+int64(recordHeaderSize+captured) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	nanos := t.UnixNano()
+	binary.LittleEndian.PutUint32(w.header[0:], uint32(nanos/1e9))
+	binary.LittleEndian.PutUint32(w.header[4:], uint32(nanos%1e9))
+	binary.LittleEndian.PutUint32(w.header[8:], uint32(captured))
+	binary.LittleEndian.PutUint32(w.header[12:], uint32(length))
+
+	// The LINKTYPE_NETLINK header is in network byte order
+	netlinkHeader := w.header[recordHeaderSize:]
+	binary.BigEndian.PutUint16(netlinkHeader[0:], uint16(direction))
+	binary.BigEndian.PutUint16(netlinkHeader[2:], unix.ARPHRD_NETLINK)
+	// address length, and the address, are zero
+	binary.BigEndian.PutUint16(netlinkHeader[14:], unix.NETLINK_SOCK_DIAG)
+
+	n, err := w.w.Write(w.header[:])
+	w.written += int64(n)
+	if err != nil {
+		return err
+	}
+	n, err = w.w.Write(messages[:captured-netlinkHeaderLen])
+	w.written += int64(n)
+	return err
+}
+
+// close flushes and closes the current file
+func (w *Writer) close() error {
+	err := w.w.Flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// Close flushes and closes the pcap file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	return w.close()
+}
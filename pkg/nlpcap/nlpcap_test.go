@@ -0,0 +1,115 @@
+package nlpcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/nlpcap"
+)
+
+// readPcap parses the pcap file, and returns the link type, and the packets including the LINKTYPE_NETLINK header
+func readPcap(t *testing.T, path string) (linkType uint32, packets [][]byte) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 24 || binary.LittleEndian.Uint32(b[0:]) != 0xa1b23c4d {
+		t.Fatalf("%s is not a nanosecond pcap", path)
+	}
+	linkType = binary.LittleEndian.Uint32(b[20:])
+	for b = b[24:]; len(b) >= 16; {
+		captured := binary.LittleEndian.Uint32(b[8:])
+		packets = append(packets, b[16:16+captured])
+		b = b[16+captured:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("%s has %d trailing bytes", path, len(b))
+	}
+	return linkType, packets
+}
+
+// TestWrite checks the pcap and LINKTYPE_NETLINK headers, so Wireshark can decode the netlink messages
+func TestWrite(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "xtcp.pcap")
+	w, err := nlpcap.Create(path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		direction nlpcap.Direction
+		messages  []byte
+	}{
+		{nlpcap.Outgoing, bytes.Repeat([]byte{1}, 72)},
+		{nlpcap.Incoming, bytes.Repeat([]byte{2}, 4096)},
+	}
+	for _, test := range tests {
+		if err := w.Write(time.Now(), test.direction, test.messages); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	linkType, packets := readPcap(t, path)
+	if linkType != 253 || len(packets) != len(tests) {
+		t.Fatalf("expected linkType:253 packets:%d\tresult:%d %d", len(tests), linkType, len(packets))
+	}
+	for i, test := range tests {
+		header, messages := packets[i][:16], packets[i][16:]
+		direction, arphrd, protocol := binary.BigEndian.Uint16(header[0:]), binary.BigEndian.Uint16(header[2:]), binary.BigEndian.Uint16(header[14:])
+		if direction != uint16(test.direction) || arphrd != 824 || protocol != 4 || !bytes.Equal(messages, test.messages) {
+			t.Errorf("test:%d\texpected direction:%d arphrd:824 protocol:4 %d bytes\tresult:%d %d %d %d bytes", i, test.direction, len(test.messages), direction, arphrd, protocol, len(messages))
+		}
+	}
+}
+
+// TestRotate checks the files are rotated by size, and only pcapFiles are kept, each with its own pcap header
+func TestRotate(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		maxBytes int64
+		files    int
+		writes   int
+		expected []string
+	}{
+		{"no rotation", 0, 3, 10, []string{"xtcp.pcap"}},
+		{"rotate", 500, 3, 10, []string{"xtcp.pcap", "xtcp.pcap.1", "xtcp.pcap.2"}},
+		{"single file", 500, 1, 10, []string{"xtcp.pcap"}},
+	}
+
+	for i, test := range tests {
+		dir := t.TempDir()
+		w, err := nlpcap.Create(filepath.Join(dir, "xtcp.pcap"), test.maxBytes, test.files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each write is 16 + 16 + 100 bytes, so three fit in 500 bytes with the 24 byte header
+		for n := 0; n < test.writes; n++ {
+			if err := w.Write(time.Now(), nlpcap.Incoming, make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		entries, _ := os.ReadDir(dir)
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.Name())
+			if info, _ := entry.Info(); test.maxBytes > 0 && info.Size() > test.maxBytes {
+				t.Errorf("test:%d %s\t%s expected <= maxBytes:%d\tresult:%d", i, test.name, entry.Name(), test.maxBytes, info.Size())
+			}
+			readPcap(t, filepath.Join(dir, entry.Name()))
+		}
+		if len(result) != len(test.expected) {
+			t.Errorf("test:%d %s\texpected:%v\tresult:%v", i, test.name, test.expected, result)
+		}
+	}
+}
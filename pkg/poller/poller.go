@@ -4,58 +4,115 @@
 package poller
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/bottleneck"
+	"github.com/Edgio/xtcp/pkg/capture"
 	"github.com/Edgio/xtcp/pkg/cliflags"
 	"github.com/Edgio/xtcp/pkg/inetdiager"
 	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/Edgio/xtcp/pkg/misc"
 	"github.com/Edgio/xtcp/pkg/netlinker"
 	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/nlpcap"
 	"github.com/Edgio/xtcp/pkg/pollerstater"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"github.com/Edgio/xtcp/pkg/streamer"
 	"github.com/Edgio/xtcp/pkg/xtcpnl" // netlink functions
 
 	"golang.org/x/sys/unix"
 )
 
-const (
-	debugLevel int = 11
-)
-
 // cleanWorkerShutdown can be used in the polling loop to shut down the inetdiag workers if required
-func cleanWorkerShutdown(inetdiagerWG *sync.WaitGroup, netlinkerCh chan<- netlinker.TimeSpecandInetDiagMessage) {
+func cleanWorkerShutdown(logger *slog.Logger, inetdiagerWG *sync.WaitGroup, netlinkerCh chan<- *netlinker.Batch) {
 
 	// Close the netlinkerCh channel, which will cause the inetdiagers to close
-	// because of "for timeSpecandInetDiagMessage := range in {"
-	if debugLevel > 10 {
-		fmt.Println("cleanWorkerShutdown  close(netlinkerCh)")
-	}
+	// because of "for batch := range in {"
+	logger.Info("cleanWorkerShutdown close(netlinkerCh)")
 	close(netlinkerCh)
 
-	if debugLevel > 10 {
-		fmt.Println("cleanWorkerShutdown inetdiagerWG.Wait()")
-	}
+	logger.Info("cleanWorkerShutdown inetdiagerWG.Wait()")
 	inetdiagerWG.Wait()
 }
 
+// dump is one of the concurrent dumps of a poll, with its own netlink socket, dump request, and netlinkers
+// Without dumpShards, there is a single dump, with all the netlinkers reading the one socket
+type dump struct {
+	shard      string // the shard name, or "" for the single dump
+	request    []byte
+	transport  xtcpnl.Transport
+	netlinkers int
+}
+
+// dumpDone is sent by each dump of the poll once it has the NLMSG_DONE, or its netlinkers have all finished without it
+type dumpDone struct {
+	dump int
+	time time.Time
+	done bool
+}
+
+// waitForNextPoll blocks until the next tick, or an immediate poll is requested via the admin API, or shutdown
+// Polling frequency changes from the admin API reset the ticker, and we keep waiting
+func waitForNextPoll(ctx context.Context, logger *slog.Logger, af uint8, ticker *time.Ticker, ctl *admin.Controller) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			return
+		case <-ctl.PollTriggerCh(af):
+			logger.Info("immediate poll requested")
+			return
+		case frequency := <-ctl.FrequencyCh(af):
+			logger.Info("polling frequency changed", "frequency", frequency)
+			ticker.Reset(frequency)
+		}
+	}
+}
+
 // Poller is instanciated once per address family, and is responsible for:
 // 1. Setting up channels and workers
 // 2. Sending netlink diag dump requests to the kernel
 // 3. Waiting for a done message from the kernel
 // 4. Waiting for the netlinkers to complete
-// 5. Block waiting for tick
+// 5. With samplingAdaptive, adjusting this address family's samplingModulus based on the poll (see the sampler package)
+// 6. Block waiting for tick, or an immediate poll request from the admin API
 // Left out stats related stuffs
-func Poller(af uint8, hostname *string, cliFlags cliflags.CliFlags, wg *sync.WaitGroup, pollerStaterCh chan<- pollerstater.PollerStats, netlinkerStaterCh chan<- netlinkerstater.NetlinkerStatsWrapper, inetdiagerStaterCh chan<- inetdiagerstater.InetdiagerStatsWrapper) {
+//
+// The netlink socket is opened with openTransport, which is xtcpnl.OpenSocketTransport for the kernel,
+// or an in memory fake for the tests (see the fakenetlink package)
+//
+// With dumpShards or dumpShardRanges, each poll is split into concurrent dumps, each on its own netlink socket, with its
+// own netlinker, and a bytecode filter selecting the shard's sockets (see xtcpnl.Shards).  The dumps all have the same
+// nlmsg_seq, so they're all the same poll (poll_id), and the poll is done once every shard has the NLMSG_DONE.
+//
+// With captureWriter, the netlink packets are also written to the capture file (see the capture package)
+// With pcapWriter, the dump requests and the netlink packets are also written to the pcap file (see the nlpcap package)
+//
+// The stages are run by the inetdiagers, with the poller's own bottleneck classifier, and each poll start also
+// completes the previous poll of the stages, e.g. the alerts and the top sockets (see inetdiager.Stages)
+//
+// While polling is paused via the admin API, the poller keeps waiting on the ticker, but does not poll.
+//
+// When ctx is cancelled (SIGTERM/SIGINT) the poller doesn't start any more polls.  The in-flight dump
+// is finished, or aborted if shutdownAbortDump, and then the inetdiagers are shut down, which drains netlinkerCh.
+// The poller returns (wg.Done) once the inetdiagers have flushed everything.
+//
+// An error is returned if the netlink socket(s) can't be opened, so main can shut down and exit(1), rather than
+// carry on without polling the address family.
+func Poller(ctx context.Context, af uint8, hostname *string, cliFlags cliflags.CliFlags, wg *sync.WaitGroup, pollerStaterCh chan<- pollerstater.PollerStats, netlinkerStaterCh chan<- netlinkerstater.NetlinkerStatsWrapper, inetdiagerStaterCh chan<- inetdiagerstater.InetdiagerStatsWrapper, recordStreamer *streamer.Streamer, ctl *admin.Controller, msgSampler sampler.MessageSampler, stages *inetdiager.Stages, captureWriter *capture.Writer, pcapWriter *nlpcap.Writer, openTransport xtcpnl.OpenTransport) error {
 
 	defer wg.Done()
 
-	if debugLevel > 10 {
-		fmt.Println("poller af:", misc.KernelEnumToString[af], "\tStart")
-	}
+	logger := logging.Logger("poller").With("af", misc.KernelEnumToString[af])
+	logger.Info("Start")
 
 	// Variables
 	//
@@ -78,15 +135,11 @@ func Poller(af uint8, hostname *string, cliFlags cliflags.CliFlags, wg *sync.Wai
 	// timeSpecMutex = &sync.RWMutex{}
 
 	// Netlink socket variables
-	var socketFileDescriptor int
-	var socketAddress *unix.SockaddrNetlink
 	var netlinkRequest []byte // binary blob containing the netlink inetdiag dump request
 
 	// Channel variables
 	// Used to pass from netlinkers to the inetdiagers
-	var netlinkerCh chan netlinker.TimeSpecandInetDiagMessage
-	// Channel to allow the netlinker which recieves the unix.NLMSG_DONE to signal the poller of this
-	var netlinkerRecievedDoneCh chan time.Time
+	var netlinkerCh chan *netlinker.Batch
 
 	// Timing variables
 	var startPollTime time.Time
@@ -94,9 +147,17 @@ func Poller(af uint8, hostname *string, cliFlags cliflags.CliFlags, wg *sync.Wai
 	var finishedPollTime time.Time
 	var pollToDoneDuration time.Duration
 	var pollDuration time.Duration
+	var shardStats []pollerstater.ShardStats
 
 	var workersStarted bool = false
 
+	// The netlinkerCh fill when the dump completes, for the adaptive sampler
+	var queueFill float64
+	var adaptiveSampler *sampler.Sampler
+	if *cliFlags.SamplingAdaptive {
+		adaptiveSampler = sampler.NewSampler(af, cliFlags)
+	}
+
 	// Map addressfamily to number of netlinkers and inetdiagers. TODO iterate
 	var afToNetlinkers = map[uint8]*int{
 		uint8(2):  cliFlags.Netlinkers4,
@@ -113,126 +174,266 @@ func Poller(af uint8, hostname *string, cliFlags cliflags.CliFlags, wg *sync.Wai
 	// Initialize sockets and netlink request binary blobs
 
 	// Build the binary blobs of the netlink inet diag dump requests, one for each address family
-	// func BuildNetlinkSockDiagRequest(addressFamily *uint8, make_size int, nlmsg_len int, nlmsg_seq int, nlmsg_pid int)
-	netlinkRequest = xtcpnl.BuildNetlinkSockDiagRequest(&af, int(128), uint32(72), uint32(*cliFlags.NlmsgSeq), uint32(0), uint8(0xFF), uint8(0)) // nice works
+	// func BuildNetlinkSockDiagRequestStates(addressFamily *uint8, make_size int, nlmsg_len int, nlmsg_seq int, nlmsg_pid int, idiag_ext uint8, idiag_stats uint8, idiag_states uint32)
+	// The states were already checked by main
+	states, err := xtcpnl.StateMask(*cliFlags.States)
+	if err != nil {
+		logger.Error("xtcpnl.StateMask failed", "states", *cliFlags.States, "err", err)
+		states = xtcpnl.EstablishedMask
+	}
+	netlinkRequest = xtcpnl.BuildNetlinkSockDiagRequestStates(&af, int(128), uint32(72), uint32(*cliFlags.NlmsgSeq), uint32(0), uint8(0xFF), uint8(0), states) // nice works
 
-	// Open the netlink socket using syscall library (rather than golang net package)
-	socketFileDescriptor, socketAddress = xtcpnl.OpenNetlinkSocketWithTimeout(*cliFlags.Timeout)
-	defer syscall.Close(socketFileDescriptor)
+	// The shards were already checked by main
+	shards, err := xtcpnl.ShardsFromFlags(cliFlags)
+	if err != nil {
+		logger.Error("xtcpnl.ShardsFromFlags failed", "err", err)
+		shards = nil
+	}
+	afShards := xtcpnl.Shards(shards, af)
+	if shards != nil && len(afShards) == 0 {
+		logger.Warn("none of the dump shards can match this address family, so it isn't polled", "dumpShardRanges", *cliFlags.DumpShardRanges)
+		return nil
+	}
+
+	// Open the netlink socket(s) using syscall library (rather than golang net package), one per dump
+	var dumps []*dump
+	defer func() {
+		for _, d := range dumps {
+			d.transport.Close()
+		}
+	}()
+	if afShards == nil {
+		dumps = append(dumps, &dump{request: netlinkRequest, netlinkers: *afToNetlinkers[af]})
+	}
+	for i, shard := range afShards {
+		// Each shard's dump request has the bytecode filter of the shard's sockets
+		dumps = append(dumps, &dump{shard: shard.Name, request: xtcpnl.AppendBytecode(netlinkRequest, xtcpnl.Bytecode(afShards, i, af)), netlinkers: 1})
+		logger.Info("dump shard", "shard", shard.Name)
+	}
+	for i, d := range dumps {
+		transport, err := openTransport(*cliFlags.Timeout)
+		if err != nil {
+			logger.Error("openTransport failed", "shard", d.shard, "err", err)
+			dumps = dumps[:i]
+			return fmt.Errorf("openTransport shard:%q: %w", d.shard, err)
+		}
+		d.transport = transport
+	}
 
 	// Sleeping the IPv6 for 1/2 the pollingLoopFrequencySeconds, so that the polling is offset from IPv4
 	// This should mean the overall system impact is spread out more evenly, although obviously because
 	// there are so many more IPv4 sockets this isn't really true.
 	if af == unix.AF_INET6 {
-		if debugLevel > 10 {
-			fmt.Println("poller af:", misc.KernelEnumToString[af], "\tSleeping IPv6 poller for:", *cliFlags.PollingFrequency/2)
+		logger.Info("Sleeping IPv6 poller", "duration", ctl.PollingFrequency()/2)
+		select {
+		case <-ctx.Done():
+		case <-time.After(ctl.PollingFrequency() / 2):
 		}
-		time.Sleep(*cliFlags.PollingFrequency / 2)
+	}
+
+	// On shutdown, the poller only stops waiting for the NLMSG_DONE if we're aborting the dump
+	// (receiving from a nil channel blocks forever)
+	var abortDumpCh <-chan struct{}
+	if *cliFlags.ShutdownAbortDump {
+		abortDumpCh = ctx.Done()
 	}
 
 	// Poller's primary loop
-	ticker := time.NewTicker(*cliFlags.PollingFrequency)
-	for pollingLoops := 0; misc.MaxLoopsOrForEver(pollingLoops, *cliFlags.MaxLoops); pollingLoops++ {
+	ticker := time.NewTicker(ctl.PollingFrequency())
+	var pollingLoops int
+	for pollingLoops = 0; misc.MaxLoopsOrForEver(pollingLoops, *cliFlags.MaxLoops) && ctx.Err() == nil; pollingLoops++ {
+
+		// Don't poll while paused, but keep waiting on the ticker so frequency changes are still applied
+		for ctl.Paused() && ctx.Err() == nil {
+			ctl.SetWorkerState("poller", af, 0, "paused", pollingLoops)
+			waitForNextPoll(ctx, logger, af, ticker, ctl)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		ctl.SetWorkerState("poller", af, 0, "polling", pollingLoops)
 
 		if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
-			if debugLevel > 10 {
-				fmt.Println("poller af:", misc.KernelEnumToString[af], "\tpollingLoops:", pollingLoops, "\t< Maxloops:", *cliFlags.MaxLoops, "\tworkersStarted:", workersStarted, "\t*netlinkers:", *afToNetlinkers[af], "\t*inetdiagers:", *afToInetdiagers[af])
-			}
+			logger.Info("polling", "pollingLoops", pollingLoops, "maxLoops", *cliFlags.MaxLoops, "workersStarted", workersStarted, "netlinkers", *afToNetlinkers[af], "inetdiagers", *afToInetdiagers[af], "shards", len(afShards))
 		}
-		currentPollerStats = pollerstater.PollerStats{Af: af, PollingLoops: pollingLoops, PollToDoneDuration: pollToDoneDuration, PollDuration: pollDuration}
+		currentPollerStats = pollerstater.PollerStats{Af: af, PollingLoops: pollingLoops, PollToDoneDuration: pollToDoneDuration, PollDuration: pollDuration, PollingFrequency: ctl.PollingFrequency(), Shards: shardStats}
 		pollerStaterCh <- currentPollerStats
 
 		if workersStarted == false {
 			// setup channels
-			netlinkerCh = make(chan netlinker.TimeSpecandInetDiagMessage, *cliFlags.NetlinkerChSize)
-			netlinkerRecievedDoneCh = make(chan time.Time)
+			netlinkerCh = make(chan *netlinker.Batch, *cliFlags.NetlinkerChPackets)
+			// The classifier keeps the previous tcp_info of each socket, so it's shared by the inetdiagers
+			afStages := stages.WithClassifier(bottleneck.NewClassifier(cliFlags, ctl))
 
 			// startup the workers in reverse pipeline order
 			for inetdiagerID := 0; inetdiagerID < *afToInetdiagers[af]; inetdiagerID++ {
 				inetdiagerWG.Add(1)
-				go inetdiager.Inetdiager(inetdiagerID, &af, netlinkerCh, &inetdiagerWG, *hostname, cliFlags, inetdiagerStaterCh)
-				if debugLevel > 100 {
-					fmt.Println("poller af:", misc.KernelEnumToString[af], "\tinetdiagerID started:", inetdiagerID)
-				}
+				go inetdiager.Inetdiager(ctx, inetdiagerID, &af, netlinkerCh, &inetdiagerWG, *hostname, cliFlags, inetdiagerStaterCh, recordStreamer, ctl, afStages)
+				logger.Debug("inetdiager started", "inetdiagerID", inetdiagerID)
 			}
 			workersStarted = true
 		}
 
-		// Send NetLink dump request   <-- IMPORTANT!!  This triggers everything else
-		if debugLevel > 100 {
-			fmt.Println("poller af:", misc.KernelEnumToString[af], "\tsendNetlinkDumpRequest")
-		}
+		// Send NetLink dump request(s)   <-- IMPORTANT!!  This triggers everything else
+		logger.Debug("sendNetlinkDumpRequest", "pollingLoops", pollingLoops)
 		// TODO We are NOT checking return sequence codes
-		binary.LittleEndian.PutUint32(netlinkRequest[8:12], uint32(*cliFlags.NlmsgSeq+pollingLoops))
+		// The sequence is the same for all the dumps of the poll, and the kernel echoes it, so it's the poll_id of the records
 		startPollTime = time.Now()
-		xtcpnl.SendNetlinkDumpRequest(socketFileDescriptor, socketAddress, netlinkRequest)
+		stages.Poll(af, startPollTime)
+
+		// Each dump has its own netlinkers, which signal the NLMSG_DONE of the dump, or that they've all finished without it,
+		// e.g. the kernel replied NLMSG_ERROR, or the socket timed out part way through the dump
+		// Buffered, so the dumps can still finish if the poller has stopped waiting because the dump was aborted
+		dumpDoneCh := make(chan dumpDone, len(dumps))
+		for i, d := range dumps {
+			binary.LittleEndian.PutUint32(d.request[8:12], uint32(*cliFlags.NlmsgSeq+pollingLoops))
+			if err := d.transport.Send(d.request); err != nil {
+				// The netlinkers will time out without the NLMSG_DONE, so this poll (or shard) will be empty
+				logger.Error("transport.Send failed", "shard", d.shard, "err", err)
+			}
+			if pcapWriter != nil {
+				// The netlinkRequest buffer is larger than the request, so only the nlmsg_len is written
+				if err := pcapWriter.Write(startPollTime, nlpcap.Outgoing, d.request[:binary.LittleEndian.Uint32(d.request[0:4])]); err != nil {
+					logger.Warn("pcap write failed", "err", err)
+				}
+			}
 
-		// Start the netlinkers to consume all the netlink messages
-		for netlinkerID := 0; netlinkerID < *afToNetlinkers[af]; netlinkerID++ {
+			var receiver netlinker.Receiver = d.transport
+			if captureWriter != nil {
+				receiver = netlinker.CaptureReceiver{Receiver: receiver, Writer: captureWriter, Af: af, PollTime: startPollTime}
+			}
+			if pcapWriter != nil {
+				receiver = netlinker.PcapReceiver{Receiver: receiver, Writer: pcapWriter}
+			}
+
+			// Start the netlinkers to consume all the netlink messages of the dump
+			// Buffered, so a netlinker can still send the DONE after the dump's netlinkers have all finished
+			netlinkerRecievedDoneCh := make(chan time.Time, 1)
+			var dumpNetlinkerWG sync.WaitGroup
+			for netlinkerID := 0; netlinkerID < d.netlinkers; netlinkerID++ {
+				dumpNetlinkerWG.Add(1)
+				go netlinker.Netlinker(ctx, netlinkerID+i, &af, receiver, netlinkerCh, netlinkerRecievedDoneCh, &dumpNetlinkerWG, startPollTime, cliFlags, netlinkerStaterCh, ctl, msgSampler)
+			}
 			netlinkerWG.Add(1)
-			go netlinker.Netlinker(netlinkerID, &af, socketFileDescriptor, netlinkerCh, netlinkerRecievedDoneCh, &netlinkerWG, startPollTime, cliFlags, netlinkerStaterCh)
+			go func(i int) {
+				defer netlinkerWG.Done()
+				dumpNetlinkersDoneCh := make(chan struct{})
+				go func() {
+					dumpNetlinkerWG.Wait()
+					close(dumpNetlinkersDoneCh)
+				}()
+				select {
+				case t := <-netlinkerRecievedDoneCh:
+					dumpDoneCh <- dumpDone{dump: i, time: t, done: true}
+				case <-dumpNetlinkersDoneCh:
+					select {
+					case t := <-netlinkerRecievedDoneCh:
+						dumpDoneCh <- dumpDone{dump: i, time: t, done: true}
+					default:
+						dumpDoneCh <- dumpDone{dump: i, time: time.Now()}
+					}
+				}
+				<-dumpNetlinkersDoneCh
+			}(i)
 		}
-		// Blocking here for unix.NLMSG_DONE means there will only ever be a single netlink request/recieve in flight at any time
+		netlinkersDoneCh := make(chan struct{})
+		go func() {
+			netlinkerWG.Wait()
+			close(netlinkersDoneCh)
+		}()
+
+		// Blocking here for unix.NLMSG_DONE of every dump means there will only ever be a single poll in flight at any time
 		// (this also conveniently allows us to grap some timing info)
-		doneReceivedTime = <-netlinkerRecievedDoneCh
+		// The poll is done when the slowest dump is done
+		doneReceivedTime = time.Time{}
+		shardStats = nil
+		if afShards != nil {
+			shardStats = make([]pollerstater.ShardStats, len(dumps))
+			for i, d := range dumps {
+				shardStats[i].Name = d.shard
+			}
+		}
+	waitForDumps:
+		for remaining := len(dumps); remaining > 0; remaining-- {
+			select {
+			case done := <-dumpDoneCh:
+				if !done.done {
+					logger.Warn("the netlinkers finished without the NLMSG_DONE, so the dump is incomplete", "shard", dumps[done.dump].shard)
+				}
+				if done.time.After(doneReceivedTime) {
+					doneReceivedTime = done.time
+				}
+				if shardStats != nil {
+					shardStats[done.dump].PollToDoneDuration = done.time.Sub(startPollTime)
+					shardStats[done.dump].Done = done.done
+				}
+			case <-abortDumpCh:
+				logger.Info("shutdown, aborting the dump")
+				doneReceivedTime = time.Now()
+				break waitForDumps
+			}
+		}
 		pollToDoneDuration = doneReceivedTime.Sub(startPollTime)
+		if cap(netlinkerCh) > 0 {
+			queueFill = float64(len(netlinkerCh)) / float64(cap(netlinkerCh))
+		}
 		if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
-			if debugLevel > 10 {
-				fmt.Println("poller af:", misc.KernelEnumToString[af], "\tpollToDoneDuration:", pollToDoneDuration, "\tpollToDoneDuration.Seconds():", pollToDoneDuration.Seconds())
-			}
+			logger.Info("done received", "pollToDoneDuration", pollToDoneDuration)
 		}
 
 		// Block waiting for all the netlinkers to finish
 		// - The netlinker who gets the DONE will get here first
 		// - Then then the other x3 (by default) will get here after timing out on the socket (up to 100ms by default)
-		netlinkerWG.Wait()
+		// - With dumpShards, each shard has a single netlinker, which finishes as soon as it gets its DONE
+		<-netlinkersDoneCh
 
 		// If we're shutting down the inetdiager workers been runs, they shut down here
 		// Please note that this will block waiting for the inetdiagerWG sync.WaitGroup to complete
 		if *cliFlags.ShutdownWorkers == true {
-			cleanWorkerShutdown(&inetdiagerWG, netlinkerCh)
+			cleanWorkerShutdown(logger, &inetdiagerWG, netlinkerCh)
 			workersStarted = false
 		}
 
 		finishedPollTime = time.Now()
 		pollDuration = finishedPollTime.Sub(startPollTime)
 		if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
-			if debugLevel > 10 {
-				//fmt.Println("poller af:", af, "\tpollDuration:", pollDuration, "\tpollDuration.Seconds():", pollDuration.Seconds())
-				fmt.Println("poller af:", misc.KernelEnumToString[af], "\tpollDuration.Seconds():", pollDuration.Seconds(), "\tout of:", *cliFlags.PollingFrequency)
-			}
+			logger.Info("poll complete", "pollDuration", pollDuration, "pollingFrequency", ctl.PollingFrequency())
 		}
 
 		// Warn if the polling loop is taking more than 80% (constant) of the polling frequency
-		if pollDuration > (time.Duration(float64(*cliFlags.PollingFrequency) * *cliFlags.PollingSafetyBuffer)) {
-			if debugLevel > 10 {
-				fmt.Println("poller af:", misc.KernelEnumToString[af], "\tPOLLING IS TAKING TOO LONG!! WARNING!!")
-			}
+		if pollDuration > (time.Duration(float64(ctl.PollingFrequency()) * *cliFlags.PollingSafetyBuffer)) {
+			logger.Warn("POLLING IS TAKING TOO LONG!!", "pollDuration", pollDuration, "pollingFrequency", ctl.PollingFrequency())
 			// Please note we calculate the pollingLong counter in pollerStats
 		}
-		// Block until the next tick
-		// TODO - block until the next tick or http request
-		if debugLevel > 100 {
-			fmt.Println("poller af:", misc.KernelEnumToString[af], "\twaiting for ticker at frequency:", *cliFlags.PollingFrequency)
-		}
-		// TODO We don't really need the select yet, but getting it ready for http hook channel goes here
-		//<-ticker.C
-		select {
-		case _ = <-ticker.C:
-			break
-			// default:
-			// 	//nothing
+
+		if adaptiveSampler != nil {
+			modulus := ctl.EffectiveSamplingModulus(af)
+			observation := sampler.Observation{PollDuration: pollDuration, PollingFrequency: ctl.PollingFrequency(), QueueFill: queueFill}
+			if next := adaptiveSampler.Next(modulus, observation); next != modulus {
+				logger.Info("adaptive sampling changed samplingModulus", "from", modulus, "to", next, "load", adaptiveSampler.Load(observation))
+				if err := ctl.SetEffectiveSamplingModulus(af, next); err != nil {
+					logger.Error("SetEffectiveSamplingModulus", "err", err)
+				}
+			}
 		}
+		// Block until the next tick or admin API poll request
+		logger.Debug("waiting for ticker", "pollingFrequency", ctl.PollingFrequency())
+		ctl.SetWorkerState("poller", af, 0, "waiting", pollingLoops)
+		waitForNextPoll(ctx, logger, af, ticker, ctl)
 	}
+	ticker.Stop()
 
 	// We're all done.  Clean up and get the heck out of here!
+	// This drains netlinkerCh, because the inetdiagers keep going until the channel is closed and empty
 	if workersStarted == true {
-		cleanWorkerShutdown(&inetdiagerWG, netlinkerCh)
+		ctl.SetWorkerState("poller", af, 0, "draining", pollingLoops)
+		cleanWorkerShutdown(logger, &inetdiagerWG, netlinkerCh)
 		workersStarted = false
 	}
 
-	if debugLevel > 10 {
-		fmt.Println("poller af:", af, "\tDone")
-	}
+	ctl.SetWorkerState("poller", af, 0, "done", pollingLoops)
+
+	logger.Info("Done")
 
+	return nil
 }
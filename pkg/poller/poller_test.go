@@ -0,0 +1,259 @@
+package poller_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/fakenetlink"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/poller"
+	"github.com/Edgio/xtcp/pkg/pollerstater"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// udpSink is the UDP destination the inetdiagers write the records to
+type udpSink struct {
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	records []*xtcppb.XtcpRecord
+	done    chan struct{}
+}
+
+// newUDPSink listens on a random localhost port, and collects the records until close
+func newUDPSink(t *testing.T) *udpSink {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadBuffer(4 << 20)
+	s := &udpSink{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			record := &xtcppb.XtcpRecord{}
+			if err := proto.Unmarshal(buf[:n], record); err != nil {
+				t.Errorf("proto.Unmarshal error:%v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.records = append(s.records, record)
+			s.mu.Unlock()
+		}
+	}()
+	return s
+}
+
+// close waits briefly for the last records in flight, and returns all the records
+func (s *udpSink) close() []*xtcppb.XtcpRecord {
+	s.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	<-s.done
+	s.conn.Close()
+	return s.records
+}
+
+// drain consumes a stats channel, like the staters do, and returns the stats once it's closed
+func drain[T any](ch <-chan T) <-chan []T {
+	result := make(chan []T, 1)
+	go func() {
+		var all []T
+		for stats := range ch {
+			all = append(all, stats)
+		}
+		result <- all
+	}()
+	return result
+}
+
+// TestPollerEndToEnd runs the poller, netlinkers, and inetdiagers against the fake kernel,
+// and checks the records the UDP sink receives
+func TestPollerEndToEnd(t *testing.T) {
+
+	var tests = []struct {
+		name            string
+		af              uint8
+		config          fakenetlink.Config
+		expectedRecords int // over the two (2) polls, because maxLoops 1 is two loops
+		expectRtt       bool
+		expectDumpIntr  bool
+		args            []string // e.g. the dump shards
+		dumps           int      // dump requests per poll, the shards of the af.  Zero (0) is one (1)
+	}{
+		{"v4", unix.AF_INET, fakenetlink.Config{Sockets: 25}, 50, true, false, nil, 0},
+		{"v6", unix.AF_INET6, fakenetlink.Config{Sockets: 25}, 50, true, false, nil, 0},
+		{"one message per packet", unix.AF_INET, fakenetlink.Config{Sockets: 7, MessagesPerPacket: 1}, 14, true, false, nil, 0},
+		{"no tcp_info", unix.AF_INET, fakenetlink.Config{Sockets: 5, Attributes: []uint16{inetdiag.INET_DIAG_CONG, inetdiag.INET_DIAG_MARK, inetdiag.INET_DIAG_CLASS_ID}}, 10, false, false, nil, 0},
+		{"bbr", unix.AF_INET, fakenetlink.Config{Sockets: 5, Congestion: "bbr"}, 10, true, false, nil, 0},
+		{"dump interrupted", unix.AF_INET, fakenetlink.Config{Sockets: 25, DumpIntr: true}, 50, true, true, nil, 0},
+		{"error", unix.AF_INET, fakenetlink.Config{Sockets: 25, Errno: syscall.EPERM}, 0, false, false, nil, 0},
+		{"timeout part way", unix.AF_INET, fakenetlink.Config{Sockets: 25, TimeoutAfter: 2}, 40, true, false, nil, 0},
+		{"no sockets", unix.AF_INET6, fakenetlink.Config{}, 0, false, false, nil, 0},
+		{"dport shards", unix.AF_INET, fakenetlink.Config{Sockets: 25}, 50, true, false, []string{"-dumpShards", "4", "-dumpShardPorts", "30000-30024"}, 4},
+		{"dport shards v6", unix.AF_INET6, fakenetlink.Config{Sockets: 25, MessagesPerPacket: 3}, 50, true, false, []string{"-dumpShards", "3", "-dumpShardPorts", "30000-30024"}, 3},
+		{"range shards", unix.AF_INET, fakenetlink.Config{Sockets: 25}, 50, true, false, []string{"-dumpShardRanges", "dst:2001:db8:1::/124,dst:192.0.2.0/28,rest"}, 2},
+		{"range shards v6", unix.AF_INET6, fakenetlink.Config{Sockets: 25}, 50, true, false, []string{"-dumpShardRanges", "dst:2001:db8:1::/124,dst:192.0.2.0/28,rest"}, 3},
+	}
+
+	for i, test := range tests {
+
+		sink := newUDPSink(t)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cliFlags := config.Register(fs)
+		args := []string{
+			"-frequency", "20ms",
+			"-maxLoops", "1",
+			"-samplingModulus", "1",
+			"-inetdiagerReportModulus", "1",
+			"-udpSendDest", sink.conn.LocalAddr().String(),
+		}
+		args = append(args, test.args...)
+		dumps := test.dumps
+		if dumps == 0 {
+			dumps = 1
+		}
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		ctl := admin.NewController(cliFlags)
+		msgSampler, _ := sampler.NewMessageSampler(cliFlags)
+		fake := fakenetlink.New(test.config)
+
+		pollerStaterCh := make(chan pollerstater.PollerStats, 10)
+		netlinkerStaterCh := make(chan netlinkerstater.NetlinkerStatsWrapper, 10)
+		inetdiagerStaterCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 10)
+		pollerStats, netlinkerStats, inetdiagerStats := drain(pollerStaterCh), drain(netlinkerStaterCh), drain(inetdiagerStaterCh)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		hostname := "test"
+		go poller.Poller(context.Background(), test.af, &hostname, cliFlags, &wg, pollerStaterCh, netlinkerStaterCh, inetdiagerStaterCh, nil, ctl, msgSampler, nil, nil, nil, fake.Open)
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("test:%d %s\tpoller did not finish", i, test.name)
+		}
+		close(pollerStaterCh)
+		close(netlinkerStaterCh)
+		close(inetdiagerStaterCh)
+		allPollerStats := <-pollerStats
+		<-inetdiagerStats
+
+		records := sink.close()
+		if len(records) != test.expectedRecords || fake.Requests() != 2*dumps {
+			t.Errorf("test:%d %s\texpected records:%d requests:%d\tresult:%d %d", i, test.name, test.expectedRecords, 2*dumps, len(records), fake.Requests())
+		}
+
+		// Each poll has its own poll_id, the nlmsg_seq, and the shards of the poll dump each socket exactly once
+		polls := make(map[uint32]map[uint32]int)
+		for _, record := range records {
+			if polls[record.GetPollId()] == nil {
+				polls[record.GetPollId()] = make(map[uint32]int)
+			}
+			polls[record.GetPollId()][record.GetInetDiagMsg().GetInode()]++
+		}
+		for pollID, inodes := range polls {
+			if (pollID != 666 && pollID != 667) || len(inodes) != test.expectedRecords/2 {
+				t.Errorf("test:%d %s\texpected poll_id:666 or 667 with %d sockets\tresult:%d with %d", i, test.name, test.expectedRecords/2, pollID, len(inodes))
+			}
+			for inode, count := range inodes {
+				if count != 1 {
+					t.Errorf("test:%d %s\tpoll_id:%d inode:%d expected once\tresult:%d", i, test.name, pollID, inode, count)
+				}
+			}
+		}
+
+		// The second poll's stats have the first poll's shards
+		if last := allPollerStats[len(allPollerStats)-1]; test.dumps > 0 {
+			if len(last.Shards) != test.dumps {
+				t.Errorf("test:%d %s\texpected shard stats:%d\tresult:%d", i, test.name, test.dumps, len(last.Shards))
+			}
+			for _, shard := range last.Shards {
+				if !shard.Done || shard.PollToDoneDuration <= 0 {
+					t.Errorf("test:%d %s\tshard:%s expected done\tresult:%t %s", i, test.name, shard.Name, shard.Done, shard.PollToDoneDuration)
+				}
+			}
+		} else if last.Shards != nil {
+			t.Errorf("test:%d %s\texpected no shard stats\tresult:%v", i, test.name, last.Shards)
+		}
+
+		for _, record := range records {
+			inode := record.GetInetDiagMsg().GetInode()
+			source, destination, destinationPort, _, rtt, _ := fakenetlink.Socket(test.af, int(inode)-1000)
+			socketID := record.GetInetDiagMsg().GetSocketID()
+			if record.GetInetDiagMsg().GetFamily() != uint32(test.af) ||
+				!net.IP(socketID.GetSource()).Equal(source) ||
+				!net.IP(socketID.GetDestination()).Equal(destination) ||
+				socketID.GetSourcePort() != 443 || socketID.GetDestinationPort() != uint32(destinationPort) {
+				t.Errorf("test:%d %s\tinode:%d expected %s:443 -> %s:%d\tresult:%s:%d -> %s:%d", i, test.name, inode, source, destination, destinationPort,
+					net.IP(socketID.GetSource()), socketID.GetSourcePort(), net.IP(socketID.GetDestination()), socketID.GetDestinationPort())
+				break
+			}
+			if test.expectRtt && record.GetTcpInfo().GetRtt() != rtt {
+				t.Errorf("test:%d %s\tinode:%d expected rtt:%d\tresult:%d", i, test.name, inode, rtt, record.GetTcpInfo().GetRtt())
+				break
+			}
+			if test.config.Congestion == "bbr" && record.GetCongestionAlgorithmEnum() != xtcppb.XtcpRecord_BBR1 {
+				t.Errorf("test:%d %s\texpected congestion:BBR1\tresult:%s", i, test.name, record.GetCongestionAlgorithmEnum())
+				break
+			}
+		}
+
+		var dumpInterrupted int
+		for _, stats := range <-netlinkerStats {
+			dumpInterrupted += stats.Stats.DumpInterrupted
+		}
+		if (dumpInterrupted > 0) != test.expectDumpIntr {
+			t.Errorf("test:%d %s\texpected dump interrupted:%t\tresult:%d", i, test.name, test.expectDumpIntr, dumpInterrupted)
+		}
+	}
+}
+
+// TestPollerOpenError checks the poller returns the error when the netlink socket can't be opened, rather than
+// silently not polling the address family
+func TestPollerOpenError(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-frequency", "20ms", "-maxLoops", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	ctl := admin.NewController(cliFlags)
+	msgSampler, _ := sampler.NewMessageSampler(cliFlags)
+	openTransport := func(timeout int64) (xtcpnl.Transport, error) {
+		return nil, syscall.EPERM
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	hostname := "test"
+	err := poller.Poller(context.Background(), unix.AF_INET, &hostname, cliFlags, &wg, nil, nil, nil, nil, ctl, msgSampler, nil, nil, nil, openTransport)
+	wg.Wait()
+	if !errors.Is(err, syscall.EPERM) {
+		t.Errorf("expected:%v\tresult:%v", syscall.EPERM, err)
+	}
+}
@@ -6,17 +6,15 @@ package pollerstater
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const (
-	debugLevel int = 11
-)
-
 // TODO move to misc
 var (
 	// Map kernel enum to human string for the IP protocol
@@ -32,6 +30,16 @@ type PollerStats struct {
 	PollingLoops       int
 	PollToDoneDuration time.Duration
 	PollDuration       time.Duration
+	PollingFrequency   time.Duration
+	Shards             []ShardStats // the dump shards of the poll, or nil for a single dump
+}
+
+// ShardStats is the timing of one of the concurrent dumps of a sharded poll (see dumpShards)
+// Done is false if the shard's netlinker finished without the NLMSG_DONE, so the shard is incomplete
+type ShardStats struct {
+	Name               string
+	PollToDoneDuration time.Duration
+	Done               bool
 }
 
 // PollerStater calculates stats for the pollers
@@ -40,7 +48,12 @@ type PollerStats struct {
 // 2. We can send the diffs to statsd to avoid overloading it with lots of small increments
 // 3. We only need to pass things over the channel relatively infrequently
 // cliFlags needed for statsd destination
-func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
+// wg.Done is called once the channel is closed and the last stats are sent, which main waits for on shutdown
+func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	logger := logging.Logger("staters")
 
 	//---------------------------------
 	// Register Prometheus metrics
@@ -51,6 +64,7 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 	// Poller frequency gauge
 	// This is the poller frequency.  Although this is based on CLI flags, including
 	// this in Prometheus, so we can setup an alarm.  e.g. If poll duration gets to 80% of poller frequency
+	// The frequency can be changed at runtime via the admin API, so this is also updated from the PollerStats
 	promFrequencyGauge := promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Namespace: "xtcp",
@@ -141,6 +155,27 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 		[]string{"af"},
 	)
 
+	// The dump shard durations show if the shards are balanced, because the poll takes as long as the slowest shard
+	promShardDurationGaugeVec := promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "poller",
+			Name:      "shard_done_duration",
+			Help:      "poller dump shard duration from the dump request to the NLMSG_DONE, by address family, and shard",
+		},
+		[]string{"af", "shard"},
+	)
+
+	promShardIncomplete := promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "poller",
+			Name:      "shard_incomplete",
+			Help:      "poller dump shards which finished without the NLMSG_DONE, by address family, and shard",
+		},
+		[]string{"af", "shard"},
+	)
+
 	//-------------------
 	// pollerStater prometheus counters
 	// Please note, these are NOT being sent to statsd
@@ -194,9 +229,7 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 	if !*cliFlags.NoStatsd {
 		udpConn, dialerr = net.Dial("udp", *cliFlags.StatsdDst)
 		if dialerr != nil {
-			if debugLevel > 10 {
-				fmt.Println("pollerStater:\tnet.Dial(\"udp\", ", *cliFlags.StatsdDst, ") error:", dialerr)
-			}
+			logger.Error("pollerStater net.Dial error", "statsdDst", *cliFlags.StatsdDst, "err", dialerr)
 		}
 		defer udpConn.Close()
 	}
@@ -208,11 +241,20 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 
 		pollerStaterMsgs.WithLabelValues(kernelEnumToString[pollerStats.Af]).Inc()
 
+		promFrequencyGauge.Set(pollerStats.PollingFrequency.Seconds())
+
 		promDurationSumVec.WithLabelValues(kernelEnumToString[pollerStats.Af], "done").Observe(pollerStats.PollToDoneDuration.Seconds())
 		promDurationGaugeVec.WithLabelValues(kernelEnumToString[pollerStats.Af], "done").Set(pollerStats.PollToDoneDuration.Seconds())
 		promDurationSumVec.WithLabelValues(kernelEnumToString[pollerStats.Af], "poll").Observe(pollerStats.PollDuration.Seconds())
 		promDurationGaugeVec.WithLabelValues(kernelEnumToString[pollerStats.Af], "poll").Set(pollerStats.PollDuration.Seconds())
 
+		for _, shard := range pollerStats.Shards {
+			promShardDurationGaugeVec.WithLabelValues(kernelEnumToString[pollerStats.Af], shard.Name).Set(shard.PollToDoneDuration.Seconds())
+			if !shard.Done {
+				promShardIncomplete.WithLabelValues(kernelEnumToString[pollerStats.Af], shard.Name).Inc()
+			}
+		}
+
 		// Calculate differences
 		diffStats.PollingLoops = pollerStats.PollingLoops - oldStatsMap[pollerStats.Af].PollingLoops
 		//diffStats.pollToDoneDuration = pollerStats.pollToDoneDuration - oldStatsMap[pollerStats.Af].pollToDoneDuration
@@ -221,20 +263,14 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 
 		pollingLoops.WithLabelValues(kernelEnumToString[pollerStats.Af]).Add(float64(diffStats.PollingLoops))
 
-		if debugLevel > 100 {
-			fmt.Println("pollerStater Af:", pollerStats.Af, "\tdiffStats.PollingLoops:", diffStats.PollingLoops)
-			//fmt.Println("pollerStater Af:", pollerStats.Af, "\tdiffStats.pollToDoneDuration.Seconds():", diffStats.pollToDoneDuration.Seconds())
-			//fmt.Println("pollerStater Af:", pollerStats.Af, "\tdiffStats.pollDuration.Seconds():", diffStats.pollDuration.Seconds())
-		}
+		logger.Debug("pollerStater", "af", kernelEnumToString[pollerStats.Af], "diffPollingLoops", diffStats.PollingLoops)
 
 		// TODO could potentially move the UDP sending to a different work to allow inserting of some sleeps to not overwhealm stats (should be ok given the rate is now low)
 		if !*cliFlags.NoStatsd {
 
 			// pollingLoops
 			updateString = fmt.Sprintf("xtcp_%s_poller_loops:%d|g", kernelEnumToString[pollerStats.Af], int(pollerStats.PollingLoops))
-			if debugLevel > 100 {
-				fmt.Println("pollerStater Af:", pollerStats.Af, "\tupdateString:", updateString)
-			}
+			logger.Debug("pollerStater statsd", "af", kernelEnumToString[pollerStats.Af], "updateString", updateString)
 			udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
 			if udpWriteErr != nil {
 				pollerStaterUDPErrors.WithLabelValues(kernelEnumToString[pollerStats.Af]).Inc()
@@ -246,9 +282,7 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 			// Please note that statsd doco says it support milliseconds ( https://github.com/statsd/statsd/blob/master/docs/metric_types.md )
 			// Please further note that the statsd doco is incorrect, and our collectd stats supports seconds only: https://github.com/collectd/collectd/blob/main/src/statsd.c#L96
 			updateString = fmt.Sprintf("xtcp_%s_done_duration:%f|g\nxtcp_%s_poll_duration:%f|g", kernelEnumToString[pollerStats.Af], pollerStats.PollToDoneDuration.Seconds(), kernelEnumToString[pollerStats.Af], pollerStats.PollDuration.Seconds())
-			if debugLevel > 100 {
-				fmt.Println("pollerStater Af:", pollerStats.Af, "\tupdateString:", updateString)
-			}
+			logger.Debug("pollerStater statsd", "af", kernelEnumToString[pollerStats.Af], "updateString", updateString)
 			udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
 			if udpWriteErr != nil {
 				pollerStaterUDPErrors.WithLabelValues(kernelEnumToString[pollerStats.Af]).Inc()
@@ -258,10 +292,8 @@ func PollerStater(in <-chan PollerStats, cliFlags cliflags.CliFlags) {
 		}
 
 		// If the polling loop is taking to long, increase the long poll counter
-		if pollerStats.PollDuration > (time.Duration(float64(*cliFlags.PollingFrequency) * *cliFlags.PollingSafetyBuffer)) {
-			if debugLevel > 100 {
-				fmt.Println("pollerStater Af:", pollerStats.Af, "\tPOLLING IS TAKING TOO LONG!! WARNING!!")
-			}
+		if pollerStats.PollDuration > (time.Duration(float64(pollerStats.PollingFrequency) * *cliFlags.PollingSafetyBuffer)) {
+			logger.Debug("POLLING IS TAKING TOO LONG!!", "af", kernelEnumToString[pollerStats.Af], "pollDuration", pollerStats.PollDuration, "pollingFrequency", pollerStats.PollingFrequency)
 			pollingLong.WithLabelValues(kernelEnumToString[pollerStats.Af]).Inc()
 
 			if !*cliFlags.NoStatsd {
@@ -0,0 +1,278 @@
+// Package replay feeds a capture file through the netlinker to inetdiager pipeline, in place of the kernel
+//
+// The capture file is written by xtcp with -capture (see the capture package).  Each captured poll is
+// replayed by a netlinker reading from a ReplayReceiver, rather than the netlink socket, and the inetdiagers
+// process the messages exactly as they would on the live host.  The records keep the original poll times.
+//
+// The replay runs at the original speed (replaySpeed 1), faster or slower (e.g. 10 or 0.5), or as fast as
+// possible (replaySpeed 0), which is useful to benchmark the parsing deterministically.
+//
+// Replay doesn't need any privileges, so it can run on a laptop.
+package replay
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/bottleneck"
+	"github.com/Edgio/xtcp/pkg/capture"
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/inetdiager"
+	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/Edgio/xtcp/pkg/netlinker"
+	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"github.com/Edgio/xtcp/pkg/streamer"
+	"golang.org/x/sys/unix"
+)
+
+// ReplayReceiver returns the packets of a single captured poll, and then the socket timeout (syscall.EAGAIN),
+// which tells the netlinker the poll is complete
+type ReplayReceiver struct {
+	mu      sync.Mutex
+	records []capture.Record
+	next    int
+	pace    func(time.Time)
+}
+
+// NewReplayReceiver creates the ReplayReceiver for the records of a poll
+// pace is called with the captured time of each packet before it is returned, or nil for no pacing
+func NewReplayReceiver(records []capture.Record, pace func(time.Time)) *ReplayReceiver {
+	return &ReplayReceiver{records: records, pace: pace}
+}
+
+// Remaining is the number of packets not yet returned
+func (r *ReplayReceiver) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.records) - r.next
+}
+
+// Recvfrom copies the next packet into the packetBuffer
+func (r *ReplayReceiver) Recvfrom(packetBuffer []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.records) {
+		return -1, syscall.EAGAIN
+	}
+	record := r.records[r.next]
+	r.next++
+	if r.pace != nil {
+		r.pace(record.Time)
+	}
+	if len(record.Packet) > len(packetBuffer) {
+		return -1, fmt.Errorf("captured packet:%d is larger than the packetBuffer:%d, increase packetSizeMply", len(record.Packet), len(packetBuffer))
+	}
+	return copy(packetBuffer, record.Packet), nil
+}
+
+// pacer sleeps so the packets are replayed at speed times the captured rate
+// The first packet of the capture is replayed straight away
+type pacer struct {
+	ctx          context.Context
+	speed        float64
+	captureStart time.Time
+	replayStart  time.Time
+	started      bool
+}
+
+// wait blocks until the captured time t, scaled by the speed, since the replay started
+func (p *pacer) wait(t time.Time) {
+	if !p.started {
+		p.captureStart, p.replayStart, p.started = t, time.Now(), true
+		return
+	}
+	due := p.replayStart.Add(time.Duration(float64(t.Sub(p.captureStart)) / p.speed))
+	select {
+	case <-p.ctx.Done():
+	case <-time.After(time.Until(due)):
+	}
+}
+
+// pipeline is the netlinkerCh and the inetdiagers for one address family, like the poller has
+type pipeline struct {
+	netlinkerCh  chan *netlinker.Batch
+	inetdiagerWG sync.WaitGroup
+}
+
+// Summary is the totals of the replay, for benchmarking
+type Summary struct {
+	Polls    int
+	Packets  int
+	Bytes    int
+	Captured time.Duration // from the first to the last captured packet
+	Duration time.Duration // from the start of the replay until the inetdiagers have processed everything
+}
+
+// Replay reads the capture file, and replays each captured poll through a netlinker and the inetdiagers
+// The address families disabled by no4/no6 are skipped.  Replay returns once the inetdiagers have processed
+// everything, or ctx is cancelled.  A truncated or corrupt capture file is replayed up to the error,
+// and then the error is returned.
+//
+// The stages run in the inetdiagers, and complete each replayed poll, like the poller (see inetdiager.Stages).  The inetdiagers aren't waited for between the polls,
+// so with replaySpeed 0 the last records of a poll can be late (xtcp_alerts_late).
+func Replay(ctx context.Context, path string, hostname string, cliFlags cliflags.CliFlags, netlinkerStaterCh chan<- netlinkerstater.NetlinkerStatsWrapper, inetdiagerStaterCh chan<- inetdiagerstater.InetdiagerStatsWrapper, recordStreamer *streamer.Streamer, ctl *admin.Controller, msgSampler sampler.MessageSampler, stages *inetdiager.Stages) (Summary, error) {
+
+	logger := logging.Logger("poller").With("replay", path)
+
+	var summary Summary
+
+	reader, err := capture.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer reader.Close()
+
+	var pace func(time.Time)
+	if *cliFlags.ReplaySpeed > 0 {
+		pace = (&pacer{ctx: ctx, speed: *cliFlags.ReplaySpeed}).wait
+	}
+
+	var afEnabled = map[uint8]bool{
+		unix.AF_INET:  !*cliFlags.No4,
+		unix.AF_INET6: !*cliFlags.No6,
+	}
+	var afToInetdiagers = map[uint8]*int{
+		unix.AF_INET:  cliFlags.Inetdiagers4,
+		unix.AF_INET6: cliFlags.Inetdiagers6,
+	}
+
+	start := time.Now()
+	pipelines := make(map[uint8]*pipeline)
+
+	// replayPoll runs a netlinker over the packets of one poll, starting the af's inetdiagers the first time
+	// A sharded poll (see dumpShards) has an NLMSG_DONE per shard, and the netlinker stops at the DONE, so the
+	// netlinkers are run one after the other until all the packets of the poll are replayed
+	// newPoll is false for the rest of a poll which has already been partly replayed, so the stages and the
+	// summary only see the poll once
+	replayPoll := func(records []capture.Record, newPoll bool) {
+		af := records[0].Af
+		pl, ok := pipelines[af]
+		if !ok {
+			pl = &pipeline{netlinkerCh: make(chan *netlinker.Batch, *cliFlags.NetlinkerChPackets)}
+			afStages := stages.WithClassifier(bottleneck.NewClassifier(cliFlags, ctl))
+			for inetdiagerID := 0; inetdiagerID < *afToInetdiagers[af]; inetdiagerID++ {
+				pl.inetdiagerWG.Add(1)
+				go inetdiager.Inetdiager(ctx, inetdiagerID, &af, pl.netlinkerCh, &pl.inetdiagerWG, hostname, cliFlags, inetdiagerStaterCh, recordStreamer, ctl, afStages)
+			}
+			pipelines[af] = pl
+		}
+
+		if newPoll {
+			stages.Poll(af, records[0].PollTime)
+			summary.Polls++
+		}
+
+		receiver := NewReplayReceiver(records, pace)
+		for receiver.Remaining() > 0 && ctx.Err() == nil {
+			// Buffered, because nothing waits for the DONE, the netlinker finishes at the DONE, or when the ReplayReceiver runs out
+			doneCh := make(chan time.Time, 1)
+			var netlinkerWG sync.WaitGroup
+			netlinkerWG.Add(1)
+			go netlinker.Netlinker(ctx, 0, &af, receiver, pl.netlinkerCh, doneCh, &netlinkerWG, records[0].PollTime, cliFlags, netlinkerStaterCh, ctl, msgSampler)
+			netlinkerWG.Wait()
+		}
+
+		summary.Packets += len(records)
+		for _, r := range records {
+			summary.Bytes += len(r.Packet)
+		}
+		logger.Debug("replayed poll", "af", misc.KernelEnumToString[af], "pollTime", records[0].PollTime, "packets", len(records))
+	}
+
+	// The packets are grouped into polls by the af and the poll time, and replayed a poll at a time
+	// The v4 and v6 pollers capture at the same time, so their packets are interleaved in the capture file.  Each
+	// af's packets are buffered until its poll's NLMSG_DONE, and then the poll is replayed.  A sharded poll has an
+	// NLMSG_DONE per shard, so the packets after the first DONE are replayed as the rest of the same poll.  A poll
+	// without a DONE (the dump timed out) is replayed when the af's next poll starts, or at the end of the capture.
+	polls := make(map[uint8][]capture.Record)
+	replayed := make(map[uint8]time.Time) // the poll time of each af's last replayed poll
+	flush := func(af uint8) {
+		records := polls[af]
+		if len(records) == 0 {
+			return
+		}
+		replayPoll(records, !replayed[af].Equal(records[0].PollTime))
+		replayed[af] = records[0].PollTime
+		polls[af] = nil
+	}
+	buffered := func() int {
+		return len(polls[unix.AF_INET]) + len(polls[unix.AF_INET6])
+	}
+
+	var first time.Time
+	var readErr error
+	for ctx.Err() == nil {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("capture read failed after %d packets: %w", summary.Packets+buffered(), err)
+			break
+		}
+		if !afEnabled[record.Af] {
+			continue
+		}
+		if first.IsZero() {
+			first = record.Time
+		}
+		summary.Captured = record.Time.Sub(first)
+		if poll := polls[record.Af]; len(poll) > 0 && !record.PollTime.Equal(poll[0].PollTime) {
+			flush(record.Af)
+		}
+		polls[record.Af] = append(polls[record.Af], record)
+		if hasDone(record.Packet) {
+			flush(record.Af)
+		}
+	}
+	if ctx.Err() == nil {
+		// The polls still buffered didn't have a DONE, and are replayed in the order they were captured
+		afs := []uint8{unix.AF_INET, unix.AF_INET6}
+		if len(polls[unix.AF_INET]) > 0 && len(polls[unix.AF_INET6]) > 0 && polls[unix.AF_INET6][0].Time.Before(polls[unix.AF_INET][0].Time) {
+			afs[0], afs[1] = afs[1], afs[0]
+		}
+		for _, af := range afs {
+			flush(af)
+		}
+	}
+
+	// Like the poller on shutdown, closing the netlinkerCh makes the inetdiagers drain it, and send the final stats
+	for _, pl := range pipelines {
+		close(pl.netlinkerCh)
+		pl.inetdiagerWG.Wait()
+	}
+	summary.Duration = time.Since(start)
+
+	attrs := []any{"polls", summary.Polls, "packets", summary.Packets, "bytes", summary.Bytes, "captured", summary.Captured, "duration", summary.Duration}
+	if seconds := summary.Duration.Seconds(); seconds > 0 {
+		attrs = append(attrs, "bytesPerSecond", int(float64(summary.Bytes)/seconds))
+	}
+	logger.Info("replay complete", attrs...)
+
+	return summary, readErr
+}
+
+// hasDone returns if the packet has an NLMSG_DONE, which ends the dump (or the dump shard)
+func hasDone(packet []byte) bool {
+	for offset := 0; offset+unix.NLMSG_HDRLEN <= len(packet); {
+		length := int(binary.LittleEndian.Uint32(packet[offset:]))
+		if binary.LittleEndian.Uint16(packet[offset+4:]) == unix.NLMSG_DONE {
+			return true
+		}
+		if length < unix.NLMSG_HDRLEN {
+			return false
+		}
+		offset += (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+	}
+	return false
+}
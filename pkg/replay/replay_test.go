@@ -0,0 +1,224 @@
+package replay_test
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/admin"
+	"github.com/Edgio/xtcp/pkg/capture"
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/inetdiagerstater"
+	"github.com/Edgio/xtcp/pkg/netlinkerstater"
+	"github.com/Edgio/xtcp/pkg/replay"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"golang.org/x/sys/unix"
+)
+
+const inetDiagMsgSize = 72
+
+// packet builds a netlink packet of sock_diag replies, each an inet_diag_msg without any attributes
+func packet(af uint8, sockets int) []byte {
+	var p []byte
+	for i := 0; i < sockets; i++ {
+		msg := make([]byte, unix.NLMSG_HDRLEN+inetDiagMsgSize)
+		binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+		binary.LittleEndian.PutUint16(msg[4:], 20) // SOCK_DIAG_BY_FAMILY
+		binary.LittleEndian.PutUint16(msg[6:], unix.NLM_F_MULTI)
+		msg[unix.NLMSG_HDRLEN] = af
+		binary.BigEndian.PutUint16(msg[unix.NLMSG_HDRLEN+4:], uint16(40000+i))
+		p = append(p, msg...)
+	}
+	return p
+}
+
+// done is the NLMSG_DONE packet at the end of the dump
+func done() []byte {
+	p := make([]byte, unix.NLMSG_HDRLEN+4)
+	binary.LittleEndian.PutUint32(p[0:], uint32(len(p)))
+	binary.LittleEndian.PutUint16(p[4:], unix.NLMSG_DONE)
+	binary.LittleEndian.PutUint16(p[6:], unix.NLM_F_MULTI)
+	return p
+}
+
+// writeCapture writes the polls to a capture file.  Each poll is an af, and the number of sockets in each packet
+// A sharded poll has a dump shard per packet, so an NLMSG_DONE after each packet
+func writeCapture(t *testing.T, polls []struct {
+	af      uint8
+	packets []int
+	sharded bool
+}) string {
+	path := filepath.Join(t.TempDir(), "test.xtcpcap")
+	w, err := capture.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollTime := time.Unix(1700000000, 0)
+	for i, poll := range polls {
+		pollTime = pollTime.Add(time.Duration(i) * 10 * time.Millisecond)
+		for _, sockets := range poll.packets {
+			w.Write(capture.Record{PollTime: pollTime, Time: pollTime.Add(time.Millisecond), Af: poll.af, Packet: packet(poll.af, sockets)})
+			if poll.sharded {
+				w.Write(capture.Record{PollTime: pollTime, Time: pollTime.Add(time.Millisecond), Af: poll.af, Packet: done()})
+			}
+		}
+		if !poll.sharded {
+			w.Write(capture.Record{PollTime: pollTime, Time: pollTime.Add(2 * time.Millisecond), Af: poll.af, Packet: done()})
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestReplay checks every captured message goes through the netlinkers to the inetdiagers
+func TestReplay(t *testing.T) {
+
+	path := writeCapture(t, []struct {
+		af      uint8
+		packets []int
+		sharded bool
+	}{
+		{unix.AF_INET, []int{3, 2}, false},
+		{unix.AF_INET6, []int{4}, false},
+		{unix.AF_INET, []int{5}, false},
+		{unix.AF_INET6, []int{1, 2, 3}, true},
+	})
+
+	var tests = []struct {
+		name             string
+		args             []string
+		expectedPolls    int
+		expectedMessages int
+	}{
+		{"max speed", []string{"-samplingModulus", "1"}, 4, 20},
+		{"original speed", []string{"-samplingModulus", "1", "-replaySpeed", "1"}, 4, 20},
+		{"no6", []string{"-samplingModulus", "1", "-no6"}, 2, 10},
+		{"sampled", []string{"-samplingModulus", "1", "-samplingMode", "hash", "-samplingStrata", "port:40000=1,port:40001=1000"}, 4, 14},
+	}
+
+	for i, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cliFlags := config.Register(fs)
+		if err := fs.Parse(append(test.args, "-inetdiagers4", "1", "-inetdiagers6", "1")); err != nil {
+			t.Fatal(err)
+		}
+		ctl := admin.NewController(cliFlags)
+		msgSampler, err := sampler.NewMessageSampler(cliFlags)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		netlinkerStaterCh := make(chan netlinkerstater.NetlinkerStatsWrapper, 10)
+		inetdiagerStaterCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 10)
+
+		summary, err := replay.Replay(context.Background(), path, "test", cliFlags, netlinkerStaterCh, inetdiagerStaterCh, nil, ctl, msgSampler, nil)
+		if err != nil {
+			t.Fatalf("test:%d %s\tunexpected error:%v", i, test.name, err)
+		}
+		close(netlinkerStaterCh)
+		close(inetdiagerStaterCh)
+
+		var sent, processed int
+		for stats := range netlinkerStaterCh {
+			sent += stats.Stats.InetdiagMsgCopyBytesTotal / inetDiagMsgSize
+		}
+		for stats := range inetdiagerStaterCh {
+			processed += stats.Stats.InetdiagMsgCount
+		}
+		if summary.Polls != test.expectedPolls || sent != test.expectedMessages || processed != test.expectedMessages {
+			t.Errorf("test:%d %s\texpected polls:%d messages:%d\tresult:%d sent:%d processed:%d", i, test.name, test.expectedPolls, test.expectedMessages, summary.Polls, sent, processed)
+		}
+	}
+}
+
+// TestReplayErrors checks a missing file is an error, and a truncated file is replayed up to the error
+func TestReplayErrors(t *testing.T) {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	ctl := admin.NewController(cliFlags)
+	msgSampler, _ := sampler.NewMessageSampler(cliFlags)
+	netlinkerStaterCh := make(chan netlinkerstater.NetlinkerStatsWrapper, 10)
+	inetdiagerStaterCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 20)
+
+	if _, err := replay.Replay(context.Background(), filepath.Join(t.TempDir(), "missing"), "test", cliFlags, netlinkerStaterCh, inetdiagerStaterCh, nil, ctl, msgSampler, nil); err == nil {
+		t.Errorf("expected an error for a missing capture file")
+	}
+
+	r := replay.NewReplayReceiver([]capture.Record{{Packet: make([]byte, 100)}}, nil)
+	if _, err := r.Recvfrom(make([]byte, 10)); err == nil {
+		t.Errorf("expected an error for a packet larger than the packetBuffer")
+	}
+	if _, err := r.Recvfrom(make([]byte, 10)); err != unix.EAGAIN {
+		t.Errorf("expected EAGAIN once the poll is complete\tresult:%v", err)
+	}
+}
+
+// TestReplayInterleaved checks the v4 and v6 polls are each replayed once, when the pollers captured at the same
+// time, so their packets are interleaved in the capture file
+func TestReplayInterleaved(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "interleaved.xtcpcap")
+	w, err := capture.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll1, poll2 := time.Unix(1700000000, 0), time.Unix(1700000010, 0)
+	for i, r := range []struct {
+		pollTime time.Time
+		af       uint8
+		packet   []byte
+	}{
+		{poll1, unix.AF_INET, packet(unix.AF_INET, 3)},
+		{poll1, unix.AF_INET6, packet(unix.AF_INET6, 4)},
+		{poll1, unix.AF_INET, packet(unix.AF_INET, 2)},
+		{poll1, unix.AF_INET6, packet(unix.AF_INET6, 1)},
+		{poll1, unix.AF_INET, done()},
+		{poll1, unix.AF_INET6, packet(unix.AF_INET6, 2)},
+		{poll1, unix.AF_INET6, done()},
+		// the second v4 poll times out, so it has no DONE
+		{poll2, unix.AF_INET6, packet(unix.AF_INET6, 5)},
+		{poll2, unix.AF_INET, packet(unix.AF_INET, 6)},
+		{poll2, unix.AF_INET6, done()},
+		{poll2, unix.AF_INET, packet(unix.AF_INET, 1)},
+	} {
+		w.Write(capture.Record{PollTime: r.pollTime, Time: r.pollTime.Add(time.Duration(i) * time.Millisecond), Af: r.af, Packet: r.packet})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-samplingModulus", "1", "-inetdiagers4", "1", "-inetdiagers6", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	ctl := admin.NewController(cliFlags)
+	msgSampler, _ := sampler.NewMessageSampler(cliFlags)
+	netlinkerStaterCh := make(chan netlinkerstater.NetlinkerStatsWrapper, 20)
+	inetdiagerStaterCh := make(chan inetdiagerstater.InetdiagerStatsWrapper, 20)
+
+	summary, err := replay.Replay(context.Background(), path, "test", cliFlags, netlinkerStaterCh, inetdiagerStaterCh, nil, ctl, msgSampler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(netlinkerStaterCh)
+
+	// A netlinker per poll, and each netlinker reads its whole poll
+	sent := make(map[uint8][]int)
+	for stats := range netlinkerStaterCh {
+		sent[stats.Af] = append(sent[stats.Af], stats.Stats.InetdiagMsgCopyBytesTotal/inetDiagMsgSize)
+	}
+	if summary.Polls != 4 || summary.Packets != 11 {
+		t.Errorf("expected polls:4 packets:11\tresult:%d %d", summary.Polls, summary.Packets)
+	}
+	if expected := map[uint8][]int{unix.AF_INET: {5, 7}, unix.AF_INET6: {7, 5}}; fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("expected messages per netlinker:%v\tresult:%v", expected, sent)
+	}
+}
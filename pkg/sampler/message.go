@@ -0,0 +1,206 @@
+package sampler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+)
+
+// Offsets into the raw inet_diag_msg, which the netlinker has not decoded yet
+// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/inet_diag.h#L115
+const (
+	familyOffset      = 0
+	sourcePortOffset  = 4 // big endian
+	destinationOffset = 24
+	cookieOffset      = 44
+	cookieEnd         = 52
+	tupleStart        = 4  // source port
+	tupleEnd          = 40 // end of the destination address
+)
+
+// MessageSampler decides which of the inet_diag messages the netlinker sends to the inetdiagers
+// Sample returns if the message is sampled, and the samplingModulus it was sampled at, which is stamped into the
+// record, so each record represents that many sockets
+type MessageSampler interface {
+	Sample(msg []byte, counts *Counts, samplingModulus int) (sampled bool, modulus int)
+}
+
+// Counts are the messages a netlinker has seen in the dump, for each stratum, which the ModulusSampler samples on.
+// The counts run across all the netlink packets of the dump, because a packet only holds about 70 messages, so
+// counting per packet couldn't sample fewer than one message per packet, whatever the samplingModulus.
+// Each netlinker has its own Counts for each dump, so the samplers themselves are stateless, and shared.
+type Counts struct {
+	rest   int   // the messages which aren't in any stratum
+	strata []int // the messages of each stratum
+}
+
+// next returns the number of the stratum's messages (-1 is no stratum) before this one, and counts this one
+func (c *Counts) next(stratum int) int {
+	if stratum < 0 {
+		c.rest++
+		return c.rest - 1
+	}
+	for len(c.strata) <= stratum {
+		c.strata = append(c.strata, 0)
+	}
+	c.strata[stratum]++
+	return c.strata[stratum] - 1
+}
+
+// Stratum is a group of sockets with its own samplingModulus, so low volume services aren't sampled away
+// Sockets match on the local (source) port, or the destination prefix
+type Stratum struct {
+	Port    uint16
+	Prefix  *net.IPNet
+	Modulus int
+}
+
+// match is true if the socket in the message is in the stratum
+func (s Stratum) match(msg []byte) bool {
+	if s.Prefix == nil {
+		return binary.BigEndian.Uint16(msg[sourcePortOffset:]) == s.Port
+	}
+	if msg[familyOffset] == syscall.AF_INET {
+		return s.Prefix.Contains(net.IP(msg[destinationOffset : destinationOffset+4]))
+	}
+	return s.Prefix.Contains(net.IP(msg[destinationOffset : destinationOffset+16]))
+}
+
+// strataModulus returns the first stratum the message matches, and its samplingModulus, or -1 and the samplingModulus
+func strataModulus(strata []Stratum, msg []byte, samplingModulus int) (int, int) {
+	if len(msg) < tupleEnd {
+		return -1, samplingModulus
+	}
+	for i, s := range strata {
+		if s.match(msg) {
+			return i, s.Modulus
+		}
+	}
+	return -1, samplingModulus
+}
+
+// ModulusSampler is the original sampling, on the position of the message in the dump
+// This is cheap, but a different set of sockets is sampled on every poll
+// Each stratum is counted separately, so every modulus'th message of the stratum is sampled, whatever the mix of
+// the strata in the dump.
+type ModulusSampler struct {
+	Strata []Stratum
+}
+
+// Sample every modulus'th message of the stratum, in the dump
+func (s ModulusSampler) Sample(msg []byte, counts *Counts, samplingModulus int) (bool, int) {
+	stratum, modulus := strataModulus(s.Strata, msg, samplingModulus)
+	return counts.next(stratum)%modulus == 1 || modulus == 1, modulus
+}
+
+// HashSampler samples on a hash of the socket identity, so the same sockets are followed across polls
+// A socket is sampled if its hash is in the lowest 1/modulus of the hash space, so when the adaptive sampler
+// raises the samplingModulus, the sockets sampled are a subset of the sockets sampled before
+type HashSampler struct {
+	Cookie bool // hash the socket cookie, rather than the ports and addresses
+	Strata []Stratum
+}
+
+// Sample if the hash of the socket identity is below the threshold for the modulus, so counts isn't used
+func (s HashSampler) Sample(msg []byte, counts *Counts, samplingModulus int) (bool, int) {
+	_, modulus := strataModulus(s.Strata, msg, samplingModulus)
+	if modulus == 1 {
+		return true, modulus
+	}
+	var key []byte
+	switch {
+	case s.Cookie && len(msg) >= cookieEnd:
+		key = msg[cookieOffset:cookieEnd]
+	case len(msg) >= tupleEnd:
+		key = msg[tupleStart:tupleEnd]
+	default:
+		// too short to be an inet_diag_msg, so pass it on, and the inetdiager will count the error
+		return true, 1
+	}
+	return Hash(key) <= math.MaxUint64/uint64(modulus), modulus
+}
+
+// Hash is FNV-1a with the splitmix64 finalizer, so the high bits are well mixed for the threshold
+// It has no seed, so the same sockets are sampled on every host and every restart
+func Hash(key []byte) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// ParseStrata parses the samplingStrata, which is a comma separated list of port:<port>=<modulus> or prefix:<cidr>=<modulus>
+// e.g. port:22=1,prefix:10.0.0.0/8=10,prefix:2001:db8::/32=5
+func ParseStrata(strata string) ([]Stratum, error) {
+	var parsed []Stratum
+	for _, item := range strings.Split(strata, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		colon := strings.Index(item, ":")
+		equals := strings.LastIndex(item, "=")
+		if colon < 0 || equals < colon {
+			return nil, fmt.Errorf("samplingStrata:%q should be port:<port>=<modulus> or prefix:<cidr>=<modulus>", item)
+		}
+		kind, value, modulusString := item[:colon], item[colon+1:equals], item[equals+1:]
+
+		var s Stratum
+		modulus, err := strconv.Atoi(modulusString)
+		if err != nil || modulus < 1 {
+			return nil, fmt.Errorf("samplingStrata:%q modulus must be >= 1", item)
+		}
+		s.Modulus = modulus
+
+		switch kind {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("samplingStrata:%q port error:%s", item, err)
+			}
+			s.Port = uint16(port)
+		case "prefix":
+			_, prefix, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("samplingStrata:%q prefix error:%s", item, err)
+			}
+			s.Prefix = prefix
+		default:
+			return nil, fmt.Errorf("samplingStrata:%q unknown kind:%q, expected port or prefix", item, kind)
+		}
+		parsed = append(parsed, s)
+	}
+	return parsed, nil
+}
+
+// NewMessageSampler creates the MessageSampler for the samplingMode, samplingHashKey, and samplingStrata
+func NewMessageSampler(cliFlags cliflags.CliFlags) (MessageSampler, error) {
+	strata, err := ParseStrata(*cliFlags.SamplingStrata)
+	if err != nil {
+		return nil, err
+	}
+	switch *cliFlags.SamplingMode {
+	case "modulus":
+		return ModulusSampler{Strata: strata}, nil
+	case "hash":
+		return HashSampler{Cookie: *cliFlags.SamplingHashKey == "cookie", Strata: strata}, nil
+	}
+	return nil, fmt.Errorf("unknown samplingMode:%s", *cliFlags.SamplingMode)
+}
@@ -0,0 +1,205 @@
+package sampler_test
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"golang.org/x/sys/unix"
+)
+
+// testMsg builds a raw inet_diag_msg, as the netlinker sees it, with the ports in network byte order
+func testMsg(source string, sourcePort uint16, destination string, destinationPort uint16, cookie uint64) []byte {
+	msg := make([]byte, 72)
+	src, dst := net.ParseIP(source), net.ParseIP(destination)
+	if src4 := src.To4(); src4 != nil {
+		msg[0] = unix.AF_INET
+		copy(msg[8:], src4)
+		copy(msg[24:], dst.To4())
+	} else {
+		msg[0] = unix.AF_INET6
+		copy(msg[8:], src)
+		copy(msg[24:], dst)
+	}
+	binary.BigEndian.PutUint16(msg[4:], sourcePort)
+	binary.BigEndian.PutUint16(msg[6:], destinationPort)
+	binary.LittleEndian.PutUint64(msg[44:], cookie)
+	return msg
+}
+
+// TestParseStrata checks the port and prefix strata, including IPv6 prefixes with colons
+func TestParseStrata(t *testing.T) {
+
+	var tests = []struct {
+		name      string
+		strata    string
+		expectErr bool
+		expected  int
+	}{
+		{"empty", "", false, 0},
+		{"port", "port:22=1", false, 1},
+		{"mixed", "port:22=1, prefix:10.0.0.0/8=10,prefix:2001:db8::/32=5", false, 3},
+		{"no modulus", "port:22", true, 0},
+		{"zero modulus", "port:22=0", true, 0},
+		{"bad port", "port:70000=1", true, 0},
+		{"bad prefix", "prefix:10.0.0.0=1", true, 0},
+		{"unknown kind", "vip:10.0.0.1=1", true, 0},
+		{"no kind", "22=1", true, 0},
+	}
+
+	for i, test := range tests {
+		strata, err := sampler.ParseStrata(test.strata)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+			continue
+		}
+		if len(strata) != test.expected {
+			t.Errorf("test:%d %s\texpected:%d\tresult:%d", i, test.name, test.expected, len(strata))
+		}
+	}
+}
+
+// TestHashSampler checks the hash sampling is stable, close to 1/modulus, and nested when the modulus is raised
+func TestHashSampler(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		s    sampler.HashSampler
+	}{
+		{"tuple", sampler.HashSampler{}},
+		{"cookie", sampler.HashSampler{Cookie: true}},
+	}
+
+	const sockets = 20000
+	for i, test := range tests {
+		var sampled4, sampled16, notNested int
+		for n := 0; n < sockets; n++ {
+			msg := testMsg("192.0.2.1", 443, net.IPv4(198, 51, byte(n>>8), byte(n)).String(), uint16(30000+n%1000), uint64(n)*7919)
+
+			first, modulus := test.s.Sample(msg, nil, 4)
+			if again, _ := test.s.Sample(msg, nil, 4); again != first {
+				t.Fatalf("test:%d %s\texpected the same socket to be sampled the same on the next poll", i, test.name)
+			}
+			if modulus != 4 {
+				t.Fatalf("test:%d %s\texpected modulus:4\tresult:%d", i, test.name, modulus)
+			}
+			if first {
+				sampled4++
+			}
+			if in16, _ := test.s.Sample(msg, nil, 16); in16 {
+				sampled16++
+				if !first {
+					notNested++
+				}
+			}
+		}
+		if sampled4 < sockets/4*9/10 || sampled4 > sockets/4*11/10 {
+			t.Errorf("test:%d %s\texpected about:%d sampled at modulus 4\tresult:%d", i, test.name, sockets/4, sampled4)
+		}
+		if sampled16 < sockets/16*8/10 || sampled16 > sockets/16*12/10 {
+			t.Errorf("test:%d %s\texpected about:%d sampled at modulus 16\tresult:%d", i, test.name, sockets/16, sampled16)
+		}
+		if notNested != 0 {
+			t.Errorf("test:%d %s\texpected the modulus 16 sample to be a subset of the modulus 4 sample\tresult:%d not in", i, test.name, notNested)
+		}
+	}
+}
+
+// TestStrata checks the strata modulus overrides the samplingModulus, and is returned for the record
+func TestStrata(t *testing.T) {
+
+	strata, err := sampler.ParseStrata("port:22=1,prefix:10.0.0.0/8=3,prefix:2001:db8::/32=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name          string
+		s             sampler.MessageSampler
+		msg           []byte
+		before        int // the messages of the same stratum before, in the dump
+		expectSampled bool
+		expectModulus int
+	}{
+		{"hash port", sampler.HashSampler{Strata: strata}, testMsg("192.0.2.1", 22, "203.0.113.1", 50000, 1), 0, true, 1},
+		{"hash prefix v6", sampler.HashSampler{Strata: strata}, testMsg("2001:db8:1::1", 443, "2001:db8::2", 50000, 1), 0, false, 5},
+		{"hash no match", sampler.HashSampler{Strata: strata}, testMsg("192.0.2.1", 443, "203.0.113.1", 50000, 1), 0, false, 100},
+		{"modulus prefix hit", sampler.ModulusSampler{Strata: strata}, testMsg("192.0.2.1", 443, "10.1.2.3", 50000, 1), 4, true, 3},
+		{"modulus prefix miss", sampler.ModulusSampler{Strata: strata}, testMsg("192.0.2.1", 443, "10.1.2.3", 50000, 1), 5, false, 3},
+		{"modulus no match", sampler.ModulusSampler{Strata: strata}, testMsg("192.0.2.1", 443, "203.0.113.1", 50000, 1), 101, true, 100},
+		{"short message", sampler.HashSampler{}, make([]byte, 10), 0, true, 1},
+	}
+
+	for i, test := range tests {
+		// the hash sampling of a single socket depends on its hash, below the threshold for the modulus
+		expectSampled := test.expectSampled
+		if _, ok := test.s.(sampler.HashSampler); ok && test.expectModulus > 1 {
+			expectSampled = sampler.Hash(test.msg[4:40]) <= math.MaxUint64/uint64(test.expectModulus)
+		}
+		var counts sampler.Counts
+		for j := 0; j < test.before; j++ {
+			test.s.Sample(test.msg, &counts, 100)
+		}
+		sampled, modulus := test.s.Sample(test.msg, &counts, 100)
+		if sampled != expectSampled || modulus != test.expectModulus {
+			t.Errorf("test:%d %s\texpected sampled:%t modulus:%d\tresult:%t %d", i, test.name, expectSampled, test.expectModulus, sampled, modulus)
+		}
+	}
+}
+
+// TestModulusSampler checks every modulus'th message of each stratum is sampled across the whole dump, so the
+// sampled fraction matches the stamped modulus, even when the modulus is more than the messages in a packet
+func TestModulusSampler(t *testing.T) {
+
+	strata, err := sampler.ParseStrata("prefix:10.0.0.0/8=150,port:22=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sampler.ModulusSampler{Strata: strata}
+
+	var tests = []struct {
+		name    string
+		msg     []byte
+		modulus int
+	}{
+		{"no stratum", testMsg("192.0.2.1", 443, "203.0.113.1", 50000, 1), 1000},
+		{"prefix stratum", testMsg("192.0.2.1", 443, "10.1.2.3", 50000, 1), 150},
+		{"port stratum", testMsg("192.0.2.1", 22, "203.0.113.1", 50000, 1), 1},
+	}
+
+	// The strata are interleaved, like the sockets of a real dump: every 5th message is the port stratum, and
+	// every 3rd of the rest is the prefix stratum
+	const messages = 30000
+	var counts sampler.Counts
+	sampled := make([]int, len(tests))
+	seen := make([]int, len(tests))
+	for n := 0; n < messages; n++ {
+		i := 0
+		switch {
+		case n%5 == 0:
+			i = 2
+		case n%3 == 0:
+			i = 1
+		}
+		seen[i]++
+		ok, modulus := s.Sample(tests[i].msg, &counts, 1000)
+		if modulus != tests[i].modulus {
+			t.Fatalf("test:%d %s\texpected modulus:%d\tresult:%d", i, tests[i].name, tests[i].modulus, modulus)
+		}
+		if ok {
+			sampled[i]++
+		}
+	}
+	for i, test := range tests {
+		// the 2nd, then every modulus'th, message of the stratum is sampled
+		expected := (seen[i] + test.modulus - 2) / test.modulus
+		if test.modulus == 1 {
+			expected = seen[i]
+		}
+		if sampled[i] != expected || sampled[i] == 0 {
+			t.Errorf("test:%d %s\texpected sampled:%d of %d\tresult:%d", i, test.name, expected, seen[i], sampled[i])
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Package sampler contains the netlinker message sampling, and the adaptive sampling feedback controller of xtcp
+//
+// The MessageSampler decides which inet_diag messages the netlinker passes to the inetdiagers (see message.go):
+// - modulus: every samplingModulus'th message of the dump, which samples different sockets every poll
+// - hash:    a stable 1/samplingModulus of the sockets, by a hash of the socket identity, so sockets are followed across polls
+// Both support strata, which are local ports or destination prefixes with their own samplingModulus.
+// The samplingModulus each message was sampled at is stamped into the record, for unbiased upscaling.
+//
+// The adaptive Sampler adjusts the samplingModulus itself.
+//
+// Hosts range from a thousand to hundreds of thousands of sockets, so a single static samplingModulus
+// either throws away most of the data on the quiet hosts, or can't keep up on the busy ones.
+//
+// After each poll, the poller gives the Sampler an Observation of the poll duration, and how full
+// the netlinkerCh was when the dump completed.  The load is the worst of:
+// - poll duration / (polling frequency * samplingTarget)
+// - netlinkerCh fill / samplingQueueHigh
+//
+// A load above 1 raises the samplingModulus in proportion (up to double per poll), so overload backs off quickly.
+// A load below half lowers the samplingModulus by a quarter (at least one), so the recovery is gentle.
+// In between, the samplingModulus is left alone, which avoids flapping.
+// The samplingModulus is always kept within samplingModulusMin and samplingModulusMax.
+//
+// There is one Sampler per address family (poller), because the IPv4 and IPv6 socket counts are usually very different.
+package sampler
+
+import (
+	"math"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// maxIncrease limits how much the samplingModulus can be raised in a single poll
+	maxIncrease = 2.0
+	// lowLoad is the load below which the samplingModulus is lowered
+	lowLoad = 0.5
+	// decrease is the fraction the samplingModulus is lowered by
+	decrease = 0.75
+)
+
+// The metrics are package level, so they are only registered once, even with a Sampler per address family
+var (
+	promLoad = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "sampler",
+			Name:      "load",
+			Help:      "sampler load of the last poll, by address family.  Above 1 the samplingModulus is raised, below 0.5 it is lowered",
+		},
+		[]string{"af"},
+	)
+	promAdjustments = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "sampler",
+			Name:      "adjustments",
+			Help:      "sampler samplingModulus adjustments, by address family, by direction (up, down)",
+		},
+		[]string{"af", "direction"},
+	)
+)
+
+// Observation is what the poller measured for one poll
+type Observation struct {
+	PollDuration     time.Duration
+	PollingFrequency time.Duration
+	QueueFill        float64 // len/cap of the netlinkerCh when the dump completed, 0 to 1
+}
+
+// Sampler adjusts the samplingModulus of one address family
+type Sampler struct {
+	af        string
+	min       int
+	max       int
+	target    float64
+	queueHigh float64
+}
+
+// NewSampler creates the Sampler for the address family, with the bounds and targets from the cliFlags
+func NewSampler(af uint8, cliFlags cliflags.CliFlags) *Sampler {
+	return &Sampler{
+		af:        misc.KernelEnumToString[af],
+		min:       *cliFlags.SamplingModulusMin,
+		max:       *cliFlags.SamplingModulusMax,
+		target:    *cliFlags.SamplingTarget,
+		queueHigh: *cliFlags.SamplingQueueHigh,
+	}
+}
+
+// Load is the worst of the poll duration against the target, and the queue fill against samplingQueueHigh
+// 1 is exactly on target
+func (s *Sampler) Load(o Observation) float64 {
+	var durationLoad float64
+	if o.PollingFrequency > 0 {
+		durationLoad = float64(o.PollDuration) / (float64(o.PollingFrequency) * s.target)
+	}
+	return math.Max(durationLoad, o.QueueFill/s.queueHigh)
+}
+
+// Next returns the samplingModulus to use for the next poll, given the current samplingModulus and the last poll
+func (s *Sampler) Next(modulus int, o Observation) int {
+
+	load := s.Load(o)
+	promLoad.WithLabelValues(s.af).Set(load)
+
+	next := modulus
+	switch {
+	case load > 1:
+		next = int(math.Ceil(float64(modulus) * math.Min(load, maxIncrease)))
+		if next == modulus {
+			next++
+		}
+	case load < lowLoad:
+		next = int(math.Floor(float64(modulus) * decrease))
+		if next == modulus {
+			next--
+		}
+	}
+
+	if next < s.min {
+		next = s.min
+	}
+	if next > s.max {
+		next = s.max
+	}
+
+	switch {
+	case next > modulus:
+		promAdjustments.WithLabelValues(s.af, "up").Inc()
+	case next < modulus:
+		promAdjustments.WithLabelValues(s.af, "down").Inc()
+	}
+	return next
+}
@@ -0,0 +1,76 @@
+package sampler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/sampler"
+	"golang.org/x/sys/unix"
+)
+
+// testSampler creates a Sampler with bounds 1-100, a 50% target, and 80% queue high
+func testSampler() *sampler.Sampler {
+	min, max := 1, 100
+	target, queueHigh := 0.5, 0.8
+	var cliFlags cliflags.CliFlags
+	cliFlags.SamplingModulusMin = &min
+	cliFlags.SamplingModulusMax = &max
+	cliFlags.SamplingTarget = &target
+	cliFlags.SamplingQueueHigh = &queueHigh
+	return sampler.NewSampler(unix.AF_INET, cliFlags)
+}
+
+// TestNext checks the samplingModulus is raised on overload, lowered when idle, and kept within the bounds
+func TestNext(t *testing.T) {
+
+	s := testSampler()
+	frequency := 10 * time.Second
+
+	var tests = []struct {
+		name         string
+		modulus      int
+		pollDuration time.Duration
+		queueFill    float64
+		expected     int
+	}{
+		{"on target", 10, 5 * time.Second, 0, 10},
+		{"dead band", 10, 3 * time.Second, 0.5, 10},
+		{"slightly over", 10, 6 * time.Second, 0, 12},
+		{"way over is at most double", 10, 20 * time.Second, 0, 20},
+		{"over from 1", 1, 6 * time.Second, 0, 2},
+		{"queue full", 10, time.Second, 1, 13},
+		{"idle", 10, time.Second, 0, 7},
+		{"idle small", 2, time.Second, 0, 1},
+		{"idle at min", 1, time.Second, 0, 1},
+		{"over at max", 100, 20 * time.Second, 0, 100},
+		{"over near max", 80, 20 * time.Second, 0, 100},
+	}
+
+	for i, test := range tests {
+		result := s.Next(test.modulus, sampler.Observation{PollDuration: test.pollDuration, PollingFrequency: frequency, QueueFill: test.queueFill})
+		if result != test.expected {
+			t.Errorf("test:%d %s\texpected:%d\tresult:%d", i, test.name, test.expected, result)
+		}
+	}
+}
+
+// TestConverges checks a host where the poll duration is proportional to the sampled sockets settles within the dead band
+func TestConverges(t *testing.T) {
+
+	s := testSampler()
+	frequency := 10 * time.Second
+	// 100k sockets, 100 microseconds each to process when sampled, plus a fixed 200ms to read the dump
+	cost := func(modulus int) time.Duration {
+		return 200*time.Millisecond + time.Duration(100000/modulus)*time.Microsecond*100
+	}
+
+	modulus := 1
+	for i := 0; i < 20; i++ {
+		modulus = s.Next(modulus, sampler.Observation{PollDuration: cost(modulus), PollingFrequency: frequency})
+	}
+	load := s.Load(sampler.Observation{PollDuration: cost(modulus), PollingFrequency: frequency})
+	if load > 1 || load < 0.5 {
+		t.Errorf("expected load within 0.5-1 after 20 polls\tresult:%f\tmodulus:%d", load, modulus)
+	}
+}
@@ -0,0 +1,353 @@
+// Package services maps the local port and the UID of the sockets to a service name, e.g. 443 to "nginx"
+//
+// The records only have the numeric ports and UID, so the Mapper resolves them to the service name, which the
+// inetdiagers stamp into the record's service field.  The service is then a field like any other, so it can be
+// used by the export filters, the alerts group_by, and the topN reports, and it's a label of the socket metrics.
+//
+// The names come from, in order:
+//  1. the servicesFile ports
+//  2. the servicesFile uids
+//  3. the local ports the processes are listening on, learnt from the LISTEN sockets (servicesLearn)
+//  4. /etc/services, by port (servicesEtc)
+//  5. /etc/passwd, by UID (servicesEtc)
+//
+// Only the local port is mapped, which is the service port for the server sockets.  The client sockets
+// have ephemeral local ports, so they are mostly mapped by the UID, if at all.
+//
+// The learning dumps the LISTEN sockets with inet_diag, like the pollers dump the established sockets but with
+// the TCP_LISTEN idiag_states, and finds the process which has each socket's inode open in /proc/<pid>/fd, so the
+// service name is the process name (comm).  Reading every fd of every process is the expensive part, so it's
+// only done when the set of LISTEN sockets has changed since the previous Learn.  The learnt ports are replaced
+// each time the fds are read, so a port which is no longer listened on is forgotten.  Reading the other
+// processes' fds needs root, or CAP_SYS_PTRACE, like ss -p.
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// listenMask is the idiag_states for just the LISTEN sockets (TCP_LISTEN = 10)
+	listenMask = uint32(1 << 10)
+	// listenTimeout is the netlink socket timeout of the LISTEN dumps, in milliseconds
+	listenTimeout = 1000
+	// packetBufferSize is the size of the netlink receive buffer, which is large enough for the kernel's dump packets
+	packetBufferSize = 65536
+)
+
+// File is the servicesFile, e.g.
+//
+//	ports:
+//	  443: https
+//	  9100: node_exporter
+//	uids:
+//	  33: www-data
+type File struct {
+	Ports map[uint16]string `yaml:"ports"`
+	UIDs  map[uint32]string `yaml:"uids"`
+}
+
+// ReadFile reads the servicesFile
+func ReadFile(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("services file %s:%w", path, err)
+	}
+	return &file, nil
+}
+
+// Mapper resolves the service names.  The Mapper is shared by all the inetdiagers.
+// A nil Mapper resolves nothing, which is how the mapping is disabled.
+type Mapper struct {
+	ports       map[uint16]string
+	uids        map[uint32]string
+	etcServices map[uint16]string
+	etcPasswd   map[uint32]string
+
+	// learnt are the listening ports, which are replaced when the LISTEN sockets change
+	learnt atomic.Pointer[map[uint16]string]
+
+	// learnMu serializes Learn, which owns listening
+	learnMu sync.Mutex
+	// listening are the inodes and the ports of the LISTEN sockets of the previous Learn
+	listening map[uint64]uint16
+}
+
+// New creates the Mapper from the File (nil = none), and the services and passwd files (empty = none),
+// which are /etc/services and /etc/passwd, except for the tests
+func New(file *File, etcServices string, etcPasswd string) (*Mapper, error) {
+	m := &Mapper{ports: map[uint16]string{}, uids: map[uint32]string{}, etcServices: map[uint16]string{}, etcPasswd: map[uint32]string{}}
+	if file != nil {
+		for port, name := range file.Ports {
+			m.ports[port] = name
+		}
+		for uid, name := range file.UIDs {
+			m.uids[uid] = name
+		}
+	}
+	if etcServices != "" {
+		if err := readEtcServices(etcServices, m.etcServices); err != nil {
+			return nil, err
+		}
+	}
+	if etcPasswd != "" {
+		if err := readEtcPasswd(etcPasswd, m.etcPasswd); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// NewFromFlags creates the Mapper, or returns nil if servicesFile, servicesEtc, and servicesLearn are all disabled
+func NewFromFlags(cliFlags cliflags.CliFlags) (*Mapper, error) {
+	if *cliFlags.ServicesFile == "" && !*cliFlags.ServicesEtc && *cliFlags.ServicesLearn == 0 {
+		return nil, nil
+	}
+	var file *File
+	if *cliFlags.ServicesFile != "" {
+		var err error
+		if file, err = ReadFile(*cliFlags.ServicesFile); err != nil {
+			return nil, err
+		}
+	}
+	var etcServices, etcPasswd string
+	if *cliFlags.ServicesEtc {
+		etcServices, etcPasswd = "/etc/services", "/etc/passwd"
+	}
+	return New(file, etcServices, etcPasswd)
+}
+
+// Resolve returns the service name of the local port and the UID, or empty if there isn't one
+func (m *Mapper) Resolve(localPort uint16, uid uint32) string {
+	if m == nil {
+		return ""
+	}
+	if name, ok := m.ports[localPort]; ok {
+		return name
+	}
+	if name, ok := m.uids[uid]; ok {
+		return name
+	}
+	if learnt := m.learnt.Load(); learnt != nil {
+		if name, ok := (*learnt)[localPort]; ok {
+			return name
+		}
+	}
+	if name, ok := m.etcServices[localPort]; ok {
+		return name
+	}
+	return m.etcPasswd[uid]
+}
+
+// Learn replaces the learnt ports with the ports of the LISTEN sockets, and the names of the processes
+// listening on them.  The LISTEN sockets are dumped on a netlink socket from openTransport, and the processes are
+// found in procRoot (/proc, except for the tests), which is only read if the LISTEN sockets have changed.
+// The sockets whose process can't be found (e.g. the fds aren't readable) aren't learnt.
+func (m *Mapper) Learn(openTransport xtcpnl.OpenTransport, procRoot string) (int, error) {
+	m.learnMu.Lock()
+	defer m.learnMu.Unlock()
+
+	transport, err := openTransport(listenTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer transport.Close()
+
+	inodes := make(map[uint64]uint16)
+	for seq, af := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		if err := dumpListening(transport, af, uint32(seq+1), inodes); err != nil {
+			return 0, err
+		}
+	}
+
+	if m.listening != nil && maps.Equal(inodes, m.listening) {
+		return len(*m.learnt.Load()), nil
+	}
+
+	learnt := make(map[uint16]string)
+	if len(inodes) > 0 {
+		pids, err := filepath.Glob(filepath.Join(procRoot, "[0-9]*"))
+		if err != nil {
+			return 0, err
+		}
+		for _, pid := range pids {
+			fds, err := os.ReadDir(filepath.Join(pid, "fd"))
+			if err != nil {
+				continue
+			}
+			var comm string
+			for _, fd := range fds {
+				link, err := os.Readlink(filepath.Join(pid, "fd", fd.Name()))
+				if err != nil || !strings.HasPrefix(link, "socket:[") {
+					continue
+				}
+				inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+				if err != nil {
+					continue
+				}
+				port, ok := inodes[inode]
+				if !ok {
+					continue
+				}
+				if comm == "" {
+					b, err := os.ReadFile(filepath.Join(pid, "comm"))
+					if err != nil {
+						break
+					}
+					comm = strings.TrimSpace(string(b))
+				}
+				learnt[port] = comm
+			}
+		}
+	}
+
+	m.learnt.Store(&learnt)
+	m.listening = inodes
+	return len(learnt), nil
+}
+
+// Run learns the listening ports every interval, until ctx is cancelled
+func (m *Mapper) Run(ctx context.Context, openTransport xtcpnl.OpenTransport, procRoot string, interval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger := logging.Logger("main").With("services", true)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := m.Learn(openTransport, procRoot); err != nil {
+			logger.Warn("services learn", "err", err)
+		} else {
+			logger.Debug("services learnt", "ports", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dumpListening adds the inodes and the local ports of the address family's LISTEN sockets, from the inet_diag
+// dump.  The request has no idiag_ext, so the responses are just the inet_diag_msg.
+func dumpListening(transport xtcpnl.Transport, af uint8, seq uint32, inodes map[uint64]uint16) error {
+	request := xtcpnl.BuildNetlinkSockDiagRequestStates(&af, 128, 72, seq, 0, 0, 0, listenMask)
+	if err := transport.Send(request); err != nil {
+		return fmt.Errorf("listen dump af:%d send:%w", af, err)
+	}
+
+	packetBuffer := make([]byte, packetBufferSize)
+	for {
+		n, err := transport.Recvfrom(packetBuffer)
+		if err != nil {
+			// EAGAIN is the socket timeout, so the kernel didn't send the NLMSG_DONE
+			return fmt.Errorf("listen dump af:%d recvfrom:%w", af, err)
+		}
+		for offset := 0; offset+unix.NLMSG_HDRLEN <= n; {
+			length := int(binary.LittleEndian.Uint32(packetBuffer[offset:]))
+			if length < unix.NLMSG_HDRLEN || offset+length > n {
+				return fmt.Errorf("listen dump af:%d bad nlmsg_len:%d", af, length)
+			}
+			body := packetBuffer[offset+unix.NLMSG_HDRLEN : offset+length]
+			switch binary.LittleEndian.Uint16(packetBuffer[offset+4:]) {
+			case unix.NLMSG_DONE:
+				return nil
+			case unix.NLMSG_ERROR:
+				if len(body) < 4 {
+					return fmt.Errorf("listen dump af:%d short NLMSG_ERROR", af)
+				}
+				return fmt.Errorf("listen dump af:%d:%w", af, syscall.Errno(-int32(binary.LittleEndian.Uint32(body))))
+			default:
+				socket, err := inetdiag.Decode(body)
+				if err != nil {
+					return fmt.Errorf("listen dump af:%d:%w", af, err)
+				}
+				if socket.InetDiagMsg.Inode != 0 {
+					inodes[uint64(socket.InetDiagMsg.Inode)] = socket.InetDiagMsg.SocketID.SourcePort
+				}
+			}
+			offset += (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		}
+	}
+}
+
+// readEtcServices adds the tcp ports of the /etc/services format file.  The first name of a port is used.
+//
+//	https		443/tcp				# http protocol over TLS/SSL
+func readEtcServices(path string, ports map[uint16]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		p, protocol, ok := strings.Cut(fields[1], "/")
+		if !ok || protocol != "tcp" {
+			continue
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			continue
+		}
+		if _, ok := ports[uint16(port)]; !ok {
+			ports[uint16(port)] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// readEtcPasswd adds the user names of the /etc/passwd format file
+//
+//	www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+func readEtcPasswd(path string, uids map[uint32]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := uids[uint32(uid)]; !ok {
+			uids[uint32(uid)] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,213 @@
+package services_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/fakenetlink"
+	"github.com/Edgio/xtcp/pkg/services"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+const etcServices = `# Network services, Internet style
+ssh		22/tcp				# SSH Remote Login Protocol
+http		80/tcp		www		# WorldWideWeb HTTP
+https		443/tcp				# http protocol over TLS/SSL
+https		443/udp
+syslog		514/udp
+`
+
+const etcPasswd = `root:x:0:0:root:/root:/bin/bash
+www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+postgres:x:110:118:PostgreSQL administrator,,,:/var/lib/postgresql:/bin/bash
+`
+
+// listening are the LISTEN sockets on 22 (inode 1001), 8080 (inode 1002), and 9100 (inode 1003)
+var listening = []fakenetlink.Listener{
+	{Af: unix.AF_INET, Port: 22, Inode: 1001},
+	{Af: unix.AF_INET, Port: 8080, Inode: 1002, UID: 33},
+	{Af: unix.AF_INET6, Port: 9100, Inode: 1003, UID: 65534},
+}
+
+// kernel is the fake kernel with the LISTEN sockets, and the established sockets (inodes 1000-1004, local port
+// 443), which aren't dumped with the LISTEN idiag_states
+func kernel(listeners ...fakenetlink.Listener) *fakenetlink.Fake {
+	return fakenetlink.New(fakenetlink.Config{Sockets: 5, Listening: listeners})
+}
+
+// write writes the file, creating the directories
+func write(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// proc creates a fake /proc, with sshd (pid 10) and the app (pid 20) listening, and node_exporter (pid 30) whose fds can't be read.
+// The app also has the established socket inode 1004.
+func proc(t *testing.T) string {
+	root := t.TempDir()
+	for _, p := range []struct {
+		pid    string
+		comm   string
+		inodes []string
+	}{
+		{"10", "sshd", []string{"1001"}},
+		{"20", "app", []string{"1002", "1004"}},
+		{"30", "node_exporter", nil},
+	} {
+		write(t, filepath.Join(root, p.pid, "comm"), p.comm+"\n")
+		if p.inodes == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(root, p.pid, "fd"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, inode := range p.inodes {
+			if err := os.Symlink("socket:["+inode+"]", filepath.Join(root, p.pid, "fd", string(rune('3'+i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("/dev/null", filepath.Join(root, p.pid, "fd", "0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// TestResolve checks the order the names are resolved in
+func TestResolve(t *testing.T) {
+
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "services"), etcServices)
+	write(t, filepath.Join(dir, "passwd"), etcPasswd)
+
+	file := &services.File{
+		Ports: map[uint16]string{443: "frontend", 5432: "db"},
+		UIDs:  map[uint32]string{110: "database"},
+	}
+	m, err := services.New(file, filepath.Join(dir, "services"), filepath.Join(dir, "passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Learn(kernel(listening...).Open, proc(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		port     uint16
+		uid      uint32
+		expected string
+	}{
+		{"file port", 443, 33, "frontend"},
+		{"file port before file uid", 5432, 110, "db"},
+		{"file uid", 45000, 110, "database"},
+		{"learnt before /etc/services", 22, 0, "sshd"},
+		{"learnt", 8080, 33, "app"},
+		{"/etc/services", 80, 33, "http"},
+		{"/etc/services udp only", 514, 1000, ""},
+		{"/etc/passwd", 45000, 33, "www-data"},
+		{"nothing", 45000, 1000, ""},
+		{"unreadable fds aren't learnt", 9100, 1000, ""},
+	}
+	for i, test := range tests {
+		if result := m.Resolve(test.port, test.uid); result != test.expected {
+			t.Errorf("test:%d %s\texpected:%q\tresult:%q", i, test.name, test.expected, result)
+		}
+	}
+
+	var nilMapper *services.Mapper
+	if nilMapper.Resolve(443, 0) != "" {
+		t.Errorf("expected a nil Mapper to resolve nothing")
+	}
+}
+
+// TestLearn checks the fds are only read when the LISTEN sockets change, and then the learnt ports are replaced
+func TestLearn(t *testing.T) {
+
+	m, err := services.New(nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := proc(t)
+	fake := kernel(listening...)
+	if n, err := m.Learn(fake.Open, root); n != 2 || err != nil {
+		t.Fatalf("expected 2 ports\tresult:%d %v", n, err)
+	}
+	if requests := fake.Requests(); requests != 2 {
+		t.Errorf("expected a LISTEN dump per address family\tresult:%d", requests)
+	}
+	if result := m.Resolve(443, 0); result != "" {
+		t.Errorf("expected the established sockets not to be learnt\tresult:%q", result)
+	}
+
+	// The fds aren't read again while the LISTEN sockets are the same, so sshd is still learnt
+	if err := os.RemoveAll(filepath.Join(root, "10", "fd")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Learn(fake.Open, root); n != 2 || err != nil || m.Resolve(22, 0) != "sshd" {
+		t.Errorf("expected the same 2 ports\tresult:%d %v %q", n, err, m.Resolve(22, 0))
+	}
+
+	// The app stops listening, so the fds are read again, which also forgets sshd
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Run(ctx, kernel(listening[0], listening[2]).Open, root, time.Hour, &wg)
+	wg.Wait()
+	if result := m.Resolve(22, 0) + m.Resolve(8080, 0); result != "" {
+		t.Errorf("expected 22 and 8080 to be forgotten\tresult:%q", result)
+	}
+
+	// A dump error keeps the learnt ports
+	m.Learn(kernel(listening...).Open, proc(t))
+	if _, err := m.Learn(fakenetlink.New(fakenetlink.Config{Errno: syscall.EPERM}).Open, root); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("expected EPERM\tresult:%v", err)
+	}
+	if result := m.Resolve(22, 0); result != "sshd" {
+		t.Errorf("expected sshd to be kept\tresult:%q", result)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	write(t, path, "ports:\n  443: https\n  9100: node_exporter\nuids:\n  33: www-data\n")
+	file, err := services.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Ports[9100] != "node_exporter" || file.UIDs[33] != "www-data" || len(file.Ports) != 2 {
+		t.Errorf("unexpected file:%+v", file)
+	}
+
+	write(t, path, "ports:\n  http: 80\n")
+	if _, err := services.ReadFile(path); err == nil {
+		t.Errorf("expected an error for a port name")
+	}
+}
+
+// TestField checks the service field can be used like the other fields, e.g. by the alerts group_by
+func TestField(t *testing.T) {
+	field, err := exportfilter.ResolveField("service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &xtcppb.XtcpRecord{Service: proto.String("nginx")}
+	if field.Name() != "service" || field.String(record) != "nginx" {
+		t.Errorf("unexpected field:%s %q", field.Name(), field.String(record))
+	}
+}
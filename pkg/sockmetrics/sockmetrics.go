@@ -0,0 +1,311 @@
+// Package sockmetrics exports Prometheus metrics about the sockets themselves, rather than xtcp's own pipeline
+//
+// Each socket of a poll is observed into the histograms of the rtt, min_rtt, rtt_var, and delivery_rate, which are
+// labelled by the address family, the local service port, the service name, and the congestion algorithm.  The local
+// port is only used as the label if it's in the configured allowlist, and every other port is "other", so the
+// cardinality is bounded by the allowlist.  The service is the name from the services package, or empty, so it's
+// bounded by the names configured.  The sockets are also counted per TCP state, into the xtcp_sockets_state gauges.
+//
+// At the start of each poll, the poller calls Recorder.Poll, which sets the state gauges to the counts of the
+// previous poll, and removes the series of the label sets which weren't seen in the previous poll, so the ports and
+// congestion algorithms which go away don't leave stale series behind.
+//
+// The histograms are the classic ones, with fixed buckets.  Native histograms need client_golang v1.14+.
+//
+// The sockets are observed before the anonymization, so the service ports are the real ones.
+package sockmetrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"github.com/Edgio/xtcp/pkg/xtcprecord"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sys/unix"
+)
+
+// otherPort is the port label of the sockets whose local port isn't in the allowlist
+const otherPort = "other"
+
+// noMinRtt is the tcpi_min_rtt before the socket has an rtt sample (~0U)
+const noMinRtt = ^uint32(0)
+
+// maxState is the highest TCP state, TCP_NEW_SYN_RECV
+const maxState = 12
+
+// The metrics are package level, so they are only registered once
+var (
+	labels = []string{"af", "port", "service", "congestion"}
+
+	// rttBuckets are 100us to ~3.3s
+	rttBuckets = prometheus.ExponentialBuckets(0.0001, 2, 16)
+
+	promRtt = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "rtt_seconds",
+			Help:      "sockets smoothed rtt (tcp_info.rtt), by address family, local service port, service, and congestion algorithm",
+			Buckets:   rttBuckets,
+		},
+		labels,
+	)
+	promMinRtt = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "min_rtt_seconds",
+			Help:      "sockets minimum rtt (tcp_info.min_rtt), by address family, local service port, service, and congestion algorithm",
+			Buckets:   rttBuckets,
+		},
+		labels,
+	)
+	promRttVar = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "rtt_var_seconds",
+			Help:      "sockets rtt variance (tcp_info.rtt_var), by address family, local service port, service, and congestion algorithm",
+			Buckets:   rttBuckets,
+		},
+		labels,
+	)
+	promDeliveryRate = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "delivery_rate_bytes_per_second",
+			Help:      "sockets delivery rate (tcp_info.delivery_rate), by address family, local service port, service, and congestion algorithm",
+			// 1 KB/s to ~4 GB/s
+			Buckets: prometheus.ExponentialBuckets(1000, 4, 12),
+		},
+		labels,
+	)
+	promState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "state",
+			Help:      "sockets in the previous poll, by address family and TCP state, scaled by the sampling modulus",
+		},
+		[]string{"af", "state"},
+	)
+	promLate = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "sockets",
+			Name:      "late",
+			Help:      "sockets which arrived after their poll was finalized, so they weren't observed",
+		},
+		[]string{"af"},
+	)
+)
+
+// stateNames are the TCP state labels, indexed by the state
+var stateNames [maxState + 1]string
+
+func init() {
+	for name, state := range xtcpnl.TCPStates {
+		stateNames[state] = name
+	}
+}
+
+// key is a label set of the histograms
+type key struct {
+	port       string
+	service    string
+	congestion string
+}
+
+// series are the histograms of a label set
+type series struct {
+	rtt, minRtt, rttVar, deliveryRate prometheus.Observer
+
+	// lastSeen is the poll time (unix nanoseconds) of the latest socket with the label set
+	lastSeen atomic.Int64
+}
+
+// afRecorder is the state of an address family
+type afRecorder struct {
+	af string
+
+	// pollTime is the poll being observed (unix nanoseconds), so the sockets of older polls are late
+	pollTime atomic.Int64
+
+	// states are the socket counts of the poll being observed
+	states [maxState + 1]atomic.Uint64
+
+	// mu protects series, which is mostly read, except for a new label set
+	mu     sync.RWMutex
+	series map[key]*series
+}
+
+// Recorder observes the sockets into the Prometheus metrics.  The Recorder is shared by all the inetdiagers.
+// A nil Recorder does nothing, which is how the metrics are disabled.
+type Recorder struct {
+	ports map[uint16]string
+	afs   map[uint8]*afRecorder
+}
+
+// New creates the Recorder, with the allowlist of local service ports
+func New(ports []uint16) *Recorder {
+	r := &Recorder{
+		ports: make(map[uint16]string, len(ports)),
+		afs:   make(map[uint8]*afRecorder),
+	}
+	for _, port := range ports {
+		r.ports[port] = strconv.Itoa(int(port))
+	}
+	for _, af := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		r.afs[af] = &afRecorder{af: misc.KernelEnumToString[af], series: make(map[key]*series)}
+	}
+	return r
+}
+
+// NewFromFlags creates the Recorder from socketMetricsPorts, or returns nil if it's empty
+func NewFromFlags(cliFlags cliflags.CliFlags) (*Recorder, error) {
+	if *cliFlags.SocketMetricsPorts == "" {
+		return nil, nil
+	}
+	ports, err := ParsePorts(*cliFlags.SocketMetricsPorts)
+	if err != nil {
+		return nil, err
+	}
+	return New(ports), nil
+}
+
+// ParsePorts parses the comma separated list of ports, e.g. "80,443"
+func ParsePorts(s string) ([]uint16, error) {
+	var ports []uint16
+	for _, p := range strings.Split(s, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("socketMetricsPorts invalid port:%q", p)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+// Observe adds the socket of the poll to the metrics, with the service name of the socket (empty = none)
+// The socket represents samplingModulus sockets, which scales the state counts.  The histograms are the
+// distributions of the sampled sockets, which aren't scaled.
+func (r *Recorder) Observe(af uint8, pollTime syscall.Timespec, socket *inetdiag.Socket, service string, samplingModulus int) {
+	if r == nil {
+		return
+	}
+	a, ok := r.afs[af]
+	if !ok {
+		return
+	}
+	t := pollTime.Nano()
+	if t < a.pollTime.Load() {
+		promLate.WithLabelValues(a.af).Inc()
+		return
+	}
+
+	if state := socket.InetDiagMsg.State; int(state) < len(a.states) {
+		a.states[state].Add(uint64(samplingModulus))
+	}
+
+	s := a.get(r.key(socket, service))
+	s.lastSeen.Store(t)
+	if info := socket.TCPInfo; info != nil {
+		s.rtt.Observe(float64(info.Rtt) / 1e6)
+		s.rttVar.Observe(float64(info.Rttvar) / 1e6)
+		if info.MinRtt != noMinRtt {
+			s.minRtt.Observe(float64(info.MinRtt) / 1e6)
+		}
+		s.deliveryRate.Observe(float64(info.DeliveryRate))
+	}
+}
+
+// key is the label set of the socket
+func (r *Recorder) key(socket *inetdiag.Socket, service string) key {
+	port, ok := r.ports[socket.InetDiagMsg.SocketID.SourcePort]
+	if !ok {
+		port = otherPort
+	}
+	return key{
+		port:       port,
+		service:    service,
+		congestion: strings.ToLower(xtcprecord.CongestionAlgorithm(socket.Congestion).String()),
+	}
+}
+
+// get returns the series of the label set, creating it the first time
+func (a *afRecorder) get(k key) *series {
+	a.mu.RLock()
+	s, ok := a.series[k]
+	a.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.series[k]; ok {
+		return s
+	}
+	s = &series{
+		rtt:          promRtt.WithLabelValues(a.af, k.port, k.service, k.congestion),
+		minRtt:       promMinRtt.WithLabelValues(a.af, k.port, k.service, k.congestion),
+		rttVar:       promRttVar.WithLabelValues(a.af, k.port, k.service, k.congestion),
+		deliveryRate: promDeliveryRate.WithLabelValues(a.af, k.port, k.service, k.congestion),
+	}
+	a.series[k] = s
+	return s
+}
+
+// Poll finalizes the previous poll of the address family, and starts observing the poll at pollTime
+// The state gauges are set to the counts of the previous poll, and the series which weren't seen in the
+// previous poll are removed.  The first Poll has nothing to finalize.
+func (r *Recorder) Poll(af uint8, pollTime time.Time) {
+	if r == nil {
+		return
+	}
+	a, ok := r.afs[af]
+	if !ok {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous := a.pollTime.Swap(pollTime.UnixNano())
+	if previous == 0 {
+		return
+	}
+
+	for state := range a.states {
+		count := a.states[state].Swap(0)
+		if stateNames[state] == "" {
+			continue
+		}
+		if count == 0 {
+			promState.DeleteLabelValues(a.af, stateNames[state])
+			continue
+		}
+		promState.WithLabelValues(a.af, stateNames[state]).Set(float64(count))
+	}
+
+	for k, s := range a.series {
+		if s.lastSeen.Load() >= previous {
+			continue
+		}
+		for _, vec := range []*prometheus.HistogramVec{promRtt, promMinRtt, promRttVar, promDeliveryRate} {
+			vec.DeleteLabelValues(a.af, k.port, k.service, k.congestion)
+		}
+		delete(a.series, k)
+	}
+}
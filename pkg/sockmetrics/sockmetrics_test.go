@@ -0,0 +1,128 @@
+package sockmetrics_test
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/sockmetrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// socket is a synthetic socket, with the local port and the congestion algorithm
+func socket(port uint16, congestion string, state uint8, rtt uint32) *inetdiag.Socket {
+	return &inetdiag.Socket{
+		InetDiagMsg: inetdiag.InetDiagMsg{State: state, SocketID: inetdiag.SocketID{SourcePort: port, DestinationPort: 40000}},
+		TCPInfo:     &inetdiag.TCPInfo54{Rtt: rtt, Rttvar: rtt / 2, MinRtt: rtt / 2, DeliveryRate: 1e6},
+		Congestion:  congestion,
+	}
+}
+
+func pollTime(i int) time.Time {
+	return time.Unix(1700000000+int64(10*i), 0)
+}
+
+func timespec(i int) syscall.Timespec {
+	return syscall.NsecToTimespec(pollTime(i).UnixNano())
+}
+
+// series counts the series of the metric
+func series(t *testing.T, name string) int {
+	n, err := testutil.GatherAndCount(prometheus.DefaultGatherer, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestRecorder checks the series of each poll, and that the series which go away are removed
+func TestRecorder(t *testing.T) {
+
+	r := sockmetrics.New([]uint16{80, 443})
+	r.Poll(unix.AF_INET, pollTime(0))
+
+	// Poll 0 has 443/cubic, 80/bbr1, and other/cubic from two ports, plus a close_wait socket
+	r.Observe(unix.AF_INET, timespec(0), socket(443, "cubic", 1, 1000), "", 1)
+	r.Observe(unix.AF_INET, timespec(0), socket(443, "cubic", 1, 3000), "", 1)
+	r.Observe(unix.AF_INET, timespec(0), socket(80, "bbr", 1, 2000), "", 1)
+	r.Observe(unix.AF_INET, timespec(0), socket(8080, "cubic", 1, 500), "", 1)
+	r.Observe(unix.AF_INET, timespec(0), socket(9090, "cubic", 8, 500), "", 1)
+	r.Poll(unix.AF_INET, pollTime(1))
+
+	var tests = []struct {
+		name   string
+		series int
+	}{
+		{"xtcp_sockets_rtt_seconds", 3},
+		{"xtcp_sockets_min_rtt_seconds", 3},
+		{"xtcp_sockets_rtt_var_seconds", 3},
+		{"xtcp_sockets_delivery_rate_bytes_per_second", 3},
+		{"xtcp_sockets_state", 2},
+	}
+	for i, test := range tests {
+		if n := series(t, test.name); n != test.series {
+			t.Errorf("test:%d %s\texpected:%d\tresult:%d", i, test.name, test.series, n)
+		}
+	}
+
+	expected := `
+# HELP xtcp_sockets_state sockets in the previous poll, by address family and TCP state, scaled by the sampling modulus
+# TYPE xtcp_sockets_state gauge
+xtcp_sockets_state{af="v4",state="close_wait"} 1
+xtcp_sockets_state{af="v4",state="established"} 4
+`
+	if err := testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "xtcp_sockets_state"); err != nil {
+		t.Error(err)
+	}
+
+	// Poll 1 only has 443/cubic, sampled 1 in 10, and a late socket of poll 0, which is ignored
+	r.Observe(unix.AF_INET, timespec(0), socket(80, "bbr", 1, 2000), "", 1)
+	r.Observe(unix.AF_INET, timespec(1), socket(443, "cubic", 1, 1000), "", 10)
+	r.Poll(unix.AF_INET, pollTime(2))
+
+	expected = `
+# HELP xtcp_sockets_state sockets in the previous poll, by address family and TCP state, scaled by the sampling modulus
+# TYPE xtcp_sockets_state gauge
+xtcp_sockets_state{af="v4",state="established"} 10
+`
+	if err := testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "xtcp_sockets_state"); err != nil {
+		t.Error(err)
+	}
+	if n := series(t, "xtcp_sockets_rtt_seconds"); n != 1 {
+		t.Errorf("expected only the 443/cubic series\tresult:%d", n)
+	}
+	if n := series(t, "xtcp_sockets_late"); n != 1 {
+		t.Errorf("expected the late counter\tresult:%d", n)
+	}
+
+	// Poll 2 is empty, so everything is removed
+	r.Poll(unix.AF_INET, pollTime(3))
+	if n := series(t, "xtcp_sockets_rtt_seconds") + series(t, "xtcp_sockets_state"); n != 0 {
+		t.Errorf("expected no series\tresult:%d", n)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	var tests = []struct {
+		ports string
+		count int
+		err   bool
+	}{
+		{"443", 1, false},
+		{"80, 443,8080", 3, false},
+		{"", 0, true},
+		{"0", 0, true},
+		{"65536", 0, true},
+		{"http", 0, true},
+	}
+	for i, test := range tests {
+		ports, err := sockmetrics.ParsePorts(test.ports)
+		if len(ports) != test.count || (err != nil) != test.err {
+			t.Errorf("test:%d %q\texpected:%d %t\tresult:%v %v", i, test.ports, test.count, test.err, ports, err)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Package streamer is the gRPC live record subscription service of xtcp
+//
+// Clients subscribe with a filter (prefixes, ports, states, min RTT) and receive the matching
+// XtcpRecords as they are parsed by the inetdiagers.  This is intended for engineers debugging
+// specific connections, without touching the central UDP/NSQ pipeline.
+//
+// The inetdiagers must never block on a subscriber, so each subscriber has its own buffered
+// channel, and if a subscriber is too slow to drain its channel, records are dropped (and counted)
+// for that subscriber only.
+//
+// When there are no subscribers, Active() is false and the inetdiagers skip all of this work.
+package streamer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Filter is the compiled version of the xtcppb.SubscribeRequest
+// Empty fields match everything
+type Filter struct {
+	Prefixes []*net.IPNet
+	Ports    map[uint32]bool
+	States   map[uint32]bool
+	MinRTT   uint32
+	Family   uint32
+}
+
+// NewFilter validates and compiles the subscribe request into a Filter
+// Single addresses without a prefix length are treated as /32 or /128
+func NewFilter(req *xtcppb.SubscribeRequest) (*Filter, error) {
+
+	f := &Filter{
+		Ports:  make(map[uint32]bool),
+		States: make(map[uint32]bool),
+		MinRTT: req.GetMinRtt(),
+		Family: req.GetFamily(),
+	}
+
+	for _, prefix := range req.GetPrefixes() {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			ip := net.ParseIP(prefix)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid prefix %q", prefix)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ipNet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			} else {
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
+		}
+		f.Prefixes = append(f.Prefixes, ipNet)
+	}
+	for _, port := range req.GetPorts() {
+		if port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+		f.Ports[port] = true
+	}
+	for _, state := range req.GetStates() {
+		f.States[state] = true
+	}
+	switch f.Family {
+	case 0, 2, 10:
+	default:
+		return nil, fmt.Errorf("invalid family %d, must be 2 (IPv4) or 10 (IPv6)", f.Family)
+	}
+
+	return f, nil
+}
+
+// Match returns true if the record matches all the filter fields
+func (f *Filter) Match(record *xtcppb.XtcpRecord) bool {
+
+	inetDiagMsg := record.GetInetDiagMsg()
+	socketID := inetDiagMsg.GetSocketID()
+
+	if f.Family != 0 && inetDiagMsg.GetFamily() != f.Family {
+		return false
+	}
+	if len(f.States) > 0 && !f.States[inetDiagMsg.GetState()] {
+		return false
+	}
+	if len(f.Ports) > 0 && !f.Ports[socketID.GetSourcePort()] && !f.Ports[socketID.GetDestinationPort()] {
+		return false
+	}
+	if f.MinRTT > 0 && record.GetTcpInfo().GetRtt() < f.MinRTT {
+		return false
+	}
+	if len(f.Prefixes) > 0 {
+		source := net.IP(socketID.GetSource())
+		destination := net.IP(socketID.GetDestination())
+		var found bool
+		for _, prefix := range f.Prefixes {
+			if prefix.Contains(source) || prefix.Contains(destination) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriber is a single gRPC client
+type subscriber struct {
+	id     uint64
+	peer   string
+	filter *Filter
+	ch     chan *xtcppb.XtcpRecord
+}
+
+// Streamer holds the current subscribers, and implements the xtcppb.XtcpStreamServer
+type Streamer struct {
+	xtcppb.UnimplementedXtcpStreamServer
+
+	mu          sync.RWMutex
+	subscribers map[uint64]*subscriber
+	nextID      uint64
+	active      int32
+
+	maxSubscribers int
+	maxBufferSize  int
+
+	logger *slog.Logger
+
+	promSubscribers prometheus.Gauge
+	promMatched     prometheus.Counter
+	promSent        prometheus.Counter
+	promDropped     prometheus.Counter
+}
+
+// NewStreamer creates the Streamer and registers the Prometheus metrics
+func NewStreamer(cliFlags cliflags.CliFlags) *Streamer {
+
+	s := &Streamer{
+		subscribers:    make(map[uint64]*subscriber),
+		maxSubscribers: *cliFlags.GRPCMaxSubscribers,
+		maxBufferSize:  *cliFlags.GRPCSubscriberBuffer,
+		logger:         logging.Logger("streamer"),
+	}
+
+	s.promSubscribers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "xtcp",
+			Subsystem: "streamer",
+			Name:      "subscribers",
+			Help:      "streamer current gRPC subscribers",
+		},
+	)
+	s.promMatched = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "streamer",
+			Name:      "matched",
+			Help:      "streamer records matching at least one subscriber filter",
+		},
+	)
+	s.promSent = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "streamer",
+			Name:      "sent",
+			Help:      "streamer records sent to subscribers",
+		},
+	)
+	s.promDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "xtcp",
+			Subsystem: "streamer",
+			Name:      "dropped",
+			Help:      "streamer records dropped because a subscriber buffer was full",
+		},
+	)
+
+	return s
+}
+
+// Active returns true if there is at least one subscriber
+// This is cheap, so the inetdiagers call it for every message
+func (s *Streamer) Active() bool {
+	if s == nil {
+		return false
+	}
+	return atomic.LoadInt32(&s.active) > 0
+}
+
+// Publish offers the record to each subscriber whose filter matches
+// Publish never blocks.  If a subscriber buffer is full, the record is dropped for that subscriber.
+//
+// The inetdiagers reuse the structs the record points into, so the record is cloned once
+// if there are any matches, and the clone is shared (read only) between the subscribers.
+func (s *Streamer) Publish(record *xtcppb.XtcpRecord) {
+
+	if !s.Active() {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var clone *xtcppb.XtcpRecord
+	for _, sub := range s.subscribers {
+		if !sub.filter.Match(record) {
+			continue
+		}
+		if clone == nil {
+			clone = proto.Clone(record).(*xtcppb.XtcpRecord)
+			s.promMatched.Inc()
+		}
+		select {
+		case sub.ch <- clone:
+		default:
+			s.promDropped.Inc()
+			s.logger.Log(context.Background(), logging.LevelTrace, "buffer full, dropped", "subscriber", sub.id, "peer", sub.peer)
+		}
+	}
+}
+
+// add registers a new subscriber, or returns an error if there are too many already
+func (s *Streamer) add(filter *Filter, bufferSize int, peerAddr string) (*subscriber, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.subscribers) >= s.maxSubscribers {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many subscribers, maximum:%d", s.maxSubscribers)
+	}
+
+	if bufferSize <= 0 || bufferSize > s.maxBufferSize {
+		bufferSize = s.maxBufferSize
+	}
+
+	s.nextID++
+	sub := &subscriber{
+		id:     s.nextID,
+		peer:   peerAddr,
+		filter: filter,
+		ch:     make(chan *xtcppb.XtcpRecord, bufferSize),
+	}
+	s.subscribers[sub.id] = sub
+	atomic.StoreInt32(&s.active, int32(len(s.subscribers)))
+	s.promSubscribers.Set(float64(len(s.subscribers)))
+
+	return sub, nil
+}
+
+// remove deletes the subscriber.  The channel is not closed, because Publish may still hold it.
+func (s *Streamer) remove(sub *subscriber) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, sub.id)
+	atomic.StoreInt32(&s.active, int32(len(s.subscribers)))
+	s.promSubscribers.Set(float64(len(s.subscribers)))
+}
+
+// Subscribe is the gRPC server side streaming handler
+// This streams records to the client until the client goes away, or a Send fails
+func (s *Streamer) Subscribe(req *xtcppb.SubscribeRequest, stream xtcppb.XtcpStream_SubscribeServer) error {
+
+	filter, err := NewFilter(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var peerAddr string
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		peerAddr = p.Addr.String()
+	}
+
+	sub, err := s.add(filter, int(req.GetBufferSize()), peerAddr)
+	if err != nil {
+		return err
+	}
+	defer s.remove(sub)
+
+	logger := s.logger.With("subscriber", sub.id, "peer", sub.peer)
+	logger.Info("subscribed", "request", req.String())
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			logger.Info("done")
+			return nil
+		case record := <-sub.ch:
+			if err := stream.Send(record); err != nil {
+				logger.Warn("stream.Send error", "err", err)
+				return err
+			}
+			s.promSent.Inc()
+		}
+	}
+}
+
+// Serve starts the gRPC server listening on listen
+// This blocks, so is expected to be called as a go routine
+func Serve(listen string, s *Streamer) {
+
+	logger := logging.Logger("streamer")
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		logger.Error("net.Listen error", "listen", listen, "err", err)
+		return
+	}
+
+	grpcServer := grpc.NewServer()
+	xtcppb.RegisterXtcpStreamServer(grpcServer, s)
+
+	logger.Info("gRPC listener started", "listen", listen)
+	if err := grpcServer.Serve(listener); err != nil {
+		logger.Error("grpcServer.Serve error", "err", err)
+	}
+}
@@ -0,0 +1,99 @@
+package streamer_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/streamer"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/proto"
+)
+
+// testRecord builds a minimal record with just the fields the filter looks at
+func testRecord(family uint32, state uint32, source string, sport uint32, destination string, dport uint32, rtt uint32) *xtcppb.XtcpRecord {
+	sourceIP := net.ParseIP(source)
+	destinationIP := net.ParseIP(destination)
+	if family == 2 {
+		sourceIP = sourceIP.To4()
+		destinationIP = destinationIP.To4()
+	}
+	return &xtcppb.XtcpRecord{
+		InetDiagMsg: &xtcppb.InetDiagMsg{
+			Family: proto.Uint32(family),
+			State:  proto.Uint32(state),
+			SocketID: &xtcppb.SocketID{
+				SourcePort:      proto.Uint32(sport),
+				DestinationPort: proto.Uint32(dport),
+				Source:          sourceIP,
+				Destination:     destinationIP,
+			},
+		},
+		TcpInfo: &xtcppb.TcpInfo{
+			Rtt: proto.Uint32(rtt),
+		},
+	}
+}
+
+// TestFilterMatch checks each of the filter fields, and the AND between them
+func TestFilterMatch(t *testing.T) {
+
+	v4 := testRecord(2, 1, "10.1.1.1", 443, "192.0.2.10", 51000, 20000)
+	v6 := testRecord(10, 1, "2001:db8::1", 443, "2001:db8:ffff::10", 51000, 80000)
+
+	var tests = []struct {
+		name     string
+		req      *xtcppb.SubscribeRequest
+		record   *xtcppb.XtcpRecord
+		expected bool
+	}{
+		{"empty matches all v4", &xtcppb.SubscribeRequest{}, v4, true},
+		{"empty matches all v6", &xtcppb.SubscribeRequest{}, v6, true},
+		{"source prefix", &xtcppb.SubscribeRequest{Prefixes: []string{"10.0.0.0/8"}}, v4, true},
+		{"destination prefix", &xtcppb.SubscribeRequest{Prefixes: []string{"192.0.2.0/24"}}, v4, true},
+		{"single address", &xtcppb.SubscribeRequest{Prefixes: []string{"192.0.2.10"}}, v4, true},
+		{"prefix miss", &xtcppb.SubscribeRequest{Prefixes: []string{"172.16.0.0/12"}}, v4, false},
+		{"v6 prefix", &xtcppb.SubscribeRequest{Prefixes: []string{"2001:db8:ffff::/48"}}, v6, true},
+		{"v6 prefix miss", &xtcppb.SubscribeRequest{Prefixes: []string{"2001:db9::/32"}}, v6, false},
+		{"source port", &xtcppb.SubscribeRequest{Ports: []uint32{443}}, v4, true},
+		{"destination port", &xtcppb.SubscribeRequest{Ports: []uint32{80, 51000}}, v4, true},
+		{"port miss", &xtcppb.SubscribeRequest{Ports: []uint32{80}}, v4, false},
+		{"state", &xtcppb.SubscribeRequest{States: []uint32{1}}, v4, true},
+		{"state miss", &xtcppb.SubscribeRequest{States: []uint32{8}}, v4, false},
+		{"min rtt", &xtcppb.SubscribeRequest{MinRtt: proto.Uint32(50000)}, v6, true},
+		{"min rtt miss", &xtcppb.SubscribeRequest{MinRtt: proto.Uint32(50000)}, v4, false},
+		{"family", &xtcppb.SubscribeRequest{Family: proto.Uint32(10)}, v6, true},
+		{"family miss", &xtcppb.SubscribeRequest{Family: proto.Uint32(10)}, v4, false},
+		{"and all match", &xtcppb.SubscribeRequest{Prefixes: []string{"10.0.0.0/8"}, Ports: []uint32{443}, States: []uint32{1}}, v4, true},
+		{"and one miss", &xtcppb.SubscribeRequest{Prefixes: []string{"10.0.0.0/8"}, Ports: []uint32{80}, States: []uint32{1}}, v4, false},
+	}
+
+	for i, test := range tests {
+		filter, err := streamer.NewFilter(test.req)
+		if err != nil {
+			t.Fatalf("test:%d %s\tNewFilter error:%v", i, test.name, err)
+		}
+		if output := filter.Match(test.record); output != test.expected {
+			t.Errorf("test:%d %s\texpected:%t\tresult:%t", i, test.name, test.expected, output)
+		}
+	}
+}
+
+// TestNewFilterErrors checks invalid requests are rejected
+func TestNewFilterErrors(t *testing.T) {
+
+	var tests = []struct {
+		name string
+		req  *xtcppb.SubscribeRequest
+	}{
+		{"bad prefix", &xtcppb.SubscribeRequest{Prefixes: []string{"10.0.0.0/33"}}},
+		{"not an address", &xtcppb.SubscribeRequest{Prefixes: []string{"banana"}}},
+		{"bad port", &xtcppb.SubscribeRequest{Ports: []uint32{65536}}},
+		{"bad family", &xtcppb.SubscribeRequest{Family: proto.Uint32(4)}},
+	}
+
+	for i, test := range tests {
+		if _, err := streamer.NewFilter(test.req); err == nil {
+			t.Errorf("test:%d %s\texpected error, got nil", i, test.name)
+		}
+	}
+}
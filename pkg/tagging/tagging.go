@@ -0,0 +1,351 @@
+// Package tagging adds the key/value tags to the records, so the records carry their context (e.g. the datacenter,
+// role, and cluster), and the downstream queries don't need to join against the inventory
+//
+// The static tags (-tags dc=lhr1,role=edge) are on every record.  The tag rules (-tagRules) add more tags to the
+// sockets they match, by the source and destination prefixes and ports, the mark, the class_id, and the UID, e.g.
+//
+//	rules:
+//	  - name: internal
+//	    destination: [10.0.0.0/8, fd00::/8]
+//	    tags:
+//	      traffic: internal
+//	  - name: frontend
+//	    source_ports: [80, 443]
+//	    marks: ["0x100/0xf00"]
+//	    tags:
+//	      role: frontend
+//
+// Within a rule, every criterion which is set must match, and any of the values of a criterion can match.
+// Every rule which matches adds its tags.  The rule tags override the static tags, and the later rules override
+// the earlier ones.  The record's tags are sorted by key.
+//
+// The sockets are matched before the anonymization, so the prefixes are the real addresses.
+package tagging
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// maxRules is the maximum tag rules, so the rules a socket matches are a uint64 bit mask
+const maxRules = 64
+
+// File is the tagRules file
+type File struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a tag rule, as written in the tagRules file
+type Rule struct {
+	Name             string            `yaml:"name"`
+	Source           []string          `yaml:"source"`            // prefixes of the source address, e.g. 192.0.2.0/24
+	Destination      []string          `yaml:"destination"`       // prefixes of the destination address
+	SourcePorts      []uint16          `yaml:"source_ports"`      // source (local) ports
+	DestinationPorts []uint16          `yaml:"destination_ports"` // destination (remote) ports
+	Marks            []string          `yaml:"marks"`             // SO_MARK values, with an optional mask, e.g. 0x100/0xf00
+	ClassIDs         []uint32          `yaml:"class_ids"`         // cgroup v1 net_cls class ids, or the tc priority
+	UIDs             []uint32          `yaml:"uids"`
+	Tags             map[string]string `yaml:"tags"`
+}
+
+// mark is a mark value and mask, like iptables -m mark
+type mark struct {
+	value uint32
+	mask  uint32
+}
+
+// rule is a compiled Rule
+type rule struct {
+	source           []*net.IPNet
+	destination      []*net.IPNet
+	sourcePorts      map[uint16]bool
+	destinationPorts map[uint16]bool
+	marks            []mark
+	classIDs         map[uint32]bool
+	uids             map[uint32]bool
+	tags             map[string]string
+}
+
+// Tagger tags the records.  The Tagger is shared by all the inetdiagers.
+// A nil Tagger adds no tags, which is how the tagging is disabled.
+type Tagger struct {
+	static map[string]string
+	rules  []rule
+
+	// cache is the tags of each combination of the rules matched (uint64), which are shared by the records
+	cache sync.Map
+}
+
+// ReadFile reads the rules of the tagRules file
+func ReadFile(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("tag rules file %s:%w", path, err)
+	}
+	return file.Rules, nil
+}
+
+// ParseTags parses the comma separated key=value tags, e.g. "dc=lhr1,role=edge"
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tags invalid key=value:%q", kv)
+		}
+		tags[key] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// New creates the Tagger with the static tags, and the tag rules
+func New(static map[string]string, rules []Rule) (*Tagger, error) {
+	if len(rules) > maxRules {
+		return nil, fmt.Errorf("tag rules:%d more than the maximum:%d", len(rules), maxRules)
+	}
+	t := &Tagger{static: static}
+	for i, r := range rules {
+		compiled, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("tag rule:%d %s %w", i, r.Name, err)
+		}
+		t.rules = append(t.rules, compiled)
+	}
+	return t, nil
+}
+
+// NewFromFlags creates the Tagger, or returns nil if there aren't any tags or tagRules
+func NewFromFlags(cliFlags cliflags.CliFlags) (*Tagger, error) {
+	if *cliFlags.Tags == "" && *cliFlags.TagRules == "" {
+		return nil, nil
+	}
+	static, err := ParseTags(*cliFlags.Tags)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if *cliFlags.TagRules != "" {
+		if rules, err = ReadFile(*cliFlags.TagRules); err != nil {
+			return nil, err
+		}
+	}
+	return New(static, rules)
+}
+
+func compile(r Rule) (rule, error) {
+	c := rule{tags: r.Tags}
+	if len(r.Tags) == 0 {
+		return c, fmt.Errorf("no tags")
+	}
+	for key := range r.Tags {
+		if key == "" {
+			return c, fmt.Errorf("empty tag key")
+		}
+	}
+
+	var err error
+	if c.source, err = parsePrefixes(r.Source); err != nil {
+		return c, err
+	}
+	if c.destination, err = parsePrefixes(r.Destination); err != nil {
+		return c, err
+	}
+	c.sourcePorts = set(r.SourcePorts)
+	c.destinationPorts = set(r.DestinationPorts)
+	c.classIDs = set(r.ClassIDs)
+	c.uids = set(r.UIDs)
+	for _, m := range r.Marks {
+		parsed, err := parseMark(m)
+		if err != nil {
+			return c, err
+		}
+		c.marks = append(c.marks, parsed)
+	}
+
+	if c.source == nil && c.destination == nil && c.sourcePorts == nil && c.destinationPorts == nil &&
+		c.marks == nil && c.classIDs == nil && c.uids == nil {
+		return c, fmt.Errorf("nothing to match, use -tags for the tags of every record")
+	}
+	return c, nil
+}
+
+// parsePrefixes parses the CIDR prefixes, or the single addresses
+func parsePrefixes(prefixes []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address:%q", p)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix:%q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseMark parses value[/mask], in decimal or 0x hex
+func parseMark(s string) (mark, error) {
+	value, mask, ok := strings.Cut(s, "/")
+	m := mark{mask: ^uint32(0)}
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return m, fmt.Errorf("invalid mark:%q", s)
+	}
+	m.value = uint32(v)
+	if ok {
+		v, err := strconv.ParseUint(mask, 0, 32)
+		if err != nil {
+			return m, fmt.Errorf("invalid mark mask:%q", s)
+		}
+		m.mask = uint32(v)
+	}
+	m.value &= m.mask
+	return m, nil
+}
+
+// set is the values as a set, or nil if there aren't any
+func set[T comparable](values []T) map[T]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	s := make(map[T]bool, len(values))
+	for _, v := range values {
+		s[v] = true
+	}
+	return s
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches is true if every criterion of the rule which is set matches the socket
+// The sockets without INET_DIAG_MARK or INET_DIAG_CLASS_ID have mark and class_id zero.
+func (r *rule) matches(socket *inetdiag.Socket) bool {
+	id := socket.InetDiagMsg.SocketID
+	if r.source != nil && !containsIP(r.source, socket.Source) {
+		return false
+	}
+	if r.destination != nil && !containsIP(r.destination, socket.Destination) {
+		return false
+	}
+	if r.sourcePorts != nil && !r.sourcePorts[id.SourcePort] {
+		return false
+	}
+	if r.destinationPorts != nil && !r.destinationPorts[id.DestinationPort] {
+		return false
+	}
+	if r.uids != nil && !r.uids[socket.InetDiagMsg.UID] {
+		return false
+	}
+	if r.classIDs != nil {
+		var classID uint32
+		if socket.ClassID != nil {
+			classID = *socket.ClassID
+		}
+		if !r.classIDs[classID] {
+			return false
+		}
+	}
+	if r.marks != nil {
+		var value uint32
+		if socket.Mark != nil {
+			value = *socket.Mark
+		}
+		matched := false
+		for _, m := range r.marks {
+			if value&m.mask == m.value {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags returns the tags of the socket, sorted by key, or nil if there aren't any
+// The tags are shared by the records with the same tags, so they must not be modified.
+func (t *Tagger) Tags(socket *inetdiag.Socket) []*xtcppb.KeyValue {
+	if t == nil {
+		return nil
+	}
+	var matched uint64
+	for i := range t.rules {
+		if t.rules[i].matches(socket) {
+			matched |= 1 << i
+		}
+	}
+	if tags, ok := t.cache.Load(matched); ok {
+		return tags.([]*xtcppb.KeyValue)
+	}
+	tags, _ := t.cache.LoadOrStore(matched, t.build(matched))
+	return tags.([]*xtcppb.KeyValue)
+}
+
+// build merges the static tags and the tags of the matched rules
+func (t *Tagger) build(matched uint64) []*xtcppb.KeyValue {
+	merged := make(map[string]string, len(t.static))
+	for key, value := range t.static {
+		merged[key] = value
+	}
+	for i := range t.rules {
+		if matched&(1<<i) == 0 {
+			continue
+		}
+		for key, value := range t.rules[i].tags {
+			merged[key] = value
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	tags := make([]*xtcppb.KeyValue, len(keys))
+	for i, key := range keys {
+		tags[i] = &xtcppb.KeyValue{Key: proto.String(key), Value: proto.String(merged[key])}
+	}
+	return tags
+}
@@ -0,0 +1,172 @@
+package tagging_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/tagging"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+const rules = `
+rules:
+  - name: internal
+    destination: [10.0.0.0/8, "fd00::/8"]
+    tags:
+      traffic: internal
+  - name: frontend
+    source_ports: [80, 443]
+    tags:
+      role: frontend
+  - name: marked
+    marks: ["0x100/0xf00"]
+    tags:
+      qos: bulk
+  - name: database
+    uids: [110]
+    class_ids: [7]
+    tags:
+      role: database
+  - name: resolver
+    destination: [192.0.2.53, 10.0.0.53]
+    destination_ports: [53]
+    tags:
+      traffic: dns
+`
+
+// socket is a synthetic socket
+func socket(destination string, sourcePort uint16, destinationPort uint16, uid uint32, mark *uint32, classID *uint32) *inetdiag.Socket {
+	return &inetdiag.Socket{
+		InetDiagMsg: inetdiag.InetDiagMsg{UID: uid, SocketID: inetdiag.SocketID{SourcePort: sourcePort, DestinationPort: destinationPort}},
+		Source:      net.ParseIP("192.0.2.1"),
+		Destination: net.ParseIP(destination),
+		Mark:        mark,
+		ClassID:     classID,
+	}
+}
+
+func u32(v uint32) *uint32 {
+	return &v
+}
+
+// format is the tags as key=value,key=value
+func format(tags []*xtcppb.KeyValue) string {
+	var kvs []string
+	for _, kv := range tags {
+		kvs = append(kvs, kv.GetKey()+"="+kv.GetValue())
+	}
+	return strings.Join(kvs, ",")
+}
+
+func TestTags(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tags.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tagging.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := tagging.ParseTags("dc=lhr1,role=edge, cluster=c7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger, err := tagging.New(static, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		socket   *inetdiag.Socket
+		expected string
+	}{
+		{"static only", socket("198.51.100.1", 40000, 443, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge"},
+		{"internal", socket("10.1.2.3", 40000, 443, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge,traffic=internal"},
+		{"internal v6", socket("fd00::1", 40000, 443, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge,traffic=internal"},
+		{"frontend overrides static", socket("198.51.100.1", 443, 50000, 0, nil, nil), "cluster=c7,dc=lhr1,role=frontend"},
+		{"internal frontend", socket("10.1.2.3", 80, 50000, 0, nil, nil), "cluster=c7,dc=lhr1,role=frontend,traffic=internal"},
+		{"mark", socket("198.51.100.1", 40000, 443, 0, u32(0x1101), nil), "cluster=c7,dc=lhr1,qos=bulk,role=edge"},
+		{"mark outside the mask", socket("198.51.100.1", 40000, 443, 0, u32(0x200), nil), "cluster=c7,dc=lhr1,role=edge"},
+		{"no mark", socket("198.51.100.1", 40000, 443, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge"},
+		{"uid and class_id", socket("198.51.100.1", 40000, 5432, 110, nil, u32(7)), "cluster=c7,dc=lhr1,role=database"},
+		{"uid without class_id", socket("198.51.100.1", 40000, 5432, 110, nil, nil), "cluster=c7,dc=lhr1,role=edge"},
+		{"single address and port", socket("192.0.2.53", 40000, 53, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge,traffic=dns"},
+		{"single address, other port", socket("192.0.2.53", 40000, 853, 0, nil, nil), "cluster=c7,dc=lhr1,role=edge"},
+		{"later rules override", socket("10.0.0.53", 443, 53, 0, nil, nil), "cluster=c7,dc=lhr1,role=frontend,traffic=dns"},
+	}
+	for i, test := range tests {
+		// Twice, so the second is from the cache
+		for j := 0; j < 2; j++ {
+			if result := format(tagger.Tags(test.socket)); result != test.expected {
+				t.Errorf("test:%d %s\texpected:%s\tresult:%s", i, test.name, test.expected, result)
+			}
+		}
+	}
+
+	var nilTagger *tagging.Tagger
+	if nilTagger.Tags(tests[0].socket) != nil {
+		t.Errorf("expected a nil Tagger to add no tags")
+	}
+	none, err := tagging.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := none.Tags(tests[0].socket); tags != nil {
+		t.Errorf("expected no tags\tresult:%v", tags)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		rule tagging.Rule
+	}{
+		{"no tags", tagging.Rule{SourcePorts: []uint16{443}}},
+		{"empty key", tagging.Rule{SourcePorts: []uint16{443}, Tags: map[string]string{"": "x"}}},
+		{"nothing to match", tagging.Rule{Tags: map[string]string{"a": "b"}}},
+		{"bad prefix", tagging.Rule{Source: []string{"10.0.0.0/33"}, Tags: map[string]string{"a": "b"}}},
+		{"bad address", tagging.Rule{Destination: []string{"nope"}, Tags: map[string]string{"a": "b"}}},
+		{"bad mark", tagging.Rule{Marks: []string{"0xzz"}, Tags: map[string]string{"a": "b"}}},
+		{"bad mark mask", tagging.Rule{Marks: []string{"1/x"}, Tags: map[string]string{"a": "b"}}},
+	}
+	for i, test := range tests {
+		if _, err := tagging.New(nil, []tagging.Rule{test.rule}); err == nil {
+			t.Errorf("test:%d %s\texpected an error", i, test.name)
+		}
+	}
+
+	tooMany := make([]tagging.Rule, 65)
+	for i := range tooMany {
+		tooMany[i] = tagging.Rule{UIDs: []uint32{uint32(i)}, Tags: map[string]string{"a": "b"}}
+	}
+	if _, err := tagging.New(nil, tooMany); err == nil {
+		t.Errorf("expected an error for 65 rules")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	var tests = []struct {
+		tags     string
+		expected int
+		err      bool
+	}{
+		{"", 0, false},
+		{"dc=lhr1", 1, false},
+		{"dc=lhr1,role=", 2, false},
+		{"dc", 0, true},
+		{"=lhr1", 0, true},
+		{"dc=lhr1,", 0, true},
+	}
+	for i, test := range tests {
+		tags, err := tagging.ParseTags(test.tags)
+		if len(tags) != test.expected || (err != nil) != test.err {
+			t.Errorf("test:%d %q\texpected:%d %t\tresult:%v %v", i, test.tags, test.expected, test.err, tags, err)
+		}
+	}
+}
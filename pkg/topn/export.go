@@ -0,0 +1,101 @@
+package topn
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/nsqio/go-nsq"
+	"google.golang.org/protobuf/proto"
+)
+
+// nsqTopic is the NSQ topic of the records, which is the same as the inetdiagers
+const nsqTopic = "xtcp"
+
+// Exporter exports the top sockets of every topNRecordModulus polls as records, to UDP and NSQ, like the inetdiagers
+// The records are tagged "topn:<metric>:<rank>", e.g. "topn:tcp_info.rtt:1" is the socket with the highest rtt.
+// The records go through the NSQ and UDP export filters and projections.  A nil Exporter does nothing.
+type Exporter struct {
+	modulus     int
+	exportSinks *exportfilter.Sinks
+	udpConn     net.Conn
+	producer    *nsq.Producer
+
+	mu    sync.Mutex
+	polls map[uint8]int
+}
+
+// NewExporter creates the Exporter, or returns nil if topNRecordModulus is zero (0)
+func NewExporter(cliFlags cliflags.CliFlags, exportSinks *exportfilter.Sinks) (*Exporter, error) {
+	if *cliFlags.TopNRecordModulus == 0 {
+		return nil, nil
+	}
+	e := &Exporter{modulus: *cliFlags.TopNRecordModulus, exportSinks: exportSinks, polls: make(map[uint8]int)}
+	var err error
+	if e.udpConn, err = net.Dial("udp", *cliFlags.UDPSendDest); err != nil {
+		return nil, fmt.Errorf("topN udp:%w", err)
+	}
+	if *cliFlags.NSQ != "" {
+		if e.producer, err = nsq.NewProducer(*cliFlags.NSQ, nsq.NewConfig()); err != nil {
+			e.udpConn.Close()
+			return nil, fmt.Errorf("topN nsq:%w", err)
+		}
+	}
+	return e, nil
+}
+
+// Export sends the records of the Report, every modulus Reports of the address family
+func (e *Exporter) Export(af uint8, report *Report) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.polls[af]++
+	export := e.polls[af]%e.modulus == 0
+	e.mu.Unlock()
+	if !export {
+		return
+	}
+
+	logger := logging.Logger("inetdiager").With("af", misc.KernelEnumToString[af], "topN", true)
+	for _, ranking := range report.Rankings {
+		for _, socket := range ranking.Sockets {
+			// The record is shared with the Report, so the tag is on a copy
+			record := proto.Clone(socket.Record()).(*xtcppb.XtcpRecord)
+			record.Tag = proto.String(fmt.Sprintf("topn:%s:%d", ranking.Metric, socket.Rank))
+
+			if e.producer != nil {
+				if nsqRecord, ok := e.exportSinks.Apply(exportfilter.NSQ, record); ok {
+					if b, err := proto.Marshal(nsqRecord); err != nil {
+						logger.Error("proto.Marshal(XtcpRecord)", "err", err)
+					} else if err := e.producer.Publish(nsqTopic, b); err != nil {
+						logger.Error("topN nsq publish", "err", err)
+					}
+				}
+			}
+			if udpRecord, ok := e.exportSinks.Apply(exportfilter.UDP, record); ok {
+				if b, err := proto.Marshal(udpRecord); err != nil {
+					logger.Error("proto.Marshal(XtcpRecord)", "err", err)
+				} else if _, err := e.udpConn.Write(b); err != nil {
+					logger.Warn("topN udpConn.Write", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// Close closes the UDP socket, and stops the NSQ producer
+func (e *Exporter) Close() {
+	if e == nil {
+		return
+	}
+	e.udpConn.Close()
+	if e.producer != nil {
+		e.producer.Stop()
+	}
+}
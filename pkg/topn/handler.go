@@ -0,0 +1,100 @@
+package topn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+)
+
+// ServeHTTP serves the latest Reports, as JSON, or a table with ?format=table
+// ?af=v4 or ?af=v6 selects the address family, and ?metric=rtt selects a metric, by its full or last name
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	af, metric := query.Get("af"), query.Get("metric")
+	if af != "" && af != "v4" && af != "v6" {
+		http.Error(w, "af must be v4 or v6", http.StatusBadRequest)
+		return
+	}
+	if metric != "" {
+		field, err := exportfilter.ResolveField(metric)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metric = field.Name()
+	}
+
+	var reports []*Report
+	for _, report := range t.Reports() {
+		if af != "" && report.Af != af {
+			continue
+		}
+		selected := *report
+		if metric != "" {
+			selected.Rankings = nil
+			for _, ranking := range report.Rankings {
+				if ranking.Metric == metric {
+					selected.Rankings = append(selected.Rankings, ranking)
+				}
+			}
+		}
+		reports = append(reports, &selected)
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if reports == nil {
+			reports = []*Report{}
+		}
+		if err := writeJSON(w, reports); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "table":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		WriteTable(w, reports)
+	default:
+		http.Error(w, "format must be json or table", http.StatusBadRequest)
+	}
+}
+
+// WriteTable writes the Reports as a table for humans, e.g.
+//
+//	v4 poll 2026-10-19T08:00:00Z sockets 1234
+//	tcp_info.rtt
+//	RANK  VALUE   SOURCE            DESTINATION          COOKIE  UID  SERVICE
+//	1     250000  192.0.2.1:443     198.51.100.7:51234   4096    0    nginx
+func WriteTable(w io.Writer, reports []*Report) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "%s poll %s sockets %d\n", report.Af, report.PollTime.Format(time.RFC3339), report.Sockets)
+		for _, ranking := range report.Rankings {
+			fmt.Fprintf(bw, "\n%s\n", ranking.Metric)
+			tw := tabwriter.NewWriter(bw, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, strings.Join([]string{"RANK", "VALUE", "SOURCE", "DESTINATION", "COOKIE", "UID", "SERVICE"}, "\t"))
+			for _, s := range ranking.Sockets {
+				fmt.Fprintf(tw, "%d\t%g\t%s\t%s\t%d\t%d\t%s\n", s.Rank, s.Value, s.Source, s.Destination, s.Cookie, s.UID, s.Service)
+			}
+			tw.Flush()
+		}
+	}
+}
+
+// writeJSON writes the indented JSON, like the other admin endpoints
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,430 @@
+// Package topn ranks the worst sockets of each poll, by metrics like the rtt and the retransmits
+//
+// Each inetdiager has its own Shard, with a min-heap of the top N sockets per metric, so ranking a socket only
+// takes the Shard's own lock, which is never contended except once per poll.  At the start of each poll,
+// the poller calls Tracker.Poll, which takes the heaps of the previous poll from all the Shards, merges them
+// into the Report, and optionally exports the top sockets as records (see Exporter).
+//
+// The Reports are served by the admin API on /admin/top, as JSON or a table.
+//
+// The sockets are ranked after the anonymization, so the Reports have the same addresses as the exported records.
+package topn
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/exportfilter"
+	"github.com/Edgio/xtcp/pkg/misc"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// entry is a ranked socket
+type entry struct {
+	value  float64
+	record *xtcppb.XtcpRecord
+}
+
+// less orders the entries by the value, and then the cookie, so the ranking is stable
+func (e entry) less(o entry) bool {
+	if e.value != o.value {
+		return e.value < o.value
+	}
+	return e.record.GetInetDiagMsg().GetSocketID().GetCookie() < o.record.GetInetDiagMsg().GetSocketID().GetCookie()
+}
+
+// entryHeap is a min-heap, so the smallest of the top N is replaced by a bigger value
+type entryHeap []entry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].less(h[j]) }
+func (h entryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x any)        { *h = append(*h, x.(entry)) }
+func (h *entryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// offer adds the entry if it's in the top n
+func (h *entryHeap) offer(e entry, n int) {
+	if len(*h) < n {
+		heap.Push(h, e)
+		return
+	}
+	if (*h)[0].less(e) {
+		(*h)[0] = e
+		heap.Fix(h, 0)
+	}
+}
+
+// Socket is a ranked socket in the Report
+type Socket struct {
+	Rank        int     `json:"rank"`
+	Value       float64 `json:"value"`
+	Source      string  `json:"source"`      // address:port
+	Destination string  `json:"destination"` // address:port
+	Cookie      uint64  `json:"cookie"`
+	UID         uint32  `json:"uid"`
+	Service     string  `json:"service,omitempty"` // see the services package
+
+	record *xtcppb.XtcpRecord
+}
+
+// Record is the socket's record
+func (s Socket) Record() *xtcppb.XtcpRecord {
+	return s.record
+}
+
+// Ranking is the top sockets by a metric, the worst first
+type Ranking struct {
+	Metric  string   `json:"metric"`
+	Sockets []Socket `json:"sockets"`
+}
+
+// Report is the top sockets of a poll
+type Report struct {
+	Af       string    `json:"af"`
+	PollTime time.Time `json:"poll_time"`
+	Sockets  int       `json:"sockets"` // the sockets ranked, which are the sampled sockets
+	Rankings []Ranking `json:"rankings"`
+}
+
+// poll is the merged heaps of a poll
+type poll struct {
+	heaps   []entryHeap
+	sockets int
+}
+
+// afTracker is the Shards, and the polls being merged, of an address family
+type afTracker struct {
+	mu        sync.Mutex
+	shards    []*Shard
+	polls     map[int64]*poll
+	finalized int64 // the newest poll in a Report
+	lastPoll  int64 // the previous Poll, so a poll without any sockets still has a Report
+	report    *Report
+}
+
+// Tracker ranks the sockets of each poll
+type Tracker struct {
+	n        int
+	metrics  []*exportfilter.Field
+	exporter *Exporter
+
+	mu  sync.Mutex
+	afs map[uint8]*afTracker
+}
+
+// New creates the Tracker of the top n sockets by each of the metrics, which are record field names
+func New(n int, metrics []string) (*Tracker, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("topN:%d must be >= 1", n)
+	}
+	t := &Tracker{n: n, afs: make(map[uint8]*afTracker)}
+	for _, name := range metrics {
+		field, err := exportfilter.ResolveField(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("topN metric %w", err)
+		}
+		if field.IsAddress() {
+			return nil, fmt.Errorf("topN metric:%s is an address", field.Name())
+		}
+		t.metrics = append(t.metrics, field)
+	}
+	if len(t.metrics) == 0 {
+		return nil, fmt.Errorf("topN needs at least one metric")
+	}
+	return t, nil
+}
+
+// NewFromFlags creates the Tracker, and the Exporter of the top records, or returns nil if topN is zero (0)
+func NewFromFlags(cliFlags cliflags.CliFlags, exportSinks *exportfilter.Sinks) (*Tracker, error) {
+	if *cliFlags.TopN == 0 {
+		return nil, nil
+	}
+	t, err := New(*cliFlags.TopN, strings.Split(*cliFlags.TopNMetrics, ","))
+	if err != nil {
+		return nil, err
+	}
+	t.exporter, err = NewExporter(cliFlags, exportSinks)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Metrics are the full names of the metrics
+func (t *Tracker) Metrics() []string {
+	names := make([]string, len(t.metrics))
+	for i, m := range t.metrics {
+		names[i] = m.Name()
+	}
+	return names
+}
+
+// tracker returns the address family's afTracker, creating it the first time
+func (t *Tracker) tracker(af uint8) *afTracker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.afs[af]
+	if !ok {
+		a = &afTracker{polls: make(map[int64]*poll)}
+		t.afs[af] = a
+	}
+	return a
+}
+
+// Shard creates a Shard for an inetdiager of the address family.  A nil Tracker returns a nil Shard.
+func (t *Tracker) Shard(af uint8) *Shard {
+	if t == nil {
+		return nil
+	}
+	s := &Shard{tracker: t, af: af, heaps: make([]entryHeap, len(t.metrics))}
+	a := t.tracker(af)
+	a.mu.Lock()
+	a.shards = append(a.shards, s)
+	a.mu.Unlock()
+	return s
+}
+
+// merge adds the heaps of a Shard to the poll.  Polls which already have a Report are ignored.
+func (t *Tracker) merge(af uint8, pollTime int64, heaps []entryHeap, sockets int) {
+	a := t.tracker(af)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pollTime <= a.finalized {
+		return
+	}
+	p, ok := a.polls[pollTime]
+	if !ok {
+		p = &poll{heaps: make([]entryHeap, len(t.metrics))}
+		a.polls[pollTime] = p
+	}
+	p.sockets += sockets
+	for i := range heaps {
+		for _, e := range heaps[i] {
+			p.heaps[i].offer(e, t.n)
+		}
+	}
+}
+
+// Poll is called at the start of each poll.  The previous polls of the address family are taken from the Shards,
+// and the newest is the Report, which is exported if the Exporter is enabled.
+// The records of the previous polls which arrive after this are ignored.
+func (t *Tracker) Poll(af uint8, pollTime time.Time) *Report {
+	if t == nil {
+		return nil
+	}
+	now := pollTime.UnixNano()
+	a := t.tracker(af)
+
+	a.mu.Lock()
+	shards := append([]*Shard(nil), a.shards...)
+	a.mu.Unlock()
+	for _, s := range shards {
+		s.flush(now)
+	}
+
+	a.mu.Lock()
+	var newest int64
+	if a.lastPoll < now {
+		newest = a.lastPoll
+	}
+	a.lastPoll = now
+	for pt := range a.polls {
+		if pt < now && pt > newest {
+			newest = pt
+		}
+	}
+	if newest <= a.finalized {
+		a.mu.Unlock()
+		return nil
+	}
+	p, ok := a.polls[newest]
+	if !ok {
+		p = &poll{heaps: make([]entryHeap, len(t.metrics))}
+	}
+	report := t.report(af, newest, p)
+	for pt := range a.polls {
+		if pt <= newest {
+			delete(a.polls, pt)
+		}
+	}
+	a.finalized = newest
+	a.report = report
+	a.mu.Unlock()
+
+	t.exporter.Export(af, report)
+	return report
+}
+
+// report builds the Report of the poll, sorting the heaps worst first
+func (t *Tracker) report(af uint8, pollTime int64, p *poll) *Report {
+	report := &Report{
+		Af:       misc.KernelEnumToString[af],
+		PollTime: time.Unix(0, pollTime).UTC(),
+		Sockets:  p.sockets,
+	}
+	for i, m := range t.metrics {
+		entries := append([]entry(nil), p.heaps[i]...)
+		sort.Slice(entries, func(x, y int) bool { return entries[y].less(entries[x]) })
+		ranking := Ranking{Metric: m.Name(), Sockets: make([]Socket, 0, len(entries))}
+		for rank, e := range entries {
+			ranking.Sockets = append(ranking.Sockets, newSocket(rank+1, e))
+		}
+		report.Rankings = append(report.Rankings, ranking)
+	}
+	return report
+}
+
+// newSocket is the Socket of the entry
+func newSocket(rank int, e entry) Socket {
+	msg := e.record.GetInetDiagMsg()
+	id := msg.GetSocketID()
+	return Socket{
+		Rank:        rank,
+		Value:       e.value,
+		Source:      hostPort(id.GetSource(), id.GetSourcePort()),
+		Destination: hostPort(id.GetDestination(), id.GetDestinationPort()),
+		Cookie:      id.GetCookie(),
+		UID:         msg.GetUID(),
+		Service:     e.record.GetService(),
+		record:      e.record,
+	}
+}
+
+// Reports are the latest Reports, by address family
+func (t *Tracker) Reports() []*Report {
+	t.mu.Lock()
+	afs := make([]uint8, 0, len(t.afs))
+	for af := range t.afs {
+		afs = append(afs, af)
+	}
+	t.mu.Unlock()
+	sort.Slice(afs, func(i, j int) bool { return afs[i] < afs[j] })
+
+	var reports []*Report
+	for _, af := range afs {
+		a := t.tracker(af)
+		a.mu.Lock()
+		if a.report != nil {
+			reports = append(reports, a.report)
+		}
+		a.mu.Unlock()
+	}
+	return reports
+}
+
+// Close closes the Exporter
+func (t *Tracker) Close() {
+	if t == nil {
+		return
+	}
+	t.exporter.Close()
+}
+
+// Shard is an inetdiager's top sockets of the current poll
+type Shard struct {
+	tracker *Tracker
+	af      uint8
+
+	mu       sync.Mutex
+	pollTime int64
+	heaps    []entryHeap
+	sockets  int
+}
+
+// Observe ranks the record, of the poll at pollTime.  A nil Shard does nothing.
+// The record is kept until the Report is replaced, so it must not be changed afterwards.
+func (s *Shard) Observe(pollTime syscall.Timespec, record *xtcppb.XtcpRecord) {
+	if s == nil {
+		return
+	}
+	now := pollTime.Nano()
+
+	s.mu.Lock()
+	if now < s.pollTime {
+		// a late record of a poll which was already taken by Tracker.Poll
+		s.mu.Unlock()
+		return
+	}
+	if now > s.pollTime {
+		// The first record of a new poll, and Tracker.Poll hasn't taken the previous poll yet
+		previous, heaps, sockets := s.take(now)
+		s.mu.Unlock()
+		if sockets > 0 {
+			s.tracker.merge(s.af, previous, heaps, sockets)
+		}
+		s.mu.Lock()
+	}
+	s.sockets++
+	for i, m := range s.tracker.metrics {
+		if value := m.Number(record); value > 0 {
+			s.heaps[i].offer(entry{value: value, record: record}, s.tracker.n)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// take returns the heaps of the current poll, and starts the poll at pollTime
+// The caller must hold the lock
+func (s *Shard) take(pollTime int64) (int64, []entryHeap, int) {
+	previous, heaps, sockets := s.pollTime, s.heaps, s.sockets
+	s.pollTime, s.heaps, s.sockets = pollTime, make([]entryHeap, len(heaps)), 0
+	return previous, heaps, sockets
+}
+
+// flush merges the polls before pollTime into the Tracker
+func (s *Shard) flush(pollTime int64) {
+	s.mu.Lock()
+	if s.pollTime >= pollTime {
+		s.mu.Unlock()
+		return
+	}
+	previous, heaps, sockets := s.take(pollTime)
+	s.mu.Unlock()
+	if sockets > 0 {
+		s.tracker.merge(s.af, previous, heaps, sockets)
+	}
+}
+
+// hostPort formats the address and port, e.g. 192.0.2.1:443 or [2001:db8::1]:443, or just the port if the address was dropped
+func hostPort(ip []byte, port uint32) string {
+	if len(ip) == 0 {
+		return fmt.Sprintf(":%d", port)
+	}
+	return net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(port)))
+}
+
+// Close merges the Shard's current poll into the Tracker, and removes the Shard, when its inetdiager is done
+func (s *Shard) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	previous, heaps, sockets := s.take(s.pollTime)
+	s.mu.Unlock()
+	if sockets > 0 {
+		s.tracker.merge(s.af, previous, heaps, sockets)
+	}
+
+	a := s.tracker.tracker(s.af)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, shard := range a.shards {
+		if shard == s {
+			a.shards = append(a.shards[:i], a.shards[i+1:]...)
+			break
+		}
+	}
+}
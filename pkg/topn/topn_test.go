@@ -0,0 +1,251 @@
+package topn_test
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Edgio/xtcp/pkg/config"
+	"github.com/Edgio/xtcp/pkg/topn"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// record is a synthetic socket, with the cookie as the destination port so the sockets are easy to tell apart
+func record(cookie uint64, rtt uint32, retrans uint32) *xtcppb.XtcpRecord {
+	return &xtcppb.XtcpRecord{
+		InetDiagMsg: &xtcppb.InetDiagMsg{
+			UID: proto.Uint32(1000),
+			SocketID: &xtcppb.SocketID{
+				Source:          net.IPv4(192, 0, 2, 1).To4(),
+				SourcePort:      proto.Uint32(443),
+				Destination:     net.IPv4(198, 51, 100, byte(cookie)).To4(),
+				DestinationPort: proto.Uint32(uint32(40000 + cookie)),
+				Cookie:          proto.Uint64(cookie),
+			},
+		},
+		TcpInfo: &xtcppb.TcpInfo{Rtt: proto.Uint32(rtt), TotalRetrans: proto.Uint32(retrans)},
+	}
+}
+
+// cookies are the cookies of the ranking, worst first
+func cookies(ranking topn.Ranking) []uint64 {
+	result := []uint64{}
+	for _, s := range ranking.Sockets {
+		result = append(result, s.Cookie)
+	}
+	return result
+}
+
+func pollTime(i int) time.Time {
+	return time.Unix(1700000000+int64(10*i), 0)
+}
+
+func timespec(i int) syscall.Timespec {
+	return syscall.NsecToTimespec(pollTime(i).UnixNano())
+}
+
+// TestTracker ranks the sockets of the inetdiagers' shards concurrently, and merges them
+func TestTracker(t *testing.T) {
+
+	tracker, err := topn.New(3, []string{"rtt", "tcp_info.total_retrans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.Poll(unix.AF_INET, pollTime(0)) != nil {
+		t.Errorf("expected no report before the first poll")
+	}
+
+	// 4 shards, each with 25 sockets, so the cookies are 1-100, with the rtt 1000 * cookie,
+	// and the retransmits only on the even cookies below 10
+	var wg sync.WaitGroup
+	for shard := 0; shard < 4; shard++ {
+		s := tracker.Shard(unix.AF_INET)
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			for i := 1; i <= 25; i++ {
+				cookie := uint64(shard*25 + i)
+				var retrans uint32
+				if cookie < 10 && cookie%2 == 0 {
+					retrans = uint32(cookie)
+				}
+				s.Observe(timespec(0), record(cookie, uint32(1000*cookie), retrans))
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	report := tracker.Poll(unix.AF_INET, pollTime(1))
+	if report == nil {
+		t.Fatal("expected a report")
+	}
+	if report.Af != "v4" || !report.PollTime.Equal(pollTime(0)) || report.Sockets != 100 || len(report.Rankings) != 2 {
+		t.Fatalf("unexpected report:%+v", report)
+	}
+
+	var tests = []struct {
+		metric  string
+		cookies []uint64
+		value   float64
+	}{
+		{"tcp_info.rtt", []uint64{100, 99, 98}, 100000},
+		{"tcp_info.total_retrans", []uint64{8, 6, 4}, 8}, // only 4 sockets have retransmits, and zero is never ranked
+	}
+	for i, test := range tests {
+		ranking := report.Rankings[i]
+		if ranking.Metric != test.metric || !reflect.DeepEqual(cookies(ranking), test.cookies) || ranking.Sockets[0].Value != test.value || ranking.Sockets[0].Rank != 1 {
+			t.Errorf("test:%d %s\texpected:%v %g\tresult:%s %v %+v", i, test.metric, test.cookies, test.value, ranking.Metric, cookies(ranking), ranking.Sockets[0])
+		}
+	}
+	first := report.Rankings[0].Sockets[0]
+	if first.Source != "192.0.2.1:443" || first.Destination != "198.51.100.100:40100" || first.UID != 1000 || first.Record().GetTcpInfo().GetRtt() != 100000 {
+		t.Errorf("unexpected socket:%+v", first)
+	}
+
+	// A late record of poll 0 is ignored, and poll 1 without any sockets still has a report
+	shard := tracker.Shard(unix.AF_INET)
+	shard.Observe(timespec(0), record(200, 1e6, 0))
+	report = tracker.Poll(unix.AF_INET, pollTime(2))
+	if report == nil || !report.PollTime.Equal(pollTime(1)) || report.Sockets != 0 || len(report.Rankings[0].Sockets) != 0 {
+		t.Errorf("expected an empty report of poll 1\tresult:%+v", report)
+	}
+
+	// An inetdiager which is shut down merges its poll
+	shard.Observe(timespec(2), record(300, 5, 0))
+	shard.Close()
+	report = tracker.Poll(unix.AF_INET, pollTime(3))
+	if report == nil || report.Sockets != 1 || !reflect.DeepEqual(cookies(report.Rankings[0]), []uint64{300}) {
+		t.Errorf("expected socket 300 in poll 2\tresult:%+v", report)
+	}
+
+	if reports := tracker.Reports(); len(reports) != 1 || reports[0] != report {
+		t.Errorf("expected the latest report\tresult:%+v", reports)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	var tests = []struct {
+		n       int
+		metrics []string
+	}{
+		{0, []string{"rtt"}},
+		{10, nil},
+		{10, []string{"nope"}},
+		{10, []string{"state"}},
+		{10, []string{"destination"}},
+		{10, []string{"tcp_info"}},
+	}
+	for i, test := range tests {
+		if _, err := topn.New(test.n, test.metrics); err == nil {
+			t.Errorf("test:%d %d %v\texpected an error", i, test.n, test.metrics)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+
+	tracker, err := topn.New(2, []string{"rtt", "total_retrans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, af := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		s := tracker.Shard(af)
+		s.Observe(timespec(0), record(1, 1000, 1))
+		s.Observe(timespec(0), record(2, 2000, 0))
+		tracker.Poll(af, pollTime(1))
+	}
+
+	var tests = []struct {
+		query    string
+		status   int
+		contains string
+		reports  int
+		rankings int
+	}{
+		{"", http.StatusOK, `"metric": "tcp_info.rtt"`, 2, 2},
+		{"?af=v6", http.StatusOK, `"af": "v6"`, 1, 2},
+		{"?metric=total_retrans", http.StatusOK, `"metric": "tcp_info.total_retrans"`, 2, 1},
+		{"?format=table&af=v4&metric=rtt", http.StatusOK, "198.51.100.2:40002", 0, 0},
+		{"?af=v5", http.StatusBadRequest, "", 0, 0},
+		{"?metric=nope", http.StatusBadRequest, "", 0, 0},
+		{"?format=xml", http.StatusBadRequest, "", 0, 0},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/top"+test.query, nil))
+		body := w.Body.String()
+		if w.Code != test.status || !strings.Contains(body, test.contains) {
+			t.Errorf("test:%d %s\texpected:%d %q\tresult:%d %s", i, test.query, test.status, test.contains, w.Code, body)
+			continue
+		}
+		if test.reports == 0 {
+			continue
+		}
+		var reports []topn.Report
+		if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+			t.Fatalf("test:%d %s\tjson.Unmarshal err:%v", i, test.query, err)
+		}
+		if len(reports) != test.reports || len(reports[0].Rankings) != test.rankings {
+			t.Errorf("test:%d %s\texpected reports:%d rankings:%d\tresult:%+v", i, test.query, test.reports, test.rankings, reports)
+		}
+	}
+}
+
+// TestExporter checks the top sockets are exported as tagged records every topNRecordModulus polls
+func TestExporter(t *testing.T) {
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cliFlags := config.Register(fs)
+	if err := fs.Parse([]string{"-topN", "2", "-topNMetrics", "rtt", "-topNRecordModulus", "2", "-udpSendDest", conn.LocalAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := topn.NewFromFlags(cliFlags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	s := tracker.Shard(unix.AF_INET)
+	for poll := 0; poll < 2; poll++ {
+		s.Observe(timespec(poll), record(1, 1000, 0))
+		s.Observe(timespec(poll), record(2, 2000, 0))
+		s.Observe(timespec(poll), record(3, 500, 0))
+		tracker.Poll(unix.AF_INET, pollTime(poll+1))
+	}
+
+	// Only the second poll is exported
+	var tags []string
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		r := &xtcppb.XtcpRecord{}
+		if err := proto.Unmarshal(buf[:n], r); err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, r.GetTag())
+	}
+	expected := []string{"topn:tcp_info.rtt:1", "topn:tcp_info.rtt:2"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected:%v\tresult:%v", expected, tags)
+	}
+}
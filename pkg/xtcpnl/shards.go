@@ -0,0 +1,322 @@
+package xtcpnl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Edgio/xtcp/pkg/cliflags"
+	"golang.org/x/sys/unix"
+)
+
+// The inet_diag bytecode filter, which is the INET_DIAG_REQ_BYTECODE attribute of the dump request
+// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/inet_diag.h#L70
+//
+//	struct inet_diag_bc_op {
+//		unsigned char	code;
+//		unsigned char	yes;
+//		unsigned short	no;
+//	};
+//
+// The kernel runs the ops for each socket, moving forward by yes bytes if the op is true, or no bytes if it's false.
+// The socket is dumped if the ops end exactly at the end of the bytecode, so jumping 4 bytes past the end rejects it.
+// (see inet_diag_bc_run and inet_diag_bc_audit in net/ipv4/inet_diag.c)
+const (
+	INET_DIAG_REQ_BYTECODE = 1
+
+	INET_DIAG_BC_NOP    = 0
+	INET_DIAG_BC_JMP    = 1
+	INET_DIAG_BC_S_GE   = 2
+	INET_DIAG_BC_S_LE   = 3
+	INET_DIAG_BC_D_GE   = 4
+	INET_DIAG_BC_D_LE   = 5
+	INET_DIAG_BC_S_COND = 7
+	INET_DIAG_BC_D_COND = 8
+)
+
+// inetDiagReqV2Len is the nlmsghdr and the inet_diag_req_v2, which the bytecode attribute follows
+const inetDiagReqV2Len = 72
+
+// Condition is a port range, or an address prefix, of the source (local) or the destination (remote)
+type Condition struct {
+	Key    string // sport, dport, src, or dst
+	Low    uint16 // sport and dport
+	High   uint16
+	Prefix *net.IPNet // src and dst
+}
+
+// Shard is one of the concurrent dumps of a poll, which dumps the sockets matching all its Conditions,
+// or with Rest, the sockets which don't match any of the other shards
+type Shard struct {
+	Name       string
+	Conditions []Condition
+	Rest       bool
+}
+
+// ShardsFromFlags returns the dump shards, or nil for a single dump
+// dumpShardRanges are the explicit shards, otherwise dumpShards > 1 splits dumpShardPorts of dumpShardBy evenly
+func ShardsFromFlags(cliFlags cliflags.CliFlags) ([]Shard, error) {
+	if *cliFlags.DumpShardRanges != "" {
+		return ParseShards(*cliFlags.DumpShardRanges)
+	}
+	if *cliFlags.DumpShards <= 1 {
+		return nil, nil
+	}
+	return PortShards(*cliFlags.DumpShards, *cliFlags.DumpShardBy, *cliFlags.DumpShardPorts)
+}
+
+// PortShards splits the port range, e.g. 1024-65535, of key (sport or dport) evenly into n shards
+// The first shard also has the ports below the range, and the last shard the ports above it, so all the sockets are dumped.
+func PortShards(n int, key string, ports string) ([]Shard, error) {
+	if key != "sport" && key != "dport" {
+		return nil, fmt.Errorf("shard by:%s isn't sport or dport", key)
+	}
+	low, high, err := parsePorts(ports)
+	if err != nil {
+		return nil, err
+	}
+	width := int(high) - int(low) + 1
+	if n < 1 || n > width {
+		return nil, fmt.Errorf("can't split the ports:%s into %d shards", ports, n)
+	}
+	shards := make([]Shard, n)
+	start := 0
+	for i := range shards {
+		end := 65535
+		if i < n-1 {
+			end = int(low) + width*(i+1)/n - 1
+		}
+		condition := Condition{Key: key, Low: uint16(start), High: uint16(end)}
+		shards[i] = Shard{Name: fmt.Sprintf("%s:%d-%d", key, start, end), Conditions: []Condition{condition}}
+		start = end + 1
+	}
+	return shards, nil
+}
+
+// ParseShards parses the comma separated shards, where each shard is one or more "+" separated conditions,
+// or "rest" for the sockets which aren't in any of the other shards
+// e.g. "dport:1024-32767,dport:32768-65535,rest" or "dst:10.0.0.0/8+dport:443,dst:2001:db8::/32,rest"
+// - sport:<port> or sport:<low>-<high> is the source (local) port
+// - dport:<port> or dport:<low>-<high> is the destination (remote) port
+// - src:<prefix> and dst:<prefix> are the source and destination addresses.  The IPv4 prefixes also match the IPv4-mapped IPv6 addresses.
+//
+// The shards can overlap, in which case the sockets in more than one shard are dumped more than once,
+// and the sockets which aren't in any shard are not dumped at all, unless there is a rest shard.
+func ParseShards(s string) ([]Shard, error) {
+	var shards []Shard
+	rest := false
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "rest" {
+			if rest {
+				return nil, fmt.Errorf("more than one rest shard")
+			}
+			rest = true
+			shards = append(shards, Shard{Name: spec, Rest: true})
+			continue
+		}
+		shard := Shard{Name: spec}
+		for _, c := range strings.Split(spec, "+") {
+			condition, err := parseCondition(c)
+			if err != nil {
+				return nil, fmt.Errorf("shard:%s %w", spec, err)
+			}
+			shard.Conditions = append(shard.Conditions, condition)
+		}
+		shards = append(shards, shard)
+	}
+	if len(shards) < 2 {
+		return nil, fmt.Errorf("shards:%s need at least two (2) shards", s)
+	}
+	return shards, nil
+}
+
+func parseCondition(c string) (Condition, error) {
+	key, value, ok := strings.Cut(c, ":")
+	if !ok {
+		return Condition{}, fmt.Errorf("condition:%s isn't <key>:<value>", c)
+	}
+	condition := Condition{Key: key}
+	var err error
+	switch key {
+	case "sport", "dport":
+		condition.Low, condition.High, err = parsePorts(value)
+	case "src", "dst":
+		_, condition.Prefix, err = net.ParseCIDR(value)
+	default:
+		err = fmt.Errorf("condition:%s key isn't sport, dport, src, or dst", c)
+	}
+	return condition, err
+}
+
+// parsePorts parses <port> or <low>-<high>
+func parsePorts(ports string) (uint16, uint16, error) {
+	lowString, highString, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		highString = lowString
+	}
+	low, err := strconv.ParseUint(lowString, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ports:%s %w", ports, err)
+	}
+	high, err := strconv.ParseUint(highString, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ports:%s %w", ports, err)
+	}
+	if low > high {
+		return 0, 0, fmt.Errorf("ports:%s low is more than high", ports)
+	}
+	return uint16(low), uint16(high), nil
+}
+
+// matches is false if the conditions can never match a socket of the address family,
+// which are the IPv6 prefixes for AF_INET
+func (s Shard) matches(af uint8) bool {
+	for _, condition := range s.Conditions {
+		if condition.Prefix != nil && condition.Prefix.IP.To4() == nil && af == unix.AF_INET {
+			return false
+		}
+	}
+	return true
+}
+
+// Shards returns the shards which can match sockets of the address family
+func Shards(shards []Shard, af uint8) []Shard {
+	var matching []Shard
+	for _, shard := range shards {
+		if shard.Rest || shard.matches(af) {
+			matching = append(matching, shard)
+		}
+	}
+	return matching
+}
+
+// op is an inet_diag_bc_op, and what follows it
+type op struct {
+	code uint8
+	data []byte // the port op, or the inet_diag_hostcond
+	no   int    // the target when false, see the target constants
+}
+
+// The targets of the ops when false, which are resolved to the offsets once the bytecode length is known
+const (
+	targetReject    = -1
+	targetNextBlock = -2
+)
+
+func (o op) size() int {
+	return 4 + len(o.data)
+}
+
+// ops are the ops which are all true if the condition matches
+func (c Condition) ops() []op {
+	var ops []op
+	switch c.Key {
+	case "sport", "dport":
+		ge, le := uint8(INET_DIAG_BC_S_GE), uint8(INET_DIAG_BC_S_LE)
+		if c.Key == "dport" {
+			ge, le = INET_DIAG_BC_D_GE, INET_DIAG_BC_D_LE
+		}
+		// The port is the "no" of the second op
+		if c.Low > 0 {
+			ops = append(ops, op{code: ge, data: binary.LittleEndian.AppendUint16([]byte{0, 0}, c.Low)})
+		}
+		if c.High < 65535 {
+			ops = append(ops, op{code: le, data: binary.LittleEndian.AppendUint16([]byte{0, 0}, c.High)})
+		}
+	case "src", "dst":
+		code := uint8(INET_DIAG_BC_S_COND)
+		if c.Key == "dst" {
+			code = INET_DIAG_BC_D_COND
+		}
+		// struct inet_diag_hostcond { __u8 family; __u8 prefix_len; int port; __be32 addr[0]; }
+		ones, _ := c.Prefix.Mask.Size()
+		family, addr := uint8(unix.AF_INET6), []byte(c.Prefix.IP.To16())
+		if ip4 := c.Prefix.IP.To4(); ip4 != nil {
+			family, addr = unix.AF_INET, ip4
+		}
+		data := []byte{family, uint8(ones), 0, 0}
+		data = binary.LittleEndian.AppendUint32(data, 0xFFFFFFFF) // port -1 is any port
+		ops = append(ops, op{code: code, data: append(data, addr...)})
+	}
+	return ops
+}
+
+// Bytecode is the inet_diag bytecode of the shard i, or nil if the shard matches everything
+// The rest shard is the sockets which don't match all the conditions of any of the other shards, so for each of the
+// other shards, the conditions are checked in a block, which jumps to the next block as soon as a condition is false,
+// or rejects the socket if they're all true.
+func Bytecode(shards []Shard, i int, af uint8) []byte {
+	var ops []op
+	if !shards[i].Rest {
+		for _, condition := range shards[i].Conditions {
+			for _, o := range condition.ops() {
+				o.no = targetReject
+				ops = append(ops, o)
+			}
+		}
+	} else {
+		for j, shard := range shards {
+			if j == i || shard.Rest || !shard.matches(af) {
+				continue
+			}
+			var block []op
+			for _, condition := range shard.Conditions {
+				block = append(block, condition.ops()...)
+			}
+			for k := range block {
+				block[k].no = targetNextBlock
+			}
+			ops = append(ops, block...)
+			ops = append(ops, op{code: INET_DIAG_BC_JMP, no: targetReject})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	// The offsets of the ops, and of the next block of each op, which starts after the JMP ending the op's block.
+	// After the last block is the end, which accepts the socket.
+	length := 0
+	offsets := make([]int, len(ops))
+	for k, o := range ops {
+		offsets[k] = length
+		length += o.size()
+	}
+	nextBlock := make([]int, len(ops))
+	next := length
+	for k := len(ops) - 1; k >= 0; k-- {
+		if ops[k].code == INET_DIAG_BC_JMP {
+			next = offsets[k] + ops[k].size()
+		}
+		nextBlock[k] = next
+	}
+
+	bytecode := make([]byte, 0, length)
+	for k, o := range ops {
+		no := length + 4 - offsets[k]
+		if o.no == targetNextBlock {
+			no = nextBlock[k] - offsets[k]
+		}
+		bytecode = append(bytecode, o.code, uint8(o.size()))
+		bytecode = binary.LittleEndian.AppendUint16(bytecode, uint16(no))
+		bytecode = append(bytecode, o.data...)
+	}
+	return bytecode
+}
+
+// AppendBytecode adds the bytecode attribute to the dump request (see BuildNetlinkSockDiagRequest), and updates the nlmsg_len
+func AppendBytecode(request []byte, bytecode []byte) []byte {
+	request = append([]byte(nil), request[:inetDiagReqV2Len]...)
+	if len(bytecode) == 0 {
+		return request
+	}
+	// struct nlattr { __u16 nla_len; __u16 nla_type; }, and the bytecode is always a multiple of NLA_ALIGNTO
+	request = binary.LittleEndian.AppendUint16(request, uint16(4+len(bytecode)))
+	request = binary.LittleEndian.AppendUint16(request, INET_DIAG_REQ_BYTECODE)
+	request = append(request, bytecode...)
+	binary.LittleEndian.PutUint32(request[0:4], uint32(len(request)))
+	return request
+}
@@ -0,0 +1,179 @@
+package xtcpnl_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/fakenetlink"
+	"github.com/Edgio/xtcp/pkg/xtcpnl"
+	"golang.org/x/sys/unix"
+)
+
+// TestParseShards checks the shard names, and the errors
+func TestParseShards(t *testing.T) {
+	var tests = []struct {
+		shards   string
+		expected string // the names, or the error
+	}{
+		{"dport:1024-32767,dport:32768-65535,rest", "dport:1024-32767 dport:32768-65535 rest"},
+		{"dst:10.0.0.0/8+dport:443, dst:2001:db8::/32", "dst:10.0.0.0/8+dport:443 dst:2001:db8::/32"},
+		{"sport:443,rest", "sport:443 rest"},
+		{"sport:443", "error"},
+		{"rest,rest", "error"},
+		{"dport:2000-1000,rest", "error"},
+		{"dport:65536,rest", "error"},
+		{"dport,rest", "error"},
+		{"port:1-2,rest", "error"},
+		{"dst:10.0.0.0/33,rest", "error"},
+		{"dst:10.0.0.0/8+,rest", "error"},
+	}
+	for i, test := range tests {
+		shards, err := xtcpnl.ParseShards(test.shards)
+		result := "error"
+		if err == nil {
+			var names []string
+			for _, shard := range shards {
+				names = append(names, shard.Name)
+			}
+			result = strings.Join(names, " ")
+		}
+		if result != test.expected {
+			t.Errorf("test:%d %s\texpected:%s\tresult:%s err:%v", i, test.shards, test.expected, result, err)
+		}
+	}
+}
+
+// TestPortShards checks the port ranges are split evenly, and cover all the ports
+func TestPortShards(t *testing.T) {
+	var tests = []struct {
+		n        int
+		key      string
+		ports    string
+		expected string
+	}{
+		{4, "dport", "1024-65535", "dport:0-17151 dport:17152-33279 dport:33280-49407 dport:49408-65535"},
+		{3, "sport", "30000-30002", "sport:0-30000 sport:30001-30001 sport:30002-65535"},
+		{1, "dport", "1024-65535", "dport:0-65535"},
+		{4, "dport", "30000-30002", "error"},
+		{2, "src", "1024-65535", "error"},
+		{2, "dport", "65535-1024", "error"},
+	}
+	for i, test := range tests {
+		shards, err := xtcpnl.PortShards(test.n, test.key, test.ports)
+		result := "error"
+		if err == nil {
+			var names []string
+			for _, shard := range shards {
+				names = append(names, shard.Name)
+			}
+			result = strings.Join(names, " ")
+		}
+		if result != test.expected {
+			t.Errorf("test:%d %d %s %s\texpected:%s\tresult:%s err:%v", i, test.n, test.key, test.ports, test.expected, result, err)
+		}
+	}
+}
+
+// dumped sends the dump request to the fake kernel, and returns the inodes of the sockets dumped, or nil for an NLMSG_ERROR
+func dumped(t *testing.T, af uint8, sockets int, request []byte) []uint32 {
+	transport, _ := fakenetlink.New(fakenetlink.Config{Sockets: sockets}).Open(0)
+	if err := transport.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	inodes := []uint32{}
+	packetBuffer := make([]byte, 65536)
+	for {
+		n, err := transport.Recvfrom(packetBuffer)
+		if err != nil {
+			return inodes
+		}
+		for offset := 0; offset+unix.NLMSG_HDRLEN <= n; {
+			length := int(binary.LittleEndian.Uint32(packetBuffer[offset:]))
+			switch binary.LittleEndian.Uint16(packetBuffer[offset+4:]) {
+			case unix.NLMSG_ERROR:
+				return nil
+			case unix.NLMSG_DONE:
+			default:
+				// idiag_inode is the last field of the inet_diag_msg
+				inodes = append(inodes, binary.LittleEndian.Uint32(packetBuffer[offset+unix.NLMSG_HDRLEN+68:]))
+			}
+			offset += (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		}
+	}
+}
+
+// TestShardBytecode dumps the fake kernel with the bytecode of each shard, and checks the sockets of each shard
+// The fake sockets are 10.0.0.1:443 or [2001:db8::1]:443 to 192.0.2.<i> or [2001:db8:1::<i>], port 30000 + i
+func TestShardBytecode(t *testing.T) {
+
+	portShards, _ := xtcpnl.PortShards(4, "dport", "30000-30199")
+
+	var tests = []struct {
+		description string
+		shards      []xtcpnl.Shard
+		af          uint8
+		expected    []int // sockets per shard, for the shards of the address family
+		partition   bool  // every socket is in exactly one shard
+	}{
+		{"dport", portShards, unix.AF_INET, []int{50, 50, 50, 50}, true},
+		{"dport v6", portShards, unix.AF_INET6, []int{50, 50, 50, 50}, true},
+		{"dst and rest", parse(t, "dst:192.0.2.0/25,dst:192.0.2.128/26,rest"), unix.AF_INET, []int{128, 64, 8}, true},
+		{"v4 prefixes in v6", parse(t, "dst:192.0.2.0/25,dst:192.0.2.128/26,rest"), unix.AF_INET6, []int{0, 0, 200}, true},
+		{"v6 prefix", parse(t, "dst:2001:db8:1::/121,dport:30100-30149+dst:192.0.2.0/24,rest"), unix.AF_INET6, []int{128, 0, 72}, true},
+		{"v6 prefix in v4", parse(t, "dst:2001:db8:1::/121,dport:30100-30149+dst:192.0.2.0/24,rest"), unix.AF_INET, []int{50, 150}, true},
+		{"and", parse(t, "dport:30010-30019+dst:192.0.2.0/28,src:10.0.0.0/8+sport:443,rest"), unix.AF_INET, []int{6, 200, 0}, false},
+		{"sport", parse(t, "sport:443,rest"), unix.AF_INET6, []int{200, 0}, true},
+		{"not in any shard", parse(t, "sport:1-442,sport:444-65535"), unix.AF_INET, []int{0, 0}, false},
+		{"rest of everything", parse(t, "dport:0-65535,rest"), unix.AF_INET, []int{200, 0}, true},
+	}
+
+	for i, test := range tests {
+		shards := xtcpnl.Shards(test.shards, test.af)
+		if len(shards) != len(test.expected) {
+			t.Errorf("test:%d %s\texpected shards:%d\tresult:%d", i, test.description, len(test.expected), len(shards))
+			continue
+		}
+		seen := make(map[uint32]int)
+		for j := range shards {
+			request := xtcpnl.AppendBytecode(xtcpnl.BuildNetlinkSockDiagRequest(&test.af, 128, 72, 666, 0, 0xFF, 0), xtcpnl.Bytecode(shards, j, test.af))
+			inodes := dumped(t, test.af, 200, request)
+			if inodes == nil {
+				t.Errorf("test:%d %s shard:%s\tthe bytecode was rejected:%x", i, test.description, shards[j].Name, request[72:])
+				continue
+			}
+			if len(inodes) != test.expected[j] {
+				t.Errorf("test:%d %s shard:%s\texpected sockets:%d\tresult:%d", i, test.description, shards[j].Name, test.expected[j], len(inodes))
+			}
+			for _, inode := range inodes {
+				seen[inode]++
+			}
+		}
+		if test.partition {
+			for inode := uint32(1000); inode < 1200; inode++ {
+				if seen[inode] != 1 {
+					t.Errorf("test:%d %s\tinode:%d expected to be dumped once\tresult:%d", i, test.description, inode, seen[inode])
+					break
+				}
+			}
+		}
+	}
+
+	// The kernel (and the fake) reject bad bytecode with NLMSG_ERROR EINVAL
+	af := uint8(unix.AF_INET)
+	for i, bytecode := range [][]byte{{xtcpnl.INET_DIAG_BC_D_GE, 4, 8, 0}, {xtcpnl.INET_DIAG_BC_D_GE, 8, 5, 0, 0, 0, 1, 0}, {99, 4, 8, 0}} {
+		request := xtcpnl.AppendBytecode(xtcpnl.BuildNetlinkSockDiagRequest(&af, 128, 72, 666, 0, 0xFF, 0), bytecode)
+		if inodes := dumped(t, af, 10, request); inodes != nil {
+			t.Errorf("test:%d %x\texpected NLMSG_ERROR\tresult:%d sockets", i, bytecode, len(inodes))
+		}
+	}
+}
+
+func parse(t *testing.T, s string) []xtcpnl.Shard {
+	shards, err := xtcpnl.ParseShards(s)
+	if err != nil {
+		t.Fatal(fmt.Errorf("%s:%w", s, err))
+	}
+	return shards
+}
@@ -0,0 +1,44 @@
+package xtcpnl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TCPStates are the kernel TCP socket states, which are the bits of the inet_diag_req_v2 idiag_states
+// https://github.com/torvalds/linux/blob/2f4c53349961c8ca480193e47da4d44fdb8335a8/include/net/tcp_states.h
+var TCPStates = map[string]uint8{
+	"established":  1,
+	"syn_sent":     2,
+	"syn_recv":     3,
+	"fin_wait1":    4,
+	"fin_wait2":    5,
+	"time_wait":    6,
+	"close":        7,
+	"close_wait":   8,
+	"last_ack":     9,
+	"listen":       10,
+	"closing":      11,
+	"new_syn_recv": 12,
+}
+
+// EstablishedMask is the idiag_states for just the established sockets, which is what xtcp dumps by default
+const EstablishedMask = uint32(1 << 1)
+
+// StateMask converts the comma separated list of state names (e.g. "established,close_wait") to the idiag_states
+// bit mask.  "all" is all the states.
+func StateMask(states string) (uint32, error) {
+	var mask uint32
+	for _, name := range strings.Split(states, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "all" {
+			return ^uint32(0), nil
+		}
+		state, ok := TCPStates[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown tcp state:%q", name)
+		}
+		mask |= 1 << state
+	}
+	return mask, nil
+}
@@ -0,0 +1,45 @@
+package xtcpnl
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestStateMask(t *testing.T) {
+	var tests = []struct {
+		states   string
+		expected uint32
+		err      bool
+	}{
+		{"established", EstablishedMask, false},
+		{"established,close_wait", 1<<1 | 1<<8, false},
+		{" Established , LISTEN ", 1<<1 | 1<<10, false},
+		{"all", 0xFFFFFFFF, false},
+		{"established,nope", 0, true},
+		{"", 0, true},
+	}
+	for i, test := range tests {
+		mask, err := StateMask(test.states)
+		if mask != test.expected || (err != nil) != test.err {
+			t.Errorf("test:%d %q\texpected:%x err:%t\tresult:%x %v", i, test.states, test.expected, test.err, mask, err)
+		}
+	}
+}
+
+// TestBuildNetlinkSockDiagRequestStates checks the idiag_states, and that BuildNetlinkSockDiagRequest is the established sockets
+func TestBuildNetlinkSockDiagRequestStates(t *testing.T) {
+	af := uint8(2)
+	var tests = []struct {
+		request  []byte
+		expected uint32
+	}{
+		{BuildNetlinkSockDiagRequest(&af, 128, 72, 666, 0, 0xFF, 0), EstablishedMask},
+		{BuildNetlinkSockDiagRequestStates(&af, 128, 72, 666, 0, 0xFF, 0, EstablishedMask), EstablishedMask},
+		{BuildNetlinkSockDiagRequestStates(&af, 128, 72, 667, 0, 0xFF, 0, 1<<1|1<<8), 1<<1 | 1<<8},
+	}
+	for i, test := range tests {
+		if states := binary.LittleEndian.Uint32(test.request[20:24]); states != test.expected {
+			t.Errorf("test:%d\texpected idiag_states:%x\tresult:%x", i, test.expected, states)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package xtcpnl
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Transport is the netlink socket a poller sends the dump requests to, and the netlinkers read the responses from
+// SocketTransport is the kernel, and the fakenetlink package has an in memory Transport for the tests.
+//
+// Recvfrom has the same semantics as syscall.Recvfrom, so it's safe to call from all the netlinkers concurrently,
+// and returns syscall.EAGAIN when the socket timeout expires.
+type Transport interface {
+	Send(request []byte) error
+	Recvfrom(packetBuffer []byte) (n int, err error)
+	Close() error
+}
+
+// OpenTransport opens a Transport for a poller, with the socket timeout in milliseconds
+type OpenTransport func(timeout int64) (Transport, error)
+
+// SocketTransport is the kernel netlink socket
+type SocketTransport struct {
+	FileDescriptor int
+	Address        *unix.SockaddrNetlink
+}
+
+// OpenSocketTransport opens the kernel netlink socket with OpenNetlinkSocketWithTimeout,
+// so like OpenNetlinkSocketWithTimeout, this log.Fatalfs if the socket can't be opened
+func OpenSocketTransport(timeout int64) (Transport, error) {
+	socketFileDescriptor, socketAddress := OpenNetlinkSocketWithTimeout(timeout)
+	return &SocketTransport{FileDescriptor: socketFileDescriptor, Address: socketAddress}, nil
+}
+
+// Send sends the netlink request to the kernel
+func (s *SocketTransport) Send(request []byte) error {
+	return unix.Sendto(s.FileDescriptor, request, 0, s.Address)
+}
+
+// Recvfrom reads a packet from the netlink socket
+func (s *SocketTransport) Recvfrom(packetBuffer []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(s.FileDescriptor, packetBuffer, 0)
+	return n, err
+}
+
+// Close closes the netlink socket
+func (s *SocketTransport) Close() error {
+	return syscall.Close(s.FileDescriptor)
+}
@@ -15,27 +15,22 @@ package xtcpnl
 
 import (
 	"encoding/binary"
-	"fmt"
 	"log"
 	"syscall"
 	"unsafe"
 
+	"github.com/Edgio/xtcp/pkg/logging"
 	"golang.org/x/sys/unix"
 )
 
-const (
-	debugLevel int = 11 //101 //11
-)
-
 // OpenNetlinkSocketWithTimeout function opens a Netlink socket in the C style way
 // Using the newer https://godoc.org/golang.org/x/sys/unix library
 // Commented out is some timeout code, which was used during testing,
 // but leaving it here in case we want it back at some point
 func OpenNetlinkSocketWithTimeout(timeout int64) (socketFileDescriptor int, socketAddress *unix.SockaddrNetlink) {
 
-	if debugLevel > 100 {
-		fmt.Println("OpenNetlinkSocketWithTimeout\ttimeout:", timeout)
-	}
+	logger := logging.Logger("poller")
+	logger.Debug("OpenNetlinkSocketWithTimeout", "timeout", timeout)
 	// Create netlink socket
 	// This is using the newer library: https://godoc.org/golang.org/x/sys/unix#Socket
 	socketFileDescriptor, err := syscall.Socket(
@@ -68,9 +63,7 @@ func OpenNetlinkSocketWithTimeout(timeout int64) (socketFileDescriptor int, sock
 			// milliseconds
 			tv.Usec = timeout * 1000 // microsecond or 1 millionth of a second.  1 milliseconds = 1000 micro
 		}
-		if debugLevel > 100 {
-			fmt.Println("OpenNetlinkSocketWithTimeout\ttv:", tv)
-		}
+		logger.Debug("OpenNetlinkSocketWithTimeout", "tv", tv)
 		err = syscall.SetsockoptTimeval(socketFileDescriptor, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
 		if err != nil {
 			log.Fatalf("OpenNetlinkSocketWithTimeout SetsockopttimeSpec %s", err)
@@ -85,7 +78,13 @@ func OpenNetlinkSocketWithTimeout(timeout int64) (socketFileDescriptor int, sock
 // addressFamily should be 2=IPv4, and 10=IPv6 per the kernel
 // TODO - switch to binary package, because we're using unsafe.  This is the only unsafe code in this program.
 // Lots of comments here to show what we're doing, and includes links to the kernel source
+// The request is for the established sockets, see BuildNetlinkSockDiagRequestStates for the other TCP states
 func BuildNetlinkSockDiagRequest(addressFamily *uint8, make_size int, nlmsg_len uint32, nlmsg_seq uint32, nlmsg_pid uint32, idiag_ext uint8, idiag_stats uint8) (packetBytes []byte) {
+	return BuildNetlinkSockDiagRequestStates(addressFamily, make_size, nlmsg_len, nlmsg_seq, nlmsg_pid, idiag_ext, idiag_stats, EstablishedMask)
+}
+
+// BuildNetlinkSockDiagRequestStates is BuildNetlinkSockDiagRequest for the TCP states of idiag_states (see StateMask)
+func BuildNetlinkSockDiagRequestStates(addressFamily *uint8, make_size int, nlmsg_len uint32, nlmsg_seq uint32, nlmsg_pid uint32, idiag_ext uint8, idiag_stats uint8, idiag_states uint32) (packetBytes []byte) {
 	// Statically build up the netlink socket diag request
 	// TODO - use binary.size in stead of constants here
 	//packetBytes = make([]byte, 72+56) //128
@@ -154,9 +153,9 @@ func BuildNetlinkSockDiagRequest(addressFamily *uint8, make_size int, nlmsg_len
 	*(*uint8)(unsafe.Pointer(&packetBytes[18:19][0])) = uint8(idiag_ext)   // hack just light up the bits, instead of the complex bit shifts above   <--- Request everything!!
 	*(*uint8)(unsafe.Pointer(&packetBytes[19:20][0])) = uint8(idiag_stats) // pad
 
-	// Which TCP socket states?
+	// Which TCP socket states?  (see StateMask, EstablishedMask is the default)
 	// https://github.com/torvalds/linux/blob/2f4c53349961c8ca480193e47da4d44fdb8335a8/include/net/tcp_states.h
-	binary.LittleEndian.PutUint32(packetBytes[20:24], uint32(1<<1)) // established
+	binary.LittleEndian.PutUint32(packetBytes[20:24], idiag_states)
 
 	// https://github.com/torvalds/linux/blob/29d9f30d4ce6c7a38745a54a8cddface10013490/include/uapi/linux/inet_diag.h#L14
 	// 	/* Socket identity */
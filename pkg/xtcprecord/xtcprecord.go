@@ -0,0 +1,184 @@
+// Package xtcprecord maps the decoded inet_diag sockets (see inetdiag.Decode) to the xtcppb.XtcpRecord protobuf
+//
+// This is the mapping the xtcp inetdiagers use, so Go programs can produce exactly the same records
+// as the daemon, without running it.
+//
+// The protobuf's smallest integer type is the uint32, so the kernel's smaller types are converted.
+// The sub messages are only included if the kernel sent the attribute, and some of the attributes
+// are only included if they are non-zero, to keep the records small.
+package xtcprecord
+
+import (
+	"syscall"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+)
+
+// congestionAlgorithms maps INET_DIAG_CONG to the protobuf enum.  Other algorithms are UNKNOWN.
+var congestionAlgorithms = map[string]xtcppb.XtcpRecordCongestionAlgorithm{
+	"cubic": xtcppb.XtcpRecord_CUBIC,
+	"bbr":   xtcppb.XtcpRecord_BBR1,
+	"bbr2":  xtcppb.XtcpRecord_BBR2,
+}
+
+// CongestionAlgorithm returns the protobuf enum for the INET_DIAG_CONG congestion algorithm
+func CongestionAlgorithm(congestion string) xtcppb.XtcpRecordCongestionAlgorithm {
+	return congestionAlgorithms[congestion]
+}
+
+// FromSocket builds the XtcpRecord for the socket
+// timeSpec is the poll time, and samplingModulus is the number of sockets this record represents
+// The record points into the socket, so the socket shouldn't be modified afterwards.
+func FromSocket(socket *inetdiag.Socket, timeSpec syscall.Timespec, hostname string, samplingModulus uint32) *xtcppb.XtcpRecord {
+
+	msg := &socket.InetDiagMsg
+	congestionAlgorithmEnum := CongestionAlgorithm(socket.Congestion)
+
+	record := &xtcppb.XtcpRecord{
+		Hostname:        &hostname,
+		SamplingModulus: &samplingModulus,
+		EpochTime: &xtcppb.Timespec64T{
+			Sec:  &timeSpec.Sec,
+			Nsec: &timeSpec.Nsec,
+		},
+		InetDiagMsg: &xtcppb.InetDiagMsg{
+			Family:  u32(msg.Family),
+			State:   u32(msg.State),
+			Timer:   u32(msg.Timer),
+			Retrans: u32(msg.Retrans),
+			SocketID: &xtcppb.SocketID{
+				SourcePort:      u32(msg.SocketID.SourcePort),
+				DestinationPort: u32(msg.SocketID.DestinationPort),
+				Source:          socket.Source,
+				Destination:     socket.Destination,
+				Interface:       &msg.SocketID.Interface,
+				Cookie:          &msg.SocketID.Cookie,
+			},
+			Expires: &msg.Expires,
+			Rqueue:  &msg.Rqueue,
+			Wqueue:  &msg.Wqueue,
+			UID:     &msg.UID,
+			Inode:   &msg.Inode,
+		},
+		CongestionAlgorithmEnum: &congestionAlgorithmEnum,
+	}
+
+	// INET_DIAG_MEMINFO is deliberately not included, because INET_DIAG_SKMEMINFO is a superset
+
+	if tcpinfo := socket.TCPInfo; tcpinfo != nil {
+		record.TcpInfo = &xtcppb.TcpInfo{
+			State:                  u32(tcpinfo.State),
+			CaState:                u32(tcpinfo.CaState),
+			Retransmits:            u32(tcpinfo.Retransmits),
+			Probes:                 u32(tcpinfo.Probes),
+			Backoff:                u32(tcpinfo.Backoff),
+			Options:                u32(tcpinfo.Options),
+			SendScale:              u32(socket.SndWscale),
+			RcvScale:               u32(socket.RcvWscale),
+			DeliveryRateAppLimited: u32(socket.DeliveryRateAppLimited),
+			// TODO fix for kernel 5+
+			//	FastOpenClientFailed:   u32(socket.FastOpenClientFail),
+			Rto:           &tcpinfo.Rto,
+			Ato:           &tcpinfo.Ato,
+			SndMss:        &tcpinfo.SndMss,
+			RcvMss:        &tcpinfo.RcvMss,
+			Unacked:       &tcpinfo.Unacked,
+			Sacked:        &tcpinfo.Sacked,
+			Lost:          &tcpinfo.Lost,
+			Retrans:       &tcpinfo.Retrans,
+			Fackets:       &tcpinfo.Fackets,
+			LastDataSent:  &tcpinfo.LastDataSent,
+			LastAckSent:   &tcpinfo.LastAckSent,
+			LastDataRecv:  &tcpinfo.LastDataRecv,
+			LastAckRecv:   &tcpinfo.LastAckRecv,
+			Pmtu:          &tcpinfo.Pmtu,
+			RcvSsthresh:   &tcpinfo.RcvSsthresh,
+			Rtt:           &tcpinfo.Rtt,
+			RttVar:        &tcpinfo.Rttvar,
+			SndSsthresh:   &tcpinfo.SndSsthresh,
+			SndCwnd:       &tcpinfo.SndCwnd,
+			AdvMss:        &tcpinfo.AdvMss,
+			Reordering:    &tcpinfo.Reordering,
+			RcvRtt:        &tcpinfo.RcvRtt,
+			RcvSpace:      &tcpinfo.RcvSpace,
+			TotalRetrans:  &tcpinfo.TotalRetrans,
+			PacingRate:    &tcpinfo.PacingRate,
+			MaxPacingRate: &tcpinfo.MaxPacingRate,
+			BytesAcked:    &tcpinfo.BytesAcked,
+			BytesReceived: &tcpinfo.BytesReceived,
+			SegsOut:       &tcpinfo.SegsOut,
+			SegsIn:        &tcpinfo.SegsIn,
+			NotSentBytes:  &tcpinfo.NotSentBytes,
+			MinRtt:        &tcpinfo.MinRtt,
+			DataSegsIn:    &tcpinfo.DataSegsIn,
+			DataSegsOut:   &tcpinfo.DataSegsOut,
+			DeliveryRate:  &tcpinfo.DeliveryRate,
+			BusyTime:      &tcpinfo.BusyTime,
+			RwndLimited:   &tcpinfo.RwndLimited,
+			SndbufLimited: &tcpinfo.SndbufLimited,
+			// 5+ kernel
+			// Delivered:     &tcpinfo.Delivered,
+			// DeliveredCe:   &tcpinfo.DeliveredCe,
+			// BytesSent:     &tcpinfo.BytesSent,
+			// BytesRetrans:  &tcpinfo.BytesRetrans,
+			// DsackDups:     &tcpinfo.DsackDups,
+			// ReordSeen:     &tcpinfo.ReordSeen,
+			// RcvOoopack:    &tcpinfo.RcvOoopack,
+			// SndWnd:        &tcpinfo.SndWnd,
+		}
+	}
+
+	if skmeminfo := socket.SkMemInfo; skmeminfo != nil {
+		record.SkMemInfo = &xtcppb.SkMemInfo{
+			RmemAlloc:  &skmeminfo.RmemAlloc,
+			RcvBuf:     &skmeminfo.RcvBuf,
+			WmemAlloc:  &skmeminfo.WmemAlloc,
+			SndBuf:     &skmeminfo.SndBuf,
+			FwdAlloc:   &skmeminfo.FwdAlloc,
+			WmemQueued: &skmeminfo.WmemQueued,
+			Optmem:     &skmeminfo.Optmem,
+			Backlog:    &skmeminfo.Backlog,
+			Drops:      &skmeminfo.Drops,
+		}
+	}
+
+	if bbrinfo := socket.BBRInfo; bbrinfo != nil {
+		record.BbrInfo = &xtcppb.BbrInfo{
+			BwLo:       &bbrinfo.BwLo,
+			BwHi:       &bbrinfo.BwHi,
+			MinRtt:     &bbrinfo.MinRtt,
+			PacingGain: &bbrinfo.PacingGain,
+			CwndGain:   &bbrinfo.CwndGain,
+		}
+	}
+
+	// Only add these if they are non-zero
+	if socket.TOS != nil && *socket.TOS != 0 {
+		record.TypeOfService = u32(*socket.TOS)
+	}
+	if socket.TClass != nil && *socket.TClass != 0 {
+		record.TrafficClass = u32(*socket.TClass)
+	}
+	if socket.Shutdown != nil && *socket.Shutdown != 0 {
+		record.ShutdownState = u32(*socket.Shutdown)
+	}
+	if socket.ClassID != nil && *socket.ClassID != 0 {
+		record.ClassId = socket.ClassID
+	}
+	// INET_DIAG_SKV6ONLY zero is meaningful, so it's included whenever the kernel sent it
+	if socket.V6Only != nil {
+		record.V6Only = u32(*socket.V6Only)
+	}
+	if socket.OriginalFamily != 0 {
+		record.OriginalFamily = u32(socket.OriginalFamily)
+	}
+
+	return record
+}
+
+// u32 converts the kernel's uint8 and uint16 to the protobuf's uint32
+func u32[T uint8 | uint16](v T) *uint32 {
+	u := uint32(v)
+	return &u
+}
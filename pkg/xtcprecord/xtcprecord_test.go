@@ -0,0 +1,63 @@
+package xtcprecord_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/inetdiag"
+	"github.com/Edgio/xtcp/pkg/xtcppb"
+	"github.com/Edgio/xtcp/pkg/xtcprecord"
+)
+
+func TestFromSocket(t *testing.T) {
+
+	tos, zero, v6only := uint8(0x10), uint8(0), uint8(1)
+
+	var tests = []struct {
+		name       string
+		socket     inetdiag.Socket
+		congestion xtcppb.XtcpRecordCongestionAlgorithm
+		tcpInfo    bool
+		bbrInfo    bool
+		tos        uint32
+		hasTOS     bool
+		family     uint32
+		v6Only     bool
+	}{
+		{"cubic", inetdiag.Socket{TCPInfo: &inetdiag.TCPInfo54{Rtt: 1500}, Congestion: "cubic", TOS: &tos}, xtcppb.XtcpRecord_CUBIC, true, false, 0x10, true, 0, false},
+		{"bbr", inetdiag.Socket{TCPInfo: &inetdiag.TCPInfo54{Rtt: 1500}, Congestion: "bbr", BBRInfo: &inetdiag.BBRInfo{MinRtt: 800}}, xtcppb.XtcpRecord_BBR1, true, true, 0, false, 0, false},
+		{"bbr2", inetdiag.Socket{Congestion: "bbr2"}, xtcppb.XtcpRecord_BBR2, false, false, 0, false, 0, false},
+		{"unknown algorithm", inetdiag.Socket{Congestion: "reno"}, xtcppb.XtcpRecord_UNKNOWN, false, false, 0, false, 0, false},
+		{"zero tos", inetdiag.Socket{TOS: &zero}, xtcppb.XtcpRecord_UNKNOWN, false, false, 0, false, 0, false},
+		{"normalized v4 mapped", inetdiag.Socket{V4Mapped: true, OriginalFamily: syscall.AF_INET6}, xtcppb.XtcpRecord_UNKNOWN, false, false, 0, false, syscall.AF_INET6, false},
+		{"v6 only listener", inetdiag.Socket{V6Only: &v6only}, xtcppb.XtcpRecord_UNKNOWN, false, false, 0, false, 0, true},
+	}
+
+	for i, test := range tests {
+
+		test.socket.InetDiagMsg.Family = syscall.AF_INET
+		test.socket.InetDiagMsg.SocketID.DestinationPort = 40000
+		test.socket.InetDiagMsg.Inode = 99
+		test.socket.Source = net.IPv4(10, 0, 0, 1).To4()
+
+		record := xtcprecord.FromSocket(&test.socket, syscall.Timespec{Sec: 1, Nsec: 2}, "host", 4)
+
+		if record.GetHostname() != "host" || record.GetSamplingModulus() != 4 || record.GetEpochTime().GetNsec() != 2 ||
+			record.GetInetDiagMsg().GetInode() != 99 || record.GetInetDiagMsg().GetSocketID().GetDestinationPort() != 40000 ||
+			len(record.GetInetDiagMsg().GetSocketID().GetSource()) != 4 {
+			t.Errorf("test:%d %s\texpected host, modulus:4, inode:99, port:40000\tresult:%v", i, test.name, record)
+		}
+		if record.GetCongestionAlgorithmEnum() != test.congestion || (record.TcpInfo != nil) != test.tcpInfo || (record.BbrInfo != nil) != test.bbrInfo ||
+			record.GetTypeOfService() != test.tos || (record.TypeOfService != nil) != test.hasTOS {
+			t.Errorf("test:%d %s\texpected congestion:%s tcpInfo:%t bbrInfo:%t tos:%d\tresult:%s %t %t %d",
+				i, test.name, test.congestion, test.tcpInfo, test.bbrInfo, test.tos, record.GetCongestionAlgorithmEnum(), record.TcpInfo != nil, record.BbrInfo != nil, record.GetTypeOfService())
+		}
+		if record.GetOriginalFamily() != test.family || (record.V6Only != nil) != test.v6Only {
+			t.Errorf("test:%d %s\texpected originalFamily:%d v6Only:%t\tresult:%d %t", i, test.name, test.family, test.v6Only, record.GetOriginalFamily(), record.V6Only != nil)
+		}
+		if test.tcpInfo && record.GetTcpInfo().GetRtt() != 1500 {
+			t.Errorf("test:%d %s\texpected rtt:1500\tresult:%d", i, test.name, record.GetTcpInfo().GetRtt())
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package xtcpstater
+
+// procstats reads the xtcp process stats directly from /proc and the cgroup filesystem,
+// rather than shelling out to systemctl and ps, so it works across distros and inside containers.
+//
+// The procRoot and cgroupRoot are configurable so the tests can point at ./testdata
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Edgio/xtcp/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// userHZ is the kernel USER_HZ, which /proc/<pid>/stat times are in.
+	// This is 100 on all the architectures we run on, and reading it properly needs cgo (sysconf(_SC_CLK_TCK))
+	userHZ = 100
+)
+
+// ProcStats are the self monitoring stats of the xtcp process
+// Cgroup values are zero if the cgroup files are not available
+type ProcStats struct {
+	CPUUserSeconds          float64
+	CPUSystemSeconds        float64
+	RSSBytes                uint64
+	VirtualBytes            uint64
+	Threads                 uint64
+	VoluntaryCtxSwitches    uint64
+	NonvoluntaryCtxSwitches uint64
+	ReadBytes               uint64
+	WriteBytes              uint64
+	OpenFDs                 uint64
+
+	CgroupVersion          int
+	CgroupCPUSeconds       float64
+	CgroupThrottledPeriods uint64
+	CgroupThrottledSeconds float64
+	CgroupMemoryBytes      uint64
+	CgroupMemoryLimitBytes uint64 // zero means no limit
+}
+
+// ParseProcStat parses /proc/<pid>/stat for the cpu times, threads, virtual size, and rss
+// https://man7.org/linux/man-pages/man5/proc.5.html
+// The comm field (2) can contain spaces and brackets, so the fields are counted from the last ")"
+func ParseProcStat(line string, stats *ProcStats) error {
+
+	end := strings.LastIndex(line, ")")
+	if end < 0 {
+		return fmt.Errorf("stat: no comm field")
+	}
+	// fields[0] is field 3 (state)
+	fields := strings.Fields(line[end+1:])
+	if len(fields) < 22 {
+		return fmt.Errorf("stat: expected at least 24 fields, got:%d", len(fields)+2)
+	}
+
+	var values [22]uint64
+	for _, i := range []int{11, 12, 17, 20, 21} {
+		v, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return fmt.Errorf("stat field %d:%w", i+3, err)
+		}
+		values[i] = v
+	}
+	stats.CPUUserSeconds = float64(values[11]) / userHZ    // utime (14)
+	stats.CPUSystemSeconds = float64(values[12]) / userHZ  // stime (15)
+	stats.Threads = values[17]                             // num_threads (20)
+	stats.VirtualBytes = values[20]                        // vsize (23)
+	stats.RSSBytes = values[21] * uint64(os.Getpagesize()) // rss (24) in pages
+	return nil
+}
+
+// ParseProcStatus parses /proc/<pid>/status for the context switches
+func ParseProcStatus(lines []string, stats *ProcStats) {
+	for _, line := range lines {
+		key, value := splitKeyValue(line, ":")
+		switch key {
+		case "voluntary_ctxt_switches":
+			stats.VoluntaryCtxSwitches, _ = strconv.ParseUint(value, 10, 64)
+		case "nonvoluntary_ctxt_switches":
+			stats.NonvoluntaryCtxSwitches, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+}
+
+// ParseProcIO parses /proc/<pid>/io for the bytes read and written to storage
+func ParseProcIO(lines []string, stats *ProcStats) {
+	for _, line := range lines {
+		key, value := splitKeyValue(line, ":")
+		switch key {
+		case "read_bytes":
+			stats.ReadBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "write_bytes":
+			stats.WriteBytes, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+}
+
+// ParseCgroupCPUStat parses the cgroup cpu.stat
+// v2 has usage_usec, nr_throttled, and throttled_usec
+// v1 has nr_throttled, and throttled_time (nanoseconds), with the usage in cpuacct.usage
+func ParseCgroupCPUStat(lines []string, stats *ProcStats) {
+	for _, line := range lines {
+		key, value := splitKeyValue(line, " ")
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "usage_usec":
+			stats.CgroupCPUSeconds = float64(v) / 1e6
+		case "nr_throttled":
+			stats.CgroupThrottledPeriods = v
+		case "throttled_usec":
+			stats.CgroupThrottledSeconds = float64(v) / 1e6
+		case "throttled_time":
+			stats.CgroupThrottledSeconds = float64(v) / 1e9
+		}
+	}
+}
+
+// ParseProcCgroup parses /proc/<pid>/cgroup, returning the cgroup path for each v1 controller,
+// and the v2 path as controller ""
+func ParseProcCgroup(lines []string) map[string]string {
+	paths := make(map[string]string)
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+	return paths
+}
+
+// ReadProcStats reads the stats for this process from procRoot (normally /proc) and cgroupRoot (normally /sys/fs/cgroup)
+// Only a /proc/self/stat failure is an error, because the other files can be restricted in containers
+func ReadProcStats(procRoot string, cgroupRoot string) (stats ProcStats, err error) {
+
+	self := filepath.Join(procRoot, "self")
+
+	b, err := os.ReadFile(filepath.Join(self, "stat"))
+	if err != nil {
+		return stats, err
+	}
+	if err = ParseProcStat(string(b), &stats); err != nil {
+		return stats, err
+	}
+
+	ParseProcStatus(readLines(filepath.Join(self, "status")), &stats)
+	ParseProcIO(readLines(filepath.Join(self, "io")), &stats)
+
+	if fds, err := os.ReadDir(filepath.Join(self, "fd")); err == nil {
+		stats.OpenFDs = uint64(len(fds))
+	}
+
+	readCgroupStats(cgroupRoot, ParseProcCgroup(readLines(filepath.Join(self, "cgroup"))), &stats)
+
+	return stats, nil
+}
+
+// readCgroupStats reads the cgroup v2 files if the unified hierarchy is mounted at cgroupRoot, otherwise v1
+// Inside a container, the cgroup path from /proc/self/cgroup often doesn't exist in the container's view
+// of the cgroup filesystem (it's the root), so we fall back to the controller root
+func readCgroupStats(cgroupRoot string, paths map[string]string, stats *ProcStats) {
+
+	dir := func(controller string) string {
+		d := filepath.Join(cgroupRoot, controller, paths[controller])
+		if _, err := os.Stat(d); err != nil {
+			return filepath.Join(cgroupRoot, controller)
+		}
+		return d
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		stats.CgroupVersion = 2
+		d := dir("")
+		ParseCgroupCPUStat(readLines(filepath.Join(d, "cpu.stat")), stats)
+		stats.CgroupMemoryBytes = readUint(filepath.Join(d, "memory.current"))
+		stats.CgroupMemoryLimitBytes = readUint(filepath.Join(d, "memory.max")) // "max" = 0 = no limit
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cpu")); err != nil {
+		return
+	}
+	stats.CgroupVersion = 1
+	ParseCgroupCPUStat(readLines(filepath.Join(dir("cpu"), "cpu.stat")), stats)
+	stats.CgroupCPUSeconds = float64(readUint(filepath.Join(dir("cpuacct"), "cpuacct.usage"))) / 1e9
+	stats.CgroupMemoryBytes = readUint(filepath.Join(dir("memory"), "memory.usage_in_bytes"))
+	stats.CgroupMemoryLimitBytes = readUint(filepath.Join(dir("memory"), "memory.limit_in_bytes"))
+	// v1 reports "no limit" as a huge page aligned number, so treat anything over 2^62 as no limit
+	if stats.CgroupMemoryLimitBytes > 1<<62 {
+		stats.CgroupMemoryLimitBytes = 0
+	}
+}
+
+// procStatsMetrics are the Prometheus gauges for the ProcStats
+// These are gauges, rather than counters, because /proc gives us the totals
+type procStatsMetrics struct {
+	cpu                    *prometheus.GaugeVec
+	rss                    prometheus.Gauge
+	threads                prometheus.Gauge
+	ctxSwitches            *prometheus.GaugeVec
+	io                     *prometheus.GaugeVec
+	fds                    prometheus.Gauge
+	cgroupCPU              prometheus.Gauge
+	cgroupThrottledPeriods prometheus.Gauge
+	cgroupThrottledSeconds prometheus.Gauge
+	cgroupMemory           *prometheus.GaugeVec
+}
+
+// newProcStatsMetrics registers the Prometheus gauges
+func newProcStatsMetrics() *procStatsMetrics {
+	return &procStatsMetrics{
+		cpu: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "cpu_seconds",
+				Help:      "xtcp cpu seconds from /proc/self/stat, by mode (user/system)",
+			},
+			[]string{"mode"},
+		),
+		rss: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "rss_bytes",
+				Help:      "xtcp resident set size from /proc/self/stat",
+			},
+		),
+		threads: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "threads",
+				Help:      "xtcp threads from /proc/self/stat",
+			},
+		),
+		ctxSwitches: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "context_switches",
+				Help:      "xtcp context switches from /proc/self/status, by type (voluntary/nonvoluntary)",
+			},
+			[]string{"type"},
+		),
+		io: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "io_bytes",
+				Help:      "xtcp storage io bytes from /proc/self/io, by direction (read/write)",
+			},
+			[]string{"direction"},
+		),
+		fds: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "self",
+				Name:      "open_fds",
+				Help:      "xtcp open file descriptors in /proc/self/fd",
+			},
+		),
+		cgroupCPU: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "cgroup",
+				Name:      "cpu_seconds",
+				Help:      "xtcp cgroup cpu usage seconds",
+			},
+		),
+		cgroupThrottledPeriods: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "cgroup",
+				Name:      "throttled_periods",
+				Help:      "xtcp cgroup cpu periods throttled",
+			},
+		),
+		cgroupThrottledSeconds: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "cgroup",
+				Name:      "throttled_seconds",
+				Help:      "xtcp cgroup cpu time throttled",
+			},
+		),
+		cgroupMemory: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "xtcp",
+				Subsystem: "cgroup",
+				Name:      "memory_bytes",
+				Help:      "xtcp cgroup memory, by type (usage/limit). limit zero (0) means no limit",
+			},
+			[]string{"type"},
+		),
+	}
+}
+
+// set updates the gauges from the ProcStats
+func (m *procStatsMetrics) set(stats ProcStats) {
+	m.cpu.WithLabelValues("user").Set(stats.CPUUserSeconds)
+	m.cpu.WithLabelValues("system").Set(stats.CPUSystemSeconds)
+	m.rss.Set(float64(stats.RSSBytes))
+	m.threads.Set(float64(stats.Threads))
+	m.ctxSwitches.WithLabelValues("voluntary").Set(float64(stats.VoluntaryCtxSwitches))
+	m.ctxSwitches.WithLabelValues("nonvoluntary").Set(float64(stats.NonvoluntaryCtxSwitches))
+	m.io.WithLabelValues("read").Set(float64(stats.ReadBytes))
+	m.io.WithLabelValues("write").Set(float64(stats.WriteBytes))
+	m.fds.Set(float64(stats.OpenFDs))
+	if stats.CgroupVersion > 0 {
+		m.cgroupCPU.Set(stats.CgroupCPUSeconds)
+		m.cgroupThrottledPeriods.Set(float64(stats.CgroupThrottledPeriods))
+		m.cgroupThrottledSeconds.Set(stats.CgroupThrottledSeconds)
+		m.cgroupMemory.WithLabelValues("usage").Set(float64(stats.CgroupMemoryBytes))
+		m.cgroupMemory.WithLabelValues("limit").Set(float64(stats.CgroupMemoryLimitBytes))
+	}
+}
+
+// ProcStatsStatsd formats the ProcStats as statsd gauges, one per line
+func ProcStatsStatsd(stats ProcStats) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "xtcp_cpu_user_seconds:%f|g\n", stats.CPUUserSeconds)
+	fmt.Fprintf(&b, "xtcp_cpu_system_seconds:%f|g\n", stats.CPUSystemSeconds)
+	fmt.Fprintf(&b, "xtcp_rss:%d|g\n", stats.RSSBytes)
+	fmt.Fprintf(&b, "xtcp_threads:%d|g\n", stats.Threads)
+	fmt.Fprintf(&b, "xtcp_voluntary_ctxt_switches:%d|g\n", stats.VoluntaryCtxSwitches)
+	fmt.Fprintf(&b, "xtcp_nonvoluntary_ctxt_switches:%d|g\n", stats.NonvoluntaryCtxSwitches)
+	fmt.Fprintf(&b, "xtcp_read_bytes:%d|g\n", stats.ReadBytes)
+	fmt.Fprintf(&b, "xtcp_write_bytes:%d|g\n", stats.WriteBytes)
+	fmt.Fprintf(&b, "xtcp_open_fds:%d|g", stats.OpenFDs)
+	if stats.CgroupVersion > 0 {
+		fmt.Fprintf(&b, "\nxtcp_cgroup_cpu_seconds:%f|g\n", stats.CgroupCPUSeconds)
+		fmt.Fprintf(&b, "xtcp_cgroup_throttled_periods:%d|g\n", stats.CgroupThrottledPeriods)
+		fmt.Fprintf(&b, "xtcp_cgroup_throttled_seconds:%f|g\n", stats.CgroupThrottledSeconds)
+		fmt.Fprintf(&b, "xtcp_cgroup_memory:%d|g\n", stats.CgroupMemoryBytes)
+		fmt.Fprintf(&b, "xtcp_cgroup_memory_limit:%d|g", stats.CgroupMemoryLimitBytes)
+	}
+	return b.String()
+}
+
+// splitKeyValue splits "key<sep> value" lines, trimming the spaces
+func splitKeyValue(line string, sep string) (key string, value string) {
+	parts := strings.SplitN(line, sep, 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// readLines returns the lines of the file, or nil if it can't be read
+func readLines(path string) []string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logging.Logger("staters").Debug("procstats readLines", "err", err)
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// readUint returns the single number in the file, or zero if it can't be read or parsed (e.g. "max")
+func readUint(path string) uint64 {
+	lines := readLines(path)
+	if len(lines) == 0 {
+		return 0
+	}
+	v, _ := strconv.ParseUint(strings.TrimSpace(lines[0]), 10, 64)
+	return v
+}
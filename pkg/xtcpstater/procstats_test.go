@@ -0,0 +1,130 @@
+package xtcpstater_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Edgio/xtcp/pkg/xtcpstater"
+)
+
+// TestParseProcStat checks the fields are counted from the last ")", so odd process names work
+func TestParseProcStat(t *testing.T) {
+
+	const tail = " S 1 11879 11879 0 -1 4194560 12345 0 3 0 1234 567 0 0 20 0 12 0 8765 1469583360 5120 18446744073709551615 1 1 0"
+
+	var tests = []struct {
+		name      string
+		line      string
+		expectErr bool
+	}{
+		{"simple", "11879 (xtcp)" + tail, false},
+		{"spaces", "11879 (xtcp worker)" + tail, false},
+		{"brackets", "11879 (xtcp (v2) x)" + tail, false},
+		{"no comm", "11879 xtcp" + tail, true},
+		{"short", "11879 (xtcp) S 1 11879", true},
+		{"not a number", "11879 (xtcp)" + strings.Replace(tail, " 1234 567 ", " abc 567 ", 1), true},
+	}
+
+	for i, test := range tests {
+		var stats xtcpstater.ProcStats
+		err := xtcpstater.ParseProcStat(test.line, &stats)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+			continue
+		}
+		if test.expectErr {
+			continue
+		}
+		expected := xtcpstater.ProcStats{
+			CPUUserSeconds:   12.34,
+			CPUSystemSeconds: 5.67,
+			Threads:          12,
+			VirtualBytes:     1469583360,
+			RSSBytes:         5120 * uint64(os.Getpagesize()),
+		}
+		if stats != expected {
+			t.Errorf("test:%d %s\texpected:%+v\tresult:%+v", i, test.name, expected, stats)
+		}
+	}
+}
+
+// TestParseCgroupCPUStat checks the v2 microseconds, and the v1 nanoseconds
+func TestParseCgroupCPUStat(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		lines    []string
+		expected xtcpstater.ProcStats
+	}{
+		{"v2", []string{"usage_usec 2500000", "nr_throttled 7", "throttled_usec 350000"},
+			xtcpstater.ProcStats{CgroupCPUSeconds: 2.5, CgroupThrottledPeriods: 7, CgroupThrottledSeconds: 0.35}},
+		{"v1", []string{"nr_periods 100", "nr_throttled 3", "throttled_time 1500000000"},
+			xtcpstater.ProcStats{CgroupThrottledPeriods: 3, CgroupThrottledSeconds: 1.5}},
+		{"garbage", []string{"usage_usec lots", "", "nr_throttled"},
+			xtcpstater.ProcStats{}},
+	}
+
+	for i, test := range tests {
+		var stats xtcpstater.ProcStats
+		xtcpstater.ParseCgroupCPUStat(test.lines, &stats)
+		if stats != test.expected {
+			t.Errorf("test:%d %s\texpected:%+v\tresult:%+v", i, test.name, test.expected, stats)
+		}
+	}
+}
+
+// TestReadProcStats reads the fake /proc in ./testdata, with both the cgroup v2 and v1 layouts
+func TestReadProcStats(t *testing.T) {
+
+	self := xtcpstater.ProcStats{
+		CPUUserSeconds:          12.34,
+		CPUSystemSeconds:        5.67,
+		RSSBytes:                5120 * uint64(os.Getpagesize()),
+		VirtualBytes:            1469583360,
+		Threads:                 12,
+		VoluntaryCtxSwitches:    4567,
+		NonvoluntaryCtxSwitches: 89,
+		ReadBytes:               4096,
+		WriteBytes:              8192,
+		OpenFDs:                 3,
+	}
+
+	v2 := self
+	v2.CgroupVersion = 2
+	v2.CgroupCPUSeconds = 2.5
+	v2.CgroupThrottledPeriods = 7
+	v2.CgroupThrottledSeconds = 0.35
+	v2.CgroupMemoryBytes = 104857600
+
+	v1 := self
+	v1.CgroupVersion = 1
+	v1.CgroupCPUSeconds = 4
+	v1.CgroupThrottledPeriods = 3
+	v1.CgroupThrottledSeconds = 1.5
+	v1.CgroupMemoryBytes = 52428800
+
+	var tests = []struct {
+		name       string
+		procRoot   string
+		cgroupRoot string
+		expectErr  bool
+		expected   xtcpstater.ProcStats
+	}{
+		{"cgroup v2", "./testdata/proc", "./testdata/cgroup2", false, v2},
+		{"cgroup v1", "./testdata/proc", "./testdata/cgroup1", false, v1},
+		{"no cgroup", "./testdata/proc", "./testdata/missing", false, self},
+		{"no proc", "./testdata/missing", "./testdata/cgroup2", true, xtcpstater.ProcStats{}},
+	}
+
+	for i, test := range tests {
+		stats, err := xtcpstater.ReadProcStats(test.procRoot, test.cgroupRoot)
+		if (err != nil) != test.expectErr {
+			t.Errorf("test:%d %s\texpected error:%t\tresult:%v", i, test.name, test.expectErr, err)
+			continue
+		}
+		if stats != test.expected {
+			t.Errorf("test:%d %s\texpected:%+v\tresult:%+v", i, test.name, test.expected, stats)
+		}
+	}
+}
@@ -2,40 +2,39 @@
 //
 // The prometheus client automagically provides a bunch of useful one, but this isn't true for statsd
 //
-// The main metric this package provides are the stats from the systemd "systemctl status xtcp"
+// By default (xTCPStaterSource=proc) the stats are read directly from /proc/self and the cgroup files (see procstats.go)
+// - cpu seconds, rss, threads, context switches, io, open fds
+// - cgroup cpu, throttling, and memory
+//
+// The fallback (xTCPStaterSource=systemctl) is the original stats from the systemd "systemctl status xtcp" and "ps"
 // - tasks
 // - memory usage
 //
 // Trying to do this WIHTOUT regexes if possible
 
-// TODO Not shell out to "ps" for memory stats, and instead use the go runtime https://golang.org/pkg/runtime/#MemStats
-
-// TODO It is apparently poor form to not know how this routine will close cleanly.  Fix this. e.g. Add a channel or whatever to allow signaling
-
 // os.Getppid()
 
 package xtcpstater
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Edgio/xtcp/pkg/cliflags"
+	"github.com/Edgio/xtcp/pkg/logging"
 	"github.com/Edgio/xtcp/pkg/misc"
 	"github.com/go-cmd/cmd"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-const (
-	debugLevel int = 11
-)
-
 // ParseGetSystemCtlStatus parses the output of "systemctl status xtcp.service"
 func ParseGetSystemCtlStatus(lines []string) (pid string, tasks string) {
 
@@ -50,24 +49,16 @@ func ParseGetSystemCtlStatus(lines []string) (pid string, tasks string) {
 		"Tasks": 1,
 	}
 
+	logger := logging.Logger("staters")
+
 	for i, line := range lines {
-		if debugLevel > 100 {
-			fmt.Println("i:", i, "\tline:", line)
-		}
+		logger.Log(context.Background(), logging.LevelTrace, "ParseGetSystemCtlStatus", "i", i, "line", line)
 		for _, attribute := range interestingAttributes {
 			if strings.Contains(line, attribute) {
-				if debugLevel > 100 {
-					fmt.Println("i:", i, "\tfound attribute:", attribute)
-				}
 				parts := strings.Fields(line)
 				for j, part := range parts {
-					if debugLevel > 100 {
-						fmt.Println("j:", j, "\tpart:", part)
-					}
 					if j == interestingColumnMap[attribute] {
-						if debugLevel > 100 {
-							fmt.Println("j:", j, "\tattribute:", attribute, "\tfound column:", part)
-						}
+						logger.Log(context.Background(), logging.LevelTrace, "ParseGetSystemCtlStatus found column", "j", j, "attribute", attribute, "part", part)
 						switch attribute {
 						case "PID":
 							pid = part
@@ -80,9 +71,7 @@ func ParseGetSystemCtlStatus(lines []string) (pid string, tasks string) {
 		}
 	}
 
-	if debugLevel > 100 {
-		fmt.Println("GetSystemCtlStatus\tpid, tasks:", pid, tasks)
-	}
+	logger.Debug("ParseGetSystemCtlStatus", "pid", pid, "tasks", tasks)
 	return pid, tasks
 }
 
@@ -95,9 +84,7 @@ func GetSystemCtlStatus(systemctlPath string, testing bool, testfile string) (pi
 	// Check the systemctlPath is executable
 	if testing != true {
 		if misc.CheckFilePermissions(systemctlPath, "0755") == false {
-			if debugLevel > 10 {
-				log.Fatal("systemctlPath does not have 0755 permissions:", systemctlPath)
-			}
+			log.Fatal("systemctlPath does not have 0755 permissions:", systemctlPath)
 		}
 	}
 
@@ -144,9 +131,7 @@ func GetPSStats(pid string, psPath string, testing bool, testfile string) (pcpu
 	// Check the psPath is executable
 	if testing != true {
 		if misc.CheckFilePermissions(psPath, "0755") == false {
-			if debugLevel > 10 {
-				log.Fatal("psPath does not have 0755 permissions:", psPath)
-			}
+			log.Fatal("psPath does not have 0755 permissions:", psPath)
 		}
 	}
 
@@ -171,28 +156,27 @@ func GetPSStats(pid string, psPath string, testing bool, testfile string) (pcpu
 	}
 
 	// please note that w'er using a loop even though there's only one line :)
+	logger := logging.Logger("staters")
+
 	for i, line := range lines {
-		if debugLevel > 100 {
-			fmt.Println("i:", i, "\tline:", line)
-		}
+		logger.Log(context.Background(), logging.LevelTrace, "ParseGetPSStats", "i", i, "line", line)
 		parts := strings.Fields(line)
 		for j, part := range parts {
-			if debugLevel > 100 {
-				fmt.Println("j:", j, "\tpart:", part)
-			}
 			*partToVariablePointer[j] = part
 		}
 	}
 
-	if debugLevel > 100 {
-		fmt.Println("GetPSStats\tpcpu, pmem, rss, sz:", pcpu, pmem, rss, sz)
-	}
+	logger.Debug("ParseGetPSStats", "pcpu", pcpu, "pmem", pmem, "rss", rss, "sz", sz)
 	return pcpu, pmem, rss, sz
 }
 
 // XTCPStater sets up Prometheus metrics and emits statsd metrics
-// This function polls at *cliFlags.XTCPStaterFrequencySeconds
-func XTCPStater(cliFlags cliflags.CliFlags) bool {
+// This function polls at *cliFlags.XTCPStaterFrequencySeconds, until ctx is cancelled on shutdown
+func XTCPStater(ctx context.Context, cliFlags cliflags.CliFlags, wg *sync.WaitGroup) bool {
+
+	defer wg.Done()
+
+	logger := logging.Logger("staters")
 
 	//---------------------------------
 	// Register Prometheus metrics
@@ -226,6 +210,9 @@ func XTCPStater(cliFlags cliflags.CliFlags) bool {
 		},
 	)
 
+	// /proc and cgroup self monitoring
+	procMetrics := newProcStatsMetrics()
+
 	// metrics for this go routine
 	XTCPStaterUDPs := promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -263,9 +250,7 @@ func XTCPStater(cliFlags cliflags.CliFlags) bool {
 	if *cliFlags.NoStatsd == false {
 		udpConn, dialerr = net.Dial("udp", *cliFlags.StatsdDst)
 		if dialerr != nil {
-			if debugLevel > 10 {
-				fmt.Println("XTCPStater:\tnet.Dial(\"udp\", ", *cliFlags.StatsdDst, ") error:", dialerr)
-			}
+			logger.Error("XTCPStater net.Dial error", "statsdDst", *cliFlags.StatsdDst, "err", dialerr)
 		}
 		defer udpConn.Close()
 	}
@@ -274,59 +259,82 @@ func XTCPStater(cliFlags cliflags.CliFlags) bool {
 
 	var pid, tasks, heapAlloc string
 	var pcpu, pmem, rss, sz string
+	var procStats ProcStats
+	var procErr error
 	// https://pkg.go.dev/runtime#MemStats
 	mS := new(runtime.MemStats)
 
 	ticker := time.NewTicker(*cliFlags.XTCPStaterFrequency)
 	for pollingLoops := 0; ; pollingLoops++ {
 
-		pid, tasks = GetSystemCtlStatus(*cliFlags.XTCPStaterSystemctlPath, false, "") // tests false, so no test file
-		pcpu, pmem, rss, sz = GetPSStats(pid, *cliFlags.XTCPStaterPsPath, false, "")
-
 		// https://pkg.go.dev/runtime#ReadMemStats
 		runtime.ReadMemStats(mS)
 		heapAlloc = strconv.FormatUint(mS.HeapAlloc, 10)
 
-		if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
-			if debugLevel > 10 {
-				fmt.Println("XTCPStater\tpid:", pid, "\ttasks:", tasks, "\theapAlloc:", heapAlloc, "\tpcpu:", pcpu, "\tpmem:", pmem, "\trss:", rss, "\tsz:", sz)
+		if *cliFlags.XTCPStaterSource == "proc" {
+
+			procStats, procErr = ReadProcStats(*cliFlags.XTCPStaterProcPath, *cliFlags.XTCPStaterCgroupPath)
+			if procErr != nil {
+				logger.Warn("XTCPStater ReadProcStats error", "err", procErr)
+			} else {
+				if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
+					logger.Info("XTCPStater", "heapAlloc", heapAlloc, "procStats", procStats)
+				}
+				procMetrics.set(procStats)
+
+				if !*cliFlags.NoStatsd {
+					updateString = fmt.Sprintf("xtcp_heapAlloc:%s|g\n%s", heapAlloc, ProcStatsStatsd(procStats))
+					logger.Debug("XTCPStater statsd", "updateString", updateString)
+					udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
+					if udpWriteErr != nil {
+						XTCPStaterUDPErrors.Inc()
+					}
+					XTCPStaterUDPs.Inc()
+					XTCPStaterUDPBytes.Add(float64(udpBytesWritten))
+				}
 			}
-		}
 
-		// The get functions return strings, so convert the them to float64 for storing in Prom
-		if pcpuF, err := strconv.ParseFloat(pcpu, 64); err == nil {
-			promPCPUGauge.Set(pcpuF)
-		}
-		if rssF, err := strconv.ParseFloat(rss, 64); err == nil {
-			promRSSGauge.Set(rssF)
-		}
-		if szF, err := strconv.ParseFloat(rss, 64); err == nil {
-			promSZGauge.Set(szF)
-		}
+		} else {
 
-		// Send to statsd
-		if !*cliFlags.NoStatsd {
-			updateString = fmt.Sprintf("xtcp_heapAlloc:%s|g\nxtcp_pcpu:%s|g\nxtcp_rss:%s|g\nxtcp_sz:%s|g", heapAlloc, pcpu, rss, sz)
-			if debugLevel > 100 {
-				fmt.Println("XTCPStater:\tupdateString:\n", updateString)
+			// Fallback to systemctl and ps
+			pid, tasks = GetSystemCtlStatus(*cliFlags.XTCPStaterSystemctlPath, false, "") // tests false, so no test file
+			pcpu, pmem, rss, sz = GetPSStats(pid, *cliFlags.XTCPStaterPsPath, false, "")
+
+			if *cliFlags.HappyPollerReportModulus == 1 || pollingLoops%*cliFlags.HappyPollerReportModulus == 1 {
+				logger.Info("XTCPStater", "pid", pid, "tasks", tasks, "heapAlloc", heapAlloc, "pcpu", pcpu, "pmem", pmem, "rss", rss, "sz", sz)
 			}
-			udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
-			if udpWriteErr != nil {
-				XTCPStaterUDPErrors.Inc()
+
+			// The get functions return strings, so convert the them to float64 for storing in Prom
+			if pcpuF, err := strconv.ParseFloat(pcpu, 64); err == nil {
+				promPCPUGauge.Set(pcpuF)
+			}
+			if rssF, err := strconv.ParseFloat(rss, 64); err == nil {
+				promRSSGauge.Set(rssF)
+			}
+			if szF, err := strconv.ParseFloat(rss, 64); err == nil {
+				promSZGauge.Set(szF)
 			}
-			XTCPStaterUDPs.Inc()
-			XTCPStaterUDPBytes.Add(float64(udpBytesWritten))
-		}
 
-		<-ticker.C
+			// Send to statsd
+			if !*cliFlags.NoStatsd {
+				updateString = fmt.Sprintf("xtcp_heapAlloc:%s|g\nxtcp_pcpu:%s|g\nxtcp_rss:%s|g\nxtcp_sz:%s|g", heapAlloc, pcpu, rss, sz)
+				logger.Debug("XTCPStater statsd", "updateString", updateString)
+				udpBytesWritten, udpWriteErr = udpConn.Write([]byte(updateString))
+				if udpWriteErr != nil {
+					XTCPStaterUDPErrors.Inc()
+				}
+				XTCPStaterUDPs.Inc()
+				XTCPStaterUDPBytes.Add(float64(udpBytesWritten))
+			}
+		}
 
-		// // select not really required, but we could add a HTTP hook or signal handler here
-		// select {
-		// case _ = <-ticker.C:
-		// 	break
-		// 	// default:
-		// 	// 	//nothing
-		// }
+		// Stop on shutdown, which closes the statsd socket
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			ticker.Stop()
+			return true
+		}
 	}
 
 }
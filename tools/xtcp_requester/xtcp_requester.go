@@ -28,6 +28,8 @@ func main() {
 	nlmsg_lens := [...]int{72, 128, 168}
 	nlmsg_seqs := [...]int{0, 666, 123456}
 	nlmsg_pids := [...]int{0, 666}
+	// The established sockets (the xtcp default), and all the TCP states (see xtcpnl.StateMask)
+	idiag_states := [...]uint32{xtcpnl.EstablishedMask, ^uint32(0)}
 
 	var packetBuffer []byte
 	packetBuffer = make([]byte, syscall.Getpagesize()*8)
@@ -38,28 +40,30 @@ func main() {
 			for _, nlmsg_len := range nlmsg_lens {
 				for _, nlmsg_seq := range nlmsg_seqs {
 					for _, nlmsg_pid := range nlmsg_pids {
-						netlinkRequest = xtcpnl.BuildNetlinkSockDiagRequest(&addressFamily, make_size, nlmsg_len, nlmsg_seq, nlmsg_pid, 0xFF, 0)
-						xtcpnl.SendNetlinkDumpRequest(socketFileDescriptor, socketAddress, netlinkRequest)
-						fmt.Println("requester i:", i, "\ttestNumber:", testNumber, "\taddressFamily:", addressFamily, "\tmake_size:", make_size, "\tnlmsg_len:", nlmsg_len, "\tnlmsg_seq:", nlmsg_seq, "\tnlmsg_pid:", nlmsg_pid)
-						testNumber++
+						for _, states := range idiag_states {
+							netlinkRequest = xtcpnl.BuildNetlinkSockDiagRequestStates(&addressFamily, make_size, uint32(nlmsg_len), uint32(nlmsg_seq), uint32(nlmsg_pid), 0xFF, 0, states)
+							xtcpnl.SendNetlinkDumpRequest(socketFileDescriptor, socketAddress, netlinkRequest)
+							fmt.Println("requester i:", i, "\ttestNumber:", testNumber, "\taddressFamily:", addressFamily, "\tmake_size:", make_size, "\tnlmsg_len:", nlmsg_len, "\tnlmsg_seq:", nlmsg_seq, "\tnlmsg_pid:", nlmsg_pid, "\tidiag_states:", states)
+							testNumber++
 
-						for x := 0; x < 100000; x++ {
-							packetBufferInSize, _, err := syscall.Recvfrom(socketFileDescriptor, packetBuffer, 0)
-							if 1 == 2 {
-								fmt.Println("packetBufferInSize", packetBufferInSize)
-							}
+							for x := 0; x < 100000; x++ {
+								packetBufferInSize, _, err := syscall.Recvfrom(socketFileDescriptor, packetBuffer, 0)
+								if 1 == 2 {
+									fmt.Println("packetBufferInSize", packetBufferInSize)
+								}
 
-							if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-								fmt.Println("syscall.Recvfrom timeout\tx:", x)
-								break //This is where we can break out from a timeout if the socket has timeout configured
-							}
-							if err != nil {
-								fmt.Println("unix.Recvfrom:", err)
-								continue
+								if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+									fmt.Println("syscall.Recvfrom timeout\tx:", x)
+									break //This is where we can break out from a timeout if the socket has timeout configured
+								}
+								if err != nil {
+									fmt.Println("unix.Recvfrom:", err)
+									continue
+								}
 							}
-						}
 
-						time.Sleep(1 * time.Second)
+							time.Sleep(1 * time.Second)
+						}
 					}
 				}
 			}